@@ -25,6 +25,10 @@
 // arguments "help ..."; this behavior is relied on when generating recursive
 // help to distinguish between external subcommands with and without children.
 //
+// Commands with at least one child, and no "tree" child, also have a hidden
+// tree command, which displays the hierarchy of commands beneath the command
+// along with their short descriptions.
+//
 // Pitfalls
 //
 // The cmdline package must be in full control of flag parsing.  Typically you
@@ -39,6 +43,7 @@
 package cmdline
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -91,6 +96,11 @@ type Command struct {
 
 	// Children of the command.
 	Children []*Command
+	// AllowPrefixMatch indicates whether a unique prefix of a child name may be
+	// used as an abbreviation for that child.  Exact matches always take
+	// precedence.  When an abbreviation is resolved, the full command path is
+	// printed to stderr, so that users and scripts learn the canonical spelling.
+	AllowPrefixMatch bool
 
 	// LookPath indicates whether to look for external subcommands in the
 	// directories specified by the PATH environment variable.  The compiled-in
@@ -112,6 +122,14 @@ type Command struct {
 
 	// Topics that provide additional info via the default help command.
 	Topics []Topic
+
+	// Examples of how to invoke the command, shown in help called on itself.
+	Examples []Example
+
+	// ExitCodes maps the exit codes that the command may exit with to their
+	// descriptions, shown in help called on itself.  Runners typically cause a
+	// specific exit code by returning an error that implements ExitCoder.
+	ExitCodes map[int]string
 }
 
 // Runner is the interface for running commands.  Return ErrExitCode to indicate
@@ -135,6 +153,13 @@ type Topic struct {
 	Long  string // Long description, shown in help for this topic.
 }
 
+// Example represents an example invocation of a command, shown in the
+// "Examples:" section of help.
+type Example struct {
+	Comment string // Description of the example, shown before the command.
+	Command string // Command line for the example, shown verbatim.
+}
+
 // Main implements the main function for the command tree rooted at root.
 //
 // It initializes a new environment from the underlying operating system, parses
@@ -151,7 +176,7 @@ type Topic struct {
 func Main(root *Command) {
 	env := EnvFromOS()
 	if env.Timer != nil && len(env.Timer.Intervals) > 0 {
-		env.Timer.Intervals[0].Name = pathName(env.prefix(), []*Command{root})
+		env.Timer.Intervals[0].Name = pathName(env.prefix(), env.ProgramName, []*Command{root})
 	}
 	err := ParseAndRun(root, env, os.Args[1:])
 	code := ExitCode(err, env.Stderr)
@@ -269,6 +294,10 @@ func cleanTree(cmd *Command) {
 		trimSpace(&cmd.Topics[tx].Short)
 		trimSpace(&cmd.Topics[tx].Long)
 	}
+	for ex := range cmd.Examples {
+		trimSpace(&cmd.Examples[ex].Comment)
+		trimSpace(&cmd.Examples[ex].Command)
+	}
 	cleanFlags(&cmd.Flags)
 	for _, child := range cmd.Children {
 		cleanTree(child)
@@ -282,7 +311,7 @@ func cleanFlags(flags *flag.FlagSet) {
 }
 
 func checkTreeInvariants(path []*Command, env *Env) error {
-	cmd, cmdPath := path[len(path)-1], pathName(env.prefix(), path)
+	cmd, cmdPath := path[len(path)-1], pathName(env.prefix(), env.ProgramName, path)
 	// Check that the root name is non-empty.
 	if cmdPath == "" {
 		return fmt.Errorf(`CODE INVARIANT BROKEN; FIX YOUR CODE
@@ -339,20 +368,26 @@ Otherwise a conflict between child names and runner args is possible.`, cmdPath)
 	return nil
 }
 
-func pathName(prefix string, path []*Command) string {
+// pathName returns the full name of the last command in path, preceded by
+// prefix.  The root command is named progName if it is non-empty.
+func pathName(prefix, progName string, path []*Command) string {
 	name := prefix
-	for _, cmd := range path {
+	for ix, cmd := range path {
 		if name != "" {
 			name += " "
 		}
-		name += cmd.Name
+		if ix == 0 && progName != "" {
+			name += progName
+		} else {
+			name += cmd.Name
+		}
 	}
 	return name
 }
 
 func (cmd *Command) parse(path []*Command, env *Env, args []string, setFlags map[string]string) (Runner, []string, error) {
 	path = append(path, cmd)
-	cmdPath := pathName(env.prefix(), path)
+	cmdPath := pathName(env.prefix(), env.ProgramName, path)
 	runHelp := makeHelpRunner(path, env)
 	env.Usage = runHelp.usageFunc
 	// Parse flags and retrieve the args remaining after the parse, as well as the
@@ -378,6 +413,14 @@ func (cmd *Command) parse(path []*Command, env *Env, args []string, setFlags map
 	// Look for matching children.
 	subName, subArgs := args[0], args[1:]
 	if len(cmd.Children) > 0 {
+		name, err := cmd.resolveChildName(subName)
+		if err != nil {
+			return nil, nil, env.UsageErrorf("%s: %v", cmdPath, err)
+		}
+		if name != subName {
+			fmt.Fprintf(env.Stderr, "%s: %q resolved to %q\n", cmdPath, subName, cmdPath+" "+name)
+			subName = name
+		}
 		for _, child := range cmd.Children {
 			if child.Name == subName {
 				return child.parse(path, env, subArgs, setFlags)
@@ -395,6 +438,15 @@ func (cmd *Command) parse(path []*Command, env *Env, args []string, setFlags map
 			return binaryRunner{subCmd, cmdPath}, extArgs, nil
 		}
 	}
+	// Every non-leaf command gets a hidden tree command, unless an external tree
+	// command was found above, or the runner takes args, in which case "tree" is
+	// passed to the runner.
+	if treeName == subName && needsTreeChild(cmd) && (cmd.Runner == nil || cmd.ArgsName == "") {
+		if len(subArgs) > 0 {
+			return nil, nil, env.UsageErrorf("%s %s: doesn't take arguments", cmdPath, treeName)
+		}
+		return treeRunner(runHelp), nil, nil
+	}
 	// No matching subcommands, check various error cases.
 	switch {
 	case cmd.Runner == nil:
@@ -413,6 +465,40 @@ func (cmd *Command) parse(path []*Command, env *Env, args []string, setFlags map
 	return cmd.Runner, args, nil
 }
 
+// resolveChildName returns the name of the child of cmd that matches name.  If
+// cmd.AllowPrefixMatch is true and no child matches exactly, returns the name of
+// the child with name as a unique prefix, or an error if name is ambiguous.  An
+// empty name is never treated as a prefix.  Otherwise returns name unchanged,
+// even if it doesn't match any child.
+func (cmd *Command) resolveChildName(name string) (string, error) {
+	names := []string{}
+	for _, child := range cmd.Children {
+		names = append(names, child.Name)
+	}
+	if needsHelpChild(cmd) {
+		names = append(names, helpName)
+	}
+	if needsTreeChild(cmd) {
+		names = append(names, treeName)
+	}
+	var matches []string
+	for _, n := range names {
+		if n == name {
+			return name, nil
+		}
+		if name != "" && strings.HasPrefix(n, name) {
+			matches = append(matches, n)
+		}
+	}
+	switch {
+	case !cmd.AllowPrefixMatch || len(matches) == 0:
+		return name, nil
+	case len(matches) > 1:
+		return "", fmt.Errorf("ambiguous command %q matches %q", name, matches)
+	}
+	return matches[0], nil
+}
+
 // parseFlags parses the flags from args for the command with the given path and
 // env.  Returns the remaining non-flag args and the flags that were set.
 func parseFlags(path []*Command, env *Env, args []string) ([]string, map[string]string, error) {
@@ -523,6 +609,13 @@ func (c *Command) subNames(prefix string) map[string]bool {
 	return m
 }
 
+// ExitCoder is implemented by errors that cause the program to exit with a
+// specific exit code.
+type ExitCoder interface {
+	error
+	ExitCode() int
+}
+
 // ErrExitCode may be returned by Runner.Run to cause the program to exit with a
 // specific error code.
 type ErrExitCode int
@@ -532,6 +625,11 @@ func (x ErrExitCode) Error() string {
 	return fmt.Sprintf("exit code %d", x)
 }
 
+// ExitCode implements the ExitCoder interface method.
+func (x ErrExitCode) ExitCode() int {
+	return int(x)
+}
+
 // ErrUsage indicates an error in command usage; e.g. unknown flags, subcommands
 // or args.  It corresponds to exit code 2.
 const ErrUsage = ErrExitCode(2)
@@ -539,8 +637,11 @@ const ErrUsage = ErrExitCode(2)
 // ExitCode returns the exit code corresponding to err.
 //   0:    if err == nil
 //   code: if err is ErrExitCode(code)
+//   code: if err or an error it wraps implements ExitCoder, and its
+//         ExitCode() returns code
 //   1:    all other errors
-// Writes the error message for "all other errors" to w, if w is non-nil.
+// Writes the error message for errors other than ErrExitCode to w, if w is
+// non-nil.
 func ExitCode(err error, w io.Writer) int {
 	if err == nil {
 		return 0
@@ -548,11 +649,16 @@ func ExitCode(err error, w io.Writer) int {
 	if code, ok := err.(ErrExitCode); ok {
 		return int(code)
 	}
+	code := 1
+	var coder ExitCoder
+	if errors.As(err, &coder) {
+		code = coder.ExitCode()
+	}
 	if w != nil {
 		// We don't print "ERROR: exit code N" above to avoid cluttering the output.
 		fmt.Fprintf(w, "ERROR: %v\n", err)
 	}
-	return 1
+	return code
 }
 
 type binaryRunner struct {
@@ -462,6 +462,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The cmdrun help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -641,6 +645,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The onecmd help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -701,6 +709,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The onecmd help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -915,6 +927,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The multi help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -1316,6 +1332,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The toplevelprog help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -1446,6 +1466,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The toplevelprog echoprog help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -1883,6 +1907,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The prog1 help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -1977,6 +2005,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The prog1 prog2 help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -2041,6 +2073,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The prog1 prog2 prog3 help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -2105,6 +2141,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The prog1 prog2 prog3 help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -2228,6 +2268,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The prog1 help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -2305,6 +2349,478 @@ The global flags are:
 	runTestCases(t, prog, tests)
 }
 
+func TestExamples(t *testing.T) {
+	cmdEcho := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		Runner:   RunnerFunc(runEcho),
+		ArgsName: "[strings]",
+		ArgsLong: "[strings] are arbitrary strings that will be echoed.",
+		Examples: []Example{
+			{"Print a greeting.", "program echo hello world"},
+			{"", "program echo"},
+			{
+				"Print a greeting with a very long description that will have to be wrapped onto the next line.",
+				"program echo a very long command line that should never be wrapped, regardless of the width",
+			},
+		},
+	}
+	prog := &Command{
+		Name:     "program",
+		Short:    "Test help strings with examples.",
+		Long:     "Test help strings with examples.",
+		Children: []*Command{cmdEcho},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"help", "echo"},
+			Stdout: `Echo prints any strings passed in to stdout.
+
+Usage:
+   program echo [flags] [strings]
+
+[strings] are arbitrary strings that will be echoed.
+
+Examples:
+   # Print a greeting.
+   program echo hello world
+
+   program echo
+
+   # Print a greeting with a very long description that will have to be wrapped
+   # onto the next line.
+   program echo a very long command line that should never be wrapped, regardless of the width
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+type errNotFound string
+
+func (e errNotFound) Error() string { return "not found: " + string(e) }
+func (e errNotFound) ExitCode() int { return 3 }
+
+func TestExitCodes(t *testing.T) {
+	cmdFind := &Command{
+		Name:     "find",
+		Short:    "Find a string",
+		Long:     "Find finds a string.",
+		ArgsName: "<string>",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			return errNotFound(args[0])
+		}),
+		ExitCodes: map[int]string{
+			0:  "The string was found.",
+			3:  "The string was not found.",
+			10: "The string could not be searched for, with a very long description that will have to be wrapped.",
+		},
+	}
+	prog := &Command{
+		Name:     "program",
+		Short:    "Test help strings with exit codes.",
+		Long:     "Test help strings with exit codes.",
+		Children: []*Command{cmdFind},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"help", "find"},
+			Stdout: `Find finds a string.
+
+Usage:
+   program find [flags] <string>
+
+Exit codes:
+    0 The string was found.
+    3 The string was not found.
+   10 The string could not be searched for, with a very long description that
+      will have to be wrapped.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+		{
+			Args: []string{"find", "foo"},
+			Err:  "not found: foo",
+		},
+	}
+	runTestCases(t, prog, tests)
+
+	var stderr bytes.Buffer
+	if got, want := ExitCode(errNotFound("foo"), &stderr), 3; got != want {
+		t.Errorf("got exit code %d, want %d", got, want)
+	}
+	if got, want := stderr.String(), "ERROR: not found: foo\n"; got != want {
+		t.Errorf("got stderr %q, want %q", got, want)
+	}
+	stderr.Reset()
+	if got, want := ExitCode(fmt.Errorf("wrapped: %w", errNotFound("foo")), &stderr), 3; got != want {
+		t.Errorf("got exit code %d, want %d", got, want)
+	}
+	if got, want := stderr.String(), "ERROR: wrapped: not found: foo\n"; got != want {
+		t.Errorf("got stderr %q, want %q", got, want)
+	}
+	stderr.Reset()
+	if got, want := ExitCode(ErrExitCode(2), &stderr), 2; got != want {
+		t.Errorf("got exit code %d, want %d", got, want)
+	}
+	if got := stderr.String(); got != "" {
+		t.Errorf("got stderr %q, want empty", got)
+	}
+}
+
+func TestProgramName(t *testing.T) {
+	cmdEcho := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		Runner:   RunnerFunc(runEcho),
+		ArgsName: "[strings]",
+	}
+	prog := &Command{
+		Name:     "program",
+		Short:    "Test program name override.",
+		Long:     "Test program name override.",
+		Children: []*Command{cmdEcho},
+	}
+	tests := []struct {
+		args           []string
+		stdout, stderr string
+	}{
+		{
+			[]string{"help", "echo"},
+			`Echo prints any strings passed in to stdout.
+
+Usage:
+   alias echo [flags] [strings]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`, "",
+		},
+		{
+			[]string{"foo"},
+			"",
+			`ERROR: alias: unknown command "foo"
+
+Test program name override.
+
+Usage:
+   alias [flags] <command>
+
+The alias commands are:
+   echo        Print strings on stdout
+   help        Display help for commands or topics
+Run "alias help [command]" for command usage.
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		env := &Env{
+			Stdout:      &stdout,
+			Stderr:      &stderr,
+			Vars:        baseVars,
+			ProgramName: "alias",
+		}
+		ParseAndRun(prog, env, test.args)
+		if got, want := stripTestFlags(stdout.String()), test.stdout; got != want {
+			t.Errorf("%q: GOT stdout:\n%s\nWANT stdout:\n%s", test.args, got, want)
+		}
+		if got, want := stripTestFlags(stderr.String()), test.stderr; got != want {
+			t.Errorf("%q: GOT stderr:\n%s\nWANT stderr:\n%s", test.args, got, want)
+		}
+	}
+}
+
+func TestHelpFlag(t *testing.T) {
+	cmdEcho := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		Runner:   RunnerFunc(runEcho),
+		ArgsName: "[strings]",
+	}
+	cmdEcho.Flags.BoolVar(&flagExtra, "extra", false, "Print an extra arg")
+	cmdHello := &Command{
+		Name:     "hello",
+		Short:    "Print strings on stdout preceded by Hello",
+		Long:     "Hello prints any strings passed in to stdout preceded by Hello.",
+		Runner:   RunnerFunc(runHello),
+		ArgsName: "[strings]",
+	}
+	cmdHello.Flags.BoolVar(&flagExtra, "extra", false, "Print an extra hello arg")
+	prog := &Command{
+		Name:     "program",
+		Short:    "Test help for flags.",
+		Long:     "Test help for flags.",
+		Children: []*Command{cmdEcho, cmdHello},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"help", "-flag=extra"},
+			Stdout: `The program echo flag is:
+ -extra=false
+   Print an extra arg
+
+The program hello flag is:
+ -extra=false
+   Print an extra hello arg
+`,
+		},
+		{
+			Args: []string{"help", "-flag=-extra", "hello"},
+			Stdout: `The program hello flag is:
+ -extra=false
+   Print an extra hello arg
+`,
+		},
+		{
+			Args: []string{"help", "-flag=global1"},
+			Stdout: `The global flag is:
+ -global1=
+   global test flag 1
+`,
+		},
+		{
+			Args: []string{"help", "-flag=unknown", "echo"},
+			Err:  errUsageStr,
+			Stderr: `ERROR: program echo: unknown flag "unknown"
+
+Echo prints any strings passed in to stdout.
+
+Usage:
+   program echo [flags] [strings]
+
+The program echo flags are:
+ -extra=false
+   Print an extra arg
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestAllowPrefixMatch(t *testing.T) {
+	cmdEcho := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		Runner:   RunnerFunc(runEcho),
+		ArgsName: "[strings]",
+	}
+	cmdEchoOpt := &Command{
+		Name:     "echoopt",
+		Short:    "Print strings on stdout, with opts",
+		Long:     "Echoopt prints any strings passed in to stdout.",
+		Runner:   RunnerFunc(runEcho),
+		ArgsName: "[strings]",
+	}
+	cmdHello := &Command{
+		Name:     "hello",
+		Short:    "Print strings on stdout preceded by Hello",
+		Long:     "Hello prints any strings passed in to stdout preceded by Hello.",
+		Runner:   RunnerFunc(runHello),
+		ArgsName: "[strings]",
+	}
+	prog := &Command{
+		Name:             "program",
+		Short:            "Test prefix matching.",
+		Long:             "Test prefix matching.",
+		Children:         []*Command{cmdEcho, cmdEchoOpt, cmdHello},
+		AllowPrefixMatch: true,
+	}
+	var tests = []testCase{
+		{
+			Args:   []string{"echo", "foo"},
+			Stdout: "[foo]\n",
+		},
+		{
+			Args:   []string{"echoo", "foo"},
+			Stdout: "[foo]\n",
+			Stderr: `program: "echoo" resolved to "program echoopt"` + "\n",
+		},
+		{
+			Args:   []string{"hell", "foo"},
+			Stdout: "Hello foo\n",
+			Stderr: `program: "hell" resolved to "program hello"` + "\n",
+		},
+		{
+			Args:   []string{"he", "foo"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: program: ambiguous command \"he\" matches [\"hello\" \"help\"]\n\nTest prefix matching.\n",
+		},
+		{
+			Args:   []string{""},
+			Err:    errUsageStr,
+			Stderr: "ERROR: program: unknown command \"\"\n\nTest prefix matching.\n",
+		},
+		{
+			Args:   []string{"help", "ech"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: program: unknown command or topic \"ech\"\n\nTest prefix matching.\n",
+		},
+		{
+			Args:   []string{"help", "hell"},
+			Stdout: "Print strings on stdout preceded by Hello\n",
+			Stderr: `program: "hell" resolved to "program hello"` + "\n",
+		},
+	}
+	for i := range tests {
+		tests[i].Vars = map[string]string{"CMDLINE_STYLE": "shortonly"}
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestTree(t *testing.T) {
+	cmdEcho := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		Runner:   RunnerFunc(runEcho),
+		ArgsName: "[strings]",
+	}
+	cmdHello := &Command{
+		Name:     "hello",
+		Short:    "Print strings on stdout preceded by Hello, with a long description that will have to be wrapped",
+		Long:     "Hello prints any strings passed in to stdout preceded by Hello.",
+		Runner:   RunnerFunc(runHello),
+		ArgsName: "[strings]",
+	}
+	prog2 := &Command{
+		Name:     "prog2",
+		Short:    "Set of hello commands",
+		Long:     "Prog2 has the hello command.",
+		Children: []*Command{cmdHello},
+	}
+	prog := &Command{
+		Name:     "prog1",
+		Short:    "Test the tree command.",
+		Long:     "Test the tree command.",
+		Children: []*Command{cmdEcho, prog2},
+	}
+	var tests = []testCase{
+		{
+			Args: []string{"tree"},
+			Stdout: `prog1       Test the tree command.
+   echo     Print strings on stdout
+   prog2    Set of hello commands
+      hello Print strings on stdout preceded by Hello, with a long description
+            that will have to be wrapped
+`,
+		},
+		{
+			Args: []string{"prog2", "tree"},
+			Stdout: `prog1 prog2 Set of hello commands
+   hello    Print strings on stdout preceded by Hello, with a long description
+            that will have to be wrapped
+`,
+		},
+		{
+			Args:   []string{"tree", "foo"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: prog1 tree: doesn't take arguments\n\nTest the tree command.\n",
+			Vars:   map[string]string{"CMDLINE_STYLE": "shortonly"},
+		},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestTreeConflicts(t *testing.T) {
+	// An external tree command takes precedence over the hidden tree command.
+	tmpDir, err := ioutil.TempDir("", "cmdline-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	script := "#!/bin/sh\necho external tree $*\n"
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "prog1-tree"), []byte(script), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	cmdEcho := &Command{
+		Name:     "echo",
+		Short:    "Print strings on stdout",
+		Long:     "Echo prints any strings passed in to stdout.",
+		Runner:   RunnerFunc(runEcho),
+		ArgsName: "[strings]",
+	}
+	prog := &Command{
+		Name:     "prog1",
+		Short:    "Test the tree command.",
+		Long:     "Test the tree command.",
+		LookPath: true,
+		Children: []*Command{cmdEcho},
+	}
+	runTestCases(t, prog, []testCase{
+		{
+			Args:   []string{"tree", "foo"},
+			Vars:   map[string]string{"PATH": tmpDir},
+			Stdout: "external tree foo\n",
+		},
+	})
+
+	// Prefix matching takes the tree command into account.
+	cmdTreehouse := &Command{
+		Name:     "treehouse",
+		Short:    "Print strings on stdout",
+		Long:     "Treehouse prints any strings passed in to stdout.",
+		Runner:   RunnerFunc(runEcho),
+		ArgsName: "[strings]",
+	}
+	prog = &Command{
+		Name:             "prog1",
+		Short:            "Test the tree command.",
+		Long:             "Test the tree command.",
+		Children:         []*Command{cmdTreehouse},
+		AllowPrefixMatch: true,
+	}
+	runTestCases(t, prog, []testCase{
+		{
+			Args: []string{"tree"},
+			Stdout: `prog1        Test the tree command.
+   treehouse Print strings on stdout
+`,
+		},
+		{
+			Args:   []string{"tre"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: prog1: ambiguous command \"tre\" matches [\"treehouse\" \"tree\"]\n\nTest the tree command.\n",
+			Vars:   map[string]string{"CMDLINE_STYLE": "shortonly"},
+		},
+		{
+			Args:   []string{"treeh", "foo"},
+			Stdout: "[foo]\n",
+			Stderr: `prog1: "treeh" resolved to "prog1 treehouse"` + "\n",
+		},
+	})
+}
+
 func TestHideGlobalFlags(t *testing.T) {
 	HideGlobalFlagsExcept(regexp.MustCompile(`^global2$`))
 	cmdChild := &Command{
@@ -2665,6 +3181,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The unlikely help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -2799,6 +3319,10 @@ Usage:
 [command/topic ...] optionally identifies a specific sub-command or help topic.
 
 The unlikely help flags are:
+ -flag=
+   Display the commands that define the flag with this name, along with the flag
+   descriptions, rather than the usage of a command.  Only the commands under
+   the specified sub-command are searched.
  -style=compact
    The formatting style for help output:
       compact   - Good for compact cmdline output.
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"strconv"
 
 	"v.io/x/lib/envvar"
 	"v.io/x/lib/lookpath"
@@ -37,6 +36,13 @@ type Env struct {
 	Vars   map[string]string // Environment variables
 	Timer  *timing.Timer
 
+	// ProgramName, if non-empty, overrides the name of the root command in
+	// usage output and error messages.  This is useful when the program is
+	// invoked via a symlink or alias, or embedded in another tool, so that the
+	// usage shows the right invocation prefix.  Child commands and external
+	// binaries found via LookPath are unaffected.
+	ProgramName string
+
 	// Usage is a function that prints usage information to w.  Typically set by
 	// calls to Main or Parse to print usage of the leaf command.
 	Usage func(env *Env, w io.Writer)
@@ -50,6 +56,8 @@ func (e *Env) clone() *Env {
 		Vars:   envvar.CopyMap(e.Vars),
 		Usage:  e.Usage,
 		Timer:  e.Timer, // use the same timer for all operations
+
+		ProgramName: e.ProgramName,
 	}
 }
 
@@ -103,16 +111,12 @@ func usageErrorf(env *Env, usage func(*Env, io.Writer), format string, args ...i
 }
 
 // defaultWidth is a reasonable default for the output width in runes.
-const defaultWidth = 80
+const defaultWidth = textutil.DefaultWidth
 
+// width returns the output width in runes, per CMDLINE_WIDTH or the terminal;
+// the same width is available to commands via textutil.OutputWidth(env.Vars).
 func (e *Env) width() int {
-	if width, err := strconv.Atoi(e.Vars["CMDLINE_WIDTH"]); err == nil && width != 0 {
-		return width
-	}
-	if _, width, err := textutil.TerminalSize(); err == nil && width != 0 {
-		return width
-	}
-	return defaultWidth
+	return textutil.OutputWidth(e.Vars)
 }
 
 func (e *Env) style() style {
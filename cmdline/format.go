@@ -0,0 +1,390 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ValueRunnerFunc is a variant of RunnerFunc for commands that return a value,
+// rather than writing output directly.  Use FormatRunner to adapt it into a
+// Runner that writes the value in a consistent output format.
+type ValueRunnerFunc func(*Env, []string) (interface{}, error)
+
+// OutputFormat describes the format used to write values returned by a
+// ValueRunnerFunc.  It implements the flag.Value interface.
+type OutputFormat int
+
+const (
+	FormatTable OutputFormat = iota // Default format, aligned columns of text.
+	FormatJSON                      // Indented JSON.
+	FormatYAML                      // Block-style YAML.
+)
+
+// String implements the flag.Value interface method.
+func (f *OutputFormat) String() string {
+	switch *f {
+	case FormatTable:
+		return "table"
+	case FormatJSON:
+		return "json"
+	case FormatYAML:
+		return "yaml"
+	default:
+		panic(fmt.Errorf("unhandled format %d", *f))
+	}
+}
+
+// Set implements the flag.Value interface method.
+func (f *OutputFormat) Set(value string) error {
+	switch value {
+	case "table":
+		*f = FormatTable
+	case "json":
+		*f = FormatJSON
+	case "yaml":
+		*f = FormatYAML
+	default:
+		return fmt.Errorf("unknown format %q", value)
+	}
+	return nil
+}
+
+const formatFlagName = "format"
+
+// FormatRunner returns a Runner that calls f, and writes the returned value to
+// env.Stdout in the format specified by the -format flag.  The -format flag is
+// defined on flags, unless it has already been defined by a previous call to
+// FormatRunner.  Typically flags is the Flags field of an ancestor command, so
+// that all descendant commands share the same flag.  If flags already has a
+// -format flag of another type, the returned Runner fails with an error
+// explaining the conflict.
+//
+// Values are converted to JSON and YAML via the encoding/json package, so
+// struct field tags are respected.  The table format writes slices of structs
+// or maps as one row per element, structs and maps as one row per field, and
+// other values as plain text.
+func FormatRunner(flags *flag.FlagSet, f ValueRunnerFunc) Runner {
+	var format *OutputFormat
+	if fl := flags.Lookup(formatFlagName); fl == nil {
+		format = new(OutputFormat)
+		flags.Var(format, formatFlagName, "The output format; one of table, json or yaml.")
+	} else if value, ok := fl.Value.(*OutputFormat); ok {
+		format = value
+	} else {
+		// Defining the flag again would panic.
+		return RunnerFunc(func(env *Env, args []string) error {
+			return fmt.Errorf("FormatRunner: -%s is already defined as a %T, not an *OutputFormat", formatFlagName, fl.Value)
+		})
+	}
+	return RunnerFunc(func(env *Env, args []string) error {
+		value, err := f(env, args)
+		if err != nil {
+			return err
+		}
+		return writeValue(env.Stdout, *format, value)
+	})
+}
+
+func writeValue(w io.Writer, format OutputFormat, value interface{}) error {
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case FormatYAML:
+		return writeYAML(w, value)
+	}
+	return writeTable(w, value)
+}
+
+////////////////////////////////////////
+// Table format
+
+func writeTable(w io.Writer, value interface{}) error {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	v := indirect(reflect.ValueOf(value))
+	switch {
+	case !v.IsValid():
+		return nil
+	case v.Kind() == reflect.Slice || v.Kind() == reflect.Array:
+		var rows [][]cell
+		for ix := 0; ix < v.Len(); ix++ {
+			rows = append(rows, cells(v.Index(ix)))
+		}
+		headers := tableHeaders(rows)
+		if headers == nil {
+			// Elements aren't structs or maps; write one element per line.
+			for ix := 0; ix < v.Len(); ix++ {
+				fmt.Fprintln(tw, cellString(v.Index(ix)))
+			}
+			break
+		}
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(headers, "\t")))
+		for _, row := range rows {
+			values := make(map[string]string)
+			for _, c := range row {
+				values[c.name] = c.value
+			}
+			var line []string
+			for _, h := range headers {
+				line = append(line, values[h])
+			}
+			fmt.Fprintln(tw, strings.Join(line, "\t"))
+		}
+	case v.Kind() == reflect.Struct || v.Kind() == reflect.Map:
+		for _, c := range cells(v) {
+			fmt.Fprintf(tw, "%s:\t%s\n", c.name, c.value)
+		}
+	default:
+		fmt.Fprintln(tw, cellString(v))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	// Empty trailing cells are padded by tabwriter; strip the trailing spaces.
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		if _, err := io.WriteString(w, strings.TrimRight(line, " \n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type cell struct {
+	name, value string
+}
+
+// tableHeaders returns the union of the cell names in rows, in order of first
+// appearance, or nil if no row has any cells.
+func tableHeaders(rows [][]cell) []string {
+	var headers []string
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		for _, c := range row {
+			if !seen[c.name] {
+				seen[c.name] = true
+				headers = append(headers, c.name)
+			}
+		}
+	}
+	return headers
+}
+
+// cells returns the named cells for v if it is a struct or map, or nil
+// otherwise.  Struct fields are named according to their json tags.
+func cells(v reflect.Value) []cell {
+	v = indirect(v)
+	var res []cell
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for ix := 0; ix < t.NumField(); ix++ {
+			field := t.Field(ix)
+			if field.PkgPath != "" {
+				continue // unexported
+			}
+			name := field.Name
+			if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			res = append(res, cell{name, cellString(v.Field(ix))})
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			res = append(res, cell{fmt.Sprint(key.Interface()), cellString(v.MapIndex(key))})
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	}
+	return res
+}
+
+// cellString returns the text for a single table cell; composite values are
+// written as compact JSON.
+func cellString(v reflect.Value) string {
+	v = indirect(v)
+	switch {
+	case !v.IsValid():
+		return ""
+	case (v.Kind() == reflect.Map || v.Kind() == reflect.Slice) && v.IsNil():
+		return ""
+	case v.Kind() == reflect.Struct, v.Kind() == reflect.Map, v.Kind() == reflect.Slice, v.Kind() == reflect.Array:
+		if data, err := json.Marshal(v.Interface()); err == nil {
+			return string(data)
+		}
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// indirect follows pointers and interfaces, returning the invalid Value if a
+// nil is encountered.
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+////////////////////////////////////////
+// YAML format
+
+// writeYAML writes value as block-style YAML.  The value is first converted to
+// JSON, and then decoded token-by-token, so that the order of struct fields is
+// retained.
+func writeYAML(w io.Writer, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	node, err := decodeYAMLNode(dec)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	node.write(&buf, 0, false)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// yamlNode is a decoded JSON value; exactly one of the fields is set.
+type yamlNode struct {
+	scalar *string
+	keys   []string
+	values []yamlNode // values for keys, or list elements if keys is nil
+	isList bool
+}
+
+func decodeYAMLNode(dec *json.Decoder) (yamlNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return yamlNode{}, err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		node := yamlNode{isList: tok == '['}
+		for dec.More() {
+			if !node.isList {
+				key, err := dec.Token()
+				if err != nil {
+					return yamlNode{}, err
+				}
+				node.keys = append(node.keys, key.(string))
+			}
+			child, err := decodeYAMLNode(dec)
+			if err != nil {
+				return yamlNode{}, err
+			}
+			node.values = append(node.values, child)
+		}
+		// Consume the closing delimiter.
+		if _, err := dec.Token(); err != nil {
+			return yamlNode{}, err
+		}
+		return node, nil
+	case string:
+		s := yamlString(tok)
+		return yamlNode{scalar: &s}, nil
+	case nil:
+		s := "null"
+		return yamlNode{scalar: &s}, nil
+	default:
+		s := fmt.Sprint(tok)
+		return yamlNode{scalar: &s}, nil
+	}
+}
+
+// write writes the node at the given indentation level.  If inline is true,
+// the first line of the node continues the current line.
+func (n yamlNode) write(w *bytes.Buffer, indent int, inline bool) {
+	prefix := strings.Repeat("  ", indent)
+	switch {
+	case n.scalar != nil:
+		if inline {
+			w.WriteString(" ")
+		}
+		w.WriteString(*n.scalar + "\n")
+	case len(n.values) == 0 && n.isList:
+		if inline {
+			w.WriteString(" ")
+		}
+		w.WriteString("[]\n")
+	case len(n.values) == 0:
+		if inline {
+			w.WriteString(" ")
+		}
+		w.WriteString("{}\n")
+	case n.isList:
+		if inline {
+			w.WriteString("\n")
+		}
+		for _, elem := range n.values {
+			w.WriteString(prefix + "-")
+			if elem.scalar == nil && !elem.isList && len(elem.values) > 0 {
+				// Write the first key of a map on the same line as the dash.
+				elem.writeMap(w, indent+1, true)
+				continue
+			}
+			elem.write(w, indent+1, true)
+		}
+	default:
+		if inline {
+			w.WriteString("\n")
+		}
+		n.writeMap(w, indent, false)
+	}
+}
+
+func (n yamlNode) writeMap(w *bytes.Buffer, indent int, afterDash bool) {
+	prefix := strings.Repeat("  ", indent)
+	for ix, key := range n.keys {
+		switch {
+		case ix == 0 && afterDash:
+			w.WriteString(" ")
+		default:
+			w.WriteString(prefix)
+		}
+		w.WriteString(yamlString(key) + ":")
+		n.values[ix].write(w, indent+1, true)
+	}
+}
+
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_./-]*( [A-Za-z0-9_./-]+)*$`)
+
+// yamlString returns s as a YAML scalar, quoting it if necessary.  Since JSON
+// strings are valid double-quoted YAML scalars, we use JSON quoting.
+func yamlString(s string) string {
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "y", "n":
+	default:
+		if yamlPlain.MatchString(s) {
+			return s
+		}
+	}
+	data, _ := json.Marshal(s)
+	return string(data)
+}
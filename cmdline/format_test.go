@@ -0,0 +1,132 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+type formatItem struct {
+	Name   string            `json:"name"`
+	Size   int               `json:"size"`
+	Tags   []string          `json:"tags"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Hidden string            `json:"-"`
+}
+
+func TestWriteValue(t *testing.T) {
+	items := []formatItem{
+		{Name: "a", Size: 1, Tags: []string{"x", "y"}, Labels: map[string]string{"k": "v"}},
+		{Name: "b c", Size: 22, Hidden: "hidden"},
+	}
+	tests := []struct {
+		format OutputFormat
+		value  interface{}
+		want   string
+	}{
+		{FormatTable, nil, ""},
+		{FormatTable, "foo", "foo\n"},
+		{FormatTable, []int{1, 2}, "1\n2\n"},
+		{FormatTable, items, `NAME  SIZE  TAGS       LABELS
+a     1     ["x","y"]  {"k":"v"}
+b c   22
+`},
+		{FormatTable, items[0], `name:    a
+size:    1
+tags:    ["x","y"]
+labels:  {"k":"v"}
+`},
+		{FormatTable, map[string]int{"b": 2, "a": 1}, "a:  1\nb:  2\n"},
+		{FormatJSON, items[1], `{
+  "name": "b c",
+  "size": 22,
+  "tags": null
+}
+`},
+		{FormatYAML, "foo", "foo\n"},
+		{FormatYAML, "true", "\"true\"\n"},
+		{FormatYAML, []int{}, "[]\n"},
+		{FormatYAML, items, `- name: a
+  size: 1
+  tags:
+    - x
+    - "y"
+  labels:
+    k: v
+- name: b c
+  size: 22
+  tags: null
+`},
+		{FormatYAML, map[string][]interface{}{"a": {1, []int{2, 3}}}, `a:
+  - 1
+  -
+    - 2
+    - 3
+`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := writeValue(&buf, test.format, test.value); err != nil {
+			t.Errorf("%v %#v: unexpected error: %v", test.format, test.value, err)
+		}
+		if got, want := buf.String(), test.want; got != want {
+			t.Errorf("%v %#v: got %q, want %q", test.format, test.value, got, want)
+		}
+	}
+}
+
+func TestFormatRunner(t *testing.T) {
+	run := func(env *Env, args []string) (interface{}, error) {
+		return args, nil
+	}
+	cmdList := &Command{Name: "list", Short: "List args", Long: "List args.", ArgsName: "[args]"}
+	cmdGet := &Command{Name: "get", Short: "Get args", Long: "Get args.", ArgsName: "[args]"}
+	prog := &Command{
+		Name:     "program",
+		Short:    "Test output formatting.",
+		Long:     "Test output formatting.",
+		Children: []*Command{cmdList, cmdGet},
+	}
+	// Both runners share the -format flag on the root command.
+	cmdList.Runner = FormatRunner(&prog.Flags, run)
+	cmdGet.Runner = FormatRunner(&prog.Flags, run)
+	if _, ok := prog.Flags.Lookup("format").Value.(*OutputFormat); !ok {
+		t.Fatalf("format flag not defined")
+	}
+	var tests = []testCase{
+		{
+			Args:   []string{"list", "a", "b"},
+			Stdout: "a\nb\n",
+		},
+		{
+			Args:   []string{"get", "-format=json", "a", "b"},
+			Stdout: "[\n  \"a\",\n  \"b\"\n]\n",
+		},
+		{
+			Args:   []string{"list", "-format=yaml", "a", "b"},
+			Stdout: "- a\n- b\n",
+		},
+	}
+	runTestCases(t, prog, tests)
+	var format OutputFormat
+	if err := format.Set("xml"); err == nil {
+		t.Errorf("expected error for unknown format")
+	}
+	var _ flag.Value = &format
+
+	// A conflicting -format flag is reported when the command is run.
+	cmdOther := &Command{Name: "other", Short: "Other", Long: "Other.", ArgsName: "[args]"}
+	cmdOther.Flags.String("format", "", "Some other format.")
+	cmdOther.Runner = FormatRunner(&cmdOther.Flags, run)
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{}}
+	err := ParseAndRun(cmdOther, env, []string{"a"})
+	if err == nil || !strings.Contains(err.Error(), "-format is already defined") {
+		t.Errorf("got error %v, want conflicting -format error", err)
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"io"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -33,16 +35,19 @@ func makeHelpRunner(path []*Command, env *Env) helpRunner {
 		style:     env.style(),
 		width:     env.width(),
 		prefix:    env.prefix(),
+		progName:  env.ProgramName,
 		firstCall: env.firstCall(),
 	}}
 }
 
-// helpConfig holds configuration data for help.  The style and width may be
-// overriden by flags if the command returned by newCommand is parsed.
+// helpConfig holds configuration data for help.  The style, width and flag may
+// be overriden by flags if the command returned by newCommand is parsed.
 type helpConfig struct {
 	style     style
 	width     int
+	flag      string
 	prefix    string
+	progName  string
 	firstCall bool
 }
 
@@ -90,6 +95,11 @@ The formatting style for help output:
    godoc     - Good for godoc processing.
    shortonly - Only output short description.
 Override the default by setting the CMDLINE_STYLE environment variable.
+`)
+	help.Flags.StringVar(&h.flag, "flag", "", `
+Display the commands that define the flag with this name, along with the flag
+descriptions, rather than the usage of a command.  Only the commands under the
+specified sub-command are searched.
 `)
 	help.Flags.IntVar(&h.width, "width", h.width, `
 Format output to this target width in runes, or unlimited if width < 0.
@@ -103,8 +113,66 @@ the CMDLINE_WIDTH environment variable.
 	return help
 }
 
+const treeName = "tree"
+
+// treeRunner is a Runner that implements the hidden "tree" command, which
+// prints the hierarchy of commands beneath the last command in path.
+type treeRunner helpRunner
+
+// Run implements the Runner interface method.
+func (t treeRunner) Run(env *Env, args []string) error {
+	w := textutil.NewUTF8WrapWriter(env.Stdout, t.width)
+	defer w.Flush()
+	// Compute the width of the name column, including the indentation of each
+	// level of the tree.
+	const indent = 3
+	nameWidth := 0
+	var measure func(cmd *Command, depth int)
+	measure = func(cmd *Command, depth int) {
+		if w := depth*indent + len(cmd.Name); w > nameWidth {
+			nameWidth = w
+		}
+		for _, child := range cmd.Children {
+			measure(child, depth+1)
+		}
+	}
+	root := t.path[len(t.path)-1]
+	measure(root, 0)
+	// Print the name of the command itself as its full path.
+	if w := len(pathName(t.prefix, t.progName, t.path)); w > nameWidth {
+		nameWidth = w
+	}
+	var printCmd func(name string, cmd *Command, depth int)
+	printCmd = func(name string, cmd *Command, depth int) {
+		w.SetIndents(spaces(depth*indent), spaces(nameWidth+1))
+		fmt.Fprintf(w, "%-[1]*[2]s %[3]s", nameWidth-depth*indent, name, cmd.Short)
+		w.Flush()
+		for _, child := range cmd.Children {
+			printCmd(child.Name, child, depth+1)
+		}
+	}
+	printCmd(pathName(t.prefix, t.progName, t.path), root, 0)
+	w.SetIndents()
+	return nil
+}
+
+// needsTreeChild returns true if cmd needs a hidden tree command.  Every
+// command that has children and doesn't already have a "tree" command needs a
+// tree child.
+func needsTreeChild(cmd *Command) bool {
+	for _, child := range cmd.Children {
+		if child.Name == treeName {
+			return false
+		}
+	}
+	return len(cmd.Children) > 0
+}
+
 // runHelp implements the run-time behavior of the help command.
 func runHelp(w *textutil.WrapWriter, env *Env, args []string, path []*Command, config *helpConfig) error {
+	if config.flag != "" && (len(args) == 0 || args[0] == "...") {
+		return flagHelp(w, env, path, config)
+	}
 	if len(args) == 0 {
 		usage(w, env, path, config, config.firstCall)
 		return nil
@@ -114,8 +182,12 @@ func runHelp(w *textutil.WrapWriter, env *Env, args []string, path []*Command, c
 		return nil
 	}
 	// Look for matching children.
-	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
+	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, config.progName, path)
 	subName, subArgs := args[0], args[1:]
+	if name, err := cmd.resolveChildName(subName); err == nil && name != subName {
+		fmt.Fprintf(env.Stderr, "%s: %q resolved to %q\n", cmdPath, subName, cmdPath+" "+name)
+		subName = name
+	}
 	for _, child := range cmd.Children {
 		if child.Name == subName {
 			return runHelp(w, env, subArgs, append(path, child), config)
@@ -148,6 +220,42 @@ func runHelp(w *textutil.WrapWriter, env *Env, args []string, path []*Command, c
 	return usageErrorf(env, fn, "%s: unknown command or topic %q", cmdPath, subName)
 }
 
+// flagHelp implements "help -flag", printing each command under the last
+// command in path that defines the flag named by config.flag.
+func flagHelp(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig) error {
+	name := strings.TrimLeft(config.flag, "-")
+	found := false
+	var walk func(path []*Command)
+	walk = func(path []*Command) {
+		cmd := path[len(path)-1]
+		if f := cmd.Flags.Lookup(name); f != nil {
+			if found {
+				fmt.Fprintln(w)
+			}
+			found = true
+			fmt.Fprintln(w, "The", pathName(config.prefix, config.progName, path), "flag is:")
+			printFlag(w, f, config.style)
+		}
+		for _, child := range cmd.Children {
+			walk(append(path, child))
+		}
+	}
+	walk(path)
+	if f := globalFlags.Lookup(name); f != nil {
+		if found {
+			fmt.Fprintln(w)
+		}
+		found = true
+		fmt.Fprintln(w, "The global flag is:")
+		printFlag(w, f, config.style)
+	}
+	if !found {
+		fn := helpRunner{path, config}.usageFunc
+		return usageErrorf(env, fn, "%s: unknown flag %q", pathName(config.prefix, config.progName, path), name)
+	}
+	return nil
+}
+
 func godocHeader(path, short string) string {
 	// The first rune must be uppercase for godoc to recognize the string as a
 	// section header, which is linked to the table of contents.
@@ -216,7 +324,7 @@ func needsHelpChild(cmd *Command) bool {
 
 // usageAll prints usage recursively via DFS from the path onward.
 func usageAll(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig, firstCall bool) {
-	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
+	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, config.progName, path)
 	usage(w, env, path, config, firstCall)
 	for _, child := range cmd.Children {
 		usageAll(w, env, append(path, child), config, false)
@@ -279,7 +387,7 @@ func usageAll(w *textutil.WrapWriter, env *Env, path []*Command, config *helpCon
 // is set to false when printing usage for multiple commands, and is used to
 // avoid printing redundant information (e.g. help command, global flags).
 func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig, firstCall bool) {
-	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
+	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, config.progName, path)
 	env.TimerPush("usage " + cmdPath)
 	defer env.TimerPop()
 	if config.style == styleShortOnly {
@@ -383,6 +491,18 @@ func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig
 		fmt.Fprintln(w)
 		fmt.Fprintln(w, cmd.ArgsLong)
 	}
+	// Examples.
+	if len(cmd.Examples) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Examples:")
+		examplesUsage(w, cmd.Examples)
+	}
+	// Exit codes.
+	if len(cmd.ExitCodes) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Exit codes:")
+		exitCodesUsage(w, cmd.ExitCodes)
+	}
 	// Help topics.
 	if len(cmd.Topics) > 0 {
 		fmt.Fprintln(w)
@@ -413,7 +533,7 @@ func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig
 		fullhelp := fmt.Sprintf(`Run "%s help -style=full" to show all flags.`, cmdPath)
 		if len(cmd.Children) == 0 {
 			if len(path) > 1 {
-				parentPath := pathName(config.prefix, path[:len(path)-1])
+				parentPath := pathName(config.prefix, config.progName, path[:len(path)-1])
 				fullhelp = fmt.Sprintf(`Run "%s help -style=full %s" to show all flags.`, parentPath, cmd.Name)
 			} else {
 				fullhelp = fmt.Sprintf(`Run "CMDLINE_STYLE=full %s -help" to show all flags.`, cmdPath)
@@ -423,8 +543,47 @@ func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig
 	}
 }
 
+// examplesUsage prints each example as a "#"-prefixed comment followed by the
+// verbatim command, so that the whole section may be copied into a shell.
+func examplesUsage(w *textutil.WrapWriter, examples []Example) {
+	for ex, example := range examples {
+		if ex > 0 {
+			fmt.Fprintln(w)
+		}
+		if example.Comment != "" {
+			w.SetIndents(spaces(3) + "# ")
+			fmt.Fprintln(w, example.Comment)
+		}
+		w.SetIndents(spaces(3))
+		w.ForceVerbatim(true)
+		fmt.Fprintln(w, example.Command)
+		w.ForceVerbatim(false)
+	}
+	w.SetIndents()
+}
+
+// exitCodesUsage prints the exit codes in increasing order, as a table with
+// aligned columns for the code and description.
+func exitCodesUsage(w *textutil.WrapWriter, exitCodes map[int]string) {
+	var codes []int
+	codeWidth := 0
+	for code := range exitCodes {
+		codes = append(codes, code)
+		if w := len(strconv.Itoa(code)); w > codeWidth {
+			codeWidth = w
+		}
+	}
+	sort.Ints(codes)
+	w.SetIndents(spaces(3), spaces(3+codeWidth+1))
+	for _, code := range codes {
+		fmt.Fprintf(w, "%[1]*[2]d %[3]s", codeWidth, code, strings.TrimSpace(exitCodes[code]))
+		w.Flush()
+	}
+	w.SetIndents()
+}
+
 func flagsUsage(w *textutil.WrapWriter, path []*Command, config *helpConfig) bool {
-	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
+	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, config.progName, path)
 	allFlags := pathFlags(path)
 	numCompact := countFlags(&cmd.Flags, nil, true)
 	numFull := countFlags(allFlags, nil, true) - numCompact
@@ -492,19 +651,23 @@ func printFlags(w *textutil.WrapWriter, flags, filter *flag.FlagSet, style style
 		if match != matchRegexps(regexps, f.Name) {
 			return
 		}
-		value := f.Value.String()
-		if style == styleGoDoc {
-			// When using styleGoDoc we use the default value, so that e.g. regular
-			// help will show "/usr/home/me/foo" while godoc will show "$HOME/foo".
-			value = f.DefValue
-		}
-		fmt.Fprintf(w, " -%s=%v", f.Name, value)
-		w.SetIndents(spaces(3))
-		fmt.Fprintln(w, f.Usage)
-		w.SetIndents()
+		printFlag(w, f, style)
 	})
 }
 
+func printFlag(w *textutil.WrapWriter, f *flag.Flag, style style) {
+	value := f.Value.String()
+	if style == styleGoDoc {
+		// When using styleGoDoc we use the default value, so that e.g. regular
+		// help will show "/usr/home/me/foo" while godoc will show "$HOME/foo".
+		value = f.DefValue
+	}
+	fmt.Fprintf(w, " -%s=%v", f.Name, value)
+	w.SetIndents(spaces(3))
+	fmt.Fprintln(w, f.Usage)
+	w.SetIndents()
+}
+
 func spaces(count int) string {
 	return strings.Repeat(" ", count)
 }
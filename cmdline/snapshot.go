@@ -0,0 +1,93 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"flag"
+	"reflect"
+)
+
+// FlagSnapshot holds the values of the flags of a command tree, along with the
+// global flags, so that they may be restored after a parse.  This allows the
+// same command tree to be parsed and run repeatedly in a single process, e.g. in
+// a REPL or in tests, without flag values from one run leaking into the next.
+//
+// A typical usage pattern:
+//
+//   snapshot := cmdline.SnapshotFlags(root)
+//   for _, args := range invocations {
+//     err := cmdline.ParseAndRun(root, env, args)
+//     // ... handle err ...
+//     if err := snapshot.Restore(); err != nil {
+//       // ... handle err ...
+//     }
+//   }
+type FlagSnapshot struct {
+	root  *Command
+	flags []flagSnapshot
+}
+
+type flagSnapshot struct {
+	value flag.Value
+	saved reflect.Value // Copy of the value pointed to, if value is a pointer.
+	str   string        // The string form of value, used if saved is invalid.
+}
+
+// SnapshotFlags returns a snapshot of the current values of the global flags,
+// and of the flags of every command in the tree rooted at root.
+//
+// Flag values that are pointers, which includes all flags defined via the
+// standard flag package, are restored by copying the pointed-to value.  The
+// copy is shallow, so flag values that mutate shared state, such as maps, are
+// not fully restored.  All other flag values are restored by calling Set with
+// the string returned by String at the time of the snapshot.
+func SnapshotFlags(root *Command) *FlagSnapshot {
+	s := &FlagSnapshot{root: root}
+	s.add(flag.CommandLine)
+	walkTree(root, func(cmd *Command) {
+		s.add(&cmd.Flags)
+	})
+	return s
+}
+
+func (s *FlagSnapshot) add(flags *flag.FlagSet) {
+	flags.VisitAll(func(f *flag.Flag) {
+		fs := flagSnapshot{value: f.Value}
+		if v := reflect.ValueOf(f.Value); v.Kind() == reflect.Ptr && !v.IsNil() {
+			fs.saved = reflect.New(v.Elem().Type()).Elem()
+			fs.saved.Set(v.Elem())
+		} else {
+			fs.str = f.Value.String()
+		}
+		s.flags = append(s.flags, fs)
+	})
+}
+
+// Restore restores the flag values recorded in the snapshot, and clears the
+// ParsedFlags of every command in the tree.  Restore may be called multiple
+// times.
+func (s *FlagSnapshot) Restore() error {
+	for _, fs := range s.flags {
+		if fs.saved.IsValid() {
+			reflect.ValueOf(fs.value).Elem().Set(fs.saved)
+			continue
+		}
+		if err := fs.value.Set(fs.str); err != nil {
+			return err
+		}
+	}
+	walkTree(s.root, func(cmd *Command) {
+		cmd.ParsedFlags = nil
+	})
+	return nil
+}
+
+// walkTree calls fn for cmd and all its descendants, in depth-first order.
+func walkTree(cmd *Command, fn func(*Command)) {
+	fn(cmd)
+	for _, child := range cmd.Children {
+		walkTree(child, fn)
+	}
+}
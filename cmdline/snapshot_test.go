@@ -0,0 +1,99 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func TestSnapshotFlags(t *testing.T) {
+	var (
+		verbose bool
+		count   int
+		tags    stringsFlag
+		gotArgs []string
+	)
+	cmdRun := &Command{
+		Name:     "run",
+		Short:    "Run things",
+		Long:     "Run things.",
+		ArgsName: "[args]",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			gotArgs = args
+			return nil
+		}),
+	}
+	cmdRun.Flags.IntVar(&count, "count", 1, "Number of runs")
+	cmdRun.Flags.Var(&tags, "tag", "Tags to add; may be repeated")
+	prog := &Command{
+		Name:     "program",
+		Short:    "Test flag snapshots.",
+		Long:     "Test flag snapshots.",
+		Children: []*Command{cmdRun},
+	}
+	prog.Flags.BoolVar(&verbose, "verbose", false, "Verbose output")
+
+	// Start with a fresh flag.CommandLine, holding a single global flag.
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	var global string
+	flag.StringVar(&global, "global", "", "global test flag")
+
+	snapshot := SnapshotFlags(prog)
+	tests := []struct {
+		args     []string
+		global   string
+		verbose  bool
+		count    int
+		tags     stringsFlag
+		wantArgs []string
+	}{
+		{[]string{"-verbose", "run", "-count=3", "-tag=a", "-tag=b", "x"}, "", true, 3, stringsFlag{"a", "b"}, []string{"x"}},
+		{[]string{"run", "-tag=c"}, "", false, 1, stringsFlag{"c"}, nil},
+		{[]string{"-global=foo", "run", "y"}, "foo", false, 1, nil, []string{"y"}},
+	}
+	for _, test := range tests {
+		var stdout, stderr strings.Builder
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: baseVars}
+		gotArgs = nil
+		if err := ParseAndRun(prog, env, test.args); err != nil {
+			t.Errorf("%v: unexpected error: %v", test.args, err)
+		}
+		if got, want := global, test.global; got != want {
+			t.Errorf("%v: got global %q, want %q", test.args, got, want)
+		}
+		if got, want := verbose, test.verbose; got != want {
+			t.Errorf("%v: got verbose %v, want %v", test.args, got, want)
+		}
+		if got, want := count, test.count; got != want {
+			t.Errorf("%v: got count %v, want %v", test.args, got, want)
+		}
+		if got, want := tags, test.tags; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got tags %q, want %q", test.args, got, want)
+		}
+		if got, want := gotArgs, test.wantArgs; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got args %q, want %q", test.args, got, want)
+		}
+		if err := snapshot.Restore(); err != nil {
+			t.Errorf("%v: Restore failed: %v", test.args, err)
+		}
+		if cmdRun.ParsedFlags != nil {
+			t.Errorf("%v: ParsedFlags not cleared", test.args)
+		}
+	}
+	if got, want := global, ""; got != want {
+		t.Errorf("got global %q, want %q", got, want)
+	}
+}
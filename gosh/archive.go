@@ -0,0 +1,213 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractTarGz extracts the given gzipped tar archive into a new temporary
+// directory, and returns the path to that directory. The directory is deleted
+// by Cleanup. Regular files, directories and symbolic links are supported.
+// To guard against path traversal, extraction fails if any entry would be
+// written outside the directory or beneath a previously extracted symbolic
+// link, or is a symbolic link that points outside the directory. Since links
+// may point through other links, ".." is only allowed at the start of a link
+// target. A relative archive path is interpreted relative to Shell.Dir, if
+// set.
+func (sh *Shell) ExtractTarGz(archive string) string {
+	sh.Ok()
+	res, err := sh.extract(sh.resolvePath(archive), extractTarGz)
+	sh.handleError(err)
+	return res
+}
+
+// ExtractZip is like ExtractTarGz, but for zip archives.
+func (sh *Shell) ExtractZip(archive string) string {
+	sh.Ok()
+	res, err := sh.extract(sh.resolvePath(archive), extractZip)
+	sh.handleError(err)
+	return res
+}
+
+////////////////////////////////////////
+// Internals
+
+func (sh *Shell) extract(archive string, f func(dir, archive string) error) (string, error) {
+	dir, err := sh.makeTempDir()
+	if err != nil {
+		return "", err
+	}
+	if err := f(dir, archive); err != nil {
+		return "", fmt.Errorf("gosh: failed to extract %s: %v", archive, err)
+	}
+	return dir, nil
+}
+
+// extractPath returns the path in dir for the archive entry with the given
+// name, or an error if that path would be outside dir.
+func extractPath(dir, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("entry %q has an absolute path", name)
+	}
+	p := filepath.Join(dir, name)
+	if !isWithin(dir, p) {
+		return "", fmt.Errorf("entry %q is outside the destination directory", name)
+	}
+	// Don't write through previously extracted symbolic links, since they may
+	// be combined to escape dir.
+	for d := filepath.Dir(p); d != dir; d = filepath.Dir(d) {
+		if fi, err := os.Lstat(d); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("entry %q is beneath a symbolic link", name)
+		}
+	}
+	return p, nil
+}
+
+// isWithin returns true if the cleaned path p is dir or is inside dir.
+func isWithin(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+// extractSymlink creates a symbolic link at p, in dir, pointing to target.
+//
+// The target is resolved lexically, which only matches the real resolution if
+// the target doesn't go through other links and then "..".  E.g. given "d ->
+// .", "e -> d/.." lexically points to dir, but really to its parent.  So ".."
+// is only allowed at the start of the target, where it goes through the real
+// directories containing p; the rest of the target may only descend, through
+// links that were themselves checked to point inside dir.
+func extractSymlink(dir, p, target string) error {
+	if filepath.IsAbs(target) || !isWithin(dir, filepath.Join(filepath.Dir(p), target)) {
+		return fmt.Errorf("symbolic link %q points outside the destination directory", target)
+	}
+	descending := false
+	for _, elem := range strings.Split(filepath.ToSlash(target), "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if descending {
+				return fmt.Errorf("symbolic link %q has \"..\" after other path elements", target)
+			}
+		default:
+			descending = true
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	return os.Symlink(target, p)
+}
+
+// extractFile writes the contents of r to a new file at p.
+func extractFile(p string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm()|0200)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func extractTarGz(dir, archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		p, err := extractPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(p, tr, os.FileMode(hdr.Mode))
+		case tar.TypeSymlink:
+			err = extractSymlink(dir, p, hdr.Linkname)
+		default:
+			err = fmt.Errorf("entry %q has unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(dir, archive string) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, zf := range zr.File {
+		p, err := extractPath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(p, 0700)
+		case mode&os.ModeSymlink != 0:
+			var target []byte
+			if target, err = readZipFile(zf); err == nil {
+				err = extractSymlink(dir, p, string(target))
+			}
+		case mode.IsRegular():
+			var r io.ReadCloser
+			if r, err = zf.Open(); err == nil {
+				err = extractFile(p, r, mode)
+				r.Close()
+			}
+		default:
+			err = fmt.Errorf("entry %q has unsupported mode %v", zf.Name, mode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readZipFile(zf *zip.File) ([]byte, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -7,6 +7,8 @@ package gosh
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"os"
 	"sync"
 )
 
@@ -14,6 +16,12 @@ type bufferedPipe struct {
 	cond   *sync.Cond
 	buf    bytes.Buffer
 	closed bool
+	// If limit is positive, at most limit bytes are buffered in memory, and
+	// subsequent data is spilled to a temporary file. If the spill file holds
+	// unread data, it always follows the data in buf.
+	limit          int
+	spill          *os.File
+	spillR, spillW int64 // read and write offsets in spill
 }
 
 var (
@@ -26,7 +34,15 @@ var (
 // in-memory buffer. Writes on the pipe never block; reads on the pipe block
 // until data is available.
 func newBufferedPipe() io.ReadWriteCloser {
-	return &bufferedPipe{cond: sync.NewCond(&sync.Mutex{})}
+	return newLimitedBufferedPipe(0)
+}
+
+// newLimitedBufferedPipe is like newBufferedPipe, but if limit is positive, at
+// most limit bytes are buffered in memory. Once the limit is reached, data is
+// spilled to a temporary file until it has been read, so writes still never
+// block.
+func newLimitedBufferedPipe(limit int) io.ReadWriteCloser {
+	return &bufferedPipe{cond: sync.NewCond(&sync.Mutex{}), limit: limit}
 }
 
 // Read reads from the pipe.
@@ -38,7 +54,11 @@ func (p *bufferedPipe) Read(d []byte) (int, error) {
 		if p.buf.Len() > 0 {
 			return p.buf.Read(d)
 		}
+		if p.spillR < p.spillW {
+			return p.readSpill(d)
+		}
 		if p.closed {
+			p.releaseSpill()
 			return 0, io.EOF
 		}
 		p.cond.Wait()
@@ -54,11 +74,25 @@ func (p *bufferedPipe) WriteTo(w io.Writer) (int64, error) {
 	p.cond.L.Lock()
 	defer p.cond.L.Unlock()
 	var written int64
+	var chunk []byte
 	for {
 		// Keep writing data until the pipe is closed.
 		n, err := p.buf.WriteTo(w)
 		written += n
+		for err == nil && p.spillR < p.spillW {
+			if chunk == nil {
+				chunk = make([]byte, 32*1024)
+			}
+			var nr, nw int
+			if nr, err = p.readSpill(chunk); err == nil {
+				nw, err = w.Write(chunk[:nr])
+				written += int64(nw)
+			}
+		}
 		if p.closed || err != nil {
+			if err == nil {
+				p.releaseSpill()
+			}
 			return written, err
 		}
 		p.cond.Wait()
@@ -73,7 +107,7 @@ func (p *bufferedPipe) Write(d []byte) (int, error) {
 		return 0, io.ErrClosedPipe
 	}
 	defer p.cond.Signal()
-	return p.buf.Write(d)
+	return p.write(d)
 }
 
 // ReadFrom implements the io.ReaderFrom method; it is the fast version of Write
@@ -85,7 +119,27 @@ func (p *bufferedPipe) ReadFrom(r io.Reader) (int64, error) {
 		return 0, io.ErrClosedPipe
 	}
 	defer p.cond.Signal()
-	return p.buf.ReadFrom(r)
+	if p.limit <= 0 {
+		return p.buf.ReadFrom(r)
+	}
+	var read int64
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			n, err := p.write(chunk[:n])
+			read += int64(n)
+			if err != nil {
+				return read, err
+			}
+		}
+		switch {
+		case err == io.EOF:
+			return read, nil
+		case err != nil:
+			return read, err
+		}
+	}
 }
 
 // Close closes the pipe.
@@ -98,3 +152,85 @@ func (p *bufferedPipe) Close() error {
 	}
 	return nil
 }
+
+// closeRead closes the pipe and discards any unread data, releasing the spill
+// file. Subsequent reads return io.EOF.
+func (p *bufferedPipe) closeRead() {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	defer p.cond.Broadcast()
+	p.closed = true
+	p.buf.Reset()
+	p.spillR, p.spillW = 0, 0
+	p.releaseSpill()
+}
+
+// pipeReader is the read end of a bufferedPipe. Unlike the pipe itself, closing
+// it discards any unread data, so that a reader that stops early doesn't leave
+// data in memory or in the spill file.
+type pipeReader struct {
+	p *bufferedPipe
+}
+
+// newPipeReader returns the read end of p, which must have been returned by
+// newBufferedPipe or newLimitedBufferedPipe.
+func newPipeReader(p io.ReadWriteCloser) io.ReadCloser {
+	return pipeReader{p.(*bufferedPipe)}
+}
+
+func (r pipeReader) Read(d []byte) (int, error)         { return r.p.Read(d) }
+func (r pipeReader) WriteTo(w io.Writer) (int64, error) { return r.p.WriteTo(w) }
+
+func (r pipeReader) Close() error {
+	r.p.closeRead()
+	return nil
+}
+
+// write writes d to the in-memory buffer, or to the spill file if the limit
+// has been reached or the spill file still holds unread data.
+func (p *bufferedPipe) write(d []byte) (int, error) {
+	if p.limit <= 0 || p.spillR == p.spillW && p.buf.Len()+len(d) <= p.limit {
+		return p.buf.Write(d)
+	}
+	if p.spill == nil {
+		f, err := ioutil.TempFile("", "gosh-pipe")
+		if err != nil {
+			return 0, err
+		}
+		// Remove the file right away where possible; the open file remains usable.
+		// Otherwise it is removed by releaseSpill.
+		os.Remove(f.Name())
+		p.spill = f
+	}
+	n, err := p.spill.WriteAt(d, p.spillW)
+	p.spillW += int64(n)
+	return n, err
+}
+
+// readSpill reads unread data from the spill file. Requires spillR < spillW.
+func (p *bufferedPipe) readSpill(d []byte) (int, error) {
+	if max := p.spillW - p.spillR; int64(len(d)) > max {
+		d = d[:max]
+	}
+	n, err := p.spill.ReadAt(d, p.spillR)
+	p.spillR += int64(n)
+	if err == io.EOF && n == len(d) {
+		err = nil
+	}
+	if err == nil && p.spillR == p.spillW {
+		// The spill file has been drained; start again from the beginning.
+		p.spillR, p.spillW = 0, 0
+		err = p.spill.Truncate(0)
+	}
+	return n, err
+}
+
+// releaseSpill closes and removes the spill file, if any. Called once the pipe
+// is closed and all data has been read, or the reader has been closed.
+func (p *bufferedPipe) releaseSpill() {
+	if p.spill != nil {
+		p.spill.Close()
+		os.Remove(p.spill.Name())
+		p.spill = nil
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 )
@@ -98,3 +99,88 @@ func TestBufferedPipeWriteToMany(t *testing.T) {
 		t.Errorf("WriteTo got (%v, %v), want (%v, <nil>)", n, err, nTotal)
 	}
 }
+
+func TestBufferedPipeSpill(t *testing.T) {
+	p := newLimitedBufferedPipe(4)
+	spilled := func() bool {
+		return p.(*bufferedPipe).spill != nil
+	}
+	for _, m := range []string{"foo", "barbaz", "q"} {
+		if n, err := p.Write([]byte(m)); n != len(m) || err != nil {
+			t.Errorf("Write(%v) got (%v, %v), want (%v, <nil>)", m, n, err, len(m))
+		}
+	}
+	if !spilled() {
+		t.Errorf("data beyond the limit was not spilled")
+	}
+	if got, want := p.(*bufferedPipe).buf.String(), "foo"; got != want {
+		t.Errorf("in-memory data got %q, want %q", got, want)
+	}
+	// Reads return the data in order, even after the spill file is drained and
+	// subsequent data is buffered in memory again.
+	b := make([]byte, 5)
+	var got string
+	for len(got) < 10 {
+		n, err := p.Read(b)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		got += string(b[:n])
+	}
+	if want := "foobarbazq"; got != want {
+		t.Errorf("Read got %q, want %q", got, want)
+	}
+	if _, err := p.(io.ReaderFrom).ReadFrom(strings.NewReader("mary had a little lamb")); err != nil {
+		t.Errorf("ReadFrom failed: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	if n, err := p.(io.WriterTo).WriteTo(buf); n != 22 || err != nil {
+		t.Errorf("WriteTo got (%v, %v), want (22, <nil>)", n, err)
+	}
+	if got, want := buf.String(), "mary had a little lamb"; got != want {
+		t.Errorf("WriteTo got %q, want %q", got, want)
+	}
+	if spilled() {
+		t.Errorf("spill file was not released")
+	}
+}
+
+func TestBufferedPipeReaderCloseEarly(t *testing.T) {
+	p := newLimitedBufferedPipe(4)
+	r := newPipeReader(p)
+	if n, err := p.Write([]byte("foobarbaz")); n != 9 || err != nil {
+		t.Errorf("Write got (%v, %v), want (9, <nil>)", n, err)
+	}
+	spill := p.(*bufferedPipe).spill
+	if spill == nil {
+		t.Fatalf("data beyond the limit was not spilled")
+	}
+	b := make([]byte, 2)
+	if n, err := r.Read(b); n != 2 || err != nil {
+		t.Errorf("Read got (%v, %v), want (2, <nil>)", n, err)
+	}
+	// Closing the reader before all data has been read discards the rest, and
+	// releases the spill file.
+	if err := r.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if p.(*bufferedPipe).spill != nil {
+		t.Errorf("spill file was not released")
+	}
+	if _, err := os.Stat(spill.Name()); !os.IsNotExist(err) {
+		t.Errorf("spill file %v was not removed: %v", spill.Name(), err)
+	}
+	if n, err := r.Read(b); n != 0 || err != io.EOF {
+		t.Errorf("Read after close got (%v, %v), want (0, EOF)", n, err)
+	}
+	if n, err := p.Write([]byte("more")); n != 0 || err != io.ErrClosedPipe {
+		t.Errorf("Write after close got (%v, %v), want (0, %v)", n, err, io.ErrClosedPipe)
+	}
+	// Closing the pipe itself afterwards is a no-op.
+	if err := p.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
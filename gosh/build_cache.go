@@ -0,0 +1,165 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+////////////////////////////////////////
+// Internals
+
+// buildCacheVars are the env vars that affect the output of "go build", and
+// are thus included in build cache keys.
+var buildCacheVars = []string{"GOOS", "GOARCH", "GOARM", "GO386", "GOAMD64", "CGO_ENABLED", "CGO_CFLAGS", "CGO_LDFLAGS", "GOFLAGS", "GOEXPERIMENT"}
+
+// buildGoPkgCached returns the path to a binary for the given package and
+// build flags in sh.BuildCacheDir, building it if it is not already cached.
+// The given env vars are added to those of the go commands.
+func buildGoPkgCached(sh *Shell, pkg string, vars map[string]string, flags ...string) (string, error) {
+	key, err := buildCacheKey(sh, pkg, vars, flags...)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(sh.BuildCacheDir, key)
+	binPath := filepath.Join(dir, path.Base(pkg))
+	if _, err := os.Stat(binPath); err == nil {
+		sh.tb.Logf("Using cached executable: %s\n", binPath)
+		return binPath, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := os.MkdirAll(sh.BuildCacheDir, 0700); err != nil {
+		return "", err
+	}
+	// Build binary in a fresh temporary directory, then rename the directory to
+	// its final location, so that other Shells and processes never observe a
+	// partially written binary.
+	tempDir, err := ioutil.TempDir(sh.BuildCacheDir, "tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tempDir)
+	args := []string{"build", "-o", filepath.Join(tempDir, path.Base(pkg))}
+	args = append(args, flags...)
+	args = append(args, pkg)
+	c, err := sh.cmd(vars, "go", args...)
+	if err != nil {
+		return "", err
+	}
+	if err := c.run(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tempDir, dir); err != nil {
+		// Someone else may have cached the same binary in the meantime.
+		if _, statErr := os.Stat(binPath); statErr != nil {
+			return "", err
+		}
+	}
+	return binPath, nil
+}
+
+// listedPkg holds the fields of "go list -json" output used by buildCacheKey.
+type listedPkg struct {
+	ImportPath string
+	Dir        string
+	Standard   bool
+	GoFiles    []string
+	CgoFiles   []string
+	CFiles     []string
+	CXXFiles   []string
+	HFiles     []string
+	SFiles     []string
+	SysoFiles  []string
+	EmbedFiles []string
+}
+
+// buildCacheKey returns a key that identifies the binary built from the given
+// package with the given flags. The key covers the Go version, the env vars
+// that affect the build, the flags, and the contents of all source files of the
+// package and its non-standard dependencies.
+func buildCacheKey(sh *Shell, pkg string, vars map[string]string, flags ...string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "pkg %q\n", pkg)
+	for _, flag := range flags {
+		fmt.Fprintf(h, "flag %q\n", flag)
+	}
+	env := mergeMaps(sh.Vars, vars)
+	for _, k := range buildCacheVars {
+		fmt.Fprintf(h, "env %s=%q\n", k, env[k])
+	}
+	version, err := sh.goOutput(nil, "version")
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "version %q\n", version)
+	args := []string{"list", "-deps", "-json"}
+	args = append(args, flags...)
+	args = append(args, pkg)
+	out, err := sh.goOutput(vars, args...)
+	if err != nil {
+		return "", err
+	}
+	dec := json.NewDecoder(strings.NewReader(out))
+	for {
+		var p listedPkg
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		// Standard library packages are covered by the Go version.
+		if p.Standard {
+			continue
+		}
+		fmt.Fprintf(h, "import %q\n", p.ImportPath)
+		for _, files := range [][]string{p.GoFiles, p.CgoFiles, p.CFiles, p.CXXFiles, p.HFiles, p.SFiles, p.SysoFiles, p.EmbedFiles} {
+			for _, file := range files {
+				if err := hashFile(h, p.Dir, file); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile writes the name and contents of the given file in dir to h.
+func hashFile(h hash.Hash, dir, name string) error {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "file %q %d\n", name, fi.Size())
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// goOutput runs the go command with the given env vars and args, and returns
+// its stdout.
+func (sh *Shell) goOutput(vars map[string]string, args ...string) (string, error) {
+	c, err := sh.cmd(vars, "go", args...)
+	if err != nil {
+		return "", err
+	}
+	// Don't clutter the output with "go list" results.
+	c.PropagateOutput, c.LogOutput = false, false
+	return c.stdout()
+}
@@ -0,0 +1,213 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// ErrCallsNotSupported is reported by Cmd.Call for commands that were not
+// spawned via Shell.FuncCmd.
+var ErrCallsNotSupported = errors.New("gosh: Cmd.Call requires a command spawned via Shell.FuncCmd")
+
+var (
+	handlersMu = sync.RWMutex{} // protects handlers
+	handlers   = map[string]reflect.Value{}
+)
+
+// RegisterHandler registers the given function as the handler for calls to
+// the given method, made by the parent process via Cmd.Call. 'fi' must be a
+// function that accepts a single JSON-decodable argument and returns a
+// JSON-encodable reply and an error. Handlers are served by child processes
+// spawned via Shell.FuncCmd, one call at a time.
+func RegisterHandler(method string, fi interface{}) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	if _, ok := handlers[method]; ok {
+		panic(fmt.Errorf("gosh: handler for %q is already registered", method))
+	}
+	v := reflect.ValueOf(fi)
+	t := v.Type()
+	if t.Kind() != reflect.Func {
+		panic(fmt.Errorf("gosh: handler for %q is not a function: %v", method, t.Kind()))
+	}
+	if t.NumIn() != 1 || t.NumOut() != 2 || t.Out(1) != errorType {
+		panic(fmt.Errorf("gosh: handler for %q must have signature func(T) (R, error): %v", method, t))
+	}
+	handlers[method] = v
+}
+
+// Call calls the handler registered for the given method in the child process
+// (see RegisterHandler), passing it arg, and decodes the handler's reply into
+// the value pointed to by reply. Fails if the handler returns an error, if the
+// process exits before replying, or if Shell.DefaultTimeout is positive and
+// elapses first. Must not be called before Start or after Wait. Not supported
+// on Windows.
+func (c *Cmd) Call(method string, arg, reply interface{}) {
+	c.sh.Ok()
+	c.handleError(c.call(method, arg, reply))
+}
+
+////////////////////////////////////////
+// Internals
+
+// wireCall is the JSON encoding of a call sent from the parent to the child.
+type wireCall struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method"`
+	Arg    json.RawMessage `json:"arg"`
+}
+
+// startCallsPipe creates a pipe for the parent to send calls over. The read
+// end of the pipe is closed once the process has started, and the write end
+// once the process has exited.
+func (c *Cmd) startCallsPipe() error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	c.callsReader, c.callsWriter = pr, pw
+	c.afterStartClosers = append(c.afterStartClosers, pr)
+	c.afterWaitClosers = append(c.afterWaitClosers, pw)
+	return nil
+}
+
+func (c *Cmd) call(method string, arg, reply interface{}) error {
+	s := c.stateAfterStart()
+	switch {
+	case s.calledWait:
+		return ErrAlreadyCalledWait
+	case s.dryRun:
+		return nil
+	case !s.started && !s.inProcess:
+		return ErrDidNotCallStart
+	case c.callsWriter == nil:
+		return ErrCallsNotSupported
+	}
+	data, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+	c.callsMu.Lock()
+	c.lastCallID++
+	id := c.lastCallID
+	if data, err = json.Marshal(wireCall{ID: id, Method: method, Arg: data}); err == nil {
+		_, err = fmt.Fprintf(c.callsWriter, "%s\n", data)
+	}
+	c.callsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	timedOut := false
+	if d := c.sh.DefaultTimeout; d > 0 {
+		// Wake up the loop below once the timeout expires.
+		timer := c.sh.clock().AfterFunc(d, func() {
+			c.cond.L.Lock()
+			timedOut = true
+			c.cond.Broadcast()
+			c.cond.L.Unlock()
+		})
+		defer timer.Stop()
+	}
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	wm, ok := c.recvReplies[id]
+	for !ok && !c.exited && !timedOut && c.ctxErr == nil {
+		c.cond.Wait()
+		wm, ok = c.recvReplies[id]
+	}
+	// Return nil error if multiple conditions triggered simultaneously.
+	switch {
+	case ok:
+		delete(c.recvReplies, id)
+		if wm.Err != "" {
+			return fmt.Errorf("gosh: call %q failed: %s", method, wm.Err)
+		}
+		if err := json.Unmarshal(wm.Payload, reply); err != nil {
+			return fmt.Errorf("gosh: failed to decode reply to call %q: %v", method, err)
+		}
+		return nil
+	case c.ctxErr != nil:
+		return c.ctxErr
+	case timedOut:
+		return c.defaultTimeoutErr(ErrTimedOut)
+	}
+	return ErrProcessExited
+}
+
+// initCallsFile starts serving calls from the parent on the dedicated pipe
+// passed by the parent, if any.
+func initCallsFile() {
+	s := os.Getenv(envCallsFD)
+	if s == "" {
+		return
+	}
+	os.Unsetenv(envCallsFD)
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		panic(err)
+	}
+	f := os.NewFile(uintptr(fd), "gosh-calls")
+	// Don't leak the pipe to our own children.
+	closeOnExec(f)
+	go serveCalls(f)
+}
+
+// serveCalls handles calls read from r until EOF, sending each reply to the
+// parent as a message. Meant to be run in a goroutine.
+func serveCalls(r io.Reader) {
+	dec := json.NewDecoder(r)
+	for {
+		var call wireCall
+		if err := dec.Decode(&call); err != nil {
+			if err != io.EOF {
+				log.Printf("gosh: failed to read call: %v", err)
+			}
+			return
+		}
+		data, err := json.Marshal(handleCall(call))
+		if err != nil {
+			panic(err)
+		}
+		sendFrame(msgPrefix, data, msgSuffix)
+	}
+}
+
+// handleCall invokes the handler for the given call, returning the reply.
+func handleCall(call wireCall) wireMessage {
+	reply := wireMessage{ID: call.ID}
+	handlersMu.RLock()
+	v, ok := handlers[call.Method]
+	handlersMu.RUnlock()
+	if !ok {
+		reply.Err = fmt.Sprintf("unknown method %q", call.Method)
+		return reply
+	}
+	arg := reflect.New(v.Type().In(0))
+	if err := json.Unmarshal(call.Arg, arg.Interface()); err != nil {
+		reply.Err = fmt.Sprintf("failed to decode arg: %v", err)
+		return reply
+	}
+	out := v.Call([]reflect.Value{arg.Elem()})
+	if err, _ := out[1].Interface().(error); err != nil {
+		reply.Err = err.Error()
+		return reply
+	}
+	data, err := json.Marshal(out[0].Interface())
+	if err != nil {
+		reply.Err = fmt.Sprintf("failed to encode reply: %v", err)
+		return reply
+	}
+	reply.Payload = data
+	return reply
+}
@@ -11,6 +11,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -19,14 +21,63 @@ var (
 	varsSuffix = []byte("goshVars>")
 )
 
+// varsFile is the file that SendVars writes to.
+var (
+	varsFile     = os.Stderr
+	varsFileOnce sync.Once
+	varsFileMu   sync.Mutex // serializes writes to varsFile
+)
+
+// initVarsFile sets varsFile to the dedicated pipe passed by the parent, if
+// any.
+func initVarsFile() {
+	varsFileOnce.Do(func() {
+		s := os.Getenv(envVarsFD)
+		if s == "" {
+			return
+		}
+		os.Unsetenv(envVarsFD)
+		fd, err := strconv.Atoi(s)
+		if err != nil {
+			panic(err)
+		}
+		varsFile = os.NewFile(uintptr(fd), "gosh-vars")
+		// Don't leak the pipe to our own children.
+		closeOnExec(varsFile)
+	})
+}
+
 // SendVars sends the given vars to the parent process. Writes a string of the
-// form "<goshVars{ ... JSON-encoded vars ... }goshVars>\n" to stderr.
+// form "<goshVars{ ... JSON-encoded vars ... }goshVars>\n" to a pipe dedicated
+// to this purpose, if the process was spawned via Shell.FuncCmd, and to stderr
+// otherwise.
 func SendVars(vars map[string]string) {
 	data, err := json.Marshal(vars)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Fprintf(os.Stderr, "%s%s%s\n", varsPrefix, data, varsSuffix)
+	sendFrame(varsPrefix, data, varsSuffix)
+}
+
+// SendTypedVars is like SendVars, but values may be ints, bools, or any other
+// values that can be encoded using json.Marshal. The parent process receives
+// string values as is, and other values as their JSON encodings, e.g. "8080"
+// or "true"; use Cmd.AwaitVarInt, Cmd.AwaitVarBool or Cmd.AwaitVarJSON to
+// decode them.
+func SendTypedVars(vars map[string]interface{}) {
+	data, err := json.Marshal(vars)
+	if err != nil {
+		panic(err)
+	}
+	sendFrame(varsPrefix, data, varsSuffix)
+}
+
+// sendFrame writes a frame with the given data to varsFile.
+func sendFrame(prefix, data, suffix []byte) {
+	initVarsFile()
+	varsFileMu.Lock()
+	defer varsFileMu.Unlock()
+	fmt.Fprintf(varsFile, "%s%s%s\n", prefix, data, suffix)
 }
 
 // watchParent periodically checks whether the parent process has exited and, if
@@ -47,10 +98,24 @@ func exitAfter(d time.Duration) {
 	log.Fatalf("gosh: timed out after %v", d)
 }
 
-// InitChildMain must be called early on in main() of child processes. It spawns
-// goroutines to kill the current process when certain conditions are met, per
-// Cmd.IgnoreParentExit and Cmd.ExitAfter.
+// InitChildMain must be called early on in main() of child processes. It sets
+// the resource limits specified by Cmd.Rlimits, spawns goroutines to kill the
+// current process when certain conditions are met, per Cmd.IgnoreParentExit
+// and Cmd.ExitAfter, sends heartbeats per Cmd.Heartbeat, and serves calls made
+// via Cmd.Call.
 func InitChildMain() {
+	initVarsFile()
+	initCallsFile()
+	if s := os.Getenv(envRlimits); s != "" {
+		var rlimits []Rlimit
+		if err := json.Unmarshal([]byte(s), &rlimits); err != nil {
+			panic(err)
+		}
+		os.Unsetenv(envRlimits)
+		if err := setRlimits(rlimits); err != nil {
+			panic(err)
+		}
+	}
 	if os.Getenv(envWatchParent) != "" {
 		os.Unsetenv(envWatchParent)
 		go watchParent()
@@ -63,4 +128,12 @@ func InitChildMain() {
 		os.Unsetenv(envExitAfter)
 		go exitAfter(d)
 	}
+	if s := os.Getenv(envHeartbeat); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			panic(err)
+		}
+		os.Unsetenv(envHeartbeat)
+		go sendHeartbeats(d)
+	}
 }
@@ -0,0 +1,202 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a source of time for the timeouts that a Shell enforces; see
+// Shell.Clock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc waits for the duration to elapse, then calls f in its own
+	// goroutine, as with time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer returned by Clock.AfterFunc. *time.Timer implements Timer.
+type Timer interface {
+	// Stop prevents the timer from firing. It returns true if the call stops
+	// the timer, and false if the timer has already fired or been stopped.
+	Stop() bool
+	// Reset changes the timer to fire after duration d. It returns true if the
+	// timer had been active, and false if it had fired or been stopped.
+	Reset(d time.Duration) bool
+}
+
+// FakeClock is a Clock whose time only moves when Advance is called, so that
+// tests of timeout behavior are deterministic and fast. Since timers are often
+// armed by other goroutines, e.g. by Cmd.AwaitVarsFor, tests may call
+// BlockUntil before Advance to wait until they have been armed. It is
+// thread-safe.
+type FakeClock struct {
+	mu     sync.Mutex // protects the fields below
+	cond   *sync.Cond // signaled when a timer is armed
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a new FakeClock whose current time is now.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc returns a Timer that calls f once the clock has been advanced by d.
+// Unlike time.AfterFunc, f is called by Advance, rather than in its own
+// goroutine.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, f: f}
+	t.resetLocked(d)
+	return t
+}
+
+// Advance moves the clock forward by d, then calls the functions of the timers
+// that have become due, in the order in which they became due, before
+// returning.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if t.active && !t.when.After(c.now) {
+			t.active = false
+			due = append(due, t)
+		}
+	}
+	c.pruneLocked()
+	c.mu.Unlock()
+	sort.SliceStable(due, func(i, j int) bool { return due[i].when.Before(due[j].when) })
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// Waiters returns the number of active timers, i.e. timers that have been
+// armed via AfterFunc or Reset, and have neither fired nor been stopped.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil blocks until the clock has at least n active timers; see Waiters.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// String returns a description of the clock, for debugging.
+func (c *FakeClock) String() string {
+	return fmt.Sprintf("gosh.FakeClock(%v)", c.Now())
+}
+
+////////////////////////////////////////
+// Internals
+
+// realClock is the Clock backed by package time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// clock returns sh.Clock, or the real clock if it's nil.
+func (sh *Shell) clock() Clock {
+	if sh.Clock != nil {
+		return sh.Clock
+	}
+	return realClock{}
+}
+
+// startExitAfterTimer arranges for c to be terminated once Cmd.ExitAfter has
+// elapsed per Shell.Clock, if both are set. Otherwise, ExitAfter is enforced by
+// the child process.
+func (c *Cmd) startExitAfterTimer() {
+	if c.ExitAfter == 0 || c.sh.Clock == nil {
+		return
+	}
+	timer := c.sh.Clock.AfterFunc(c.ExitAfter, func() {
+		err := fmt.Errorf("gosh: timed out after %v (Cmd.ExitAfter)", c.ExitAfter)
+		if c.expire(err) {
+			c.sh.tb.Logf("%s (PID %d): %v; terminating\n", c.Path, c.Pid(), err)
+		}
+	})
+	go func() {
+		<-c.exitedChan
+		timer.Stop()
+	}()
+}
+
+// fakeTimer is a Timer returned by FakeClock.AfterFunc. Its fields are
+// protected by c.mu.
+type fakeTimer struct {
+	c      *FakeClock
+	f      func()
+	when   time.Time
+	active bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	t.c.pruneLocked()
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.resetLocked(d)
+}
+
+// resetLocked arms the timer to fire after d. Requires that t.c.mu is held.
+func (t *fakeTimer) resetLocked(d time.Duration) bool {
+	wasActive := t.active
+	t.when, t.active = t.c.now.Add(d), true
+	if !wasActive {
+		t.c.timers = append(t.c.timers, t)
+		t.c.cond.Broadcast()
+	}
+	return wasActive
+}
+
+// pruneLocked removes inactive timers. Requires that c.mu is held.
+func (c *FakeClock) pruneLocked() {
+	active := c.timers[:0]
+	for _, t := range c.timers {
+		if t.active {
+			active = append(active, t)
+		}
+	}
+	for i := len(active); i < len(c.timers); i++ {
+		c.timers[i] = nil
+	}
+	c.timers = active
+}
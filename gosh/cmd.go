@@ -6,6 +6,7 @@ package gosh
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +14,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -21,16 +24,55 @@ import (
 	"v.io/x/lib/lookpath"
 )
 
+// Errors reported by Cmd methods, e.g. for use with errors.Is on Cmd.Err or
+// Shell.Err when Shell.ContinueOnError is set. Errors that add detail, e.g. the
+// duration of a timeout, wrap these values.
 var (
-	errAlreadyCalledStart = errors.New("gosh: already called Cmd.Start")
-	errAlreadyCalledWait  = errors.New("gosh: already called Cmd.Wait")
-	errAlreadySetStdin    = errors.New("gosh: already set stdin")
-	errDidNotCallStart    = errors.New("gosh: did not call Cmd.Start")
-	errProcessExited      = errors.New("gosh: process exited")
+	// ErrAlreadyCalledStart is reported if Start is called more than once, or if
+	// a method that must be called before Start is called after it.
+	ErrAlreadyCalledStart = errors.New("gosh: already called Cmd.Start")
+	// ErrAlreadyCalledWait is reported if Signal, AwaitVars or another method
+	// that must be called before Wait is called after it.
+	ErrAlreadyCalledWait = errors.New("gosh: already called Cmd.Wait")
+	// ErrAlreadySetStdin is reported if stdin is configured more than once, e.g.
+	// via StdinPipe and SetStdinReader.
+	ErrAlreadySetStdin = errors.New("gosh: already set stdin")
+	// ErrDidNotCallStart is reported if a method that must be called after Start
+	// is called before it.
+	ErrDidNotCallStart = errors.New("gosh: did not call Cmd.Start")
+	// ErrDidNotUsePTY is reported by SetPTYSize if the command was not started
+	// via StartWithPTY.
+	ErrDidNotUsePTY = errors.New("gosh: did not call Cmd.StartWithPTY")
+	// ErrProcessExited is reported by AwaitVars and the like if the process
+	// exits before the awaited condition is met.
+	ErrProcessExited = errors.New("gosh: process exited")
+	// ErrTimedOut is reported by WaitFor, AwaitVarsFor and the like if the
+	// given duration elapses, and by other waits per Shell.DefaultTimeout.
+	ErrTimedOut = errors.New("gosh: timed out")
 )
 
-// Cmd represents a command. Not thread-safe.
-// Public fields should not be modified after calling Start.
+// Kill is a pseudo-signal that may be passed to Cmd.Signal, Cmd.Terminate and
+// the like to kill the process via os.Process.Kill. Unlike os.Kill, whose
+// meaning is platform-specific when sent as a signal, Kill always causes the
+// process to exit immediately. If Cmd.SignalProcessGroup is set, the entire
+// process group is killed.
+var Kill os.Signal = killSignal{}
+
+type killSignal struct{}
+
+func (killSignal) Signal()        {}
+func (killSignal) String() string { return "gosh.Kill" }
+
+// Cmd represents a command. Public fields should not be modified after calling
+// Start.
+//
+// Methods that configure the command, i.e. those that must be called before
+// Start, are not thread-safe. The remaining methods (e.g. Wait, WaitFor,
+// AwaitVars, AwaitMessage, AwaitReady, Call, Signal, Terminate, Shutdown, Pid
+// and ExitCode) may be called concurrently from multiple goroutines, including
+// concurrently with Start, in which case they first wait for Start to return.
+// Each method sets Cmd.Err and Shell.Err, so with concurrent use, these fields
+// reflect whichever call finished last; use Shell.ContinueOnError with care.
 type Cmd struct {
 	// Err is the most recent error from this Cmd (may be nil).
 	Err error
@@ -45,19 +87,59 @@ type Cmd struct {
 	Args []string
 	// IgnoreParentExit, if true, makes it so the child process does not exit when
 	// its parent exits. Only takes effect if the child process was spawned via
-	// Shell.FuncCmd or explicitly calls InitChildMain.
+	// Shell.FuncCmd or explicitly calls InitChildMain, except on Windows, where
+	// all child processes are placed in a job object that kills them when the
+	// parent exits.
 	IgnoreParentExit bool
 	// ExitAfter, if non-zero, specifies that the child process should exit after
 	// the given duration has elapsed. Only takes effect if the child process was
-	// spawned via Shell.FuncCmd or explicitly calls InitChildMain.
+	// spawned via Shell.FuncCmd or explicitly calls InitChildMain, unless
+	// Shell.Clock is set, in which case the Shell terminates the command.
 	ExitAfter time.Duration
+	// Heartbeat, if non-zero, specifies that the child process should send a
+	// heartbeat to the parent at the given interval; see LastHeartbeat and
+	// OnStall. Only takes effect if the child process was spawned via
+	// Shell.FuncCmd or explicitly calls InitChildMain. Note, such heartbeats are
+	// sent by a dedicated goroutine, and so only detect stalls of the entire
+	// process, e.g. if it was stopped; children can call SendHeartbeat from their
+	// main loop to detect stalls of that loop.
+	Heartbeat time.Duration
+	// Rlimits specifies resource limits for the child process, e.g. to limit the
+	// number of open files. Only supported for child processes spawned via
+	// Shell.FuncCmd or Shell.TestHelperCmd, which set the limits in
+	// InitChildMain before doing anything else; Start fails for other commands,
+	// rather than silently ignoring the limits. Not supported on Windows.
+	Rlimits []Rlimit
 	// PropagateOutput is inherited from Shell.PropagateChildOutput.
 	PropagateOutput bool
+	// LogOutput is inherited from Shell.LogChildOutput.
+	LogOutput bool
+	// OutputPrefix, if non-empty, is written at the start of each line of output
+	// propagated per PropagateOutput or LogOutput, e.g. "[server] ", so that
+	// interleaved output from several commands can be told apart. Propagated
+	// output is then written a line at a time.
+	OutputPrefix string
 	// OutputDir is inherited from Shell.ChildOutputDir.
 	OutputDir string
-	// ExitErrorIsOk specifies whether an *exec.ExitError should be reported via
-	// Shell.HandleError.
+	// OutputName is inherited from Shell.ChildOutputName.
+	OutputName string
+	// OutputMaxBytes is inherited from Shell.ChildOutputMaxBytes.
+	OutputMaxBytes int64
+	// OutputThrottle is inherited from Shell.ChildOutputThrottle. It limits the
+	// output propagated per PropagateOutput or LogOutput; see Throttle.
+	OutputThrottle Throttle
+	// Dir is inherited from Shell.Dir. If non-empty, it specifies the working
+	// directory of the command; otherwise the command runs in the calling
+	// process's current directory.
+	Dir string
+	// ExitErrorIsOk specifies whether an *exec.ExitError, or a *PanicError,
+	// should be reported via Shell.HandleError.
 	ExitErrorIsOk bool
+	// AllowedExitCodes lists non-zero exit codes that, like ExitErrorIsOk but
+	// only for those codes, are not reported via Shell.HandleError, e.g. []int{1}
+	// for grep, which exits with code 1 if no lines were selected. Cmd.Err is
+	// still set to the exit error, and other exit codes still fail.
+	AllowedExitCodes []int
 	// IgnoreClosedPipeError, if true, causes errors from read/write on a closed
 	// pipe to be indistinguishable from success. These errors often occur in
 	// command pipelines, e.g. "yes | head -1", where "yes" will receive a closed
@@ -65,28 +147,191 @@ type Cmd struct {
 	// closed pipe error occurs, Cmd.Err will be nil, and no err is reported to
 	// Shell.HandleError.
 	IgnoreClosedPipeError bool
+	// MaxCaptureBytes, if positive, limits the memory used by Stdout,
+	// StdoutStderr and CombinedOutput: only the first and last MaxCaptureBytes
+	// bytes of each captured stream are retained, separated by a marker noting
+	// the number of bytes that were skipped.
+	MaxCaptureBytes int
+	// MaxPipeBufferBytes, if positive, limits the memory used to buffer data for
+	// the pipes returned by StdinPipe, StdoutPipe and StderrPipe. Data beyond
+	// the limit is spilled to a temporary file until it has been read, so that
+	// slow readers do not cause unbounded memory growth.
+	MaxPipeBufferBytes int
+	// StdinMode specifies when the process's stdin is closed, if stdin is not
+	// configured or is configured via SetStdinReader. It must be the default,
+	// StdinCloseOnEOF, if StdinPipe or SetStdinFromStdout is used. Only applies
+	// to commands run as processes, rather than in-process per Shell.Intercept.
+	StdinMode StdinMode
 	// ExtraFiles is used to populate ExtraFiles in the underlying exec.Cmd
-	// object. Does not get cloned.
+	// object. The child process may retrieve them via ExtraFile, or via
+	// ExtraFileByName for files added via AddExtraFile. Does not get cloned.
 	ExtraFiles []*os.File
+	// SignalProcessGroup, if true, makes it so Signal and Terminate send the
+	// signal to the command's entire process group, i.e. to the process and any
+	// descendants that have not moved to a different process group. On
+	// Windows, the process is placed in its own job object, and Kill terminates
+	// every process in the job, i.e. the process and any descendants that have
+	// not broken away from the job; other signals are only sent to the process.
+	SignalProcessGroup bool
+	// SysProcAttr, if non-nil, holds OS-specific process attributes for the
+	// underlying exec.Cmd object. It is copied before use, so that it may be
+	// shared between Cmds. On Unix, gosh always starts the process in a new
+	// process group, so that the process and its descendants may be signaled
+	// and cleaned up together; the Setpgid and Pgid fields are overridden.
+	SysProcAttr *syscall.SysProcAttr
+	// InheritVars, if non-nil, specifies which of the env vars inherited from
+	// Shell.Vars are passed to the process: those for which it returns true.
+	// Vars set on the Cmd, i.e. those that were not inherited or whose values
+	// have been changed, are always passed. See InheritNone, InheritOnly and
+	// InheritExcept.
+	InheritVars func(key string) bool
+	// ExpandVars is inherited from Shell.ExpandVars. It specifies whether ${VAR}
+	// references in Args (excluding the path) and in the values of Vars are
+	// replaced with the values of Shell.Vars when the command is started. The
+	// Args and Vars fields themselves are not modified. "$${" may be used to
+	// denote a literal "${".
+	ExpandVars ExpandMode
+	// Namespaces specifies the Linux namespaces to create for the process. Only
+	// supported on Linux; creating namespaces other than NewUserNamespace
+	// typically requires privileges, unless combined with NewUserNamespace.
+	// Starting the command fails if the namespaces cannot be created.
+	Namespaces Namespaces
+	// Windows specifies Windows-specific process creation options. Ignored on
+	// other platforms.
+	Windows WindowsOptions
+	// Context is inherited from Shell.Context. If non-nil, the process is
+	// cleaned up as in Shell.Cleanup once the context is done, and pending or
+	// subsequent calls to Wait and AwaitVars fail with the context's error.
+	Context context.Context
+	// InactivityTimeout, if positive, makes it so the process is cleaned up as
+	// in Shell.Cleanup if it writes nothing to stdout or stderr for the given
+	// duration, e.g. because it hung, and pending or subsequent calls to Wait
+	// and AwaitVars fail with an error saying so. This catches hung processes
+	// well before any job-level timeout. Does not apply to commands that run
+	// in-process per Shell.Intercept.
+	InactivityTimeout time.Duration
 	// Internal state.
 	sh                *Shell
 	c                 *exec.Cmd
 	calledStart       bool
 	calledWait        bool
 	cond              *sync.Cond
-	waitChan          chan error
 	stdinDoneChan     chan error
-	started           bool // protected by sh.cleanupMu
-	exited            bool // protected by cond.L
+	varsWriter        *os.File   // write end of the vars pipe, if any
+	varsDoneChan      chan error // receives the result of readVars
+	started           bool       // protected by sh.cleanupMu and stateMu
+	exited            bool       // protected by cond.L
+	ctxErr            error      // protected by cond.L
+	exitedChan        chan struct{}
+	stdinFromReader   bool // stdin was set via SetStdinReader
 	calledCleanup     bool // protected by cleanupMu
 	cleanupMu         sync.Mutex
+	job               uintptr // windows job object per SignalProcessGroup; protected by cleanupMu
 	stdoutHeadTail    *headTail
 	stderrHeadTail    *headTail
 	stdoutWriters     []io.Writer
 	stderrWriters     []io.Writer
 	afterStartClosers []io.Closer
 	afterWaitClosers  []io.Closer
-	recvVars          map[string]string // protected by cond.L
+	recvVars          map[string]string      // protected by cond.L
+	recvVarsJSON      map[string][]byte      // JSON-encoded recvVars; protected by cond.L
+	recvMsgs          []wireMessage          // protected by cond.L
+	recvReplies       map[uint64]wireMessage // protected by cond.L
+	recvPanic         *wirePanic             // protected by cond.L
+	callsReader       *os.File               // read end of the calls pipe, if any
+	callsWriter       *os.File               // write end of the calls pipe, if any
+	callsMu           sync.Mutex             // protects callsWriter writes and lastCallID
+	lastCallID        uint64
+	extraFileNames    map[string]*os.File // files added via AddExtraFile
+	ptySize           *PTYSize
+	ptyMaster         *os.File
+	ptyOutput         io.Writer
+	ptyDoneChan       chan struct{}
+	startTime         time.Time
+	readyTime         time.Time         // protected by cond.L
+	exitTime          time.Time         // protected by cond.L
+	lastHeartbeat     time.Time         // protected by cond.L
+	stallWatchers     []*stallWatcher   // protected by cond.L
+	stallArmed        bool              // OnStall timers are running; protected by cond.L
+	shellVars         map[string]string // vars inherited from the Shell
+	dryRun            bool              // started with Shell.DryRun
+	inProcess         bool              // started via startInProcess
+	inProcessExitCode int
+	outputInfoDir     string
+	outputInfo        *outputFile // per OutputDir
+	transcript        *transcript // per Shell.TranscriptFile
+	transcriptIndex   int
+	lookName          string // name passed to Shell.Cmd, if it had no separators
+	lookPath          string // path resolved from lookName when the Cmd was created
+	exitErr           error
+	exitFuncs         []func(error)
+	watchdog          *inactivityWatchdog
+	startMu           sync.Mutex // held while start runs
+	stateMu           sync.Mutex // protects calledStart, started, inProcess, dryRun and calledWait
+	calledExitFuncs   bool       // protected by cond.L, as are exitErr and exitFuncs
+}
+
+// ExpandMode specifies how ${VAR} references are expanded; see Cmd.ExpandVars.
+type ExpandMode int
+
+const (
+	ExpandNone   ExpandMode = iota // References are not expanded.
+	ExpandLoose                    // References to undefined vars expand to "".
+	ExpandStrict                   // References to undefined vars are an error.
+)
+
+// Rlimit is a resource limit; see Cmd.Rlimits.
+type Rlimit struct {
+	// Resource is the resource to limit, e.g. syscall.RLIMIT_NOFILE.
+	Resource int
+	// Cur and Max are the soft and hard limits.
+	Cur, Max uint64
+}
+
+// Namespaces is a set of Linux namespaces; see Cmd.Namespaces.
+type Namespaces int
+
+const (
+	// NewUserNamespace runs the process in a new user namespace, in which the
+	// calling user and group are mapped to root, unless SysProcAttr specifies
+	// other mappings.
+	NewUserNamespace Namespaces = 1 << iota
+	// NewPIDNamespace runs the process in a new PID namespace, in which it has
+	// PID 1. Note that /proc still reflects the parent's PID namespace, unless a
+	// new procfs is mounted.
+	NewPIDNamespace
+	// NewNetworkNamespace runs the process in a new network namespace, which
+	// only has a loopback interface, initially down.
+	NewNetworkNamespace
+	// NewMountNamespace runs the process in a new mount namespace, so that its
+	// mounts and unmounts are not visible to the parent.
+	NewMountNamespace
+)
+
+// WindowsOptions specifies Windows-specific process creation options; see
+// Cmd.Windows. The zero value means no options.
+type WindowsOptions struct {
+	// HideWindow, if true, starts the process without a console window and
+	// with its main window hidden, e.g. for GUI-less helpers that would
+	// otherwise pop up windows on interactive test machines.
+	HideWindow bool
+	// NewProcessGroup, if true, starts the process in a new console process
+	// group (CREATE_NEW_PROCESS_GROUP). Signaling such a process with
+	// os.Interrupt sends it a CTRL_BREAK_EVENT, which does not affect the
+	// calling process. Without this option, os.Interrupt is not supported on
+	// Windows.
+	NewProcessGroup bool
+	// BreakawayFromJob, if true, starts the process outside of any job object
+	// that the calling process belongs to (CREATE_BREAKAWAY_FROM_JOB), e.g. so
+	// that it is not killed when a CI job that runs the tests is torn down.
+	// The job must permit breakaway. The process is still added to gosh's own
+	// job object unless IgnoreParentExit is set.
+	BreakawayFromJob bool
+}
+
+// PTYSize is the window size of a pseudo-terminal, in characters.
+type PTYSize struct {
+	Rows, Cols uint16
 }
 
 // Shell returns the shell that this Cmd was created from.
@@ -146,6 +391,17 @@ func (c *Cmd) SetStdinReader(r io.Reader) {
 	c.handleError(c.setStdinReader(r))
 }
 
+// SetStdinFromStdout configures this Cmd to read stdin from the stdout of src,
+// via an os pipe. Must be called before either command is started, and both
+// commands must then be started; they may be started in either order. The pipe
+// is closed for writing once src exits, so this Cmd receives EOF on stdin. Sets
+// src.IgnoreClosedPipeError to true. For longer chains of commands, use
+// Pipeline.
+func (c *Cmd) SetStdinFromStdout(src *Cmd) {
+	c.sh.Ok()
+	c.handleError(c.setStdinFromStdout(src))
+}
+
 // AddStdoutWriter configures this Cmd to tee stdout to the given Writer. Must
 // be called before Start. If the same Writer is passed to both AddStdoutWriter
 // and AddStderrWriter, Cmd will ensure that Write is never called concurrently.
@@ -162,14 +418,50 @@ func (c *Cmd) AddStderrWriter(w io.Writer) {
 	c.handleError(c.addStderrWriter(w))
 }
 
+// AddStdoutLineHandler configures this Cmd to call f for each line of stdout,
+// without the trailing newline. Must be called before Start. If the output
+// does not end with a newline, f is called with the final partial line once the
+// process exits. Calls to f for stdout and stderr never occur concurrently.
+func (c *Cmd) AddStdoutLineHandler(f func(line string)) {
+	c.sh.Ok()
+	c.handleError(c.addStdoutLineHandler(f))
+}
+
+// AddStderrLineHandler is like AddStdoutLineHandler, but for stderr.
+func (c *Cmd) AddStderrLineHandler(f func(line string)) {
+	c.sh.Ok()
+	c.handleError(c.addStderrLineHandler(f))
+}
+
 // Start starts the command.
 func (c *Cmd) Start() {
 	c.sh.Ok()
 	c.handleError(c.start())
 }
 
+// StartWithPTY is like Start, but runs the command with a new pseudo-terminal
+// of the given size as its stdin, stdout, stderr and controlling terminal. This
+// is useful for programs that behave differently when run on a terminal.
+//
+// Since a terminal has a single output stream, all output is sent to the stdout
+// writers, e.g. StdoutPipe, AddStdoutWriter and Stdout. Note that the terminal
+// typically translates "\n" to "\r\n". Input from StdinPipe or SetStdinReader
+// is written to the terminal. Not supported on Windows.
+func (c *Cmd) StartWithPTY(size PTYSize) {
+	c.sh.Ok()
+	c.handleError(c.startWithPTY(size))
+}
+
+// SetPTYSize sets the window size of the pseudo-terminal of a command started
+// via StartWithPTY.
+func (c *Cmd) SetPTYSize(size PTYSize) {
+	c.sh.Ok()
+	c.handleError(c.setPTYSize(size))
+}
+
 // AwaitVars waits for the child process to send values for the given vars
-// (e.g. using SendVars). Must not be called before Start or after Wait.
+// (e.g. using SendVars). Fails if Shell.DefaultTimeout is positive and elapses
+// first. Must not be called before Start or after Wait.
 func (c *Cmd) AwaitVars(keys ...string) map[string]string {
 	c.sh.Ok()
 	res, err := c.awaitVars(keys...)
@@ -177,13 +469,122 @@ func (c *Cmd) AwaitVars(keys ...string) map[string]string {
 	return res
 }
 
-// Wait waits for the command to exit.
+// AwaitVarsFor is like AwaitVars, but fails if the child process has not sent
+// values for all of the given vars within the given duration. A non-positive
+// duration means no timeout.
+func (c *Cmd) AwaitVarsFor(d time.Duration, keys ...string) map[string]string {
+	c.sh.Ok()
+	res, err := c.awaitVarsFor(d, keys...)
+	c.handleError(err)
+	return res
+}
+
+// AwaitVarsPartial waits for the child process to send values for the keys of
+// timeouts, waiting for each key for at most its duration, and returns the
+// values that were received along with the sorted keys that are still missing,
+// rather than failing. A non-positive duration means no timeout for that key.
+// It returns once every key has been received or has timed out, or the process
+// has exited. This suits children that publish vars incrementally, some of
+// which may never arrive. Must not be called before Start or after Wait.
+func (c *Cmd) AwaitVarsPartial(timeouts map[string]time.Duration) (vars map[string]string, missing []string) {
+	c.sh.Ok()
+	vars, missing, err := c.awaitVarsPartial(timeouts)
+	c.handleError(err)
+	return vars, missing
+}
+
+// AwaitVarInt waits for the child process to send a value for the given var,
+// as with AwaitVars, and returns it as an int. Fails if the value is not an
+// integer, e.g. as sent by SendTypedVars.
+func (c *Cmd) AwaitVarInt(key string) int {
+	c.sh.Ok()
+	res, err := c.awaitVarInt(key)
+	c.handleError(err)
+	return res
+}
+
+// AwaitVarBool is like AwaitVarInt, but for bools.
+func (c *Cmd) AwaitVarBool(key string) bool {
+	c.sh.Ok()
+	res, err := c.awaitVarBool(key)
+	c.handleError(err)
+	return res
+}
+
+// AwaitVarJSON waits for the child process to send a value for the given var,
+// as with AwaitVars, and decodes it into v using json.Unmarshal. Values sent
+// via SendVars are JSON strings.
+func (c *Cmd) AwaitVarJSON(key string, v interface{}) {
+	c.sh.Ok()
+	c.handleError(c.awaitVarJSON(key, v))
+}
+
+// AwaitMessage waits for the child process to send a message of one of the
+// given kinds (e.g. using SendMessage), or of any kind if none are given, and
+// returns it. Messages are returned in the order they were sent, and each
+// message is returned at most once. Fails if Shell.DefaultTimeout is positive
+// and elapses first. Must not be called before Start or after Wait.
+func (c *Cmd) AwaitMessage(kinds ...string) Message {
+	c.sh.Ok()
+	res, err := c.awaitMessage(kinds...)
+	c.handleError(err)
+	return res
+}
+
+// AwaitMessageFor is like AwaitMessage, but fails if the child process has not
+// sent a matching message within the given duration. A non-positive duration
+// means no timeout.
+func (c *Cmd) AwaitMessageFor(d time.Duration, kinds ...string) Message {
+	c.sh.Ok()
+	res, err := c.awaitMessageFor(d, kinds...)
+	c.handleError(err)
+	return res
+}
+
+// AwaitListening waits until connections to the given network address, e.g.
+// "tcp" and "127.0.0.1:8080", succeed, by polling. This is useful for servers
+// that cannot send vars to signal readiness, e.g. third-party binaries. Fails
+// if the process exits first, or if the address is not accepting connections
+// within the given duration. A non-positive duration means
+// Shell.DefaultTimeout, if positive, and otherwise no timeout. Must not be
+// called before Start or after Wait. See also AwaitReady.
+func (c *Cmd) AwaitListening(network, addr string, d time.Duration) {
+	c.sh.Ok()
+	c.handleError(c.awaitListening(network, addr, d))
+}
+
+// AwaitFileExists waits until the given file exists, by polling. This is useful
+// for programs that signal readiness by creating a file or unix socket. A
+// relative path is interpreted relative to the command's working directory.
+// Fails if the process exits first, or if the file does not exist within the
+// given duration. A non-positive duration means Shell.DefaultTimeout, if
+// positive, and otherwise no timeout. Must not be called before Start or after
+// Wait. See also AwaitReady.
+func (c *Cmd) AwaitFileExists(path string, d time.Duration) {
+	c.sh.Ok()
+	c.handleError(c.awaitFileExists(path, d))
+}
+
+// Wait waits for the command to exit. Fails if Shell.DefaultTimeout is positive
+// and elapses first, in which case the command is left running, as with
+// WaitFor. Wait may be called multiple times, including concurrently; once the
+// command has exited, each call returns the same result.
 func (c *Cmd) Wait() {
 	c.sh.Ok()
-	c.handleError(c.wait())
+	c.handleError(c.waitDefault())
+}
+
+// WaitFor is like Wait, but fails if the command has not exited within the
+// given duration. A non-positive duration means no timeout. If WaitFor times
+// out, the command is left running, and Wait, WaitFor, Signal or Terminate may
+// be called subsequently.
+func (c *Cmd) WaitFor(d time.Duration) {
+	c.sh.Ok()
+	c.handleError(c.waitFor(d))
 }
 
-// Signal sends a signal to the underlying process.
+// Signal sends a signal to the underlying process. Pass Kill to kill the
+// process via os.Process.Kill.
 func (c *Cmd) Signal(sig os.Signal) {
 	c.sh.Ok()
 	c.handleError(c.signal(sig))
@@ -192,11 +593,22 @@ func (c *Cmd) Signal(sig os.Signal) {
 // Terminate sends a signal to the underlying process, then waits for it to
 // exit. Terminate is different from Signal followed by Wait: Terminate succeeds
 // as long as the process exits, whereas Wait fails if the exit code isn't 0.
+// Once Wait has returned, Terminate sends no signal, so it may be called
+// repeatedly, e.g. by deferred teardown code.
 func (c *Cmd) Terminate(sig os.Signal) {
 	c.sh.Ok()
 	c.handleError(c.terminate(sig))
 }
 
+// Shutdown sends a signal to the underlying process, then waits up to the given
+// grace period for it to exit. If the process is still running after the grace
+// period, Shutdown kills it with os.Kill, and waits for it to exit. Like
+// Terminate, Shutdown succeeds as long as the process exits.
+func (c *Cmd) Shutdown(sig os.Signal, grace time.Duration) {
+	c.sh.Ok()
+	c.handleError(c.shutdown(sig, grace))
+}
+
 // Run calls Start followed by Wait.
 func (c *Cmd) Run() {
 	c.sh.Ok()
@@ -231,12 +643,121 @@ func (c *Cmd) CombinedOutput() string {
 
 // Pid returns the command's PID, or -1 if the command has not been started.
 func (c *Cmd) Pid() int {
-	if !c.started {
+	if !c.state().started {
 		return -1
 	}
 	return c.c.Process.Pid
 }
 
+// ProcessState returns information about the exited process, or nil if Wait
+// (or a method that calls Wait, such as Run or Terminate) has not returned.
+func (c *Cmd) ProcessState() *os.ProcessState {
+	if !c.state().calledWait {
+		return nil
+	}
+	return c.c.ProcessState
+}
+
+// ExitCode returns the exit code of the exited process, or -1 if the process
+// was terminated by a signal, or if Wait (or a method that calls Wait, such as
+// Run or Terminate) has not returned.
+func (c *Cmd) ExitCode() int {
+	if s := c.state(); s.inProcess && s.calledWait {
+		return c.inProcessExitCode
+	}
+	if ps := c.ProcessState(); ps != nil {
+		return ps.ExitCode()
+	}
+	return -1
+}
+
+// Running returns true iff the command has been started and has not yet exited.
+func (c *Cmd) Running() bool {
+	if s := c.state(); !s.started && !s.inProcess {
+		return false
+	}
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	return !c.exited
+}
+
+// OnExit arranges for f to be called once the command exits, with the error
+// that Wait returns (or would return), so that callers can react to the command
+// exiting, e.g. unexpectedly, without blocking in Wait. It may be called before
+// or after Start; if the command has already exited, f is called right away.
+// Functions are called in registration order, in a goroutine owned by gosh, and
+// are never called if the command is not started.
+func (c *Cmd) OnExit(f func(err error)) {
+	c.cond.L.Lock()
+	if !c.calledExitFuncs {
+		c.exitFuncs = append(c.exitFuncs, f)
+		c.cond.L.Unlock()
+		return
+	}
+	err := c.exitErr
+	c.cond.L.Unlock()
+	go f(err)
+}
+
+// ExitStatus describes how an exited process terminated.
+type ExitStatus struct {
+	// Code is the exit code of the process, or -1 if the process was terminated
+	// by a signal.
+	Code int
+	// Signal is the signal that terminated the process, or nil if the process
+	// exited normally. Always nil on Windows, where a killed process simply
+	// exits with a non-zero code.
+	Signal os.Signal
+}
+
+// Signaled returns true if the process was terminated by a signal.
+func (s ExitStatus) Signaled() bool {
+	return s.Signal != nil
+}
+
+func (s ExitStatus) String() string {
+	if s.Signal != nil {
+		return fmt.Sprintf("signal: %v", s.Signal)
+	}
+	return fmt.Sprintf("exit code %d", s.Code)
+}
+
+// ExitStatus returns the exit status of the exited process, or nil if Wait (or
+// a method that calls Wait, such as Run or Terminate) has not returned.
+func (c *Cmd) ExitStatus() *ExitStatus {
+	if s := c.state(); s.inProcess && s.calledWait {
+		return &ExitStatus{Code: c.inProcessExitCode}
+	}
+	ps := c.ProcessState()
+	if ps == nil {
+		return nil
+	}
+	return &ExitStatus{Code: ps.ExitCode(), Signal: exitSignal(ps)}
+}
+
+// Usage describes the resources used by an exited process.
+type Usage struct {
+	// UserTime and SystemTime are the CPU time spent in user and system mode.
+	UserTime, SystemTime time.Duration
+	// MaxRSS is the maximum resident set size in bytes, or 0 if unavailable on
+	// the current platform.
+	MaxRSS int64
+}
+
+// Usage returns the resources used by the exited process, or nil if Wait (or a
+// method that calls Wait, such as Run or Terminate) has not returned.
+func (c *Cmd) Usage() *Usage {
+	ps := c.ProcessState()
+	if ps == nil {
+		return nil
+	}
+	return &Usage{
+		UserTime:   ps.UserTime(),
+		SystemTime: ps.SystemTime(),
+		MaxRSS:     maxRSS(ps),
+	}
+}
+
 ////////////////////////////////////////
 // Internals
 
@@ -250,16 +771,17 @@ func newCmdInternal(sh *Shell, vars map[string]string, path string, args []strin
 		sh:             sh,
 		c:              &exec.Cmd{},
 		cond:           sync.NewCond(&sync.Mutex{}),
-		waitChan:       make(chan error, 1),
+		exitedChan:     make(chan struct{}),
 		stdoutHeadTail: newHeadTail(headTailCapacity),
 		stderrHeadTail: newHeadTail(headTailCapacity),
 		recvVars:       map[string]string{},
+		recvReplies:    map[uint64]wireMessage{},
 	}
 	// Protect against concurrent signal-triggered Shell.cleanup().
 	sh.cleanupMu.Lock()
 	defer sh.cleanupMu.Unlock()
 	if sh.calledCleanup {
-		return nil, errAlreadyCalledCleanup
+		return nil, ErrAlreadyCalledCleanup
 	}
 	sh.cmds = append(sh.cmds, c)
 	return c, nil
@@ -267,23 +789,102 @@ func newCmdInternal(sh *Shell, vars map[string]string, path string, args []strin
 
 func newCmd(sh *Shell, vars map[string]string, name string, args ...string) (*Cmd, error) {
 	// Mimics https://golang.org/src/os/exec/exec.go Command.
-	if filepath.Base(name) == name {
-		lp, err := lookpath.Look(sh.Vars, name)
-		if err != nil {
-			return nil, fmt.Errorf("gosh: failed to locate executable: %s", name)
+	if filepath.Base(name) != name {
+		return newCmdInternal(sh, vars, name, args)
+	}
+	lp, err := sh.lookPath(vars, name)
+	switch {
+	case err == nil:
+	case !sh.hasInterceptor(name):
+		return nil, fmt.Errorf("gosh: failed to locate executable: %s", name)
+	default:
+		lp = name
+	}
+	c, err := newCmdInternal(sh, vars, lp, args)
+	if err != nil {
+		return nil, err
+	}
+	c.lookName, c.lookPath = name, lp
+	return c, nil
+}
+
+// lookPath returns the path of the executable with the given name, per
+// Shell.LookPath if set, given the env vars the command will see. Results are
+// cached per Shell.FastSpawn.
+func (sh *Shell) lookPath(vars map[string]string, name string) (string, error) {
+	if sh.LookPath != nil {
+		return sh.LookPath(vars, name)
+	}
+	if sh.FastSpawn {
+		return sh.lookPathCached(vars, name)
+	}
+	return lookpath.Look(vars, name)
+}
+
+// relookPath resolves the name passed to Shell.Cmd again, given the env vars
+// the child will see, in case c.Vars was changed after c was created. It
+// updates c.Path, and c.Args[0] and args[0] to match, unless c.Path was set by
+// the user.
+// Requires that sh.cleanupMu is held.
+func (c *Cmd) relookPath(args []string, vars map[string]string) error {
+	if c.lookName == "" || c.Path != c.lookPath {
+		return nil
+	}
+	lp, err := c.sh.lookPath(vars, c.lookName)
+	if err != nil {
+		for _, i := range c.sh.interceptors {
+			if i.name == c.lookName {
+				return nil
+			}
 		}
-		name = lp
+		return fmt.Errorf("gosh: failed to locate executable: %s", c.lookName)
+	}
+	if len(args) > 0 && args[0] == c.Path {
+		args[0] = lp
+	}
+	if len(c.Args) > 0 && c.Args[0] == c.Path {
+		c.Args[0] = lp
 	}
-	return newCmdInternal(sh, vars, name, args)
+	c.Path, c.lookPath, c.c.Path = lp, lp, lp
+	return nil
 }
 
 func isExitError(err error) bool {
-	_, ok := err.(*exec.ExitError)
-	return ok
+	switch err.(type) {
+	case *exec.ExitError, interceptExitError, *PanicError:
+		return true
+	}
+	return false
 }
 
 func (c *Cmd) errorIsOk(err error) bool {
-	return err == nil || c.ExitErrorIsOk && isExitError(err)
+	if err == nil || c.ExitErrorIsOk && isExitError(err) {
+		return true
+	}
+	if code, ok := exitErrorCode(err); ok {
+		for _, allowed := range c.AllowedExitCodes {
+			if code == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exitErrorCode returns the exit code for err, if err is an exit error for a
+// process that exited normally.
+func exitErrorCode(err error) (int, bool) {
+	switch e := err.(type) {
+	case *exec.ExitError:
+		if code := e.ExitCode(); code >= 0 {
+			return code, true
+		}
+	case interceptExitError:
+		return e.code, true
+	case *PanicError:
+		return exitErrorCode(e.Err)
+	}
+	return 0, false
 }
 
 // An explanation of closed pipe errors. Consider the pipeline "yes | head -1",
@@ -313,23 +914,87 @@ func (c *Cmd) errorIsOk(err error) bool {
 var sep = strings.Repeat("-", 40)
 
 func (c *Cmd) handleError(err error) {
+	err = c.setErr(err)
+	// With LogOutput, describe the command for any error that occurs after it
+	// was started, e.g. a timeout in AwaitVars, not just for exit errors.
+	if err != nil && !c.sh.ContinueOnError && (isExitError(err) || c.LogOutput && c.state().calledStart) {
+		res := c.sh.redactions
+		c.sh.tb.Logf("gosh: command failed: %s\n", redact(res, strings.Join(c.Args, " ")))
+		c.sh.tb.Logf("\nSTDOUT\n%s\n%s\n", sep, redact(res, c.stdoutHeadTail.String()))
+		c.sh.tb.Logf("\nSTDERR\n%s\n%s\n", sep, redact(res, c.stderrHeadTail.String()))
+	}
+	c.sh.HandleErrorWithSkip(err, c.sh.ErrorDepth+1)
+}
+
+// setErr sets c.Err to err, or to nil if err is a closed pipe error that should
+// be ignored. It returns the error to be reported to the Shell, if any.
+func (c *Cmd) setErr(err error) error {
 	if c.IgnoreClosedPipeError && isClosedPipeError(err) {
 		err = nil
 	}
+	c.sh.errMu.Lock()
 	c.Err = err
+	c.sh.errMu.Unlock()
 	if c.errorIsOk(err) {
-		err = nil
+		return nil
 	}
-	if isExitError(err) && !c.sh.ContinueOnError {
-		c.sh.tb.Logf("gosh: command failed: %s\n", strings.Join(c.Args, " "))
-		c.sh.tb.Logf("\nSTDOUT\n%s\n%s\n", sep, c.stdoutHeadTail.String())
-		c.sh.tb.Logf("\nSTDERR\n%s\n%s\n", sep, c.stderrHeadTail.String())
+	return err
+}
+
+// cmdState is a snapshot of the lifecycle state of a Cmd.
+type cmdState struct {
+	calledStart, started, inProcess, dryRun, calledWait bool
+}
+
+// state returns a snapshot of c's lifecycle state.
+func (c *Cmd) state() cmdState {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return cmdState{
+		calledStart: c.calledStart,
+		started:     c.started,
+		inProcess:   c.inProcess,
+		dryRun:      c.dryRun,
+		calledWait:  c.calledWait,
+	}
+}
+
+// stateAfterStart is like state, but first waits for any in-progress call to
+// Start to return, so that methods called concurrently with Start observe the
+// started command.
+func (c *Cmd) stateAfterStart() cmdState {
+	c.startMu.Lock()
+	c.startMu.Unlock()
+	return c.state()
+}
+
+// sendWaitErr makes waitErr available to Wait, then calls any functions
+// registered via OnExit.
+func (c *Cmd) sendWaitErr(waitErr error) {
+	c.cond.L.Lock()
+	if c.ctxErr != nil {
+		waitErr = c.ctxErr
+	}
+	c.cond.L.Unlock()
+	if c.outputInfo != nil {
+		// Write the info file before Wait returns, so that callers may archive
+		// the output directory as soon as Wait returns.
+		c.writeOutputInfo(waitErr)
+	}
+	c.cond.L.Lock()
+	c.exitErr = waitErr
+	fs := c.exitFuncs
+	c.exitFuncs, c.calledExitFuncs = nil, true
+	c.cond.Broadcast()
+	c.cond.L.Unlock()
+	c.traceExited(c.exitErr)
+	for _, f := range fs {
+		f(c.exitErr)
 	}
-	c.sh.HandleErrorWithSkip(err, c.sh.ErrorDepth+1)
 }
 
 func (c *Cmd) isRunning() bool {
-	if !c.started {
+	if !c.state().started {
 		return false
 	}
 	c.cond.L.Lock()
@@ -337,79 +1002,216 @@ func (c *Cmd) isRunning() bool {
 	return !c.exited
 }
 
-// recvWriter listens for gosh vars from a child process.
+// decodeVars decodes a JSON object of vars sent by SendVars or SendTypedVars,
+// returning the vars as strings, per SendTypedVars, and as JSON.
+func decodeVars(data []byte) (map[string]string, map[string][]byte, error) {
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, err
+	}
+	vars := make(map[string]string, len(raw))
+	varsJSON := make(map[string][]byte, len(raw))
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			vars[k] = s
+		} else {
+			vars[k] = string(v)
+		}
+		varsJSON[k] = v
+	}
+	return vars, varsJSON, nil
+}
+
+// recvWriter listens for gosh vars and messages from a child process.
 type recvWriter struct {
-	c             *Cmd
-	buf           []byte
-	matchedPrefix int
+	c   *Cmd
+	buf []byte
+	// matchedPrefixes[i] is the length of the matched prefix of frames[i].
+	matchedPrefixes [2]int
+	// frame is the index of the frame being read, or -1 if none.
+	frame         int
 	matchedSuffix int
 }
 
+// frames holds the prefix and suffix of each kind of frame recognized by
+// recvWriter: vars, then messages.
+var frames = [2]struct{ prefix, suffix []byte }{
+	{varsPrefix, varsSuffix},
+	{msgPrefix, msgSuffix},
+}
+
+func newRecvWriter(c *Cmd) *recvWriter {
+	return &recvWriter{c: c, frame: -1}
+}
+
 func (w *recvWriter) Write(p []byte) (n int, err error) {
 	for i, b := range p {
-		if w.matchedPrefix < len(varsPrefix) {
+		if w.frame < 0 {
 			// Look for matching prefix.
-			if b != varsPrefix[w.matchedPrefix] {
-				w.matchedPrefix = 0
-			}
-			if b == varsPrefix[w.matchedPrefix] {
-				w.matchedPrefix++
+			for j, f := range frames {
+				if b != f.prefix[w.matchedPrefixes[j]] {
+					w.matchedPrefixes[j] = 0
+				}
+				if b == f.prefix[w.matchedPrefixes[j]] {
+					w.matchedPrefixes[j]++
+				}
+				if w.matchedPrefixes[j] == len(f.prefix) {
+					w.frame = j
+				}
 			}
 			continue
 		}
+		suffix := frames[w.frame].suffix
 		w.buf = append(w.buf, b)
 		// Look for matching suffix.
-		if b != varsSuffix[w.matchedSuffix] {
+		if b != suffix[w.matchedSuffix] {
 			w.matchedSuffix = 0
 		}
-		if b == varsSuffix[w.matchedSuffix] {
+		if b == suffix[w.matchedSuffix] {
 			w.matchedSuffix++
 		}
-		if w.matchedSuffix != len(varsSuffix) {
+		if w.matchedSuffix != len(suffix) {
 			continue
 		}
 		// Found matching suffix.
-		data := w.buf[:len(w.buf)-len(varsSuffix)]
+		data := w.buf[:len(w.buf)-len(suffix)]
+		frame := w.frame
 		w.buf = w.buf[:0]
-		w.matchedPrefix, w.matchedSuffix = 0, 0
-		vars := make(map[string]string)
-		if err := json.Unmarshal(data, &vars); err != nil {
-			return i, err
-		}
-		w.c.cond.L.Lock()
-		w.c.recvVars = mergeMaps(w.c.recvVars, vars)
-		w.c.cond.Signal()
+		w.matchedPrefixes = [2]int{}
+		w.frame, w.matchedSuffix = -1, 0
+		if frame == 0 {
+			vars, varsJSON, err := decodeVars(data)
+			if err != nil {
+				return i, err
+			}
+			w.c.cond.L.Lock()
+			w.c.recvVars = mergeMaps(w.c.recvVars, vars)
+			if w.c.recvVarsJSON == nil {
+				w.c.recvVarsJSON = make(map[string][]byte)
+			}
+			for k, v := range varsJSON {
+				w.c.recvVarsJSON[k] = v
+			}
+		} else {
+			var wm wireMessage
+			if err := json.Unmarshal(data, &wm); err != nil {
+				return i, err
+			}
+			w.c.cond.L.Lock()
+			switch {
+			case wm.Panic != nil:
+				w.c.recvPanic = wm.Panic
+			case wm.Heartbeat:
+				w.c.recvHeartbeatLocked()
+			case wm.ID != 0:
+				w.c.recvReplies[wm.ID] = wm
+			default:
+				w.c.recvMsgs = append(w.c.recvMsgs, wm)
+			}
+		}
+		// Wake up all waiters, since AwaitVars and AwaitMessage may be called
+		// concurrently.
+		w.c.cond.Broadcast()
 		w.c.cond.L.Unlock()
 	}
 	return len(p), nil
 }
 
+// startVarsReader creates a pipe for the child to send vars over, and starts a
+// goroutine that reads vars from the pipe. The write end of the pipe is closed
+// once the process has started.
+func (c *Cmd) startVarsReader() error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	c.varsWriter = pw
+	c.afterStartClosers = append(c.afterStartClosers, pw)
+	c.varsDoneChan = make(chan error, 1)
+	go c.readVars(pr)
+	return nil
+}
+
+// readVars reads vars from r until EOF, then closes r. Meant to be run in a
+// goroutine.
+func (c *Cmd) readVars(r *os.File) {
+	_, err := io.Copy(newRecvWriter(c), r)
+	r.Close()
+	c.varsDoneChan <- err
+}
+
 func (c *Cmd) makeStdoutStderr() (io.Writer, io.Writer, error) {
-	c.stderrWriters = append(c.stderrWriters, &recvWriter{c: c})
+	if c.varsDoneChan == nil {
+		// Listen for vars on stderr.
+		c.stderrWriters = append(c.stderrWriters, newRecvWriter(c))
+	}
 	c.stdoutWriters = append(c.stdoutWriters, c.stdoutHeadTail)
 	c.stderrWriters = append(c.stderrWriters, c.stderrHeadTail)
+	if c.InactivityTimeout > 0 {
+		c.addInactivityWatchdog()
+	}
+	res := c.sh.redactions
 	if c.PropagateOutput {
-		c.stdoutWriters = append(c.stdoutWriters, os.Stdout)
-		c.stderrWriters = append(c.stderrWriters, os.Stderr)
+		if c.OutputPrefix == "" && len(res) == 0 {
+			c.stdoutWriters = append(c.stdoutWriters, c.throttleOutput(os.Stdout))
+			c.stderrWriters = append(c.stderrWriters, c.throttleOutput(os.Stderr))
+		} else {
+			stdout := newPrefixWriter(os.Stdout, c.OutputPrefix, res)
+			stderr := newPrefixWriter(os.Stderr, c.OutputPrefix, res)
+			c.stdoutWriters = append(c.stdoutWriters, c.throttleOutput(stdout))
+			c.stderrWriters = append(c.stderrWriters, c.throttleOutput(stderr))
+			c.afterWaitClosers = append(c.afterWaitClosers, stdout, stderr)
+		}
+	}
+	if c.LogOutput {
+		prefix := c.OutputPrefix
+		if prefix == "" {
+			prefix = "[" + reportName(c) + "] "
+		}
+		logLine := func(line string) {
+			c.sh.tb.Logf("%s%s\n", prefix, redact(res, line))
+		}
+		stdout, stderr := newLineWriter(logLine), newLineWriter(logLine)
+		c.stdoutWriters = append(c.stdoutWriters, c.throttleOutput(stdout))
+		c.stderrWriters = append(c.stderrWriters, c.throttleOutput(stderr))
+		c.afterWaitClosers = append(c.afterWaitClosers, stdout, stderr)
 	}
 	if c.OutputDir != "" {
-		t := time.Now().Format("20060102.150405.000000")
-		name := filepath.Join(c.OutputDir, filepath.Base(c.Path)+"."+t)
-		const flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
-		switch file, err := os.OpenFile(name+".stdout", flags, 0600); {
-		case err != nil:
+		stdout, stderr, info, err := c.newOutputFiles()
+		if err != nil {
 			return nil, nil, err
-		default:
-			c.stdoutWriters = append(c.stdoutWriters, file)
-			c.afterWaitClosers = append(c.afterWaitClosers, file)
 		}
-		switch file, err := os.OpenFile(name+".stderr", flags, 0600); {
-		case err != nil:
+		dir := c.c.Dir
+		if dir == "" {
+			if dir, err = os.Getwd(); err != nil {
+				return nil, nil, err
+			}
+		}
+		c.outputInfo, c.outputInfoDir = info, dir
+		if len(res) == 0 {
+			c.stdoutWriters = append(c.stdoutWriters, stdout)
+			c.stderrWriters = append(c.stderrWriters, stderr)
+		} else {
+			// The redacting writers must be closed before the files.
+			rStdout, rStderr := newPrefixWriter(stdout, "", res), newPrefixWriter(stderr, "", res)
+			c.stdoutWriters = append(c.stdoutWriters, rStdout)
+			c.stderrWriters = append(c.stderrWriters, rStderr)
+			c.afterWaitClosers = append(c.afterWaitClosers, rStdout, rStderr)
+		}
+		c.afterWaitClosers = append(c.afterWaitClosers, stdout, stderr)
+	}
+	if c.sh.TranscriptFile != "" {
+		t, err := c.sh.openTranscript()
+		if err != nil {
 			return nil, nil, err
-		default:
-			c.stderrWriters = append(c.stderrWriters, file)
-			c.afterWaitClosers = append(c.afterWaitClosers, file)
 		}
+		c.transcript, c.transcriptIndex = t, len(c.sh.startedCmds)
+		stdout := newLineWriter(t.lineHandler(c.transcriptIndex, "stdout"))
+		stderr := newLineWriter(t.lineHandler(c.transcriptIndex, "stderr"))
+		c.stdoutWriters = append(c.stdoutWriters, stdout)
+		c.stderrWriters = append(c.stderrWriters, stderr)
+		c.afterWaitClosers = append(c.afterWaitClosers, stdout, stderr)
 	}
 	switch hasOut, hasErr := len(c.stdoutWriters) > 0, len(c.stderrWriters) > 0; {
 	case hasOut && hasErr:
@@ -449,19 +1251,95 @@ func (c *Cmd) clone() (*Cmd, error) {
 	}
 	res.IgnoreParentExit = c.IgnoreParentExit
 	res.ExitAfter = c.ExitAfter
+	res.Heartbeat = c.Heartbeat
+	res.Rlimits = append([]Rlimit(nil), c.Rlimits...)
 	res.PropagateOutput = c.PropagateOutput
+	res.LogOutput = c.LogOutput
+	res.OutputPrefix = c.OutputPrefix
 	res.OutputDir = c.OutputDir
+	res.OutputName = c.OutputName
+	res.OutputMaxBytes = c.OutputMaxBytes
+	res.OutputThrottle = c.OutputThrottle
+	res.Dir = c.Dir
 	res.ExitErrorIsOk = c.ExitErrorIsOk
+	res.AllowedExitCodes = append([]int(nil), c.AllowedExitCodes...)
 	res.IgnoreClosedPipeError = c.IgnoreClosedPipeError
+	res.MaxCaptureBytes = c.MaxCaptureBytes
+	res.MaxPipeBufferBytes = c.MaxPipeBufferBytes
+	res.StdinMode = c.StdinMode
+	res.SignalProcessGroup = c.SignalProcessGroup
+	res.SysProcAttr = c.SysProcAttr
+	res.Namespaces = c.Namespaces
+	res.Windows = c.Windows
+	res.InheritVars = c.InheritVars
+	res.ExpandVars = c.ExpandVars
+	res.Context = c.Context
+	res.InactivityTimeout = c.InactivityTimeout
+	res.shellVars = c.shellVars
+	res.lookName, res.lookPath = c.lookName, c.lookPath
+	res.traceCreated()
 	return res, nil
 }
 
+// InheritNone returns a Cmd.InheritVars function that makes it so no vars are
+// inherited from the Shell.
+func InheritNone() func(key string) bool {
+	return func(string) bool { return false }
+}
+
+// InheritOnly returns a Cmd.InheritVars function that makes it so only the
+// given vars are inherited from the Shell.
+func InheritOnly(keys ...string) func(key string) bool {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[key] = true
+	}
+	return func(key string) bool { return set[key] }
+}
+
+// InheritExcept returns a Cmd.InheritVars function that makes it so all vars
+// except the given ones are inherited from the Shell.
+func InheritExcept(keys ...string) func(key string) bool {
+	only := InheritOnly(keys...)
+	return func(key string) bool { return !only(key) }
+}
+
+// resolveArgsAndVars returns copies of c.Args and c.Vars, with vars filtered
+// according to c.InheritVars, and ${VAR} references expanded according to
+// c.ExpandVars.
+func (c *Cmd) resolveArgsAndVars() ([]string, map[string]string, error) {
+	args, vars := append([]string(nil), c.Args...), copyMap(c.Vars)
+	if c.InheritVars != nil {
+		for k, v := range vars {
+			if sv, ok := c.shellVars[k]; ok && sv == v && !c.InheritVars(k) {
+				delete(vars, k)
+			}
+		}
+	}
+	if c.ExpandVars == ExpandNone {
+		return args, vars, nil
+	}
+	strict := c.ExpandVars == ExpandStrict
+	var err error
+	for i := 1; i < len(args); i++ {
+		if args[i], err = expandVars(args[i], c.sh.Vars, strict); err != nil {
+			return nil, nil, err
+		}
+	}
+	for k, v := range vars {
+		if vars[k], err = expandVars(v, c.sh.Vars, strict); err != nil {
+			return nil, nil, err
+		}
+	}
+	return args, vars, nil
+}
+
 func (c *Cmd) stdinPipe() (io.WriteCloser, error) {
 	switch {
 	case c.calledStart:
-		return nil, errAlreadyCalledStart
+		return nil, ErrAlreadyCalledStart
 	case c.c.Stdin != nil:
-		return nil, errAlreadySetStdin
+		return nil, ErrAlreadySetStdin
 	}
 	// We want to provide an unlimited-size pipe to the user. If we set c.c.Stdin
 	// directly to the newBufferedPipe, the os/exec package will create an os.Pipe
@@ -480,8 +1358,9 @@ func (c *Cmd) stdinPipe() (io.WriteCloser, error) {
 	}
 	c.c.Stdin = pr
 	c.afterStartClosers = append(c.afterStartClosers, pr)
-	bp := newBufferedPipe()
-	c.afterWaitClosers = append(c.afterWaitClosers, bp)
+	bp := newLimitedBufferedPipe(c.MaxPipeBufferBytes)
+	// Once the process has exited, discard any data it didn't read.
+	c.afterWaitClosers = append(c.afterWaitClosers, newPipeReader(bp))
 	c.stdinDoneChan = make(chan error, 1)
 	go c.stdinPipeCopier(pw, bp) // pw is closed by stdinPipeCopier
 	return bp, nil
@@ -526,37 +1405,61 @@ func isClosedPipeError(err error) bool {
 func (c *Cmd) setStdinReader(r io.Reader) error {
 	switch {
 	case c.calledStart:
-		return errAlreadyCalledStart
+		return ErrAlreadyCalledStart
 	case c.c.Stdin != nil:
-		return errAlreadySetStdin
+		return ErrAlreadySetStdin
 	}
 	c.c.Stdin = r
+	c.stdinFromReader = true
+	return nil
+}
+
+func (c *Cmd) setStdinFromStdout(src *Cmd) error {
+	switch {
+	case c.sh != src.sh:
+		return errors.New("gosh: cmds have different shells")
+	case c.calledStart || src.calledStart:
+		return ErrAlreadyCalledStart
+	case c.c.Stdin != nil:
+		return ErrAlreadySetStdin
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	// The read side is closed once c has started, since c has its own copy. The
+	// write side is closed once src has exited, or failed to start.
+	c.c.Stdin = pr
+	c.afterStartClosers = append(c.afterStartClosers, pr)
+	src.stdoutWriters = append(src.stdoutWriters, pw)
+	src.afterWaitClosers = append(src.afterWaitClosers, pw)
+	src.IgnoreClosedPipeError = true
 	return nil
 }
 
 func (c *Cmd) stdoutPipe() (io.ReadCloser, error) {
 	if c.calledStart {
-		return nil, errAlreadyCalledStart
+		return nil, ErrAlreadyCalledStart
 	}
-	p := newBufferedPipe()
+	p := newLimitedBufferedPipe(c.MaxPipeBufferBytes)
 	c.stdoutWriters = append(c.stdoutWriters, p)
 	c.afterWaitClosers = append(c.afterWaitClosers, p)
-	return p, nil
+	return newPipeReader(p), nil
 }
 
 func (c *Cmd) stderrPipe() (io.ReadCloser, error) {
 	if c.calledStart {
-		return nil, errAlreadyCalledStart
+		return nil, ErrAlreadyCalledStart
 	}
-	p := newBufferedPipe()
+	p := newLimitedBufferedPipe(c.MaxPipeBufferBytes)
 	c.stderrWriters = append(c.stderrWriters, p)
 	c.afterWaitClosers = append(c.afterWaitClosers, p)
-	return p, nil
+	return newPipeReader(p), nil
 }
 
 func (c *Cmd) addStdoutWriter(w io.Writer) error {
 	if c.calledStart {
-		return errAlreadyCalledStart
+		return ErrAlreadyCalledStart
 	}
 	c.stdoutWriters = append(c.stdoutWriters, w)
 	return nil
@@ -564,23 +1467,60 @@ func (c *Cmd) addStdoutWriter(w io.Writer) error {
 
 func (c *Cmd) addStderrWriter(w io.Writer) error {
 	if c.calledStart {
-		return errAlreadyCalledStart
+		return ErrAlreadyCalledStart
+	}
+	c.stderrWriters = append(c.stderrWriters, w)
+	return nil
+}
+
+func (c *Cmd) addStdoutLineHandler(f func(string)) error {
+	if c.calledStart {
+		return ErrAlreadyCalledStart
 	}
+	w := newLineWriter(f)
+	c.stdoutWriters = append(c.stdoutWriters, w)
+	c.afterWaitClosers = append(c.afterWaitClosers, w)
+	return nil
+}
+
+func (c *Cmd) addStderrLineHandler(f func(string)) error {
+	if c.calledStart {
+		return ErrAlreadyCalledStart
+	}
+	w := newLineWriter(f)
 	c.stderrWriters = append(c.stderrWriters, w)
+	c.afterWaitClosers = append(c.afterWaitClosers, w)
 	return nil
 }
 
 // startExitWaiter spawns a goroutine that calls exec.Cmd.Wait, waiting for the
 // process to exit. Calling exec.Cmd.Wait here rather than in gosh.Cmd.Wait
 // ensures that the child process is reaped once it exits. Note, gosh.Cmd.wait
-// blocks on waitChan.
+// waits for sendWaitErr.
 func (c *Cmd) startExitWaiter() {
 	go func() {
 		waitErr := c.c.Wait()
+		if c.varsDoneChan != nil {
+			// Wait for all vars to be received, so that awaitVars doesn't fail
+			// because the process has exited while vars are still in the pipe.
+			if err := <-c.varsDoneChan; waitErr == nil {
+				waitErr = err
+			}
+		}
 		c.cond.L.Lock()
+		if c.recvPanic != nil && isExitError(waitErr) {
+			waitErr = &PanicError{Value: c.recvPanic.Value, Stack: c.recvPanic.Stack, Err: waitErr}
+		}
 		c.exited = true
-		c.cond.Signal()
+		c.exitTime = time.Now()
+		c.stopStallWatchersLocked()
+		c.cond.Broadcast()
 		c.cond.L.Unlock()
+		close(c.exitedChan)
+		if c.ptyDoneChan != nil {
+			// Wait for all output from the pty to be copied.
+			<-c.ptyDoneChan
+		}
 		if err := closeClosers(c.afterWaitClosers); waitErr == nil {
 			waitErr = err
 		}
@@ -590,9 +1530,31 @@ func (c *Cmd) startExitWaiter() {
 				waitErr = err
 			}
 		}
-		c.waitChan <- waitErr
+		c.logExited(waitErr)
+		c.sendWaitErr(waitErr)
 		c.cleanupProcessGroup()
 	}()
+	if c.Context != nil {
+		go c.watchContext()
+	}
+	c.startInactivityWatchdog()
+	c.startExitAfterTimer()
+	c.startStallWatchers()
+}
+
+// watchContext waits for either c.Context to be done or the process to exit.
+// In the former case, it records the context's error, wakes up any goroutine
+// blocked in awaitVars, and cleans up the process.
+func (c *Cmd) watchContext() {
+	select {
+	case <-c.Context.Done():
+		c.cond.L.Lock()
+		c.ctxErr = c.Context.Err()
+		c.cond.Broadcast()
+		c.cond.L.Unlock()
+		c.cleanupProcessGroup()
+	case <-c.exitedChan:
+	}
 }
 
 func closeClosers(closers []io.Closer) error {
@@ -605,14 +1567,35 @@ func closeClosers(closers []io.Closer) error {
 	return firstErr
 }
 
-// TODO(sadovsky): Maybe add optional timeouts for Cmd.{awaitVars,wait}.
+func (c *Cmd) startWithPTY(size PTYSize) error {
+	if c.calledStart {
+		return ErrAlreadyCalledStart
+	}
+	c.ptySize = &size
+	return c.start()
+}
+
+func (c *Cmd) setPTYSize(size PTYSize) error {
+	if c.ptyMaster == nil {
+		return ErrDidNotUsePTY
+	}
+	return setPTYSize(c.ptyMaster, size)
+}
 
 func (c *Cmd) awaitVars(keys ...string) (map[string]string, error) {
+	res, err := c.awaitVarsFor(c.sh.DefaultTimeout, keys...)
+	return res, c.defaultTimeoutErr(err)
+}
+
+func (c *Cmd) awaitVarsFor(d time.Duration, keys ...string) (map[string]string, error) {
+	s := c.stateAfterStart()
 	switch {
-	case !c.started:
-		return nil, errDidNotCallStart
-	case c.calledWait:
-		return nil, errAlreadyCalledWait
+	case s.calledWait:
+		return nil, ErrAlreadyCalledWait
+	case s.dryRun:
+		return map[string]string{}, nil
+	case !s.started && !s.inProcess:
+		return nil, ErrDidNotCallStart
 	}
 	wantKeys := map[string]bool{}
 	for _, key := range keys {
@@ -626,29 +1609,256 @@ func (c *Cmd) awaitVars(keys ...string) (map[string]string, error) {
 			}
 		}
 	}
+	timedOut := false
+	if d > 0 {
+		// Wake up the loop below once the timeout expires.
+		timer := c.sh.clock().AfterFunc(d, func() {
+			c.cond.L.Lock()
+			timedOut = true
+			c.cond.Broadcast()
+			c.cond.L.Unlock()
+		})
+		defer timer.Stop()
+	}
 	c.cond.L.Lock()
 	defer c.cond.L.Unlock()
 	updateRes()
-	for !c.exited && len(res) < len(wantKeys) {
+	for !c.exited && !timedOut && c.ctxErr == nil && len(res) < len(wantKeys) {
 		c.cond.Wait()
 		updateRes()
 	}
-	// Return nil error if both conditions triggered simultaneously.
-	if len(res) < len(wantKeys) {
-		return nil, errProcessExited
+	// Return nil error if multiple conditions triggered simultaneously.
+	switch {
+	case len(res) == len(wantKeys):
+		c.markReadyLocked()
+		return res, nil
+	case c.ctxErr != nil:
+		return nil, c.ctxErr
+	case c.exited:
+		return nil, ErrProcessExited
+	}
+	return nil, ErrTimedOut
+}
+
+func (c *Cmd) awaitVarsPartial(timeouts map[string]time.Duration) (map[string]string, []string, error) {
+	s := c.stateAfterStart()
+	switch {
+	case s.calledWait:
+		return nil, nil, ErrAlreadyCalledWait
+	case s.dryRun:
+		// Like awaitVarsFor, report that no vars were sent.
+		var missing []string
+		for k := range timeouts {
+			missing = append(missing, k)
+		}
+		sort.Strings(missing)
+		return map[string]string{}, missing, nil
+	case !s.started && !s.inProcess:
+		return nil, nil, ErrDidNotCallStart
+	}
+	clock := c.sh.clock()
+	start := clock.Now()
+	for _, d := range timeouts {
+		if d > 0 {
+			// Wake up the loop below once each timeout expires.
+			timer := c.sh.clock().AfterFunc(d, func() {
+				c.cond.L.Lock()
+				c.cond.Broadcast()
+				c.cond.L.Unlock()
+			})
+			defer timer.Stop()
+		}
+	}
+	// pending returns true iff some key has been neither received nor timed out.
+	pending := func() bool {
+		elapsed := clock.Now().Sub(start)
+		for k, d := range timeouts {
+			if _, ok := c.recvVars[k]; !ok && (d <= 0 || elapsed < d) {
+				return true
+			}
+		}
+		return false
+	}
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	for !c.exited && c.ctxErr == nil && pending() {
+		c.cond.Wait()
+	}
+	if c.ctxErr != nil {
+		return nil, nil, c.ctxErr
+	}
+	res := map[string]string{}
+	var missing []string
+	for k := range timeouts {
+		if v, ok := c.recvVars[k]; ok {
+			res[k] = v
+		} else {
+			missing = append(missing, k)
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) == 0 {
+		c.markReadyLocked()
+	}
+	return res, missing, nil
+}
+
+// awaitVar waits for the given var, and returns its value both as a string and
+// JSON-encoded. Returns ok false if the var was not sent, i.e. for DryRun.
+func (c *Cmd) awaitVar(key string) (s string, data []byte, ok bool, err error) {
+	vars, err := c.awaitVars(key)
+	if err != nil {
+		return "", nil, false, err
+	}
+	if s, ok = vars[key]; !ok {
+		return "", nil, false, nil
+	}
+	c.cond.L.Lock()
+	data = c.recvVarsJSON[key]
+	c.cond.L.Unlock()
+	return s, data, true, nil
+}
+
+func (c *Cmd) awaitVarInt(key string) (int, error) {
+	s, _, ok, err := c.awaitVar(key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	res, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("gosh: var %q is not an int: %v", key, err)
 	}
 	return res, nil
 }
 
-func (c *Cmd) wait() error {
+func (c *Cmd) awaitVarBool(key string) (bool, error) {
+	s, _, ok, err := c.awaitVar(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	res, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("gosh: var %q is not a bool: %v", key, err)
+	}
+	return res, nil
+}
+
+func (c *Cmd) awaitVarJSON(key string, v interface{}) error {
+	_, data, ok, err := c.awaitVar(key)
+	if err != nil || !ok {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("gosh: failed to decode var %q: %v", key, err)
+	}
+	return nil
+}
+
+func (c *Cmd) awaitMessage(kinds ...string) (Message, error) {
+	res, err := c.awaitMessageFor(c.sh.DefaultTimeout, kinds...)
+	return res, c.defaultTimeoutErr(err)
+}
+
+func (c *Cmd) awaitMessageFor(d time.Duration, kinds ...string) (Message, error) {
+	s := c.stateAfterStart()
+	switch {
+	case s.calledWait:
+		return Message{}, ErrAlreadyCalledWait
+	case s.dryRun:
+		return Message{}, nil
+	case !s.started && !s.inProcess:
+		return Message{}, ErrDidNotCallStart
+	}
+	wantKinds := map[string]bool{}
+	for _, kind := range kinds {
+		wantKinds[kind] = true
+	}
+	// popMsg removes and returns the first matching message, if any.
+	popMsg := func() (wireMessage, bool) {
+		for i, wm := range c.recvMsgs {
+			if len(wantKinds) == 0 || wantKinds[wm.Kind] {
+				c.recvMsgs = append(c.recvMsgs[:i], c.recvMsgs[i+1:]...)
+				return wm, true
+			}
+		}
+		return wireMessage{}, false
+	}
+	timedOut := false
+	if d > 0 {
+		// Wake up the loop below once the timeout expires.
+		timer := c.sh.clock().AfterFunc(d, func() {
+			c.cond.L.Lock()
+			timedOut = true
+			c.cond.Broadcast()
+			c.cond.L.Unlock()
+		})
+		defer timer.Stop()
+	}
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	wm, ok := popMsg()
+	for !ok && !c.exited && !timedOut && c.ctxErr == nil {
+		c.cond.Wait()
+		wm, ok = popMsg()
+	}
+	// Return nil error if multiple conditions triggered simultaneously.
 	switch {
-	case !c.started:
-		return errDidNotCallStart
-	case c.calledWait:
-		return errAlreadyCalledWait
+	case ok:
+		return decodeMessage(wm)
+	case c.ctxErr != nil:
+		return Message{}, c.ctxErr
+	case c.exited:
+		return Message{}, ErrProcessExited
+	}
+	return Message{}, ErrTimedOut
+}
+
+func (c *Cmd) wait() error {
+	return c.waitFor(0)
+}
+
+// waitDefault is like wait, but times out per Shell.DefaultTimeout.
+func (c *Cmd) waitDefault() error {
+	return c.defaultTimeoutErr(c.waitFor(c.sh.DefaultTimeout))
+}
+
+// defaultTimeoutErr returns err, annotated if it is a timeout per
+// Shell.DefaultTimeout.
+func (c *Cmd) defaultTimeoutErr(err error) error {
+	if err == ErrTimedOut {
+		return fmt.Errorf("%w after %v (Shell.DefaultTimeout)", ErrTimedOut, c.sh.DefaultTimeout)
+	}
+	return err
+}
+
+func (c *Cmd) waitFor(d time.Duration) error {
+	if s := c.stateAfterStart(); !s.started && !s.inProcess {
+		return ErrDidNotCallStart
+	}
+	timedOut := false
+	if d > 0 {
+		// Wake up the loop below once the timeout expires.
+		timer := c.sh.clock().AfterFunc(d, func() {
+			c.cond.L.Lock()
+			timedOut = true
+			c.cond.Broadcast()
+			c.cond.L.Unlock()
+		})
+		defer timer.Stop()
 	}
+	c.cond.L.Lock()
+	for !c.calledExitFuncs && !timedOut {
+		c.cond.Wait()
+	}
+	done, err := c.calledExitFuncs, c.exitErr
+	c.cond.L.Unlock()
+	if !done {
+		return ErrTimedOut
+	}
+	c.stateMu.Lock()
 	c.calledWait = true
-	return <-c.waitChan
+	c.stateMu.Unlock()
+	return err
 }
 
 // Note: We check for this particular error message to handle the unavoidable
@@ -657,34 +1867,97 @@ func (c *Cmd) wait() error {
 // https://golang.org/src/os/exec_windows.go
 const errFinished = "os: process already finished"
 
-// NOTE(sadovsky): Technically speaking, Process.Signal(os.Kill) is different
-// from Process.Kill. Currently, gosh.Cmd does not provide a way to trigger
-// Process.Kill. If it proves necessary, we'll add a "gosh.Kill" implementation
-// of the os.Signal interface, and have the signal and terminate methods map
-// that to Process.Kill.
 func (c *Cmd) signal(sig os.Signal) error {
+	s := c.stateAfterStart()
 	switch {
-	case !c.started:
-		return errDidNotCallStart
-	case c.calledWait:
-		return errAlreadyCalledWait
+	case s.calledWait:
+		return ErrAlreadyCalledWait
+	case s.inProcess:
+		return nil
+	case !s.started:
+		return ErrDidNotCallStart
 	}
+	return c.sendSignal(sig)
+}
+
+// sendSignal sends sig to the process if it's still running. Unlike signal, it
+// doesn't check calledWait, so it may be called concurrently with wait.
+func (c *Cmd) sendSignal(sig os.Signal) error {
 	if !c.isRunning() {
 		return nil
 	}
-	if err := c.c.Process.Signal(sig); err != nil && err.Error() != errFinished {
+	c.logEvent(CmdEvent{Type: CmdSignaled, Signal: sig})
+	c.traceSignaled(sig)
+	if c.SignalProcessGroup {
+		if sig == Kill {
+			sig = os.Kill
+		}
+		return c.signalProcessGroup(sig)
+	}
+	var err error
+	if sig == Kill {
+		err = c.c.Process.Kill()
+	} else {
+		err = c.signalProcess(sig)
+	}
+	if err != nil && err.Error() != errFinished {
+		return err
+	}
+	return nil
+}
+
+// signalUnlessWaited is like signal, but does nothing if Wait has returned, so
+// that Terminate and Shutdown may be called repeatedly.
+func (c *Cmd) signalUnlessWaited(sig os.Signal) error {
+	if err := c.signal(sig); err != nil && err != ErrAlreadyCalledWait {
 		return err
 	}
 	return nil
 }
 
 func (c *Cmd) terminate(sig os.Signal) error {
-	if err := c.signal(sig); err != nil {
+	if err := c.signalUnlessWaited(sig); err != nil {
 		return err
 	}
 	if err := c.wait(); err != nil {
 		// Succeed as long as the process exited, regardless of the exit code.
-		if _, ok := err.(*exec.ExitError); !ok {
+		if !c.exitedWith(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// exitedWith returns true iff err, as returned by wait, means that the process
+// exited, regardless of the exit code. This includes errors from Cmd.Context,
+// the Shell's deadline and Cmd.InactivityTimeout, which terminate the process.
+func (c *Cmd) exitedWith(err error) bool {
+	if isExitError(err) {
+		return true
+	}
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	return c.ctxErr != nil && err == c.ctxErr
+}
+
+func (c *Cmd) shutdown(sig os.Signal, grace time.Duration) error {
+	if err := c.signalUnlessWaited(sig); err != nil {
+		return err
+	}
+	// Note that waitFor treats a non-positive duration as no timeout.
+	if grace <= 0 {
+		grace = time.Nanosecond
+	}
+	err := c.waitFor(grace)
+	if err == ErrTimedOut {
+		if err := c.signal(os.Kill); err != nil {
+			return err
+		}
+		err = c.wait()
+	}
+	if err != nil {
+		// Succeed as long as the process exited, regardless of the exit code.
+		if !c.exitedWith(err) {
 			return err
 		}
 	}
@@ -695,37 +1968,68 @@ func (c *Cmd) run() error {
 	if err := c.start(); err != nil {
 		return err
 	}
-	return c.wait()
+	return c.waitDefault()
+}
+
+// captureBuffer is the buffer used to capture output for Stdout, StdoutStderr
+// and CombinedOutput.
+type captureBuffer interface {
+	io.Writer
+	String() string
+}
+
+func (c *Cmd) newCaptureBuffer() captureBuffer {
+	var res captureBuffer = &bytes.Buffer{}
+	if c.MaxCaptureBytes > 0 {
+		res = boundedBuffer{newHeadTail(c.MaxCaptureBytes)}
+	}
+	if len(c.sh.redactions) > 0 {
+		res = redactedBuffer{res, c.sh.redactions}
+	}
+	return res
+}
+
+// boundedBuffer is a headTail that returns an empty string if nothing has been
+// written.
+type boundedBuffer struct {
+	*headTail
+}
+
+func (b boundedBuffer) String() string {
+	if b.nWritten == 0 {
+		return ""
+	}
+	return b.headTail.String()
 }
 
 func (c *Cmd) stdout() (string, error) {
 	if c.calledStart {
-		return "", errAlreadyCalledStart
+		return "", ErrAlreadyCalledStart
 	}
-	var stdout bytes.Buffer
-	c.stdoutWriters = append(c.stdoutWriters, &stdout)
+	stdout := c.newCaptureBuffer()
+	c.stdoutWriters = append(c.stdoutWriters, stdout)
 	err := c.run()
 	return stdout.String(), err
 }
 
 func (c *Cmd) stdoutStderr() (string, string, error) {
 	if c.calledStart {
-		return "", "", errAlreadyCalledStart
+		return "", "", ErrAlreadyCalledStart
 	}
-	var stdout, stderr bytes.Buffer
-	c.stdoutWriters = append(c.stdoutWriters, &stdout)
-	c.stderrWriters = append(c.stderrWriters, &stderr)
+	stdout, stderr := c.newCaptureBuffer(), c.newCaptureBuffer()
+	c.stdoutWriters = append(c.stdoutWriters, stdout)
+	c.stderrWriters = append(c.stderrWriters, stderr)
 	err := c.run()
 	return stdout.String(), stderr.String(), err
 }
 
 func (c *Cmd) combinedOutput() (string, error) {
 	if c.calledStart {
-		return "", errAlreadyCalledStart
+		return "", ErrAlreadyCalledStart
 	}
-	var output bytes.Buffer
-	c.stdoutWriters = append(c.stdoutWriters, &output)
-	c.stderrWriters = append(c.stderrWriters, &output)
+	output := c.newCaptureBuffer()
+	c.stdoutWriters = append(c.stdoutWriters, output)
+	c.stderrWriters = append(c.stderrWriters, output)
 	err := c.run()
 	return output.String(), err
 }
@@ -733,32 +2037,38 @@ func (c *Cmd) combinedOutput() (string, error) {
 ////////////////////////////////////////
 // Head-and-tail buffer
 
-// headTail stores the first and last 'capacity' written bytes.
+// headTail stores the first and last 'capacity' written bytes. It is safe for
+// concurrent use, so that it may be read while the process is running.
+//
+// Memory is allocated as data is written, so a large capacity costs nothing
+// until that much output is produced.
 type headTail struct {
+	mu       sync.Mutex
+	capacity int
 	head     []byte
 	tail     *ringBuffer
 	nWritten int // number of bytes written
 }
 
 func newHeadTail(capacity int) *headTail {
-	return &headTail{head: make([]byte, capacity)}
+	return &headTail{capacity: capacity}
 }
 
 // Write writes to the buffer.
 func (b *headTail) Write(p []byte) (int, error) {
-	nHead := len(b.head) - b.nWritten // number of bytes to write to head
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	nHead := b.capacity - len(b.head) // number of bytes to write to head
 	if nHead > len(p) {
 		nHead = len(p)
-	} else if nHead < 0 {
-		nHead = 0
 	}
 	if nHead > 0 {
-		copy(b.head[b.nWritten:], p[:nHead])
+		b.head = append(b.head, p[:nHead]...)
 	}
 	// Write any remaining bytes to tail.
 	if len(p) > nHead {
 		if b.tail == nil {
-			b.tail = newRingBuffer(len(b.head))
+			b.tail = newRingBuffer(b.capacity)
 		}
 		b.tail.Append(p[nHead:])
 	}
@@ -768,14 +2078,16 @@ func (b *headTail) Write(p []byte) (int, error) {
 
 // String returns the buffer as a string.
 func (b *headTail) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	if b.nWritten == 0 {
 		return "[ empty ]"
 	}
 	if b.tail == nil {
-		return string(b.head[:b.nWritten])
+		return string(b.head)
 	}
 	tail := b.tail.String()
-	skipped := b.nWritten - 2*len(b.head)
+	skipped := b.nWritten - 2*b.capacity
 	if skipped <= 0 {
 		return fmt.Sprintf("%s%s", b.head, tail)
 	}
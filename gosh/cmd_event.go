@@ -0,0 +1,142 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CmdEventType describes the type of a CmdEvent.
+type CmdEventType int
+
+const (
+	CmdStarted  CmdEventType = iota // The process was started.
+	CmdSignaled                     // A signal was sent to the process.
+	CmdExited                       // The process exited.
+)
+
+// CmdEvent describes something that happened to a command's process. Events
+// are reported to Shell.CmdEventLogger, if set.
+type CmdEvent struct {
+	Type CmdEventType
+	// Cmd is the command that the event applies to.
+	Cmd *Cmd
+	// Time is the time at which the event occurred.
+	Time time.Time
+	// For CmdStarted events, SetVars holds the env vars of the process that are
+	// not set to the same value in the calling process's environment, and
+	// UnsetVars holds the names of env vars of the calling process that are not
+	// set for the process.
+	SetVars   map[string]string
+	UnsetVars []string
+	// For CmdSignaled events, Signal is the signal that was sent.
+	Signal os.Signal
+	// For CmdExited events, ExitCode is the exit code of the process (-1 if it
+	// was terminated by a signal), Duration is the time since it was started,
+	// and Err is the error that Wait will return, if any.
+	ExitCode int
+	Duration time.Duration
+	Err      error
+}
+
+// String returns a single-line description of the event.
+func (e CmdEvent) String() string {
+	pid := e.Cmd.Pid()
+	switch e.Type {
+	case CmdStarted:
+		return fmt.Sprintf("gosh: started (PID %d): %s", pid, describeCmd(e.Cmd, e.SetVars, e.UnsetVars))
+	case CmdSignaled:
+		return fmt.Sprintf("gosh: signaled (PID %d): %v", pid, e.Signal)
+	case CmdExited:
+		return fmt.Sprintf("gosh: exited (PID %d): code %d after %v (err: %v)", pid, e.ExitCode, e.Duration, e.Err)
+	}
+	return fmt.Sprintf("gosh: unknown event type %d (PID %d)", e.Type, pid)
+}
+
+// describeCmd returns a description of the args, working directory and env
+// diff of c. Requires that c has been configured by start.
+func describeCmd(c *Cmd, setVars map[string]string, unsetVars []string) string {
+	var vars []string
+	for k, v := range setVars {
+		vars = append(vars, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(vars)
+	for _, k := range unsetVars {
+		vars = append(vars, "-"+k)
+	}
+	return fmt.Sprintf("%s [dir=%q env: %s]", strings.Join(c.c.Args, " "), c.Dir, strings.Join(vars, " "))
+}
+
+// envDiff returns the env vars in env that are not set to the same value in the
+// calling process's environment, and the sorted names of env vars of the
+// calling process that are not set in env.
+func envDiff(env []string) (map[string]string, []string) {
+	d := diffEnv(sliceToMap(os.Environ()), sliceToMap(env))
+	setVars, unsetVars := d.Added, []string(nil)
+	for k, v := range d.Changed {
+		setVars[k] = v.Child
+	}
+	for k := range d.Removed {
+		unsetVars = append(unsetVars, k)
+	}
+	sort.Strings(unsetVars)
+	return setVars, unsetVars
+}
+
+// logEvent reports the event to the Shell's CmdEventLogger and transcript, if
+// any.
+func (c *Cmd) logEvent(e CmdEvent) {
+	logger := c.sh.CmdEventLogger
+	if logger == nil && c.transcript == nil {
+		return
+	}
+	e.Cmd = c
+	e.Time = time.Now()
+	if c.transcript != nil {
+		c.transcript.writeEvent(c.transcriptIndex, e)
+	}
+	if logger != nil {
+		logger(e)
+	}
+}
+
+// logStarted reports a CmdStarted event, computing the env diff relative to the
+// calling process's environment.
+func (c *Cmd) logStarted() {
+	if c.sh.CmdEventLogger == nil && c.transcript == nil {
+		return
+	}
+	e := CmdEvent{Type: CmdStarted}
+	e.SetVars, e.UnsetVars = envDiff(c.c.Env)
+	c.logEvent(e)
+}
+
+// logDryRun logs the command that would have been started, for Shell.DryRun.
+func (c *Cmd) logDryRun() {
+	setVars, unsetVars := envDiff(c.c.Env)
+	c.sh.tb.Logf("gosh: dry run: %s\n", describeCmd(c, setVars, unsetVars))
+}
+
+// logExited reports a CmdExited event. Must be called after the process has
+// been waited for.
+func (c *Cmd) logExited(err error) {
+	if c.sh.CmdEventLogger == nil && c.transcript == nil {
+		return
+	}
+	code := c.c.ProcessState.ExitCode()
+	if c.state().inProcess {
+		code = c.inProcessExitCode
+	}
+	c.logEvent(CmdEvent{
+		Type:     CmdExited,
+		ExitCode: code,
+		Duration: time.Since(c.startTime),
+		Err:      err,
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// CmdOption configures a Cmd created by Shell.CmdOpt. Options are applied in
+// order, after the Cmd has been configured per the Shell's settings.
+type CmdOption func(c *Cmd) error
+
+// CmdOpt returns a Cmd for an invocation of the named program with the given
+// arguments, as with Cmd, configured by the given options. This way, a Cmd is
+// fully configured when it is created, rather than by modifying its fields
+// before Start. If any option fails, no Cmd is returned.
+func (sh *Shell) CmdOpt(name string, args []string, opts ...CmdOption) *Cmd {
+	sh.Ok()
+	res, err := sh.cmdOpt(name, args, opts...)
+	sh.handleError(err)
+	return res
+}
+
+// WithDir sets Cmd.Dir.
+func WithDir(dir string) CmdOption {
+	return func(c *Cmd) error {
+		c.Dir = dir
+		return nil
+	}
+}
+
+// WithVars sets the given env vars in Cmd.Vars. The program name is resolved
+// again using these vars when the command is started.
+func WithVars(vars map[string]string) CmdOption {
+	return func(c *Cmd) error {
+		for k, v := range vars {
+			c.Vars[k] = v
+		}
+		return nil
+	}
+}
+
+// WithInheritVars sets Cmd.InheritVars, e.g. to InheritNone().
+func WithInheritVars(f func(key string) bool) CmdOption {
+	return func(c *Cmd) error {
+		c.InheritVars = f
+		return nil
+	}
+}
+
+// WithStdinReader configures the Cmd to read stdin from r, as with
+// Cmd.SetStdinReader.
+func WithStdinReader(r io.Reader) CmdOption {
+	return func(c *Cmd) error {
+		return c.setStdinReader(r)
+	}
+}
+
+// WithStdoutWriter configures the Cmd to tee stdout to w, as with
+// Cmd.AddStdoutWriter.
+func WithStdoutWriter(w io.Writer) CmdOption {
+	return func(c *Cmd) error {
+		return c.addStdoutWriter(w)
+	}
+}
+
+// WithStderrWriter configures the Cmd to tee stderr to w, as with
+// Cmd.AddStderrWriter.
+func WithStderrWriter(w io.Writer) CmdOption {
+	return func(c *Cmd) error {
+		return c.addStderrWriter(w)
+	}
+}
+
+// WithOutputPrefix sets Cmd.OutputPrefix.
+func WithOutputPrefix(prefix string) CmdOption {
+	return func(c *Cmd) error {
+		c.OutputPrefix = prefix
+		return nil
+	}
+}
+
+// WithContext sets Cmd.Context.
+func WithContext(ctx context.Context) CmdOption {
+	return func(c *Cmd) error {
+		c.Context = ctx
+		return nil
+	}
+}
+
+// WithInactivityTimeout sets Cmd.InactivityTimeout.
+func WithInactivityTimeout(d time.Duration) CmdOption {
+	return func(c *Cmd) error {
+		c.InactivityTimeout = d
+		return nil
+	}
+}
+
+// WithExitAfter sets Cmd.ExitAfter.
+func WithExitAfter(d time.Duration) CmdOption {
+	return func(c *Cmd) error {
+		c.ExitAfter = d
+		return nil
+	}
+}
+
+// WithExitErrorIsOk sets Cmd.ExitErrorIsOk to true.
+func WithExitErrorIsOk() CmdOption {
+	return func(c *Cmd) error {
+		c.ExitErrorIsOk = true
+		return nil
+	}
+}
+
+// WithAllowedExitCodes adds the given codes to Cmd.AllowedExitCodes.
+func WithAllowedExitCodes(codes ...int) CmdOption {
+	return func(c *Cmd) error {
+		c.AllowedExitCodes = append(c.AllowedExitCodes, codes...)
+		return nil
+	}
+}
+
+////////////////////////////////////////
+// Internals
+
+func (sh *Shell) cmdOpt(name string, args []string, opts ...CmdOption) (*Cmd, error) {
+	c, err := sh.cmd(nil, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"time"
+)
+
+// SetDeadline arranges for all commands started by this Shell to be terminated
+// once the given time is reached, as a safety net against hung tests. Once the
+// deadline is exceeded, pending and subsequent calls to Wait, AwaitVars and the
+// like fail with a deadline error, as do attempts to start new commands.
+// Cleanup works as usual. Calling SetDeadline again replaces the deadline, and
+// a zero time removes it. For a timeout, use
+// sh.SetDeadline(time.Now().Add(d)).
+func (sh *Shell) SetDeadline(t time.Time) {
+	sh.Ok()
+	sh.handleError(sh.setDeadline(t))
+}
+
+// ErrDeadlineExceeded is reported by Wait, AwaitVars and the like, and by
+// Start, once the deadline set by SetDeadline has been exceeded.
+var ErrDeadlineExceeded = errors.New("gosh: shell deadline exceeded")
+
+////////////////////////////////////////
+// Internals
+
+// deadline is the state for a call to SetDeadline. Its fields are protected by
+// Shell.cleanupMu.
+type deadline struct {
+	timer    Timer
+	exceeded bool
+}
+
+func (sh *Shell) setDeadline(t time.Time) error {
+	sh.cleanupMu.Lock()
+	defer sh.cleanupMu.Unlock()
+	if sh.calledCleanup {
+		return ErrAlreadyCalledCleanup
+	}
+	if sh.deadline != nil {
+		sh.deadline.timer.Stop()
+		sh.deadline = nil
+	}
+	if !t.IsZero() {
+		d := &deadline{}
+		clock := sh.clock()
+		d.timer = clock.AfterFunc(t.Sub(clock.Now()), func() { sh.expireDeadline(d) })
+		sh.deadline = d
+	}
+	return nil
+}
+
+// expireDeadline terminates all running commands, and makes their pending and
+// subsequent waits fail with ErrDeadlineExceeded, unless d has been replaced by
+// a subsequent call to SetDeadline.
+func (sh *Shell) expireDeadline(d *deadline) {
+	sh.cleanupMu.Lock()
+	if sh.calledCleanup || sh.deadline != d {
+		sh.cleanupMu.Unlock()
+		return
+	}
+	d.exceeded = true
+	cmds := append([]*Cmd(nil), sh.startedCmds...)
+	sh.cleanupMu.Unlock()
+	sh.tb.Logf("%v; terminating all commands\n", ErrDeadlineExceeded)
+	for _, c := range cmds {
+		c.expire(ErrDeadlineExceeded)
+	}
+}
+
+// expire terminates c if it's still running, makes its pending and subsequent
+// waits fail with err, and wakes up any goroutine blocked waiting on it.
+// Returns false if c had already exited.
+func (c *Cmd) expire(err error) bool {
+	c.cond.L.Lock()
+	if c.exited {
+		c.cond.L.Unlock()
+		return false
+	}
+	if c.ctxErr == nil {
+		c.ctxErr = err
+	}
+	c.cond.Broadcast()
+	c.cond.L.Unlock()
+	// Don't block the other commands on this one's grace period.
+	go c.cleanupProcessGroup()
+	return true
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DownloadOpts specifies options for Shell.Download.
+type DownloadOpts struct {
+	// SHA256 is the expected hex-encoded SHA-256 checksum of the downloaded
+	// file. If empty, the checksum is not verified.
+	SHA256 string
+	// Name is the base name of the downloaded file. If empty, the last element
+	// of the URL path is used.
+	Name string
+	// Mode is the permission bits of the downloaded file, e.g. 0700 for an
+	// executable. If zero, 0600 is used.
+	Mode os.FileMode
+	// Client is the HTTP client used to fetch the file. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Download fetches the given URL into a new file in a temporary directory, and
+// returns the path to the file. The temporary directory is deleted by Cleanup.
+// Download fails if the response status is not 200 OK, or if opts.SHA256 is set
+// and does not match the checksum of the downloaded file.
+func (sh *Shell) Download(url string, opts DownloadOpts) string {
+	sh.Ok()
+	res, err := sh.download(url, opts)
+	sh.handleError(err)
+	return res
+}
+
+////////////////////////////////////////
+// Internals
+
+func (sh *Shell) download(rawurl string, opts DownloadOpts) (string, error) {
+	name := opts.Name
+	if name == "" {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return "", err
+		}
+		if name = path.Base(u.Path); name == "." || name == "/" {
+			name = "download"
+		}
+	}
+	mode := opts.Mode
+	if mode == 0 {
+		mode = 0600
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	dir, err := sh.makeTempDir()
+	if err != nil {
+		return "", err
+	}
+	sh.tb.Logf("Downloading %s\n", rawurl)
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gosh: failed to download %s: %s", rawurl, resp.Status)
+	}
+	p := filepath.Join(dir, name)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if opts.SHA256 != "" {
+		if got := hex.EncodeToString(h.Sum(nil)); got != strings.ToLower(opts.SHA256) {
+			os.Remove(p)
+			return "", fmt.Errorf("gosh: checksum mismatch for %s: got sha256 %s, want %s", rawurl, got, opts.SHA256)
+		}
+	}
+	return p, nil
+}
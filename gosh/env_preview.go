@@ -0,0 +1,127 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"os"
+	"sort"
+)
+
+// EnvDiff describes how the environment of a child process differs from that
+// of the current process; see Cmd.EnvPreview.
+type EnvDiff struct {
+	// Added holds the vars that are set for the child, but not for the current
+	// process.
+	Added map[string]string
+	// Changed holds the vars that are set for both, with different values.
+	Changed map[string]EnvChange
+	// Removed holds the vars that are set for the current process, but not for
+	// the child, mapped to their values for the current process.
+	Removed map[string]string
+}
+
+// EnvChange holds the values of a var that is set for both the current process
+// and a child process, with different values.
+type EnvChange struct {
+	Parent, Child string
+}
+
+// Empty returns true if the environments are the same.
+func (d EnvDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
+
+// String returns the diff in a unified-diff-like format, with one line per
+// var, sorted by key: "+key=value" for vars that are added, "-key=value" for
+// vars that are removed, and both for vars that are changed.
+func (d EnvDiff) String() string {
+	var keys []string
+	for k := range d.Added {
+		keys = append(keys, k)
+	}
+	for k := range d.Changed {
+		keys = append(keys, k)
+	}
+	for k := range d.Removed {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		if v, ok := d.Added[k]; ok {
+			buf.WriteString("+" + joinKeyValue(k, v) + "\n")
+		}
+		if v, ok := d.Changed[k]; ok {
+			buf.WriteString("-" + joinKeyValue(k, v.Parent) + "\n")
+			buf.WriteString("+" + joinKeyValue(k, v.Child) + "\n")
+		}
+		if v, ok := d.Removed[k]; ok {
+			buf.WriteString("-" + joinKeyValue(k, v) + "\n")
+		}
+	}
+	return buf.String()
+}
+
+// EnvPreview returns exactly the environment that the child process would
+// receive if the command were started now, as a list of "key=value" strings in
+// the order passed to the child, and how it differs from the environment of the
+// current process. The list is sorted by key, except that the vars that tell
+// children spawned via Shell.FuncCmd about gosh's pipes come last. It includes
+// the vars that gosh sets per e.g. Cmd.IgnoreParentExit and Cmd.ExitAfter.
+// This helps debug commands that behave differently when run via gosh than when
+// run directly. Commands that run in process, e.g. per Shell.DryRun, receive no
+// environment of their own.
+func (c *Cmd) EnvPreview() ([]string, EnvDiff) {
+	c.sh.Ok()
+	env, diff, err := c.envPreview()
+	c.handleError(err)
+	return env, diff
+}
+
+////////////////////////////////////////
+// Internals
+
+func (c *Cmd) envPreview() ([]string, EnvDiff, error) {
+	_, vars, err := c.resolveArgsAndVars()
+	if err != nil {
+		return nil, EnvDiff{}, err
+	}
+	if err := c.setGoshVars(vars); err != nil {
+		return nil, EnvDiff{}, err
+	}
+	env := mapToSlice(vars)
+	if usesPipes(vars) {
+		env = append(env, c.pipeFDVars()...)
+	}
+	return env, diffEnv(sliceToMap(os.Environ()), sliceToMap(env)), nil
+}
+
+// usesPipes returns true if a child process with the given vars, i.e. one
+// spawned via Shell.FuncCmd or TestHelperCmd, is given the vars and calls
+// pipes.
+func usesPipes(vars map[string]string) bool {
+	_, isFunc := vars[envInvocation]
+	_, isTestHelper := vars[envTestHelper]
+	return isFunc || isTestHelper
+}
+
+// diffEnv returns the difference between the parent and child environments.
+func diffEnv(parent, child map[string]string) EnvDiff {
+	d := EnvDiff{Added: map[string]string{}, Changed: map[string]EnvChange{}, Removed: map[string]string{}}
+	for k, v := range child {
+		if pv, ok := parent[k]; !ok {
+			d.Added[k] = v
+		} else if pv != v {
+			d.Changed[k] = EnvChange{Parent: pv, Child: v}
+		}
+	}
+	for k, v := range parent {
+		if _, ok := child[k]; !ok {
+			d.Removed[k] = v
+		}
+	}
+	return d
+}
@@ -5,6 +5,7 @@
 package gosh
 
 import (
+	"fmt"
 	"sort"
 	"strings"
 )
@@ -48,7 +49,13 @@ func sliceToMap(s []string) map[string]string {
 
 // mapToSlice converts a map to a slice of "key=value" entries, sorted by key.
 func mapToSlice(m map[string]string) []string {
-	s := make([]string, 0, len(m))
+	return mapToSliceCap(m, 0)
+}
+
+// mapToSliceCap is like mapToSlice, but preallocates room for extra more
+// entries, so that appending them does not copy the slice.
+func mapToSliceCap(m map[string]string, extra int) []string {
+	s := make([]string, 0, len(m)+extra)
 	for k, v := range m {
 		s = append(s, joinKeyValue(k, v))
 	}
@@ -59,7 +66,13 @@ func mapToSlice(m map[string]string) []string {
 // mergeMaps merges the given maps into a new map, preferring values from later
 // maps over those from earlier maps.
 func mergeMaps(maps ...map[string]string) map[string]string {
-	res := make(map[string]string)
+	n := 0
+	for _, m := range maps {
+		if len(m) > n {
+			n = len(m)
+		}
+	}
+	res := make(map[string]string, n)
 	for _, m := range maps {
 		for k, v := range m {
 			res[k] = v
@@ -72,3 +85,53 @@ func mergeMaps(maps ...map[string]string) map[string]string {
 func copyMap(m map[string]string) map[string]string {
 	return mergeMaps(m)
 }
+
+// expandVars replaces each ${NAME} reference in s with the value of NAME in
+// vars, where NAME consists of letters, digits and underscores. "$${" is
+// replaced with a literal "${". All other text, including "$NAME" and "${"
+// references without a valid name, is left unchanged. If strict is true,
+// references to names that are not in vars are an error; otherwise they are
+// replaced with the empty string.
+func expandVars(s string, vars map[string]string, strict bool) (string, error) {
+	var res []byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "$${"):
+			res = append(res, "${"...)
+			i += 2
+			continue
+		case strings.HasPrefix(s[i:], "${"):
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 || !isVarName(s[i+2:i+end]) {
+				break
+			}
+			name := s[i+2 : i+end]
+			value, ok := vars[name]
+			if !ok && strict {
+				return "", fmt.Errorf("gosh: undefined variable %q in %q", name, s)
+			}
+			res = append(res, value...)
+			i += end
+			continue
+		}
+		res = append(res, s[i])
+	}
+	return string(res), nil
+}
+
+// isVarName returns true iff s is a non-empty string of letters, digits and
+// underscores that does not start with a digit.
+func isVarName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
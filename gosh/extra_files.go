@@ -0,0 +1,185 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// AddExtraFile appends f to ExtraFiles, associating it with the given name, so
+// that the child process may retrieve it via ExtraFileByName. Must be called
+// before Start. The name must be unique within this Cmd. Not supported on
+// Windows.
+func (c *Cmd) AddExtraFile(name string, f *os.File) {
+	c.sh.Ok()
+	c.handleError(c.addExtraFile(name, f))
+}
+
+// ExtraFile returns the i'th file in Cmd.ExtraFiles of the command that started
+// the current process, or nil if the current process was not started by gosh
+// or was not passed an i'th file. Repeated calls return the same *os.File.
+func ExtraFile(i int) *os.File {
+	names := extraFileNames()
+	if i < 0 || i >= len(names) {
+		return nil
+	}
+	return extraFile(i, names[i])
+}
+
+// ExtraFileByName returns the file that was passed to the current process via
+// Cmd.AddExtraFile with the given name, or nil if there is no such file.
+// Repeated calls return the same *os.File.
+func ExtraFileByName(name string) *os.File {
+	if name == "" {
+		return nil
+	}
+	for i, n := range extraFileNames() {
+		if n == name {
+			return extraFile(i, n)
+		}
+	}
+	return nil
+}
+
+// Listen opens a listener on the given network and address, e.g. "tcp" and
+// "127.0.0.1:0", and passes it to the child process as an extra file with the
+// given name, for retrieval via Listener. Returns the listener's address. Since
+// the socket is bound and listening before the child starts, clients may
+// connect as soon as Listen returns, without racing against the child, and
+// tests may use port 0 to pick a free port. The parent's copy of the listener
+// is closed once the child has started. Must be called before Start. Not
+// supported on Windows.
+func (c *Cmd) Listen(name, network, addr string) net.Addr {
+	c.sh.Ok()
+	res, err := c.listen(name, network, addr)
+	c.handleError(err)
+	return res
+}
+
+// Listener returns the listener that was passed to the current process via
+// Cmd.Listen with the given name.
+func Listener(name string) (net.Listener, error) {
+	f := ExtraFileByName(name)
+	if f == nil {
+		return nil, fmt.Errorf("gosh: no listener named %q", name)
+	}
+	return net.FileListener(f)
+}
+
+////////////////////////////////////////
+// Internals
+
+func (c *Cmd) addExtraFile(name string, f *os.File) error {
+	switch {
+	case c.calledStart:
+		return ErrAlreadyCalledStart
+	case name == "":
+		return fmt.Errorf("gosh: extra file name must not be empty")
+	case c.extraFileNames[name] != nil:
+		return fmt.Errorf("gosh: extra file %q already added", name)
+	}
+	if c.extraFileNames == nil {
+		c.extraFileNames = map[string]*os.File{}
+	}
+	c.extraFileNames[name] = f
+	c.ExtraFiles = append(c.ExtraFiles, f)
+	return nil
+}
+
+func (c *Cmd) listen(name, network, addr string) (net.Addr, error) {
+	if c.calledStart {
+		return nil, ErrAlreadyCalledStart
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the listener below must not remove the socket file.
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	fl, ok := l.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("gosh: cannot pass %s listener to a child process", network)
+	}
+	// The file is a duplicate of the listener's descriptor, so the listener may
+	// be closed right away.
+	f, err := fl.File()
+	l.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.addExtraFile(name, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.afterStartClosers = append(c.afterStartClosers, f)
+	return l.Addr(), nil
+}
+
+// extraFilesVar returns the value of envExtraFiles for this Cmd: the
+// JSON-encoded list of names of the files in ExtraFiles, with "" for files
+// that were not added via AddExtraFile.
+func (c *Cmd) extraFilesVar() (string, error) {
+	names := make([]string, len(c.ExtraFiles))
+	for name, f := range c.extraFileNames {
+		for i, g := range c.ExtraFiles {
+			if f == g {
+				names[i] = name
+				break
+			}
+		}
+	}
+	buf, err := json.Marshal(names)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+var (
+	extraFilesOnce  sync.Once
+	extraFilesNames []string
+	extraFilesMu    sync.Mutex // protects extraFiles
+	extraFiles      = map[int]*os.File{}
+)
+
+// extraFileNames returns the names of the extra files passed to the current
+// process, per envExtraFiles.
+func extraFileNames() []string {
+	extraFilesOnce.Do(func() {
+		if s := os.Getenv(envExtraFiles); s != "" {
+			if err := json.Unmarshal([]byte(s), &extraFilesNames); err != nil {
+				panic(err)
+			}
+		}
+	})
+	return extraFilesNames
+}
+
+// extraFile returns the *os.File for the i'th extra file, creating it on first
+// use. Files are cached, since an *os.File closes its descriptor once garbage
+// collected.
+func extraFile(i int, name string) *os.File {
+	extraFilesMu.Lock()
+	defer extraFilesMu.Unlock()
+	f, ok := extraFiles[i]
+	if !ok {
+		if name == "" {
+			name = fmt.Sprintf("extra-file-%d", i)
+		}
+		// File i in ExtraFiles becomes file descriptor 3+i in the child.
+		f = os.NewFile(uintptr(3+i), name)
+		extraFiles[i] = f
+	}
+	return f
+}
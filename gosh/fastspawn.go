@@ -0,0 +1,48 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"path/filepath"
+
+	"v.io/x/lib/lookpath"
+)
+
+////////////////////////////////////////
+// Internals
+
+// lookPathCacheKey identifies a path cached per Shell.FastSpawn.
+type lookPathCacheKey struct {
+	name, path string
+}
+
+// lookPathCached is like lookpath.Look, but caches successful results by name
+// and PATH. Relative names with multiple components are resolved against the
+// current working directory, which may change, so they are not cached. Since
+// commands may be started concurrently, e.g. by a Pool, the cache has its own
+// lock.
+func (sh *Shell) lookPathCached(vars map[string]string, name string) (string, error) {
+	if !filepath.IsAbs(name) && filepath.Base(name) != name {
+		return lookpath.Look(vars, name)
+	}
+	key := lookPathCacheKey{name, vars["PATH"]}
+	sh.lookPathMu.Lock()
+	lp, ok := sh.lookPathCache[key]
+	sh.lookPathMu.Unlock()
+	if ok {
+		return lp, nil
+	}
+	lp, err := lookpath.Look(vars, name)
+	if err != nil {
+		return "", err
+	}
+	sh.lookPathMu.Lock()
+	defer sh.lookPathMu.Unlock()
+	if sh.lookPathCache == nil {
+		sh.lookPathCache = make(map[lookPathCacheKey]string)
+	}
+	sh.lookPathCache[key] = lp
+	return lp, nil
+}
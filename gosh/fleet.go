@@ -0,0 +1,106 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"os"
+)
+
+// Fleet is a group of near-identical commands created by Cmd.CloneN, e.g.
+// servers that differ only in their ports, which may be started, waited for
+// and terminated together. Each method is applied to every command, even if it
+// fails for some of them; each command's Err is set to its result, and if any
+// command failed, a *GroupError is reported via Shell.HandleError.
+type Fleet struct {
+	sh   *Shell
+	cmds []*Cmd
+}
+
+// CloneN returns a Fleet of n clones of this Cmd, as returned by Clone. If f is
+// non-nil, it is called with the index and Cmd of each clone, in order, to
+// apply per-instance tweaks, e.g. to set a different port for each clone.
+func (c *Cmd) CloneN(n int, f func(i int, c *Cmd)) *Fleet {
+	c.sh.Ok()
+	res, err := c.cloneN(n, f)
+	c.handleError(err)
+	return res
+}
+
+// Cmds returns the commands in the fleet.
+func (f *Fleet) Cmds() []*Cmd {
+	return f.cmds
+}
+
+// Start starts all commands in the fleet.
+func (f *Fleet) Start() {
+	f.sh.Ok()
+	f.sh.handleError(f.each((*Cmd).start))
+}
+
+// Wait waits for all commands in the fleet to exit.
+func (f *Fleet) Wait() {
+	f.sh.Ok()
+	f.sh.handleError(f.each((*Cmd).waitDefault))
+}
+
+// Signal sends a signal to all commands in the fleet.
+func (f *Fleet) Signal(sig os.Signal) {
+	f.sh.Ok()
+	f.sh.handleError(f.each(func(c *Cmd) error { return c.signal(sig) }))
+}
+
+// Terminate sends a signal to all commands in the fleet, then waits for all of
+// them to exit. Like Cmd.Terminate, it succeeds as long as the commands exit,
+// regardless of their exit codes.
+func (f *Fleet) Terminate(sig os.Signal) {
+	f.sh.Ok()
+	f.sh.handleError(f.each(func(c *Cmd) error { return c.terminate(sig) }))
+}
+
+// Run starts all commands in the fleet, then waits for those that started, as
+// with Shell.RunGroup.
+func (f *Fleet) Run() {
+	f.sh.Ok()
+	_, err := f.sh.runGroup(f.cmds...)
+	f.sh.handleError(err)
+}
+
+////////////////////////////////////////
+// Internals
+
+func (c *Cmd) cloneN(n int, f func(int, *Cmd)) (*Fleet, error) {
+	if n < 0 {
+		return nil, errors.New("gosh: CloneN requires a non-negative count")
+	}
+	res := &Fleet{sh: c.sh}
+	for i := 0; i < n; i++ {
+		clone, err := c.clone()
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			f(i, clone)
+		}
+		res.cmds = append(res.cmds, clone)
+	}
+	return res, nil
+}
+
+// each calls fn for every command in the fleet, and returns a *GroupError if
+// any call failed.
+func (f *Fleet) each(fn func(c *Cmd) error) error {
+	errs := make([]error, len(f.cmds))
+	failed := false
+	for i, c := range f.cmds {
+		if errs[i] = c.setErr(fn(c)); errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return &GroupError{Cmds: f.cmds, Errs: errs}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+// Go returns a function that starts the given command, unless it has already
+// been started, waits for it to exit, and returns the error that Wait would
+// report, rather than handling it per Shell.HandleError. This way, commands
+// compose with structured-concurrency code, e.g. errgroup.Group:
+//
+//	g, ctx := errgroup.WithContext(ctx)
+//	g.Go(sh.Go(sh.CmdOpt("server", nil, gosh.WithContext(ctx))))
+//	g.Go(sh.Go(sh.CmdOpt("client", nil, gosh.WithContext(ctx))))
+//	err := g.Wait()
+//
+// Cmd.Context is honored: if it is done before the command is started, the
+// command is not started, and otherwise the process is cleaned up once it is
+// done; either way, the function returns the context's error. Errors that are
+// ok per Cmd.ExitErrorIsOk or Cmd.AllowedExitCodes are not returned. As with
+// Wait, Cmd.Err is set, and the wait times out per Shell.DefaultTimeout.
+func (sh *Shell) Go(c *Cmd) func() error {
+	sh.Ok()
+	return func() error {
+		return c.setErr(c.runForGo())
+	}
+}
+
+////////////////////////////////////////
+// Internals
+
+func (c *Cmd) runForGo() error {
+	if c.Context != nil {
+		if err := c.Context.Err(); err != nil {
+			return err
+		}
+	}
+	if !c.state().calledStart {
+		if err := c.start(); err != nil {
+			return err
+		}
+	}
+	return c.waitDefault()
+}
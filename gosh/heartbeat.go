@@ -0,0 +1,129 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// SendHeartbeat sends a heartbeat to the parent process, as InitChildMain does
+// periodically per Cmd.Heartbeat. Children can call it from their main loop,
+// so that the parent can tell that the loop is making progress, rather than
+// just that the process is alive; see Cmd.LastHeartbeat and Cmd.OnStall.
+func SendHeartbeat() {
+	data, err := json.Marshal(wireMessage{Heartbeat: true})
+	if err != nil {
+		panic(err)
+	}
+	sendFrame(msgPrefix, data, msgSuffix)
+}
+
+// LastHeartbeat returns the time at which the most recent heartbeat from the
+// child process was received, per Shell.Clock, or the zero time if none has
+// been received. See Cmd.Heartbeat and SendHeartbeat.
+func (c *Cmd) LastHeartbeat() time.Time {
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	return c.lastHeartbeat
+}
+
+// OnStall arranges for f to be called if the child process is running and no
+// heartbeat has been received from it for the given duration, per Shell.Clock,
+// so that a child that is alive but hung can be detected. The duration is
+// measured from the most recent heartbeat, or from the later of Start and the
+// call to OnStall. f is passed the time of the most recent heartbeat, or the
+// zero time if none has been received, and is called in a goroutine owned by
+// gosh. f is called again if the child stalls again after sending another
+// heartbeat. See Cmd.Heartbeat and SendHeartbeat.
+func (c *Cmd) OnStall(d time.Duration, f func(last time.Time)) {
+	c.sh.Ok()
+	c.handleError(c.onStall(d, f))
+}
+
+////////////////////////////////////////
+// Internals
+
+// sendHeartbeats sends a heartbeat to the parent process every d, per
+// Cmd.Heartbeat. Meant to be run in a goroutine.
+func sendHeartbeats(d time.Duration) {
+	for {
+		SendHeartbeat()
+		time.Sleep(d)
+	}
+}
+
+// stallWatcher is the state for a call to OnStall.
+type stallWatcher struct {
+	d     time.Duration
+	f     func(last time.Time)
+	timer Timer // nil until the command has started
+}
+
+func (c *Cmd) onStall(d time.Duration, f func(last time.Time)) error {
+	if d <= 0 {
+		return errors.New("gosh: OnStall duration must be positive")
+	}
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	if c.exited {
+		return nil
+	}
+	w := &stallWatcher{d: d, f: f}
+	c.stallWatchers = append(c.stallWatchers, w)
+	if c.stallArmed {
+		c.armStallWatcherLocked(w)
+	}
+	return nil
+}
+
+// startStallWatchers arms the watchers registered via OnStall before the
+// command was started.
+func (c *Cmd) startStallWatchers() {
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	if c.exited {
+		return
+	}
+	c.stallArmed = true
+	for _, w := range c.stallWatchers {
+		c.armStallWatcherLocked(w)
+	}
+}
+
+// armStallWatcherLocked starts w's timer. Requires that cond.L is held.
+func (c *Cmd) armStallWatcherLocked(w *stallWatcher) {
+	w.timer = c.sh.clock().AfterFunc(w.d, func() {
+		c.cond.L.Lock()
+		exited, last := c.exited, c.lastHeartbeat
+		c.cond.L.Unlock()
+		if !exited {
+			w.f(last)
+		}
+	})
+}
+
+// recvHeartbeatLocked records a heartbeat from the child process, and resets
+// the OnStall timers. Requires that cond.L is held.
+func (c *Cmd) recvHeartbeatLocked() {
+	c.lastHeartbeat = c.sh.clock().Now()
+	for _, w := range c.stallWatchers {
+		if w.timer != nil {
+			w.timer.Reset(w.d)
+		}
+	}
+}
+
+// stopStallWatchersLocked stops the OnStall timers once the command has
+// exited. Requires that cond.L is held.
+func (c *Cmd) stopStallWatchersLocked() {
+	for _, w := range c.stallWatchers {
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+	}
+	c.stallWatchers = nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////
+// Internals
+
+// inactivityWatchdog is a writer for a command's stdout and stderr that calls a
+// function if nothing is written for a given duration, per
+// Cmd.InactivityTimeout.
+type inactivityWatchdog struct {
+	d      time.Duration
+	clock  Clock
+	mu     sync.Mutex // protects the fields below
+	timer  Timer
+	closed bool
+}
+
+// start arms the watchdog, which calls f if nothing is written for the
+// watchdog's duration. Writes before start have no effect.
+func (w *inactivityWatchdog) start(f func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.timer = w.clock.AfterFunc(w.d, f)
+	}
+}
+
+func (w *inactivityWatchdog) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil && !w.closed {
+		w.timer.Reset(w.d)
+	}
+	return len(p), nil
+}
+
+func (w *inactivityWatchdog) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	return nil
+}
+
+// addInactivityWatchdog adds an inactivity watchdog for c's stdout and stderr,
+// per Cmd.InactivityTimeout. The watchdog is armed once the process has been
+// started.
+func (c *Cmd) addInactivityWatchdog() {
+	w := &inactivityWatchdog{d: c.InactivityTimeout, clock: c.sh.clock()}
+	c.stdoutWriters = append(c.stdoutWriters, w)
+	c.stderrWriters = append(c.stderrWriters, w)
+	c.afterWaitClosers = append(c.afterWaitClosers, w)
+	c.watchdog = w
+}
+
+// startInactivityWatchdog arms c's inactivity watchdog, if any.
+func (c *Cmd) startInactivityWatchdog() {
+	if c.watchdog == nil {
+		return
+	}
+	c.watchdog.start(func() {
+		err := fmt.Errorf("gosh: no output for %v (Cmd.InactivityTimeout)", c.InactivityTimeout)
+		if c.expire(err) {
+			c.sh.tb.Logf("%s (PID %d): %v; terminating\n", c.Path, c.Pid(), err)
+		}
+	})
+}
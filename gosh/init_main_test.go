@@ -0,0 +1,66 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+var failFunc = RegisterFunc("failFunc", func(fail bool) error {
+	if fail {
+		return errors.New("failed")
+	}
+	return nil
+})
+
+func TestInitMainNoExit(t *testing.T) {
+	// TestMain has already called InitMain.
+	defer func(v bool) { calledInitMain = v }(calledInitMain)
+
+	// Parent process.
+	calledInitMain = false
+	isChild, err := InitMainNoExit()
+	if isChild || err != nil {
+		t.Fatalf("got %v, %v, want false, nil", isChild, err)
+	}
+
+	// Child process.
+	for _, fail := range []bool{false, true} {
+		s, err := encodeInvocation(failFunc.handle, fail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv(envInvocation, s)
+		calledInitMain = false
+		isChild, err = InitMainNoExit()
+		if !isChild || (err != nil) != fail {
+			t.Fatalf("got %v, %v, want true, fail=%v", isChild, err, fail)
+		}
+		if v := os.Getenv(envInvocation); v != "" {
+			t.Fatalf("%s was not unset: %q", envInvocation, v)
+		}
+	}
+
+	// Unknown function.
+	s, err := encodeInvocation(failFunc.handle, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcsMu.Lock()
+	delete(funcs, failFunc.handle)
+	funcsMu.Unlock()
+	defer func() {
+		funcsMu.Lock()
+		funcs[failFunc.handle] = failFunc
+		funcsMu.Unlock()
+	}()
+	os.Setenv(envInvocation, s)
+	calledInitMain = false
+	if isChild, err = InitMainNoExit(); !isChild || err == nil {
+		t.Fatalf("got %v, %v, want true, non-nil", isChild, err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// InterceptFunc handles an intercepted command in-process. It is passed the
+// command's args (starting with its path), reads stdin and writes output as the
+// command would, and returns the command's exit code. It is run in a separate
+// goroutine.
+type InterceptFunc func(args []string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// CannedOutput returns an InterceptFunc that ignores stdin, writes the given
+// stdout and stderr, and returns the given exit code.
+func CannedOutput(stdout, stderr string, exitCode int) InterceptFunc {
+	return func(args []string, stdin io.Reader, outw, errw io.Writer) int {
+		io.WriteString(outw, stdout)
+		io.WriteString(errw, stderr)
+		return exitCode
+	}
+}
+
+// Intercept makes it so subsequently started commands that match name and args
+// are handled in-process by f, rather than by starting a process. This allows
+// tests of code built on gosh to run without the real executables installed.
+//
+// A command matches if its path equals name (if name contains a path
+// separator) or its path's base name equals name (otherwise), and its args,
+// excluding the path, start with the given args. If name cannot be found on
+// PATH, Cmd creates a command with path name, so that it may be intercepted.
+// If multiple interceptors match, the most recently registered one is used.
+//
+// An intercepted command behaves like a process that cannot receive signals or
+// send vars. A non-zero exit code is reported as an error for which
+// Cmd.ExitErrorIsOk applies, and is returned by Cmd.ExitCode.
+func (sh *Shell) Intercept(name string, args []string, f InterceptFunc) {
+	sh.Ok()
+	sh.handleError(sh.intercept(name, args, f))
+}
+
+////////////////////////////////////////
+// Internals
+
+type interceptor struct {
+	name string
+	args []string
+	f    InterceptFunc
+}
+
+func (i *interceptor) matches(c *Cmd) bool {
+	if strings.ContainsRune(i.name, filepath.Separator) || strings.ContainsRune(i.name, '/') {
+		if filepath.Clean(c.Path) != filepath.Clean(i.name) {
+			return false
+		}
+	} else if filepath.Base(c.Path) != i.name {
+		return false
+	}
+	// Use the args in c.c, which have been expanded.
+	if len(c.c.Args) == 0 || len(c.c.Args)-1 < len(i.args) {
+		return false
+	}
+	for j, arg := range i.args {
+		if c.c.Args[j+1] != arg {
+			return false
+		}
+	}
+	return true
+}
+
+func (sh *Shell) intercept(name string, args []string, f InterceptFunc) error {
+	sh.cleanupMu.Lock()
+	defer sh.cleanupMu.Unlock()
+	if sh.calledCleanup {
+		return ErrAlreadyCalledCleanup
+	}
+	sh.interceptors = append(sh.interceptors, &interceptor{name, append([]string(nil), args...), f})
+	return nil
+}
+
+// hasInterceptor returns true iff an interceptor has been registered for the
+// given name.
+func (sh *Shell) hasInterceptor(name string) bool {
+	sh.cleanupMu.Lock()
+	defer sh.cleanupMu.Unlock()
+	for _, i := range sh.interceptors {
+		if i.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// findInterceptor returns the InterceptFunc for c, or nil if there is none.
+// Requires that sh.cleanupMu is held, and that c.c.Args has been set.
+func (sh *Shell) findInterceptor(c *Cmd) InterceptFunc {
+	for j := len(sh.interceptors) - 1; j >= 0; j-- {
+		if i := sh.interceptors[j]; i.matches(c) {
+			return i.f
+		}
+	}
+	return nil
+}
+
+// interceptExitError is the error returned by Wait for an in-process command
+// that exits with a non-zero code.
+type interceptExitError struct {
+	code int
+}
+
+func (e interceptExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// startInProcess runs f, if non-nil, in a goroutine in place of a process, and
+// arranges for Wait to return its result. A nil f behaves like a command that
+// exits immediately with no output. Requires that sh.cleanupMu is held.
+func (c *Cmd) startInProcess(f InterceptFunc) error {
+	stdout, stderr, err := c.makeStdoutStderr()
+	if err != nil {
+		return err
+	}
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	stdin := c.c.Stdin
+	if stdin == nil {
+		stdin = strings.NewReader("")
+	}
+	c.stateMu.Lock()
+	c.inProcess = true
+	c.stateMu.Unlock()
+	c.startTime = time.Now()
+	c.sh.startedCmds = append(c.sh.startedCmds, c)
+	c.logStarted()
+	c.traceStarted()
+	// Files that would have been passed to the process must stay open until f
+	// returns.
+	c.afterWaitClosers = append(c.afterWaitClosers, c.afterStartClosers...)
+	c.afterStartClosers = nil
+	go func() {
+		var waitErr error
+		if f != nil {
+			if code := f(c.c.Args, stdin, stdout, stderr); code != 0 {
+				c.inProcessExitCode = code
+				waitErr = interceptExitError{code}
+			}
+		}
+		c.cond.L.Lock()
+		c.exited = true
+		c.exitTime = time.Now()
+		c.cond.Broadcast()
+		c.cond.L.Unlock()
+		close(c.exitedChan)
+		if err := closeClosers(c.afterWaitClosers); waitErr == nil {
+			waitErr = err
+		}
+		if c.stdinDoneChan != nil {
+			if err := <-c.stdinDoneChan; waitErr == nil {
+				waitErr = err
+			}
+		}
+		c.logExited(waitErr)
+		c.sendWaitErr(waitErr)
+	}()
+	return nil
+}
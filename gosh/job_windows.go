@@ -0,0 +1,135 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+
+package gosh
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Children are placed in a job object that is configured to kill all of its
+// processes once the last handle to it is closed. We never close our handle,
+// so it is closed by the OS when the current process exits, for whatever
+// reason. This provides the same guarantee as watchParent, but also for
+// children that do not call InitChildMain.
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+
+	jobOnce   sync.Once
+	jobHandle syscall.Handle
+	jobErr    error
+)
+
+const (
+	jobObjectExtendedLimitInformationClass = 9
+	jobObjectLimitKillOnJobClose           = 0x2000
+	processSetQuota                        = 0x0100
+	processTerminate                       = 0x0001
+)
+
+// Mirrors JOBOBJECT_BASIC_LIMIT_INFORMATION.
+type jobObjectBasicLimitInformation struct {
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+}
+
+// Mirrors IO_COUNTERS.
+type ioCounters struct {
+	ReadOperationCount  uint64
+	WriteOperationCount uint64
+	OtherOperationCount uint64
+	ReadTransferCount   uint64
+	WriteTransferCount  uint64
+	OtherTransferCount  uint64
+}
+
+// Mirrors JOBOBJECT_EXTENDED_LIMIT_INFORMATION.
+type jobObjectExtendedLimitInformation struct {
+	BasicLimitInformation jobObjectBasicLimitInformation
+	IoInfo                ioCounters
+	ProcessMemoryLimit    uintptr
+	JobMemoryLimit        uintptr
+	PeakProcessMemoryUsed uintptr
+	PeakJobMemoryUsed     uintptr
+}
+
+// createJob creates the kill-on-close job object.
+func createJob() (syscall.Handle, error) {
+	h, _, err := procCreateJobObjectW.Call(0, 0)
+	if h == 0 {
+		return 0, err
+	}
+	info := jobObjectExtendedLimitInformation{}
+	info.BasicLimitInformation.LimitFlags = jobObjectLimitKillOnJobClose
+	if ok, _, err := procSetInformationJobObject.Call(h, jobObjectExtendedLimitInformationClass, uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info)); ok == 0 {
+		syscall.CloseHandle(syscall.Handle(h))
+		return 0, err
+	}
+	return syscall.Handle(h), nil
+}
+
+// addToJob adds the process with the given pid to the kill-on-close job
+// object, creating the job object if needed.
+func addToJob(pid int) error {
+	jobOnce.Do(func() {
+		jobHandle, jobErr = createJob()
+	})
+	if jobErr != nil {
+		return jobErr
+	}
+	return assignToJob(jobHandle, pid)
+}
+
+// newCmdJob creates a job object for a single Cmd, per Cmd.SignalProcessGroup,
+// and adds the process with the given pid to it. Descendants of the process are
+// added to the job automatically. Since Windows 8, a process may be in several
+// nested jobs, so the process may also be added to the kill-on-close job.
+func newCmdJob(pid int) (syscall.Handle, error) {
+	h, _, err := procCreateJobObjectW.Call(0, 0)
+	if h == 0 {
+		return 0, err
+	}
+	if err := assignToJob(syscall.Handle(h), pid); err != nil {
+		syscall.CloseHandle(syscall.Handle(h))
+		return 0, err
+	}
+	return syscall.Handle(h), nil
+}
+
+// assignToJob adds the process with the given pid to the given job object.
+func assignToJob(job syscall.Handle, pid int) error {
+	p, err := syscall.OpenProcess(processSetQuota|processTerminate, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(p)
+	if ok, _, err := procAssignProcessToJobObject.Call(uintptr(job), uintptr(p)); ok == 0 {
+		return err
+	}
+	return nil
+}
+
+// terminateJob terminates all processes in the given job object.
+func terminateJob(job syscall.Handle) error {
+	if ok, _, err := procTerminateJobObject.Call(uintptr(job), 1); ok == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// DecodeJSONLines configures this Cmd to decode each line of stdout as a JSON
+// value, e.g. for tools run with --output=json, and send it on ch, which must
+// be a channel of a type that encoding/json can decode into, e.g. chan Event
+// or chan *Event. Blank lines are ignored. Must be called before Start.
+//
+// Sends on ch block, so callers must receive from ch until it is closed, which
+// happens once the process exits, or until ctx is done, after which remaining
+// values are discarded. A nil ctx is never done. If a line cannot be decoded,
+// the remaining lines are discarded, and Wait fails with the decoding error.
+func (c *Cmd) DecodeJSONLines(ctx context.Context, ch interface{}) {
+	c.sh.Ok()
+	c.handleError(c.decodeJSONLines(ctx, ch))
+}
+
+////////////////////////////////////////
+// Internals
+
+// jsonLinesDecoder decodes lines of JSON and sends the resulting values on a
+// channel. Its Close method closes the channel, and returns the first decoding
+// error, if any.
+type jsonLinesDecoder struct {
+	done <-chan struct{}
+	ch   reflect.Value
+	err  error
+}
+
+func (c *Cmd) decodeJSONLines(ctx context.Context, ch interface{}) error {
+	if c.calledStart {
+		return ErrAlreadyCalledStart
+	}
+	v := reflect.ValueOf(ch)
+	if v.Kind() != reflect.Chan || v.Type().ChanDir()&reflect.SendDir == 0 {
+		return fmt.Errorf("gosh: DecodeJSONLines requires a channel that can be sent on, got %T", ch)
+	}
+	d := &jsonLinesDecoder{ch: v}
+	if ctx != nil {
+		d.done = ctx.Done()
+	}
+	w := newLineWriter(d.handleLine)
+	c.stdoutWriters = append(c.stdoutWriters, w)
+	// Close w first, so that any final partial line is decoded.
+	c.afterWaitClosers = append(c.afterWaitClosers, w, d)
+	return nil
+}
+
+func (d *jsonLinesDecoder) handleLine(line string) {
+	if d.err != nil || strings.TrimSpace(line) == "" {
+		return
+	}
+	p := reflect.New(d.ch.Type().Elem())
+	if err := json.Unmarshal([]byte(line), p.Interface()); err != nil {
+		d.err = fmt.Errorf("gosh: failed to decode JSON line %q: %v", line, err)
+		return
+	}
+	reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: d.ch, Send: p.Elem()},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(d.done)},
+	})
+}
+
+func (d *jsonLinesDecoder) Close() error {
+	d.ch.Close()
+	return d.err
+}
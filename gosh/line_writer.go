@@ -0,0 +1,60 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// lineWriter is an io.WriteCloser that calls a handler for each line written to
+// it. Lines are passed to the handler without their trailing "\n" or "\r\n".
+// Close passes any remaining partial line to the handler.
+type lineWriter struct {
+	handler func(string)
+	buf     []byte
+}
+
+func newLineWriter(handler func(string)) *lineWriter {
+	return &lineWriter{handler: handler}
+}
+
+// newPrefixWriter returns a lineWriter that writes each line to w, preceded by
+// prefix, and with all matches of the given regular expressions redacted. A
+// trailing partial line is terminated with "\n" upon Close.
+func newPrefixWriter(w io.Writer, prefix string, res []*regexp.Regexp) *lineWriter {
+	return newLineWriter(func(line string) {
+		fmt.Fprintf(w, "%s%s\n", prefix, redact(res, line))
+	})
+}
+
+// Write writes to the lineWriter.
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.handler(string(bytes.TrimSuffix(w.buf[:i], []byte("\r"))))
+		w.buf = w.buf[i+1:]
+	}
+	// Reclaim the buffer, rather than letting it grow forever.
+	if len(w.buf) == 0 {
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+// Close passes any remaining partial line to the handler.
+func (w *lineWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.handler(string(bytes.TrimSuffix(w.buf, []byte("\r"))))
+		w.buf = nil
+	}
+	return nil
+}
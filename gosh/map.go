@@ -0,0 +1,84 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"sync"
+)
+
+// Map runs a command for each of the given inputs, one at a time, and returns
+// the result of each command, as returned by Cmd.Result, in the order of
+// inputs. The commands are created up front by calling makeCmd with each
+// input; each must be created from this Shell, and must not have been
+// started. As with Cmd.Result, exit errors are returned in Result.Err rather
+// than treated as failures; if any command fails for another reason, e.g.
+// failure to start, a *GroupError is reported via HandleError once all
+// commands have been run.
+func (sh *Shell) Map(inputs []string, makeCmd func(in string) *Cmd) []Result {
+	sh.Ok()
+	res, err := sh.mapInputs(1, inputs, makeCmd)
+	handleError(sh, err)
+	return res
+}
+
+// MapParallel is like Map, but runs up to n commands concurrently.
+func (sh *Shell) MapParallel(n int, inputs []string, makeCmd func(in string) *Cmd) []Result {
+	sh.Ok()
+	res, err := sh.mapInputs(n, inputs, makeCmd)
+	handleError(sh, err)
+	return res
+}
+
+////////////////////////////////////////
+// Internals
+
+func (sh *Shell) mapInputs(n int, inputs []string, makeCmd func(string) *Cmd) ([]Result, error) {
+	if n <= 0 {
+		return nil, errors.New("gosh: MapParallel requires a positive number of concurrent commands")
+	}
+	// Create all commands first, since Shell methods are not thread-safe.
+	cmds := make([]*Cmd, len(inputs))
+	for i, in := range inputs {
+		c := makeCmd(in)
+		if sh.Err != nil {
+			return nil, errAlreadyHandled{sh.Err}
+		}
+		if c == nil || c.sh != sh {
+			return nil, errors.New("gosh: map cmds must be created from the same shell")
+		}
+		cmds[i] = c
+	}
+	res := make([]Result, len(cmds))
+	errs := make([]error, len(cmds))
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, c := range cmds {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, c *Cmd) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			res[i], errs[i] = c.result()
+		}(i, c)
+	}
+	wg.Wait()
+	failed := false
+	for i, c := range cmds {
+		c.setErr(errs[i])
+		if isExitError(errs[i]) {
+			errs[i] = nil
+		} else if errs[i] != nil {
+			sh.tb.Logf("%s failed: %v\n", c.Path, errs[i])
+			failed = true
+		}
+	}
+	if failed {
+		return res, &GroupError{Cmds: cmds, Errs: errs}
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultMergedTimeFormat is the default MergedOutput.TimeFormat.
+const DefaultMergedTimeFormat = "15:04:05.000000"
+
+// MergedOutput merges the stdout and stderr of several commands into a single
+// stream, one line at a time. Each line is annotated with the time at which it
+// was completed and a label identifying its command and stream, as in
+// "15:04:05.000000 [server:stderr] listening". Lines from different commands
+// never interleave. For each command, lines appear in the order in which they
+// were written, across both stdout and stderr.
+type MergedOutput struct {
+	// TimeFormat is the time.Format layout used for line timestamps.
+	TimeFormat string
+	mu         sync.Mutex // protects w
+	w          io.Writer
+}
+
+// NewMergedOutput returns a new MergedOutput that writes to w.
+func NewMergedOutput(w io.Writer) *MergedOutput {
+	return &MergedOutput{TimeFormat: DefaultMergedTimeFormat, w: w}
+}
+
+// Add arranges for the stdout and stderr of c to be written to the merged
+// stream, labeled with the given label. Must be called before c is started.
+// A trailing partial line is written when c exits.
+func (m *MergedOutput) Add(c *Cmd, label string) {
+	c.sh.Ok()
+	c.handleError(m.add(c, label))
+}
+
+////////////////////////////////////////
+// Internals
+
+func (m *MergedOutput) add(c *Cmd, label string) error {
+	if err := c.addStdoutLineHandler(m.lineHandler(label + ":stdout")); err != nil {
+		return err
+	}
+	return c.addStderrLineHandler(m.lineHandler(label + ":stderr"))
+}
+
+func (m *MergedOutput) lineHandler(tag string) func(string) {
+	return func(line string) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		fmt.Fprintf(m.w, "%s [%s] %s\n", time.Now().Format(m.TimeFormat), tag, line)
+	}
+}
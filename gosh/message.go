@@ -0,0 +1,106 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	msgPrefix = []byte("<goshMsg")
+	msgSuffix = []byte("goshMsg>")
+)
+
+var (
+	msgTypesMu = sync.RWMutex{} // protects msgTypes
+	msgTypes   = map[string]reflect.Type{}
+)
+
+// Message is a typed message sent by a child process via SendMessage.
+type Message struct {
+	// Kind is the kind of the message, as passed to RegisterMessageType.
+	Kind string
+	// Payload holds a value of the type registered for Kind.
+	Payload interface{}
+}
+
+// wireMessage is the JSON encoding of a Message. Replies to calls made via
+// Cmd.Call are also sent as messages, with a non-zero ID and no kind, as are
+// panics in Shell.FuncCmd functions, with a non-nil Panic and no kind, and
+// heartbeats, with Heartbeat set and no kind.
+type wireMessage struct {
+	Kind    string          `json:"kind,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	ID      uint64          `json:"id,omitempty"`
+	Err     string          `json:"err,omitempty"`
+	Panic   *wirePanic      `json:"panic,omitempty"`
+	// Heartbeat is true for heartbeats sent per Cmd.Heartbeat.
+	Heartbeat bool `json:"heartbeat,omitempty"`
+}
+
+// RegisterMessageType registers the payload type for messages of the given
+// kind. 'payload' must be a JSON-encodable value of the desired type; only its
+// type is used. Both the parent and the child process must register each kind
+// of message they exchange, typically from a package-level var declaration.
+func RegisterMessageType(kind string, payload interface{}) {
+	msgTypesMu.Lock()
+	defer msgTypesMu.Unlock()
+	if _, ok := msgTypes[kind]; ok {
+		panic(fmt.Errorf("gosh: message kind %q is already registered", kind))
+	}
+	if payload == nil {
+		panic(fmt.Errorf("gosh: message kind %q has nil payload type", kind))
+	}
+	msgTypes[kind] = reflect.TypeOf(payload)
+}
+
+// getMessageType returns the payload type registered for the given kind.
+func getMessageType(kind string) (reflect.Type, error) {
+	msgTypesMu.RLock()
+	t, ok := msgTypes[kind]
+	msgTypesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("gosh: unknown message kind %q", kind)
+	}
+	return t, nil
+}
+
+// SendMessage sends a message of the given kind to the parent process. The
+// payload must be of the type registered for the kind. Writes a string of the
+// form "<goshMsg{ ... JSON-encoded message ... }goshMsg>\n" to the same stream
+// as SendVars.
+func SendMessage(kind string, payload interface{}) {
+	t, err := getMessageType(kind)
+	if err != nil {
+		panic(err)
+	}
+	if pt := reflect.TypeOf(payload); pt != t {
+		panic(fmt.Errorf("gosh: message kind %q has payload type %v, got %v", kind, t, pt))
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		panic(err)
+	}
+	if data, err = json.Marshal(wireMessage{Kind: kind, Payload: data}); err != nil {
+		panic(err)
+	}
+	sendFrame(msgPrefix, data, msgSuffix)
+}
+
+// decodeMessage decodes the payload of a message sent by SendMessage.
+func decodeMessage(wm wireMessage) (Message, error) {
+	t, err := getMessageType(wm.Kind)
+	if err != nil {
+		return Message{}, err
+	}
+	v := reflect.New(t)
+	if err := json.Unmarshal(wm.Payload, v.Interface()); err != nil {
+		return Message{}, fmt.Errorf("gosh: failed to decode %q message: %v", wm.Kind, err)
+	}
+	return Message{Kind: wm.Kind, Payload: v.Elem().Interface()}, nil
+}
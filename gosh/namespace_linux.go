@@ -0,0 +1,39 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package gosh
+
+import (
+	"os"
+	"syscall"
+)
+
+// setNamespaces configures attr to start the process in the given new
+// namespaces.
+func setNamespaces(attr *syscall.SysProcAttr, ns Namespaces) error {
+	if ns&NewUserNamespace != 0 {
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		// Map the calling user and group to root in the new namespace, unless
+		// the caller has specified their own mappings.
+		if len(attr.UidMappings) == 0 {
+			attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		}
+		if len(attr.GidMappings) == 0 {
+			attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+			attr.GidMappingsEnableSetgroups = false
+		}
+	}
+	if ns&NewPIDNamespace != 0 {
+		attr.Cloneflags |= syscall.CLONE_NEWPID
+	}
+	if ns&NewNetworkNamespace != 0 {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if ns&NewMountNamespace != 0 {
+		attr.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	return nil
+}
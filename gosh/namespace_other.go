@@ -0,0 +1,21 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package gosh
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errNamespacesNotSupported = errors.New("gosh: namespaces are only supported on linux")
+
+func setNamespaces(attr *syscall.SysProcAttr, ns Namespaces) error {
+	if ns != 0 {
+		return errNamespacesNotSupported
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// DefaultOutputName is the template used to name files in Cmd.OutputDir if
+// Cmd.OutputName is empty.
+const DefaultOutputName = "{{.Name}}.{{.Time}}.{{.Stream}}"
+
+// OutputNameData holds the values available to Cmd.OutputName templates.
+type OutputNameData struct {
+	// Name is the base name of the command's path.
+	Name string
+	// Index is the number of commands started by the Shell before this one.
+	Index int
+	// PID is the process ID of the command, or -1 if the command was not run as
+	// a process, e.g. if it was intercepted.
+	PID int
+	// Time is the time at which the command was started, formatted as
+	// "20060102.150405.000000".
+	Time string
+	// Stream is "stdout", "stderr" or "info".
+	Stream string
+}
+
+// OutputInfo describes a command whose output was written to Cmd.OutputDir.
+// It is written as JSON to the "info" file alongside the stdout and stderr
+// files once the command exits, so that archived output directories are
+// self-describing. Values are redacted per Shell.Redact.
+type OutputInfo struct {
+	// Path is the path of the executable.
+	Path string `json:"path"`
+	// Args holds the args of the command, including the path.
+	Args []string `json:"args"`
+	// Env holds the env vars of the command, as "key=value" entries.
+	Env []string `json:"env"`
+	// Dir is the working directory of the command.
+	Dir string `json:"dir"`
+	// PID is the process ID of the command, or -1 if it was not run as a
+	// process.
+	PID int `json:"pid"`
+	// StartTime and ExitTime are the times at which the command was started and
+	// exited.
+	StartTime time.Time `json:"start_time"`
+	ExitTime  time.Time `json:"exit_time"`
+	// ExitCode is the exit code of the command, or -1 if it was terminated by a
+	// signal.
+	ExitCode int `json:"exit_code"`
+	// Signal is the signal that terminated the command, if any.
+	Signal string `json:"signal,omitempty"`
+	// Err is the error returned by Wait, if any.
+	Err string `json:"err,omitempty"`
+}
+
+////////////////////////////////////////
+// Internals
+
+// outputFile is a writer that writes to a file in Cmd.OutputDir. The file is
+// created on the first write, or on Close if nothing was written, so that its
+// name may include the PID of the process. If maxBytes is positive, once the
+// file would exceed maxBytes, it is renamed to have an ".old" suffix, replacing
+// any previous such file, and a new file is started.
+type outputFile struct {
+	mu       sync.Mutex
+	dir      string
+	tmpl     *template.Template
+	data     OutputNameData
+	pid      func() int
+	maxBytes int64
+	path     string
+	file     *os.File
+	size     int64
+	closed   bool
+}
+
+// newOutputFiles returns outputFiles for the stdout, stderr and OutputInfo of
+// c, per c.OutputDir, c.OutputName and c.OutputMaxBytes.
+func (c *Cmd) newOutputFiles() (*outputFile, *outputFile, *outputFile, error) {
+	name := c.OutputName
+	if name == "" {
+		name = DefaultOutputName
+	}
+	tmpl, err := template.New("OutputName").Option("missingkey=error").Parse(name)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("gosh: invalid OutputName: %v", err)
+	}
+	data := OutputNameData{
+		Name:  filepath.Base(c.Path),
+		Index: len(c.sh.startedCmds),
+		PID:   -1,
+		Time:  time.Now().Format("20060102.150405.000000"),
+	}
+	// Report template errors now, rather than on the first write.
+	if err := tmpl.Execute(&bytes.Buffer{}, data); err != nil {
+		return nil, nil, nil, fmt.Errorf("gosh: invalid OutputName: %v", err)
+	}
+	pid := func() int {
+		// The process is started before any output is written.
+		if p := c.c.Process; p != nil {
+			return p.Pid
+		}
+		return -1
+	}
+	var res [3]*outputFile
+	for i, stream := range []string{"stdout", "stderr", "info"} {
+		res[i] = &outputFile{dir: c.OutputDir, tmpl: tmpl, data: data, pid: pid, maxBytes: c.OutputMaxBytes}
+		res[i].data.Stream = stream
+	}
+	// The info file is written all at once, and is never rotated.
+	res[2].maxBytes = 0
+	return res[0], res[1], res[2], nil
+}
+
+// writeOutputInfo writes an OutputInfo for c, which has exited with the given
+// error, to c.outputInfo, and closes it. Errors are logged, since the command
+// has already exited.
+func (c *Cmd) writeOutputInfo(err error) {
+	f := c.outputInfo
+	res := c.sh.redactions
+	info := OutputInfo{
+		Path:     redact(res, c.c.Path),
+		Dir:      c.outputInfoDir,
+		PID:      -1,
+		ExitCode: c.exitCodeAfterExit(),
+	}
+	for _, arg := range c.c.Args {
+		info.Args = append(info.Args, redact(res, arg))
+	}
+	for _, kv := range c.c.Env {
+		info.Env = append(info.Env, redact(res, kv))
+	}
+	if p := c.c.Process; p != nil && !c.inProcess {
+		info.PID = p.Pid
+	}
+	if ps := c.c.ProcessState; ps != nil && !c.inProcess {
+		if sig := exitSignal(ps); sig != nil {
+			info.Signal = sig.String()
+		}
+	}
+	t := c.Timing()
+	info.StartTime, info.ExitTime = t.Start, t.Exit
+	if err != nil {
+		info.Err = redact(res, err.Error())
+	}
+	buf, jsonErr := json.MarshalIndent(info, "", "  ")
+	if jsonErr == nil {
+		_, jsonErr = f.Write(append(buf, '\n'))
+	}
+	if closeErr := f.Close(); jsonErr == nil {
+		jsonErr = closeErr
+	}
+	if jsonErr != nil {
+		c.sh.tb.Logf("gosh: failed to write output info for %s: %v\n", c.Path, jsonErr)
+	}
+}
+
+// open creates the file. Requires that f.mu is held.
+func (f *outputFile) open() error {
+	if f.path == "" {
+		f.data.PID = f.pid()
+		buf := &bytes.Buffer{}
+		if err := f.tmpl.Execute(buf, f.data); err != nil {
+			return err
+		}
+		f.path = filepath.Join(f.dir, buf.String())
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	f.file, f.size = file, 0
+	return nil
+}
+
+// rotate closes the file and renames it. Requires that f.mu is held.
+func (f *outputFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	old := f.path + ".old"
+	// Renaming over an existing file fails on Windows.
+	os.Remove(old)
+	return os.Rename(f.path, old)
+}
+
+func (f *outputFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file != nil && f.maxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *outputFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,51 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+func TestOutputFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_file_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := &outputFile{
+		dir:      dir,
+		tmpl:     template.Must(template.New("").Parse("{{.Name}}.{{.PID}}.{{.Stream}}")),
+		data:     OutputNameData{Name: "foo", Stream: "stdout"},
+		pid:      func() int { return 42 },
+		maxBytes: 4,
+	}
+	for _, s := range []string{"ab", "cd", "e", "fghij", "k"} {
+		if n, err := f.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) returned (%d, %v)", s, n, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Errorf("Write after Close succeeded")
+	}
+	for name, want := range map[string]string{
+		"foo.42.stdout":     "k",
+		"foo.42.stdout.old": "fghij",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
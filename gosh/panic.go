@@ -0,0 +1,64 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is the error reported by Cmd.Wait, and by methods that call it,
+// if the function run by a Shell.FuncCmd command panicked.
+type PanicError struct {
+	// Value is the panic value, formatted with fmt's %v verb.
+	Value string
+	// Stack is the stack trace of the panicking goroutine.
+	Stack string
+	// Err is the underlying error, typically an *exec.ExitError.
+	Err error
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("gosh: function panicked: %s\n\n%s", e.Value, e.Stack)
+}
+
+// Unwrap returns the underlying error, so that errors.As can find the
+// *exec.ExitError.
+func (e *PanicError) Unwrap() error {
+	return e.Err
+}
+
+////////////////////////////////////////
+// Internals
+
+// wirePanic is the JSON encoding of a panic in a child process.
+type wirePanic struct {
+	Value string `json:"value"`
+	Stack string `json:"stack"`
+}
+
+// callFuncReportingPanic is like callFunc, but if the function panics, it sends
+// the panic value and stack trace to the parent process before resuming the
+// panic, so that the parent can report a PanicError.
+func callFuncReportingPanic(handle string, args ...interface{}) error {
+	defer func() {
+		if r := recover(); r != nil {
+			sendPanic(r, debug.Stack())
+			panic(r)
+		}
+	}()
+	return callFunc(handle, args...)
+}
+
+// sendPanic sends the given panic value and stack trace to the parent process.
+func sendPanic(r interface{}, stack []byte) {
+	data, err := json.Marshal(wireMessage{Panic: &wirePanic{Value: fmt.Sprint(r), Stack: string(stack)}})
+	if err != nil {
+		// Don't mask the original panic.
+		return
+	}
+	sendFrame(msgPrefix, data, msgSuffix)
+}
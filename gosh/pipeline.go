@@ -19,8 +19,9 @@ import (
 // read/write errors on closed pipes are ignored. This is different from bash,
 // where the default is to only check the status of the last command, unless
 // "set -o pipefail" is enabled to check the status of all commands, causing
-// closed pipe errors to fail the pipeline. Use Cmd.ExitErrorIsOk and
-// Cmd.IgnoreClosedPipeError to fine-tune the failure semantics.
+// closed pipe errors to fail the pipeline. Use Cmd.ExitErrorIsOk,
+// Cmd.AllowedExitCodes and Cmd.IgnoreClosedPipeError to fine-tune the failure
+// semantics.
 //
 // The implementation of Pipeline only uses exported methods from Shell and Cmd.
 type Pipeline struct {
@@ -59,6 +60,21 @@ func NewPipeline(c *Cmd, cmds ...*Cmd) *Pipeline {
 	return res
 }
 
+// Pipeline is like NewPipeline, but reports errors to sh rather than to the
+// Shell of the first command. Each command must have been created from sh. The
+// returned pipeline starts all commands together via Start or Run, and fails if
+// any command fails, similar to bash with "set -o pipefail".
+func (sh *Shell) Pipeline(c *Cmd, cmds ...*Cmd) *Pipeline {
+	sh.Ok()
+	if sh != c.Shell() {
+		handleError(sh, errors.New("gosh: pipeline cmds have different shells"))
+		return nil
+	}
+	res, err := newPipeline(sh, c, cmds...)
+	handleError(sh, err)
+	return res
+}
+
 // Cmds returns the commands in the pipeline.
 func (p *Pipeline) Cmds() []*Cmd {
 	return p.cmds
@@ -363,7 +379,7 @@ func (p *Pipeline) stdout() (string, error) {
 		return "", errAlreadyHandled{p.sh.Err}
 	}
 	err := p.run()
-	return stdout.String(), err
+	return redact(p.sh.redactions, stdout.String()), err
 }
 
 func (p *Pipeline) stdoutStderr() (string, string, error) {
@@ -376,7 +392,8 @@ func (p *Pipeline) stdoutStderr() (string, string, error) {
 		return "", "", errAlreadyHandled{p.sh.Err}
 	}
 	err := p.run()
-	return stdout.String(), stderr.String(), err
+	res := p.sh.redactions
+	return redact(res, stdout.String()), redact(res, stderr.String()), err
 }
 
 func (p *Pipeline) combinedOutput() (string, error) {
@@ -389,5 +406,5 @@ func (p *Pipeline) combinedOutput() (string, error) {
 		return "", errAlreadyHandled{p.sh.Err}
 	}
 	err := p.run()
-	return output.String(), err
+	return redact(p.sh.redactions, output.String()), err
 }
@@ -52,6 +52,12 @@ func TestPipeline(t *testing.T) {
 	p.PipeStdout(sh.FuncCmd(catFunc))
 	eq(t, p.Stdout(), "ZZ")
 	eq(t, p.Clone().Stdout(), "ZZ")
+
+	// Try the Shell.Pipeline convenience.
+	echo = sh.FuncCmd(echoFunc)
+	echo.Args = append(echo.Args, "foo")
+	p = sh.Pipeline(echo, sh.FuncCmd(replaceFunc, byte('o'), byte('Z')), sh.FuncCmd(catFunc))
+	eq(t, p.Stdout(), "fZZ\n")
 }
 
 func TestPipelineDifferentShells(t *testing.T) {
@@ -62,6 +68,8 @@ func TestPipelineDifferentShells(t *testing.T) {
 
 	setsErr(t, sh1, func() { gosh.NewPipeline(sh1.FuncCmd(echoFunc), sh2.FuncCmd(catFunc)) })
 	setsErr(t, sh2, func() { gosh.NewPipeline(sh2.FuncCmd(echoFunc), sh1.FuncCmd(catFunc)) })
+	setsErr(t, sh1, func() { sh1.Pipeline(sh2.FuncCmd(echoFunc), sh1.FuncCmd(catFunc)) })
+	setsErr(t, sh1, func() { sh1.Pipeline(sh1.FuncCmd(echoFunc), sh2.FuncCmd(catFunc)) })
 	p := gosh.NewPipeline(sh1.FuncCmd(echoFunc))
 	setsErr(t, sh1, func() { p.PipeStdout(sh2.FuncCmd(catFunc)) })
 	p = gosh.NewPipeline(sh1.FuncCmd(echoFunc))
@@ -0,0 +1,183 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"sync"
+)
+
+// Pool runs queued commands, at most a fixed number at a time, e.g. for test
+// suites that run hundreds of short commands and should not start them all at
+// once. Commands are started in the order in which they were added. Unlike the
+// Shell and its Cmds, Pool is thread-safe.
+type Pool struct {
+	sh      *Shell
+	results chan PoolResult
+	done    chan struct{}
+	mu      sync.Mutex // protects the fields below
+	cond    *sync.Cond // signaled when queue or closed changes
+	queue   []*Cmd
+	closed  bool
+}
+
+// PoolResult is the result of running a command in a Pool.
+type PoolResult struct {
+	// Cmd is the command that was run.
+	Cmd *Cmd
+	// Err is the error from starting or waiting for the command, if any. Like
+	// Cmd.Err, it is nil for exit errors if Cmd.ExitErrorIsOk is set.
+	Err error
+}
+
+// Pool returns a new Pool that runs at most n of the commands added to it
+// concurrently. The Pool is closed by Cleanup, and commands that have not been
+// started by then are dropped.
+func (sh *Shell) Pool(n int) *Pool {
+	sh.Ok()
+	res, err := sh.newPool(n)
+	sh.handleError(err)
+	return res
+}
+
+// Add queues the given commands, which must have been created from the Pool's
+// Shell and not yet started. Each command is started once fewer than n other
+// commands are running, then waited for as with Cmd.Wait, except that errors
+// are reported via Results rather than Shell.HandleError. Add fails if the Pool
+// has been closed.
+func (p *Pool) Add(cmds ...*Cmd) {
+	p.sh.Ok()
+	p.sh.handleError(p.add(cmds...))
+}
+
+// Results returns a channel that receives the result of each command as it
+// completes. The channel is closed once the Pool has been closed and all
+// queued commands have completed. Up to n results are buffered; once the buffer
+// is full, commands that complete wait for their results to be received before
+// the next commands are started, so callers must receive from the channel, or
+// call Wait, for the Pool to make progress. Results that have not been received
+// by the time of Cleanup are discarded.
+func (p *Pool) Results() <-chan PoolResult {
+	return p.results
+}
+
+// Close closes the Pool to new commands. Commands that have already been
+// added still run.
+func (p *Pool) Close() {
+	p.close(false)
+}
+
+// Wait closes the Pool, waits for all queued commands to complete, and returns
+// the results that were not received from Results, in order of completion. If
+// any of these commands failed, a *GroupError is reported via
+// Shell.HandleError.
+func (p *Pool) Wait() []PoolResult {
+	p.sh.Ok()
+	res, err := p.wait()
+	p.sh.handleError(err)
+	return res
+}
+
+////////////////////////////////////////
+// Internals
+
+func (sh *Shell) newPool(n int) (*Pool, error) {
+	if n <= 0 {
+		return nil, errors.New("gosh: Pool requires a positive number of concurrent commands")
+	}
+	p := &Pool{sh: sh, results: make(chan PoolResult, n), done: make(chan struct{})}
+	p.cond = sync.NewCond(&p.mu)
+	if err := sh.addCleanupHandler(func() { p.close(true) }); err != nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			p.runWorker()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(p.results)
+	}()
+	return p, nil
+}
+
+func (p *Pool) add(cmds ...*Cmd) error {
+	for _, c := range cmds {
+		if c.sh != p.sh {
+			return errors.New("gosh: pool cmds must be created from the same shell")
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("gosh: pool is closed")
+	}
+	p.queue = append(p.queue, cmds...)
+	p.cond.Broadcast()
+	return nil
+}
+
+// close closes the Pool to new commands. If drop is true, commands that have
+// not been started are dropped, and results that are not received are
+// discarded; this is done once, by Cleanup.
+func (p *Pool) close(drop bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if drop {
+		p.queue = nil
+		close(p.done)
+	}
+	p.cond.Broadcast()
+}
+
+// runWorker runs queued commands one at a time, until the Pool is closed and
+// the queue is empty.
+func (p *Pool) runWorker() {
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		c := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+		err := c.start()
+		if err == nil {
+			err = c.waitDefault()
+		}
+		select {
+		case p.results <- PoolResult{Cmd: c, Err: c.setErr(err)}:
+		case <-p.done:
+		}
+	}
+}
+
+func (p *Pool) wait() ([]PoolResult, error) {
+	p.close(false)
+	var res []PoolResult
+	var cmds []*Cmd
+	var errs []error
+	failed := false
+	for r := range p.results {
+		res = append(res, r)
+		cmds, errs = append(cmds, r.Cmd), append(errs, r.Err)
+		if r.Err != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return res, &GroupError{Cmds: cmds, Errs: errs}
+	}
+	return res, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Probe checks whether a command is ready, e.g. whether a server is serving
+// requests. It returns nil if the command is ready, and otherwise an error
+// describing why not. See Cmd.AwaitReady.
+type Probe func() error
+
+// DialProbe returns a Probe that succeeds once a connection to the given
+// network address, e.g. "tcp" and "127.0.0.1:8080", succeeds.
+func DialProbe(network, addr string) Probe {
+	return func() error {
+		conn, err := net.DialTimeout(network, addr, time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// FileProbe returns a Probe that succeeds once the given file exists.
+func FileProbe(path string) Probe {
+	return func() error {
+		_, err := os.Stat(path)
+		return err
+	}
+}
+
+// HTTPProbe returns a Probe that succeeds once a GET request for the given URL
+// returns a 2xx or 3xx status code, e.g. for a server's health check endpoint.
+func HTTPProbe(url string) Probe {
+	client := &http.Client{Timeout: time.Second}
+	return func() error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("gosh: GET %s returned %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// AwaitReady waits until the given probe succeeds, calling it every interval.
+// A non-positive interval means a default of 20ms. Fails if the process exits
+// first, or if the probe has not succeeded within the given timeout, in which
+// case the error includes the probe's most recent error. A non-positive timeout
+// means Shell.DefaultTimeout, if positive, and otherwise no timeout. Must not
+// be called before Start or after Wait.
+func (c *Cmd) AwaitReady(probe Probe, interval, timeout time.Duration) {
+	c.sh.Ok()
+	c.handleError(c.awaitReady(probe, interval, timeout))
+}
+
+////////////////////////////////////////
+// Internals
+
+// defaultProbeInterval is the interval at which awaitReady calls its probe, if
+// none is specified.
+const defaultProbeInterval = 20 * time.Millisecond
+
+func (c *Cmd) awaitListening(network, addr string, d time.Duration) error {
+	return c.awaitReady(DialProbe(network, addr), 0, d)
+}
+
+func (c *Cmd) awaitFileExists(path string, d time.Duration) error {
+	if !filepath.IsAbs(path) && c.Dir != "" {
+		path = filepath.Join(c.Dir, path)
+	}
+	return c.awaitReady(FileProbe(path), 0, d)
+}
+
+func (c *Cmd) awaitReady(probe Probe, interval, d time.Duration) error {
+	s := c.stateAfterStart()
+	switch {
+	case s.calledWait:
+		return ErrAlreadyCalledWait
+	case s.dryRun:
+		return nil
+	case !s.started && !s.inProcess:
+		return ErrDidNotCallStart
+	}
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	errTimedOut := ErrTimedOut
+	if d <= 0 {
+		d = c.sh.DefaultTimeout
+		errTimedOut = c.defaultTimeoutErr(ErrTimedOut)
+	}
+	clock := c.sh.clock()
+	timeout := make(chan struct{})
+	if d > 0 {
+		timer := clock.AfterFunc(d, func() { close(timeout) })
+		defer timer.Stop()
+	}
+	for {
+		err := probe()
+		if err == nil {
+			c.markReady()
+			return nil
+		}
+		tick := make(chan struct{})
+		timer := clock.AfterFunc(interval, func() { close(tick) })
+		select {
+		case <-c.exitedChan:
+			timer.Stop()
+			// The probe may have succeeded just before the process exited.
+			if probe() == nil {
+				c.markReady()
+				return nil
+			}
+			c.cond.L.Lock()
+			defer c.cond.L.Unlock()
+			if c.ctxErr != nil {
+				return c.ctxErr
+			}
+			return ErrProcessExited
+		case <-timeout:
+			timer.Stop()
+			return fmt.Errorf("%w waiting for readiness: %v", errTimedOut, err)
+		case <-tick:
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestRecvWriter(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   map[string]string
+	}{
+		{[]string{`<goshVars{"a":"1","b":"2"}goshVars>`}, map[string]string{"a": "1", "b": "2"}},
+		{[]string{`<goshVars{"a":"1"}goshVars><gosh`}, map[string]string{"a": "1"}},
+		{[]string{`<goshVars{"a":"1"}goshVars><goshVars{"b":"2"}goshVars>`}, map[string]string{"a": "1", "b": "2"}},
+		{[]string{`<g<goshVars{"a":"goshVars"}goshVars>s><goshVars`}, map[string]string{"a": "goshVars"}},
+		{[]string{`<<goshVars{"a":"1"}goshVars>><<goshVars{"b":"<goshVars"}goshVars>>`}, map[string]string{"a": "1", "b": "<goshVars"}},
+		// Messages may be split across writes.
+		{[]string{`<gosh`, `Vars{"a":`, `"1"}gosh`, `Vars>`}, map[string]string{"a": "1"}},
+		{[]string{`<goshVars{"a":"1"}`, `goshVars><goshVars{"a":"2"}goshVars>`}, map[string]string{"a": "2"}},
+		// Vars may be interleaved with messages.
+		{[]string{`<goshMsg{"kind":"k","payload":"goshVars>"}goshMsg><goshVars{"a":"1"}goshVars>`}, map[string]string{"a": "1"}},
+		{[]string{`<goshVars{"a":"<goshMsg"}goshVars><gosh`, `Msg{"kind":"k"}goshMsg>`}, map[string]string{"a": "<goshMsg"}},
+	}
+	for _, test := range tests {
+		c := &Cmd{cond: sync.NewCond(&sync.Mutex{}), recvVars: map[string]string{}}
+		w := newRecvWriter(c)
+		for _, s := range test.writes {
+			if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+				t.Errorf("%q: Write(%q) returned (%d, %v)", test.writes, s, n, err)
+			}
+		}
+		if got := c.recvVars; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.writes, got, test.want)
+		}
+	}
+}
+
+func TestRecvWriterMessages(t *testing.T) {
+	c := &Cmd{cond: sync.NewCond(&sync.Mutex{}), recvVars: map[string]string{}}
+	w := newRecvWriter(c)
+	s := `x<goshMsg{"kind":"a","payload":1}goshMsg>y<g<goshMsg{"kind":"b","payload":"goshMsg"}goshMsg><goshVars{}goshVars>`
+	if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+		t.Fatalf("Write(%q) returned (%d, %v)", s, n, err)
+	}
+	want := []wireMessage{{Kind: "a", Payload: []byte("1")}, {Kind: "b", Payload: []byte(`"goshMsg"`)}}
+	if got := c.recvMsgs; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
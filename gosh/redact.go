@@ -0,0 +1,60 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"regexp"
+)
+
+// RedactedText is the text that replaces redacted values; see Shell.Redact.
+const RedactedText = "[REDACTED]"
+
+// Redact arranges for each occurrence of the given values, e.g. tokens passed
+// to child processes via args or env vars, to be replaced with RedactedText
+// wherever gosh reports the output of subsequently started commands: in output
+// propagated per PropagateChildOutput or logged per LogChildOutput, in output
+// captured by methods such as Cmd.Stdout and Cmd.CombinedOutput, in files
+// written to ChildOutputDir, and in the args and output logged when a command
+// fails. Output passed to writers added via Cmd.AddStdoutWriter and the like,
+// or read via Cmd.StdoutPipe and the like, is not redacted. Redaction is done
+// a line at a time, so redacted output that is propagated, logged or written to
+// files appears once each line is complete. Empty values are ignored.
+func (sh *Shell) Redact(values ...string) {
+	sh.Ok()
+	for _, v := range values {
+		if v != "" {
+			sh.redactions = append(sh.redactions, regexp.MustCompile(regexp.QuoteMeta(v)))
+		}
+	}
+}
+
+// RedactPattern is like Redact, but redacts all matches of the given regular
+// expression, e.g. `ghp_[A-Za-z0-9]+`.
+func (sh *Shell) RedactPattern(re *regexp.Regexp) {
+	sh.Ok()
+	sh.redactions = append(sh.redactions, re)
+}
+
+////////////////////////////////////////
+// Internals
+
+// redact returns s with all matches of the given regular expressions replaced
+// with RedactedText.
+func redact(res []*regexp.Regexp, s string) string {
+	for _, re := range res {
+		s = re.ReplaceAllLiteralString(s, RedactedText)
+	}
+	return s
+}
+
+// redactedBuffer is a captureBuffer whose contents are redacted when read.
+type redactedBuffer struct {
+	captureBuffer
+	res []*regexp.Regexp
+}
+
+func (b redactedBuffer) String() string {
+	return redact(b.res, b.captureBuffer.String())
+}
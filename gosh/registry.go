@@ -8,37 +8,69 @@ package gosh
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/base64"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 )
 
 // Func is a registered, callable function.
 type Func struct {
 	handle string
+	name   string
+	file   string
+	line   int
 	value  reflect.Value
 }
 
+// FuncInfo describes a function registered via RegisterFunc.
+type FuncInfo struct {
+	// Name is the name the function was registered with.
+	Name string
+	// File and Line identify the call to RegisterFunc.
+	File string
+	Line int
+	// Type is the function's signature, e.g. "func(int, ...string) error".
+	Type string
+}
+
 var (
 	errorType = reflect.TypeOf((*error)(nil)).Elem()
-	funcsMu   = sync.RWMutex{} // protects funcs
+	bytesType = reflect.TypeOf([]byte(nil))
+	funcsMu   = sync.RWMutex{} // protects funcs and funcNames
 	funcs     = map[string]*Func{}
+	funcNames = map[string]*Func{}
+	codecsMu  = sync.RWMutex{} // protects codecs
+	codecs    = map[string]*argCodec{}
 )
 
+// argCodec holds the functions registered via RegisterArgCodec for some type.
+type argCodec struct {
+	encode, decode reflect.Value
+}
+
+func init() {
+	gob.Register(codedArg{})
+}
+
 // RegisterFunc registers the given function with the given name. 'fi' must be a
 // function that accepts gob-encodable arguments and returns an error or
-// nothing.
+// nothing. Names must be unique within a program; RegisterFunc panics if the
+// name is already registered.
 func RegisterFunc(name string, fi interface{}) *Func {
 	funcsMu.Lock()
 	defer funcsMu.Unlock()
 	_, file, line, _ := runtime.Caller(1)
 	handle := fmt.Sprintf("%s:%d:%s", file, line, name)
-	if _, ok := funcs[handle]; ok {
-		panic(fmt.Errorf("gosh: %q is already registered", handle))
+	if f, ok := funcNames[name]; ok {
+		panic(fmt.Errorf("gosh: %q is already registered at %s:%d", name, f.file, f.line))
 	}
 	v := reflect.ValueOf(fi)
 	t := v.Type()
@@ -58,17 +90,77 @@ func RegisterFunc(name string, fi interface{}) *Func {
 		}
 		gob.Register(reflect.Zero(t.In(i)).Interface())
 	}
-	f := &Func{handle: handle, value: v}
+	f := &Func{handle: handle, name: name, file: file, line: line, value: v}
 	funcs[handle] = f
+	funcNames[name] = f
 	return f
 }
 
+// Info returns information about this Func.
+func (f *Func) Info() FuncInfo {
+	return FuncInfo{Name: f.name, File: f.file, Line: f.line, Type: f.value.Type().String()}
+}
+
+// RegisteredFuncs returns information about all registered functions, sorted
+// by name.
+func RegisteredFuncs() []FuncInfo {
+	funcsMu.RLock()
+	defer funcsMu.RUnlock()
+	res := make([]FuncInfo, 0, len(funcNames))
+	for _, f := range funcNames {
+		res = append(res, f.Info())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// DumpRegistry writes a description of each registered function to w, one per
+// line, e.g. for debugging "unknown function" failures in child processes.
+// Write errors are ignored.
+func DumpRegistry(w io.Writer) {
+	for _, info := range RegisteredFuncs() {
+		fmt.Fprintf(w, "%s %s (%s:%d)\n", info.Name, info.Type, info.File, info.Line)
+	}
+}
+
+// RegisterArgCodec registers functions for encoding and decoding arguments of
+// some type T, for use with Shell.FuncCmd. Codecs are needed for types that gob
+// cannot encode faithfully, e.g. structs with unexported fields, which would
+// otherwise be dropped, or a time.Time whose location name must be preserved.
+// 'encode' must be a function with signature func(T) ([]byte, error), and
+// 'decode' must be a function with signature func([]byte) (T, error). As with
+// RegisterFunc, codecs must be registered in both the parent and the child
+// process, e.g. at init time. Arguments of type T, including those passed as
+// interface{} values, are encoded via the codec instead of gob.
+func RegisterArgCodec(encode, decode interface{}) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	ev, dv := reflect.ValueOf(encode), reflect.ValueOf(decode)
+	et, dt := ev.Type(), dv.Type()
+	if et.Kind() != reflect.Func || et.NumIn() != 1 || et.NumOut() != 2 || et.Out(0) != bytesType || et.Out(1) != errorType {
+		panic(fmt.Errorf("gosh: encode must have signature func(T) ([]byte, error): %v", et))
+	}
+	t := et.In(0)
+	if dt.Kind() != reflect.Func || dt.NumIn() != 1 || dt.In(0) != bytesType || dt.NumOut() != 2 || dt.Out(0) != t || dt.Out(1) != errorType {
+		panic(fmt.Errorf("gosh: decode must have signature func([]byte) (%v, error): %v", t, dt))
+	}
+	key := typeKey(t)
+	if _, ok := codecs[key]; ok {
+		panic(fmt.Errorf("gosh: codec for %v is already registered", t))
+	}
+	codecs[key] = &argCodec{encode: ev, decode: dv}
+}
+
 // getFunc returns the referenced function.
 func getFunc(handle string) (*Func, error) {
 	funcsMu.RLock()
 	f, ok := funcs[handle]
+	g := funcNames[handle[strings.LastIndex(handle, ":")+1:]]
 	funcsMu.RUnlock()
 	if !ok {
+		if g != nil {
+			return nil, fmt.Errorf("gosh: unknown function %q; a function with the same name is registered at %s:%d, so the parent and child may have been built from different sources", handle, g.file, g.line)
+		}
 		return nil, fmt.Errorf("gosh: unknown function %q", handle)
 	}
 	return f, nil
@@ -155,6 +247,10 @@ func encodeInvocation(handle string, args ...interface{}) (string, error) {
 	if err := checkCall(handle, args...); err != nil {
 		return "", err
 	}
+	args, err := encodeArgs(args)
+	if err != nil {
+		return "", err
+	}
 	inv := invocation{Handle: handle, Args: args}
 	buf := &bytes.Buffer{}
 	if err := gob.NewEncoder(buf).Encode(inv); err != nil {
@@ -175,5 +271,109 @@ func decodeInvocation(s string) (handle string, args []interface{}, err error) {
 	if err != nil {
 		return "", nil, fmt.Errorf("gosh: failed to decode invocation: %v", err)
 	}
-	return inv.Handle, inv.Args, nil
+	args, err = decodeArgs(inv.Args)
+	if err != nil {
+		return "", nil, err
+	}
+	return inv.Handle, args, nil
+}
+
+////////////////////////////////////////
+// codecs
+
+// codedArg is the gob-encodable form of an argument encoded via a codec
+// registered with RegisterArgCodec.
+type codedArg struct {
+	Type string
+	Data []byte
+}
+
+var (
+	gobEncoderType      = reflect.TypeOf((*gob.GobEncoder)(nil)).Elem()
+	binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+)
+
+// typeKey returns the key for the given type in the codecs map.
+func typeKey(t reflect.Type) string {
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+// getCodec returns the codec registered for the type with the given key, or
+// nil if there is none.
+func getCodec(key string) *argCodec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[key]
+}
+
+// encodeArgs replaces args that have registered codecs with their encodings,
+// and fails for args that gob would not encode faithfully.
+func encodeArgs(args []interface{}) ([]interface{}, error) {
+	res := make([]interface{}, len(args))
+	for i, arg := range args {
+		res[i] = arg
+		if arg == nil {
+			continue
+		}
+		t := reflect.TypeOf(arg)
+		key := typeKey(t)
+		codec := getCodec(key)
+		if codec == nil {
+			if hasUnexportedFields(t) {
+				return nil, fmt.Errorf("gosh: cannot encode argument of type %v, which has unexported fields; see RegisterArgCodec", t)
+			}
+			continue
+		}
+		out := codec.encode.Call([]reflect.Value{reflect.ValueOf(arg)})
+		if err, _ := out[1].Interface().(error); err != nil {
+			return nil, fmt.Errorf("gosh: failed to encode argument of type %v: %v", t, err)
+		}
+		res[i] = codedArg{Type: key, Data: out[0].Bytes()}
+	}
+	return res, nil
+}
+
+// decodeArgs reverses encodeArgs.
+func decodeArgs(args []interface{}) ([]interface{}, error) {
+	for i, arg := range args {
+		ca, ok := arg.(codedArg)
+		if !ok {
+			continue
+		}
+		codec := getCodec(ca.Type)
+		if codec == nil {
+			return nil, fmt.Errorf("gosh: no codec registered for %s", ca.Type)
+		}
+		out := codec.decode.Call([]reflect.Value{reflect.ValueOf(ca.Data)})
+		if err, _ := out[1].Interface().(error); err != nil {
+			return nil, fmt.Errorf("gosh: failed to decode argument of type %s: %v", ca.Type, err)
+		}
+		args[i] = out[0].Interface()
+	}
+	return args, nil
+}
+
+// hasUnexportedFields returns true if t is a struct, or a pointer to a struct,
+// with unexported fields that gob would silently drop, i.e. one that does not
+// implement its own encoding.
+func hasUnexportedFields(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	pt := reflect.PtrTo(t)
+	if pt.Implements(gobEncoderType) || pt.Implements(binaryMarshalerType) {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			return true
+		}
+	}
+	return false
 }
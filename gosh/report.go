@@ -0,0 +1,120 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CmdTiming records when a command reached each stage of its life. Stages that
+// have not been reached have zero times.
+type CmdTiming struct {
+	// Start is the time at which the command was started.
+	Start time.Time
+	// Ready is the time at which a call to AwaitVars, AwaitReady,
+	// AwaitListening or AwaitFileExists first succeeded.
+	Ready time.Time
+	// Exit is the time at which the process exited.
+	Exit time.Time
+}
+
+// Timing returns timing information for this command.
+func (c *Cmd) Timing() CmdTiming {
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	return CmdTiming{Start: c.startTime, Ready: c.readyTime, Exit: c.exitTime}
+}
+
+// Report writes a table summarizing the commands started by this Shell, in
+// start order, to w. For each command, it lists when the command was started
+// relative to the first command, how long it took to become ready and to exit,
+// and its exit code. This makes it easy to spot slow steps in large test
+// suites. Report may be called before or after Cleanup. Write errors are
+// ignored.
+func (sh *Shell) Report(w io.Writer) {
+	sh.cleanupMu.Lock()
+	cmds := append([]*Cmd(nil), sh.startedCmds...)
+	sh.cleanupMu.Unlock()
+	buf := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PID\tCOMMAND\tSTART\tREADY\tEXIT\tSTATUS")
+	var first time.Time
+	for _, c := range cmds {
+		t := c.Timing()
+		if first.IsZero() {
+			first = t.Start
+		}
+		ready, exit, status := "-", "-", "running"
+		if !t.Ready.IsZero() {
+			ready = t.Ready.Sub(t.Start).String()
+		}
+		if !t.Exit.IsZero() {
+			exit = t.Exit.Sub(t.Start).String()
+			status = fmt.Sprintf("exit %d", c.exitCodeAfterExit())
+		}
+		fmt.Fprintf(tw, "%d\t%s\t+%v\t%s\t%s\t%s\n", c.Pid(), reportName(c), t.Start.Sub(first), ready, exit, status)
+	}
+	tw.Flush()
+	w.Write(buf.Bytes())
+}
+
+////////////////////////////////////////
+// Internals
+
+// maxReportNameLen is the maximum length of a command's name in Report.
+const maxReportNameLen = 50
+
+// reportName returns a short name for c, for use in Report: the name of the
+// function for Shell.FuncCmd and Shell.TestHelperCmd commands, and the base
+// name of the path and the args otherwise.
+func reportName(c *Cmd) string {
+	var name string
+	if s, ok := c.Vars[envInvocation]; ok {
+		if handle, _, err := decodeInvocation(s); err == nil {
+			// Handles are of the form "file:line:name".
+			name = handle[strings.LastIndex(handle, ":")+1:] + "()"
+		}
+	}
+	if s, ok := c.Vars[envTestHelper]; ok {
+		name = s
+	}
+	if name == "" {
+		name = strings.Join(append([]string{filepath.Base(c.Path)}, c.Args[1:]...), " ")
+	}
+	if len(name) > maxReportNameLen {
+		name = name[:maxReportNameLen-3] + "..."
+	}
+	return name
+}
+
+// markReady records the time at which the command first became ready.
+func (c *Cmd) markReady() {
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	c.markReadyLocked()
+}
+
+// markReadyLocked is like markReady, but requires that cond.L is held.
+func (c *Cmd) markReadyLocked() {
+	if c.readyTime.IsZero() {
+		c.readyTime = time.Now()
+		c.traceReady()
+	}
+}
+
+// exitCodeAfterExit returns the exit code of the process, which must have
+// exited, without requiring that Wait has been called.
+func (c *Cmd) exitCodeAfterExit() int {
+	if c.inProcess {
+		return c.inProcessExitCode
+	}
+	return c.c.ProcessState.ExitCode()
+}
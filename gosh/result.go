@@ -0,0 +1,61 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"time"
+)
+
+// Result is the result of running a command, as returned by Cmd.Result.
+type Result struct {
+	// Stdout and Stderr are the command's captured stdout and stderr.
+	Stdout, Stderr string
+	// ExitCode is the exit code of the process, as returned by Cmd.ExitCode.
+	ExitCode int
+	// Duration is the time from when the command was started until it exited.
+	Duration time.Duration
+	// Err is the error returned by Wait, or nil if the command succeeded.
+	Err error
+}
+
+// Result calls Start followed by Wait, then returns the command's captured
+// output, exit code, duration and error. Unlike Run, Stdout and the like,
+// Result does not treat a non-zero exit code (or other exit error, per
+// ExitErrorIsOk) as a failure; such errors are returned in Result.Err, and set
+// in Cmd.Err, so that callers can inspect them. Other errors, e.g. failure to
+// start the command, are handled as usual.
+func (c *Cmd) Result() Result {
+	c.sh.Ok()
+	res, err := c.result()
+	if isExitError(err) {
+		c.Err = err
+	} else {
+		c.handleError(err)
+	}
+	return res
+}
+
+////////////////////////////////////////
+// Internals
+
+func (c *Cmd) result() (Result, error) {
+	if c.calledStart {
+		return Result{}, ErrAlreadyCalledStart
+	}
+	stdout, stderr := c.newCaptureBuffer(), c.newCaptureBuffer()
+	c.stdoutWriters = append(c.stdoutWriters, stdout)
+	c.stderrWriters = append(c.stderrWriters, stderr)
+	err := c.run()
+	res := Result{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: c.ExitCode(),
+		Err:      err,
+	}
+	if t := c.Timing(); !t.Start.IsZero() && !t.Exit.IsZero() {
+		res.Duration = t.Exit.Sub(t.Start)
+	}
+	return res, err
+}
@@ -5,22 +5,32 @@
 package gosh
 
 type ringBuffer struct {
-	buf   []byte
-	start int
-	len   int
+	buf      []byte
+	capacity int
+	start    int
+	len      int
 }
 
 // newRingBuffer returns a new fixed-size buffer that holds the last 'capacity'
-// bytes written.
+// bytes written. Memory is allocated as data is written, up to capacity.
 func newRingBuffer(capacity int) *ringBuffer {
-	return &ringBuffer{buf: make([]byte, capacity)}
+	return &ringBuffer{capacity: capacity}
 }
 
 // Append writes to the buffer.
 func (b *ringBuffer) Append(p []byte) {
-	if len(b.buf) == 0 {
+	if b.capacity == 0 {
 		return
 	}
+	if len(b.buf) < b.capacity {
+		// The buffer hasn't wrapped yet, so b.start == 0 and b.len == len(b.buf).
+		if len(b.buf)+len(p) <= b.capacity {
+			b.buf = append(b.buf, p...)
+			b.len = len(b.buf)
+			return
+		}
+		b.buf = append(b.buf, make([]byte, b.capacity-len(b.buf))...)
+	}
 	if len(p) >= len(b.buf) {
 		copy(b.buf, p[len(p)-len(b.buf):])
 		b.start = 0
@@ -125,3 +125,33 @@ func TestRingBufferStress(t *testing.T) {
 		}
 	}
 }
+
+func TestRingBufferGrowsLazily(t *testing.T) {
+	b := newRingBuffer(1 << 30)
+	b.Append([]byte("foo"))
+	b.Append([]byte("bar"))
+	if got, want := b.String(), "foobar"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := cap(b.buf); got > 1<<10 {
+		t.Errorf("got cap %v, want at most %v", got, 1<<10)
+	}
+}
+
+func TestHeadTailGrowsLazily(t *testing.T) {
+	b := newHeadTail(1 << 30)
+	b.Write([]byte("foo"))
+	if got, want := b.String(), "foo"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := cap(b.head); got > 1<<10 {
+		t.Errorf("got cap %v, want at most %v", got, 1<<10)
+	}
+	b = newHeadTail(3)
+	for _, s := range []string{"fo", "obarbaz", "q"} {
+		b.Write([]byte(s))
+	}
+	if got, want := b.String(), "foo\n[ ... skipping 4 bytes ... ]\nazq"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
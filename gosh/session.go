@@ -0,0 +1,154 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Session is an expect-style wrapper around the stdin and stdout of a Cmd, for
+// scripting interactive programs such as installers and REPLs:
+//
+//	s := gosh.NewSession(sh.Cmd("python3", "-i"))
+//	s.Cmd().Start()
+//	s.Send("1 + 2\n")
+//	s.Expect(regexp.MustCompile(`\d+`), time.Minute)
+//
+// Errors are reported via the Cmd, as with Cmd methods.
+type Session struct {
+	c     *Cmd
+	stdin io.WriteCloser
+	out   *expectBuffer
+}
+
+// NewSession returns a new Session for c, which must not have been started.
+// It takes over c's stdin via Cmd.StdinPipe, and adds a writer for c's stdout.
+// Output that is not consumed by Expect is retained until c exits.
+func NewSession(c *Cmd) *Session {
+	c.sh.Ok()
+	res, err := newSession(c)
+	c.handleError(err)
+	return res
+}
+
+// Cmd returns the Cmd for this Session.
+func (s *Session) Cmd() *Cmd {
+	return s.c
+}
+
+// Send writes the given text to the command's stdin. Include a trailing "\n"
+// to send a line.
+func (s *Session) Send(text string) {
+	s.c.sh.Ok()
+	_, err := io.WriteString(s.stdin, text)
+	s.c.handleError(err)
+}
+
+// Expect waits until the command's stdout, starting from the end of the
+// previous match, matches re, and returns the match and its submatches, as
+// with regexp.FindStringSubmatch. Output up to the end of the match is
+// consumed. Fails if the stdout is closed, e.g. because the command exited,
+// or if there is no match within the given duration. A non-positive duration
+// means no timeout.
+func (s *Session) Expect(re *regexp.Regexp, d time.Duration) []string {
+	s.c.sh.Ok()
+	res, err := s.out.expect(re, d)
+	s.c.handleError(err)
+	return res
+}
+
+// Close closes the command's stdin.
+func (s *Session) Close() {
+	s.c.sh.Ok()
+	s.c.handleError(s.stdin.Close())
+}
+
+////////////////////////////////////////
+// Internals
+
+func newSession(c *Cmd) (*Session, error) {
+	s := &Session{c: c, out: newExpectBuffer(c.sh.clock())}
+	var err error
+	if s.stdin, err = c.stdinPipe(); err != nil {
+		return nil, err
+	}
+	if err := c.addStdoutWriter(s.out); err != nil {
+		return nil, err
+	}
+	c.afterWaitClosers = append(c.afterWaitClosers, s.out)
+	return s, nil
+}
+
+// expectBuffer holds output not yet consumed by Session.Expect. Its Close
+// method marks the end of output.
+type expectBuffer struct {
+	clock Clock // used for expect timeouts
+
+	mu   sync.Mutex
+	cond *sync.Cond // signaled when output is received, or on Close
+	buf  []byte
+	eof  bool
+}
+
+func newExpectBuffer(clock Clock) *expectBuffer {
+	b := &expectBuffer{clock: clock}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *expectBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+func (b *expectBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.eof = true
+	b.cond.Broadcast()
+	return nil
+}
+
+func (b *expectBuffer) expect(re *regexp.Regexp, d time.Duration) ([]string, error) {
+	timedOut := false
+	if d > 0 {
+		// Wake up the loop below once the timeout expires.
+		timer := b.clock.AfterFunc(d, func() {
+			b.mu.Lock()
+			timedOut = true
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		if loc := re.FindSubmatchIndex(b.buf); loc != nil {
+			res := make([]string, len(loc)/2)
+			for i := range res {
+				if loc[2*i] >= 0 {
+					res[i] = string(b.buf[loc[2*i]:loc[2*i+1]])
+				}
+			}
+			b.buf = b.buf[loc[1]:]
+			return res, nil
+		}
+		switch {
+		case b.eof:
+			return nil, fmt.Errorf("gosh: stdout closed before matching %q; unmatched output: %q", re, b.buf)
+		case timedOut:
+			return nil, fmt.Errorf("%w waiting for stdout to match %q; unmatched output: %q", ErrTimedOut, re, b.buf)
+		}
+		b.cond.Wait()
+	}
+}
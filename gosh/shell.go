@@ -13,6 +13,7 @@
 package gosh
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -24,8 +25,10 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -33,14 +36,28 @@ import (
 
 const (
 	envExitAfter   = "GOSH_EXIT_AFTER"
+	envExtraFiles  = "GOSH_EXTRA_FILES"
+	envHeartbeat   = "GOSH_HEARTBEAT"
+	envCallsFD     = "GOSH_CALLS_FD"
 	envInvocation  = "GOSH_INVOCATION"
+	envRlimits     = "GOSH_RLIMITS"
+	envSubreaper   = "GOSH_SUBREAPER"
+	envTestHelper  = "GOSH_TEST_HELPER"
+	envVarsFD      = "GOSH_VARS_FD"
 	envWatchParent = "GOSH_WATCH_PARENT"
 )
 
+// Errors reported by Shell methods; see also the errors reported by Cmd
+// methods, e.g. ErrAlreadyCalledStart.
 var (
-	errAlreadyCalledCleanup = errors.New("gosh: already called Shell.Cleanup")
-	errDidNotCallInitMain   = errors.New("gosh: did not call gosh.InitMain")
-	errDidNotCallNewShell   = errors.New("gosh: did not call gosh.NewShell")
+	// ErrAlreadyCalledCleanup is reported if a method that creates or starts
+	// commands, or otherwise allocates resources, is called after Cleanup.
+	ErrAlreadyCalledCleanup = errors.New("gosh: already called Shell.Cleanup")
+	// ErrDidNotCallInitMain is reported by FuncCmd if InitMain was not called.
+	ErrDidNotCallInitMain = errors.New("gosh: did not call gosh.InitMain")
+	// ErrDidNotCallNewShell is the panic value if a Shell that was not created
+	// by NewShell is used.
+	ErrDidNotCallNewShell = errors.New("gosh: did not call gosh.NewShell")
 )
 
 // TB is a subset of the testing.TB interface, defined here to avoid depending
@@ -50,7 +67,8 @@ type TB interface {
 	Logf(format string, args ...interface{})
 }
 
-// Shell represents a shell. Not thread-safe.
+// Shell represents a shell. Not thread-safe, except that the Cmds it creates
+// may be used concurrently as described in the Cmd documentation.
 type Shell struct {
 	// Err is the most recent error from this Shell or any of its child Cmds (may
 	// be nil).
@@ -58,30 +76,161 @@ type Shell struct {
 	// PropagateChildOutput specifies whether to propagate child stdout and stderr
 	// up to the parent's stdout and stderr.
 	PropagateChildOutput bool
+	// LogChildOutput, if true, makes it so child stdout and stderr are logged
+	// via TB.Logf a line at a time, with each line prefixed by Cmd.OutputPrefix,
+	// or by the command's name if OutputPrefix is empty. In addition, if an error
+	// occurs for a started command, e.g. a timeout in AwaitVars, the command's
+	// args and the head and tail of its output are logged along with the error,
+	// as they are for exit errors.
+	LogChildOutput bool
 	// ChildOutputDir, if non-empty, makes it so child stdout and stderr are tee'd
-	// to files in the specified directory.
+	// to files in the specified directory. An "info" file holding a
+	// JSON-encoded OutputInfo that describes the command is written alongside
+	// them once the command exits.
 	ChildOutputDir string
+	// ChildOutputName is a text/template for the names of the files in
+	// ChildOutputDir, executed with an OutputNameData for each stream. If empty,
+	// DefaultOutputName is used. Since the name may include the PID, files are
+	// created once the process has started.
+	ChildOutputName string
+	// ChildOutputMaxBytes, if positive, limits the size of the files in
+	// ChildOutputDir: once a file would exceed the limit, it is renamed to have
+	// an ".old" suffix, replacing any previous such file, and a new file is
+	// started. This bounds the disk space used by long-running children.
+	ChildOutputMaxBytes int64
+	// ChildOutputThrottle limits the child output propagated per
+	// PropagateChildOutput or LogChildOutput, e.g. collapsing repeated lines or
+	// capping the number of lines per second, while full output is still
+	// written to ChildOutputDir; see Throttle.
+	ChildOutputThrottle Throttle
+	// BuildCacheDir, if non-empty, is a directory in which BuildGoPkg caches the
+	// binaries it builds, keyed by a hash of the package path, the build flags,
+	// the Go version and relevant env vars, and the contents of the source files
+	// of the package and its non-standard dependencies. The directory may be
+	// shared by multiple Shells and processes, e.g. across repeated test runs, so
+	// that identical helper binaries are built only once. The cache is never
+	// pruned; users should remove stale entries as needed.
+	BuildCacheDir string
+	// TranscriptFile, if non-empty, is the path of a file to which a transcript
+	// of the session is appended: for each command, when it was started, its
+	// args, working directory and env vars (relative to the calling process's
+	// environment), each line of its stdout and stderr, and when it was signaled
+	// and exited, with its exit code and duration. Lines are tagged with the
+	// number of commands started before the command, so that the output of
+	// concurrent commands can be told apart. Values registered via Redact are
+	// redacted. The file is created when the first command is started, and
+	// closed by Cleanup.
+	TranscriptFile string
+	// Dir, if non-empty, is the working directory for subsequently created Cmds.
+	// Setting Dir, directly or via Pushd and Popd, does not change the current
+	// directory of the calling process.
+	Dir string
 	// ContinueOnError specifies whether to invoke TB.FailNow on error, i.e.
 	// whether to panic on error. Users that set ContinueOnError to true should
 	// inspect sh.Err after each Shell method invocation.
 	ContinueOnError bool
+	// CollectErrors, if true, makes it so errors are logged and recorded rather
+	// than fatal, and calls may continue to be made while sh.Err is set, which
+	// holds the result of the most recent call. Recorded errors are returned by
+	// Errors. This suits cleanup-style scripts that should attempt every step,
+	// then report all failures at the end. Takes precedence over
+	// ContinueOnError.
+	CollectErrors bool
+	// DefaultTimeout, if positive, bounds how long Cmd.Wait, Cmd.AwaitVars,
+	// Cmd.AwaitMessage and Cmd.Call wait before failing, including the waits
+	// done by Run, Stdout and the like, and by Shell.Wait for each command. It
+	// also bounds Cmd.AwaitReady, Cmd.AwaitListening and Cmd.AwaitFileExists
+	// when they are given a non-positive timeout. This turns a hung child into a
+	// clear failure rather than a hung test. Variants such as WaitFor and
+	// AwaitVarsFor use their own timeouts instead.
+	DefaultTimeout time.Duration
 	// Vars is the map of env vars for this Shell.
 	Vars map[string]string
+	// LookPath, if non-nil, is used to resolve the names of executables passed
+	// to Cmd and the like, given the env vars the command will see. By default,
+	// names are resolved using the PATH in those env vars, per lookpath.Look.
+	// Names are resolved when the Cmd is created, and again when it is started,
+	// in case Cmd.Vars was changed in the meantime.
+	LookPath func(vars map[string]string, name string) (string, error)
 	// Args is the list of args to append to subsequent command invocations.
 	Args []string
 	// Set the depth to use for runtime.Caller when generating error messages.
 	ErrorDepth int
+	// ExpandVars specifies whether ${VAR} references are expanded for
+	// subsequently created Cmds; see Cmd.ExpandVars.
+	ExpandVars ExpandMode
+	// Context, if non-nil, is the context for subsequently created Cmds. Once the
+	// context is done, all such Cmds are terminated; see Cmd.Context.
+	Context context.Context
+	// DryRun, if true, makes it so commands are not actually started. Instead,
+	// Cmd.Start logs the command that would have been started, including its
+	// resolved path, args, working directory and env vars (relative to the
+	// calling process's environment), and the command behaves as if it exited
+	// immediately with no output. AwaitVars returns no vars, and signals are
+	// ignored.
+	DryRun bool
+	// CmdEventLogger, if non-nil, is called whenever a command created by this
+	// Shell is started, signaled, or exits, e.g. to record a trace of what the
+	// Shell did. It is called synchronously, possibly from a goroutine spawned by
+	// gosh and while internal locks are held, so it must be thread-safe and must
+	// not call methods on the Shell or its Cmds, other than Pid.
+	CmdEventLogger func(CmdEvent)
+	// Tracer holds functions that are called as commands created by this Shell
+	// are created, started, become ready, are signaled, and exit; see Tracer.
+	Tracer Tracer
+	// FastSpawn, if true, optimizes the Shell for spawning many short-lived
+	// commands, e.g. for load-generation and fuzzing harnesses. Executable
+	// paths resolved per lookpath.Look are cached by name and PATH, so that
+	// commands with the same name skip the search both when created and when
+	// started; as a result, executables that are added, removed or replaced
+	// in PATH after a name was first resolved are not noticed. Note, os/exec
+	// already spawns processes using vfork-style clone on Linux, i.e. the same
+	// mechanism as posix_spawn, so there is no separate posix_spawn path.
+	FastSpawn bool
+	// Subreaper, if true, makes the current process a child subreaper
+	// (PR_SET_CHILD_SUBREAPER) when a command is started, so that descendants of
+	// commands that are orphaned, e.g. by daemonizing or because their parent
+	// exited, are re-parented to the current process rather than to init.
+	// Commands are given an env var that identifies the Shell, which their
+	// descendants inherit. Cleanup then kills and reaps any re-parented
+	// descendants that are still in the process group or session of one of the
+	// Shell's commands, or that still have the env var, e.g. after moving to a
+	// new session via setsid, so that they are neither leaked nor left as
+	// zombies. Descendants that clear their environment and leave the session
+	// are not found. Being a subreaper is a property of the process, and is not
+	// undone. Only supported on Linux; on other platforms, starting a command
+	// fails.
+	Subreaper bool
+	// Clock, if non-nil, is used instead of real time for the timeouts enforced
+	// by this Shell: Cmd.ExitAfter, Cmd.InactivityTimeout, SetDeadline, the
+	// timeouts of AwaitVarsFor, AwaitVarsPartial, AwaitMessageFor, WaitFor and
+	// Session.Expect, the timeouts and probe intervals of AwaitReady,
+	// AwaitListening and AwaitFileExists, and Supervisor backoff. With a
+	// FakeClock, tests of timeout behavior can advance time explicitly rather
+	// than sleeping. When Clock is set, Cmd.ExitAfter is enforced by the Shell,
+	// which terminates the command, rather than by the child process itself, and
+	// so applies to all commands. Grace periods and retries use real time.
+	Clock Clock
 	// Internal state.
-	calledNewShell  bool
-	tb              TB
-	cleanupDone     chan struct{}
-	cleanupMu       sync.Mutex // protects the fields below; held during cleanup
-	calledCleanup   bool
-	cmds            []*Cmd
-	tempFiles       []*os.File
-	tempDirs        []string
-	dirStack        []string // for pushd/popd
-	cleanupHandlers []func()
+	calledNewShell bool
+	redactions     []*regexp.Regexp
+	transcript     *transcript
+	tb             TB
+	cleanupDone    chan struct{}
+	cleanupMu      sync.Mutex // protects the fields below; held during cleanup
+	calledCleanup  bool
+	cmds           []*Cmd
+	startedCmds    []*Cmd   // in start order
+	dirStack       []string // for pushd/popd
+	cleanupStack   []cleanupEntry
+	varsStack      []varsFrame // for PushVars/PopVars
+	deadline       *deadline   // per SetDeadline
+	subreaper      string      // per Subreaper; see subreaperID
+	errMu          sync.Mutex  // protects writes to Err and Cmd.Err, and errs
+	errs           []error     // per CollectErrors
+	interceptors   []*interceptor
+	lookPathMu     sync.Mutex // protects lookPathCache
+	lookPathCache  map[lookPathCacheKey]string
 }
 
 // NewShell returns a new Shell. Tests and benchmarks should pass their
@@ -92,8 +241,9 @@ func NewShell(tb TB) *Shell {
 	return sh
 }
 
-// HandleError sets sh.Err. If err is not nil and sh.ContinueOnError is false,
-// it also calls TB.FailNow.
+// HandleError sets sh.Err. If err is not nil and sh.CollectErrors is true, it
+// also records err; otherwise, if sh.ContinueOnError is false, it also calls
+// TB.FailNow.
 func (sh *Shell) HandleError(err error) {
 	sh.HandleErrorWithSkip(err, sh.ErrorDepth)
 }
@@ -107,13 +257,18 @@ func (sh *Shell) handleError(err error) {
 // skip value to pass to runtime.Caller.
 func (sh *Shell) HandleErrorWithSkip(err error, skip int) {
 	sh.Ok()
+	sh.errMu.Lock()
 	sh.Err = err
+	if err != nil && sh.CollectErrors {
+		sh.errs = append(sh.errs, err)
+	}
+	sh.errMu.Unlock()
 	if err == nil {
 		return
 	}
 	_, file, line, _ := runtime.Caller(skip)
 	toLog := fmt.Sprintf("%s:%d: %v\n", filepath.Base(file), line, err)
-	if sh.ContinueOnError {
+	if sh.ContinueOnError || sh.CollectErrors {
 		sh.tb.Logf(toLog)
 		return
 	}
@@ -126,6 +281,14 @@ func (sh *Shell) HandleErrorWithSkip(err error, skip int) {
 	sh.tb.FailNow()
 }
 
+// Errors returns the errors recorded per CollectErrors, in the order in which
+// they were handled.
+func (sh *Shell) Errors() []error {
+	sh.errMu.Lock()
+	defer sh.errMu.Unlock()
+	return append([]error(nil), sh.errs...)
+}
+
 // Cmd returns a Cmd for an invocation of the named program. The given arguments
 // are passed to the child as command-line arguments.
 func (sh *Shell) Cmd(name string, args ...string) *Cmd {
@@ -135,6 +298,18 @@ func (sh *Shell) Cmd(name string, args ...string) *Cmd {
 	return res
 }
 
+// CmdFromString returns a Cmd for the command line s, which is split into the
+// program name and arguments following the quoting rules of the POSIX shell,
+// e.g. `ls -la "a b"` runs ls with arguments "-la" and "a b". Only quoting and
+// backslash escapes are interpreted; there is no globbing, variable expansion,
+// command substitution, redirection or piping.
+func (sh *Shell) CmdFromString(s string) *Cmd {
+	sh.Ok()
+	res, err := sh.cmdFromString(s)
+	sh.handleError(err)
+	return res
+}
+
 // FuncCmd returns a Cmd for an invocation of the given registered Func. The
 // given arguments are gob-encoded in the parent process, then gob-decoded in
 // the child and passed to the Func as parameters. To specify command-line
@@ -146,20 +321,84 @@ func (sh *Shell) FuncCmd(f *Func, args ...interface{}) *Cmd {
 	return res
 }
 
-// Wait waits for all commands started by this Shell to exit.
+// Wait waits for all commands started by this Shell to exit, in reverse start
+// order. Each wait is subject to Shell.DefaultTimeout.
 func (sh *Shell) Wait() {
 	sh.Ok()
 	sh.handleError(sh.wait())
 }
 
+// TerminateAll sends a signal to each command started by this Shell that has
+// not been waited for, in reverse start order, and waits for it to exit, as in
+// Cmd.Terminate. This allows teardown code to stop all commands without having
+// to keep track of them.
+func (sh *Shell) TerminateAll(sig os.Signal) {
+	sh.Ok()
+	sh.handleError(sh.terminateAll(sig))
+}
+
+// RunGroup starts all of the given commands, then waits for all of them to
+// exit. Unlike calling Run on each command, the commands run concurrently, and
+// a failure to start or wait for one command does not prevent the others from
+// running. Each command's Err is set to its result, and the results are also
+// returned in the order of cmds. If any command failed, a *GroupError is
+// reported via HandleError. Each command must have been created from this
+// Shell.
+func (sh *Shell) RunGroup(cmds ...*Cmd) []error {
+	sh.Ok()
+	res, err := sh.runGroup(cmds...)
+	sh.handleError(err)
+	return res
+}
+
 // Move moves a file from 'oldpath' to 'newpath'. It first attempts os.Rename;
 // if that fails, it copies 'oldpath' to 'newpath', then deletes 'oldpath'.
 // Requires that 'newpath' does not exist, and that the parent directory of
 // 'newpath' does exist. Currently only supports moving an individual file;
-// moving a directory is not yet supported.
+// moving a directory is not yet supported. Relative paths are interpreted
+// relative to Shell.Dir, if set.
 func (sh *Shell) Move(oldpath, newpath string) {
 	sh.Ok()
-	sh.handleError(sh.move(oldpath, newpath))
+	sh.handleError(sh.move(sh.resolvePath(oldpath), sh.resolvePath(newpath)))
+}
+
+// Copy copies the file or directory 'src' to 'dst', recursively in the case of
+// a directory, preserving permissions and symbolic links. Requires that 'dst'
+// does not exist, and that the parent directory of 'dst' does exist. Relative
+// paths are interpreted relative to Shell.Dir, if set. Like temporary files,
+// 'dst' is removed by Cleanup.
+func (sh *Shell) Copy(src, dst string) {
+	sh.Ok()
+	sh.handleError(sh.copy(sh.resolvePath(src), sh.resolvePath(dst)))
+}
+
+// Symlink creates 'newname' as a symbolic link to 'oldname'. As with "ln -s",
+// 'oldname' is stored as given, whereas a relative 'newname' is interpreted
+// relative to Shell.Dir, if set. Like temporary files, 'newname' is removed by
+// Cleanup.
+func (sh *Shell) Symlink(oldname, newname string) {
+	sh.Ok()
+	sh.handleError(sh.symlink(oldname, sh.resolvePath(newname)))
+}
+
+// Glob returns the names of all files matching the given pattern, per
+// filepath.Glob. A relative pattern is interpreted relative to Shell.Dir, if
+// set, in which case the returned names are also relative to Shell.Dir.
+func (sh *Shell) Glob(pattern string) []string {
+	sh.Ok()
+	res, err := sh.glob(pattern)
+	sh.handleError(err)
+	return res
+}
+
+// Remove removes the named file or directory, including any children, as with
+// "rm -rf". It succeeds if the path does not exist. A relative path is
+// interpreted relative to Shell.Dir, if set. To guard against typos, it fails
+// for an empty path, and for paths that refer to the working directory, i.e.
+// "." or Shell.Dir, or to a root directory, e.g. "/".
+func (sh *Shell) Remove(path string) {
+	sh.Ok()
+	sh.handleError(sh.remove(path))
 }
 
 // MakeTempFile creates a new temporary file in os.TempDir, opens the file for
@@ -180,21 +419,54 @@ func (sh *Shell) MakeTempDir() string {
 	return res
 }
 
-// Pushd behaves like Bash pushd.
+// Pushd behaves like Bash pushd, except that rather than changing the current
+// directory of the calling process, it sets Shell.Dir, and thus the working
+// directory of subsequently created Cmds. A relative dir is interpreted
+// relative to the current Shell.Dir, or to the current directory of the calling
+// process if Shell.Dir is empty. The previous value of Shell.Dir is pushed onto
+// a directory stack.
 func (sh *Shell) Pushd(dir string) {
 	sh.Ok()
 	sh.handleError(sh.pushd(dir))
 }
 
-// Popd behaves like Bash popd.
+// Popd behaves like Bash popd: it restores Shell.Dir to its value before the
+// matching Pushd.
 func (sh *Shell) Popd() {
 	sh.Ok()
 	sh.handleError(sh.popd())
 }
 
+// PushVars sets the given env vars in Shell.Vars, saving their previous values,
+// so that a block of commands may run with a temporarily modified environment.
+// Each call must be matched by a call to PopVars, typically deferred:
+//
+//	sh.PushVars(map[string]string{"GOOS": "windows"})
+//	defer sh.PopVars()
+func (sh *Shell) PushVars(vars map[string]string) {
+	sh.Ok()
+	sh.handleError(sh.pushVars(vars))
+}
+
+// PopVars restores the env vars set by the matching PushVars to their previous
+// values, unsetting any that were previously unset. Other changes made to
+// Shell.Vars in the meantime are preserved. Unlike other Shell methods, PopVars
+// may be called even if Shell.Err is non-nil or Cleanup has been called, so
+// that it is always safe to defer.
+func (sh *Shell) PopVars() {
+	if !sh.calledNewShell {
+		panic(ErrDidNotCallNewShell)
+	}
+	if err := sh.popVars(); err != nil && sh.Err == nil {
+		sh.handleError(err)
+	}
+}
+
 // AddCleanupHandler registers the given function to be called during cleanup.
 // Cleanup handlers are called in LIFO order, possibly in a separate goroutine
-// spawned by gosh.
+// spawned by gosh. The ordering also applies to the rest of the cleanup: a
+// handler is called after commands started since it was registered have been
+// cleaned up, and before earlier temporary files and directories are removed.
 func (sh *Shell) AddCleanupHandler(f func()) {
 	sh.Ok()
 	sh.handleError(sh.addCleanupHandler(f))
@@ -207,7 +479,7 @@ func (sh *Shell) AddCleanupHandler(f func()) {
 // HandleError.
 func (sh *Shell) Cleanup() {
 	if !sh.calledNewShell {
-		panic(errDidNotCallNewShell)
+		panic(ErrDidNotCallNewShell)
 	}
 	sh.cleanupMu.Lock()
 	defer sh.cleanupMu.Unlock()
@@ -220,16 +492,19 @@ func (sh *Shell) Cleanup() {
 // methods. This method is public to facilitate Shell wrapping.
 func (sh *Shell) Ok() {
 	if !sh.calledNewShell {
-		panic(errDidNotCallNewShell)
+		panic(ErrDidNotCallNewShell)
 	}
 	// Panic on incorrect usage of Shell.
-	if sh.Err != nil {
-		panic(fmt.Errorf("gosh: Shell.Err is not nil: %v", sh.Err))
+	sh.errMu.Lock()
+	err := sh.Err
+	sh.errMu.Unlock()
+	if err != nil && !sh.CollectErrors {
+		panic(fmt.Errorf("gosh: Shell.Err is not nil: %v", err))
 	}
 	sh.cleanupMu.Lock()
 	defer sh.cleanupMu.Unlock()
 	if sh.calledCleanup {
-		panic(errAlreadyCalledCleanup)
+		panic(ErrAlreadyCalledCleanup)
 	}
 }
 
@@ -254,7 +529,7 @@ func newShell(tb TB) (*Shell, error) {
 	}
 	// Filter out any gosh env vars coming from outside.
 	shVars := sliceToMap(os.Environ())
-	for _, key := range []string{envExitAfter, envInvocation, envWatchParent} {
+	for _, key := range []string{envCallsFD, envExitAfter, envExtraFiles, envHeartbeat, envInvocation, envRlimits, envTestHelper, envVarsFD, envWatchParent} {
 		delete(shVars, key)
 	}
 	sh := &Shell{
@@ -302,11 +577,34 @@ func (sh *Shell) cmd(vars map[string]string, name string, args ...string) (*Cmd,
 	if err != nil {
 		return nil, err
 	}
+	c.shellVars = copyMap(sh.Vars)
+	for k := range vars {
+		delete(c.shellVars, k)
+	}
 	c.PropagateOutput = sh.PropagateChildOutput
+	c.LogOutput = sh.LogChildOutput
 	c.OutputDir = sh.ChildOutputDir
+	c.OutputName = sh.ChildOutputName
+	c.OutputMaxBytes = sh.ChildOutputMaxBytes
+	c.OutputThrottle = sh.ChildOutputThrottle
+	c.Dir = sh.Dir
+	c.ExpandVars = sh.ExpandVars
+	c.Context = sh.Context
+	c.traceCreated()
 	return c, nil
 }
 
+func (sh *Shell) cmdFromString(s string) (*Cmd, error) {
+	words, err := splitCommand(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, errEmptyCommand
+	}
+	return sh.cmd(nil, words[0], words[1:]...)
+}
+
 var executablePath = os.Args[0]
 
 func init() {
@@ -320,7 +618,7 @@ func (sh *Shell) funcCmd(f *Func, args ...interface{}) (*Cmd, error) {
 	// Safeguard against the developer forgetting to call InitMain, which could
 	// lead to infinite recursion.
 	if !calledInitMain {
-		return nil, errDidNotCallInitMain
+		return nil, ErrDidNotCallInitMain
 	}
 	buf, err := encodeInvocation(f.handle, args...)
 	if err != nil {
@@ -330,16 +628,25 @@ func (sh *Shell) funcCmd(f *Func, args ...interface{}) (*Cmd, error) {
 	return sh.cmd(vars, executablePath)
 }
 
+// startedCmdsReversed returns the commands started by this Shell, in reverse
+// start order.
+func (sh *Shell) startedCmdsReversed() []*Cmd {
+	sh.cleanupMu.Lock()
+	defer sh.cleanupMu.Unlock()
+	res := make([]*Cmd, len(sh.startedCmds))
+	for i, c := range sh.startedCmds {
+		res[len(res)-1-i] = c
+	}
+	return res
+}
+
 func (sh *Shell) wait() error {
-	// Note: It is illegal to call newCmdInternal (which mutates sh.cmds)
-	// concurrently with Shell.wait, so we need not hold cleanupMu when accessing
-	// sh.cmds below.
 	var res error
-	for _, c := range sh.cmds {
-		if !c.started || c.calledWait {
+	for _, c := range sh.startedCmdsReversed() {
+		if c.state().calledWait {
 			continue
 		}
-		if err := c.wait(); !c.errorIsOk(err) {
+		if err := c.waitDefault(); !c.errorIsOk(err) {
 			sh.tb.Logf("%s (PID %d) failed: %v\n", c.Path, c.Pid(), err)
 			res = err
 		}
@@ -347,6 +654,71 @@ func (sh *Shell) wait() error {
 	return res
 }
 
+func (sh *Shell) terminateAll(sig os.Signal) error {
+	var res error
+	for _, c := range sh.startedCmdsReversed() {
+		if c.state().calledWait {
+			continue
+		}
+		if err := c.terminate(sig); err != nil {
+			sh.tb.Logf("%s (PID %d) failed to terminate: %v\n", c.Path, c.Pid(), err)
+			res = err
+		}
+	}
+	return res
+}
+
+// GroupError is the error reported by Shell.RunGroup, Shell.Map, Pool.Wait and
+// the methods of Fleet, if any of their commands failed.
+type GroupError struct {
+	// Cmds holds the commands in the group, e.g. those passed to RunGroup.
+	Cmds []*Cmd
+	// Errs holds the result of each command, in the order of Cmds; entries are
+	// nil for commands that succeeded.
+	Errs []error
+}
+
+// Error returns a description of each failed command.
+func (e *GroupError) Error() string {
+	var failed []string
+	for i, err := range e.Errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", e.Cmds[i].Path, err))
+		}
+	}
+	return fmt.Sprintf("gosh: %d of %d commands failed: %s", len(failed), len(e.Cmds), strings.Join(failed, "; "))
+}
+
+func (sh *Shell) runGroup(cmds ...*Cmd) ([]error, error) {
+	for _, c := range cmds {
+		if c.sh != sh {
+			return nil, errors.New("gosh: group cmds must be created from the same shell")
+		}
+	}
+	// Start all commands, then wait for those that started. Ensure all commands
+	// are processed by avoiding early-exit.
+	errs := make([]error, len(cmds))
+	for i, c := range cmds {
+		errs[i] = c.start()
+	}
+	for i, c := range cmds {
+		if errs[i] == nil {
+			errs[i] = c.waitDefault()
+		}
+	}
+	failed := false
+	for i, c := range cmds {
+		if errs[i] = c.setErr(errs[i]); errs[i] != nil {
+			sh.tb.Logf("%s (PID %d) failed: %v\n", c.Path, c.Pid(), errs[i])
+			failed = true
+		}
+	}
+	if failed {
+		return errs, &GroupError{Cmds: cmds, Errs: errs}
+	}
+	return errs, nil
+}
+
 func copyFile(to, from string) error {
 	fi, err := os.Stat(from)
 	if err != nil {
@@ -377,13 +749,7 @@ func (sh *Shell) move(oldpath, newpath string) error {
 	if fi.Mode().IsDir() {
 		return errors.New("gosh: moving a directory is not yet supported")
 	}
-	if _, err := os.Stat(newpath); !os.IsNotExist(err) {
-		return errors.New("gosh: destination file must not exist")
-	}
-	if _, err := os.Stat(filepath.Dir(newpath)); err != nil {
-		if os.IsNotExist(err) {
-			return errors.New("gosh: destination file's parent directory must exist")
-		}
+	if err := checkDst(newpath); err != nil {
 		return err
 	}
 	if err := os.Rename(oldpath, newpath); err == nil {
@@ -402,17 +768,136 @@ func (sh *Shell) move(oldpath, newpath string) error {
 	return os.Remove(oldpath)
 }
 
+func (sh *Shell) glob(pattern string) ([]string, error) {
+	if sh.Dir == "" || filepath.IsAbs(pattern) {
+		return filepath.Glob(pattern)
+	}
+	matches, err := filepath.Glob(filepath.Join(sh.Dir, pattern))
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range matches {
+		if matches[i], err = filepath.Rel(sh.Dir, m); err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+func (sh *Shell) remove(path string) error {
+	if path == "" {
+		return errors.New("gosh: cannot remove empty path")
+	}
+	p := filepath.Clean(sh.resolvePath(path))
+	if p == "." || (sh.Dir != "" && p == filepath.Clean(sh.Dir)) || filepath.Dir(p) == p {
+		return fmt.Errorf("gosh: refusing to remove %q", path)
+	}
+	return os.RemoveAll(p)
+}
+
+// resolvePath returns path, interpreted relative to sh.Dir if it is relative.
+func (sh *Shell) resolvePath(path string) string {
+	if sh.Dir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(sh.Dir, path)
+}
+
+// checkDst checks that dst does not exist, and that its parent directory does.
+func checkDst(dst string) error {
+	if _, err := os.Lstat(dst); !os.IsNotExist(err) {
+		return errors.New("gosh: destination file must not exist")
+	}
+	if _, err := os.Stat(filepath.Dir(dst)); err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("gosh: destination file's parent directory must exist")
+		}
+		return err
+	}
+	return nil
+}
+
+// copyTree copies the file, directory or symbolic link 'from' to 'to'.
+func copyTree(to, from string) error {
+	fi, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(from)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, to)
+	case fi.IsDir():
+		// Make the directory writable while its contents are copied.
+		if err := os.Mkdir(to, 0700); err != nil {
+			return err
+		}
+		f, err := os.Open(from)
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := copyTree(filepath.Join(to, name), filepath.Join(from, name)); err != nil {
+				return err
+			}
+		}
+		return os.Chmod(to, fi.Mode().Perm())
+	default:
+		return copyFile(to, from)
+	}
+}
+
+func (sh *Shell) copy(src, dst string) error {
+	if err := checkDst(dst); err != nil {
+		return err
+	}
+	if err := copyTree(dst, src); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return sh.addCleanupPath(dst)
+}
+
+func (sh *Shell) symlink(oldname, newname string) error {
+	if err := checkDst(newname); err != nil {
+		return err
+	}
+	if err := os.Symlink(oldname, newname); err != nil {
+		return err
+	}
+	return sh.addCleanupPath(newname)
+}
+
+// addCleanupPath arranges for the given path to be removed by Cleanup.
+func (sh *Shell) addCleanupPath(path string) error {
+	sh.cleanupMu.Lock()
+	defer sh.cleanupMu.Unlock()
+	if sh.calledCleanup {
+		return ErrAlreadyCalledCleanup
+	}
+	sh.pushCleanupEntry(cleanupEntry{path: path})
+	return nil
+}
+
 func (sh *Shell) makeTempFile() (*os.File, error) {
 	sh.cleanupMu.Lock()
 	defer sh.cleanupMu.Unlock()
 	if sh.calledCleanup {
-		return nil, errAlreadyCalledCleanup
+		return nil, ErrAlreadyCalledCleanup
 	}
 	f, err := ioutil.TempFile("", "")
 	if err != nil {
 		return nil, err
 	}
-	sh.tempFiles = append(sh.tempFiles, f)
+	sh.pushCleanupEntry(cleanupEntry{tempFile: f})
 	return f, nil
 }
 
@@ -420,13 +905,13 @@ func (sh *Shell) makeTempDir() (string, error) {
 	sh.cleanupMu.Lock()
 	defer sh.cleanupMu.Unlock()
 	if sh.calledCleanup {
-		return "", errAlreadyCalledCleanup
+		return "", ErrAlreadyCalledCleanup
 	}
 	name, err := ioutil.TempDir("", "")
 	if err != nil {
 		return "", err
 	}
-	sh.tempDirs = append(sh.tempDirs, name)
+	sh.pushCleanupEntry(cleanupEntry{tempDir: name})
 	return name, nil
 }
 
@@ -434,16 +919,27 @@ func (sh *Shell) pushd(dir string) error {
 	sh.cleanupMu.Lock()
 	defer sh.cleanupMu.Unlock()
 	if sh.calledCleanup {
-		return errAlreadyCalledCleanup
+		return ErrAlreadyCalledCleanup
 	}
-	cwd, err := os.Getwd()
+	if !filepath.IsAbs(dir) {
+		base := sh.Dir
+		if base == "" {
+			var err error
+			if base, err = os.Getwd(); err != nil {
+				return err
+			}
+		}
+		dir = filepath.Join(base, dir)
+	}
+	fi, err := os.Stat(dir)
 	if err != nil {
 		return err
 	}
-	if err := os.Chdir(dir); err != nil {
-		return err
+	if !fi.IsDir() {
+		return fmt.Errorf("gosh: not a directory: %s", dir)
 	}
-	sh.dirStack = append(sh.dirStack, cwd)
+	sh.dirStack = append(sh.dirStack, sh.Dir)
+	sh.Dir = dir
 	return nil
 }
 
@@ -451,39 +947,91 @@ func (sh *Shell) popd() error {
 	sh.cleanupMu.Lock()
 	defer sh.cleanupMu.Unlock()
 	if sh.calledCleanup {
-		return errAlreadyCalledCleanup
+		return ErrAlreadyCalledCleanup
 	}
 	if len(sh.dirStack) == 0 {
 		return errors.New("gosh: dir stack is empty")
 	}
-	dir := sh.dirStack[len(sh.dirStack)-1]
-	if err := os.Chdir(dir); err != nil {
-		return err
-	}
+	sh.Dir = sh.dirStack[len(sh.dirStack)-1]
 	sh.dirStack = sh.dirStack[:len(sh.dirStack)-1]
 	return nil
 }
 
+// varsFrame records the values of env vars before a call to PushVars.
+type varsFrame struct {
+	prev  map[string]string // vars that were set
+	unset []string          // vars that were unset
+}
+
+func (sh *Shell) pushVars(vars map[string]string) error {
+	sh.cleanupMu.Lock()
+	defer sh.cleanupMu.Unlock()
+	if sh.calledCleanup {
+		return ErrAlreadyCalledCleanup
+	}
+	f := varsFrame{prev: map[string]string{}}
+	for k, v := range vars {
+		if prev, ok := sh.Vars[k]; ok {
+			f.prev[k] = prev
+		} else {
+			f.unset = append(f.unset, k)
+		}
+		sh.Vars[k] = v
+	}
+	sh.varsStack = append(sh.varsStack, f)
+	return nil
+}
+
+func (sh *Shell) popVars() error {
+	sh.cleanupMu.Lock()
+	defer sh.cleanupMu.Unlock()
+	if len(sh.varsStack) == 0 {
+		return errors.New("gosh: vars stack is empty")
+	}
+	f := sh.varsStack[len(sh.varsStack)-1]
+	sh.varsStack = sh.varsStack[:len(sh.varsStack)-1]
+	for k, v := range f.prev {
+		sh.Vars[k] = v
+	}
+	for _, k := range f.unset {
+		delete(sh.Vars, k)
+	}
+	return nil
+}
+
 func (sh *Shell) addCleanupHandler(f func()) error {
 	sh.cleanupMu.Lock()
 	defer sh.cleanupMu.Unlock()
 	if sh.calledCleanup {
-		return errAlreadyCalledCleanup
+		return ErrAlreadyCalledCleanup
 	}
-	sh.cleanupHandlers = append(sh.cleanupHandlers, f)
+	sh.pushCleanupEntry(cleanupEntry{handler: f})
 	return nil
 }
 
-// Note: It is safe to run Shell.cleanupRunningCmds concurrently with the waiter
-// goroutine and with Cmd.wait. In particular, Shell.cleanupRunningCmds only
-// calls c.{isRunning,Pid}, all of which are thread-safe with the waiter
-// goroutine and with Cmd.wait.
-func (sh *Shell) cleanupRunningCmds() {
+// cleanupEntry is a resource to be released during cleanup. Exactly one of
+// tempFile, tempDir and handler is set.
+type cleanupEntry struct {
+	numStarted int // len(sh.startedCmds) when the entry was pushed
+	tempFile   *os.File
+	tempDir    string
+	path       string // created by Copy or Symlink
+	handler    func()
+}
+
+// pushCleanupEntry adds e to the cleanup stack. Requires that cleanupMu is held.
+func (sh *Shell) pushCleanupEntry(e cleanupEntry) {
+	e.numStarted = len(sh.startedCmds)
+	sh.cleanupStack = append(sh.cleanupStack, e)
+}
+
+// Note: It is safe to run Shell.cleanupCmds concurrently with the waiter
+// goroutine and with Cmd.wait. In particular, Shell.cleanupCmds only calls
+// c.{isRunning,Pid}, all of which are thread-safe with the waiter goroutine and
+// with Cmd.wait.
+func (sh *Shell) cleanupCmds(cmds []*Cmd) {
 	var wg sync.WaitGroup
-	for _, c := range sh.cmds {
-		if !c.started {
-			continue
-		}
+	for _, c := range cmds {
 		wg.Add(1)
 		go func(cmd *Cmd) {
 			defer wg.Done()
@@ -495,35 +1043,46 @@ func (sh *Shell) cleanupRunningCmds() {
 
 func (sh *Shell) cleanup() {
 	sh.calledCleanup = true
-	// Clean up all children that are still running.
-	sh.cleanupRunningCmds()
-	// Close and delete all temporary files.
-	for _, tempFile := range sh.tempFiles {
-		name := tempFile.Name()
-		if err := tempFile.Close(); err != nil {
-			sh.tb.Logf("%q.Close() failed: %v\n", name, err)
-		}
-		if err := os.RemoveAll(name); err != nil {
-			sh.tb.Logf("os.RemoveAll(%q) failed: %v\n", name, err)
-		}
+	if sh.deadline != nil {
+		sh.deadline.timer.Stop()
 	}
-	// Delete all temporary directories.
-	for _, tempDir := range sh.tempDirs {
-		if err := os.RemoveAll(tempDir); err != nil {
-			sh.tb.Logf("os.RemoveAll(%q) failed: %v\n", tempDir, err)
+	// Release resources in LIFO order. Before releasing each resource, clean up
+	// all children that were started after it was acquired and are still
+	// running.
+	numStarted := len(sh.startedCmds)
+	for i := len(sh.cleanupStack) - 1; i >= 0; i-- {
+		e := sh.cleanupStack[i]
+		if e.numStarted < numStarted {
+			sh.cleanupCmds(sh.startedCmds[e.numStarted:numStarted])
+			numStarted = e.numStarted
 		}
-	}
-	// Change back to the top of the dir stack.
-	if len(sh.dirStack) > 0 {
-		dir := sh.dirStack[0]
-		if err := os.Chdir(dir); err != nil {
-			sh.tb.Logf("os.Chdir(%q) failed: %v\n", dir, err)
+		switch {
+		case e.tempFile != nil:
+			// Close and delete the temporary file.
+			name := e.tempFile.Name()
+			if err := e.tempFile.Close(); err != nil {
+				sh.tb.Logf("%q.Close() failed: %v\n", name, err)
+			}
+			if err := os.RemoveAll(name); err != nil {
+				sh.tb.Logf("os.RemoveAll(%q) failed: %v\n", name, err)
+			}
+		case e.tempDir != "":
+			// Delete the temporary directory.
+			if err := os.RemoveAll(e.tempDir); err != nil {
+				sh.tb.Logf("os.RemoveAll(%q) failed: %v\n", e.tempDir, err)
+			}
+		case e.path != "":
+			// Delete the path created by Copy or Symlink.
+			if err := os.RemoveAll(e.path); err != nil {
+				sh.tb.Logf("os.RemoveAll(%q) failed: %v\n", e.path, err)
+			}
+		case e.handler != nil:
+			e.handler()
 		}
 	}
-	// Call cleanup handlers in LIFO order.
-	for i := len(sh.cleanupHandlers) - 1; i >= 0; i-- {
-		sh.cleanupHandlers[i]()
-	}
+	sh.cleanupCmds(sh.startedCmds[:numStarted])
+	sh.reapOrphans()
+	sh.closeTranscript()
 	close(sh.cleanupDone)
 }
 
@@ -536,34 +1095,80 @@ var calledInitMain = false
 // parent process, it returns immediately with no effect. In a child process for
 // a Shell.FuncCmd command, it runs the specified function, then exits.
 func InitMain() {
+	if isChild, err := InitMainNoExit(); err != nil {
+		log.Fatal(err)
+	} else if isChild {
+		os.Exit(0)
+	}
+}
+
+// InitMainNoExit is like InitMain, but returns instead of exiting, so that the
+// caller may run deferred cleanup and choose its own exit code. In the parent
+// process, it returns false and nil. In a child process for a Shell.FuncCmd
+// command, it runs the specified function, then returns true and the error, if
+// any, from decoding or running the function; the caller should then exit,
+// with a non-zero code if the error is non-nil. Functions that call os.Exit
+// still exit directly.
+func InitMainNoExit() (isChild bool, err error) {
 	if calledInitMain {
 		panic("gosh: already called gosh.InitMain")
 	}
 	calledInitMain = true
 	s := os.Getenv(envInvocation)
 	if s == "" {
-		return
+		return false, nil
 	}
 	os.Unsetenv(envInvocation)
 	InitChildMain()
 	name, args, err := decodeInvocation(s)
 	if err != nil {
-		log.Fatal(err)
+		return true, err
 	}
-	if err := callFunc(name, args...); err != nil {
-		log.Fatal(err)
+	if _, err := getFunc(name); err != nil {
+		fmt.Fprintln(os.Stderr, "gosh: registered functions:")
+		DumpRegistry(os.Stderr)
+		return true, err
 	}
-	os.Exit(0)
+	return true, callFuncReportingPanic(name, args...)
 }
 
 // BuildGoPkg compiles a Go package using the "go build" command and writes the
 // resulting binary to the given binDir, or to the -o flag location if
 // specified. If -o is relative, it is interpreted as relative to binDir. If the
-// binary already exists at the target location, it is not rebuilt. Returns the
-// absolute path to the binary.
+// binary already exists at the target location, it is not rebuilt. If
+// sh.BuildCacheDir is set, the binary is copied from the cache when possible;
+// see Shell.BuildCacheDir. Returns the absolute path to the binary.
 func BuildGoPkg(sh *Shell, binDir, pkg string, flags ...string) string {
 	sh.Ok()
-	res, err := buildGoPkg(sh, binDir, pkg, flags...)
+	res, err := buildGoPkg(sh, binDir, pkg, nil, flags...)
+	sh.handleError(err)
+	return res
+}
+
+// BuildOpts specifies options for BuildGoPkgOpts.
+type BuildOpts struct {
+	// GOOS and GOARCH, if non-empty, specify the target platform, e.g. to build
+	// binaries for an emulator.
+	GOOS, GOARCH string
+	// Tags is the list of build tags, passed via -tags.
+	Tags []string
+	// Race specifies whether to enable the race detector, via -race.
+	Race bool
+	// LDFlags, if non-empty, is passed via -ldflags, e.g. "-X main.version=1.0".
+	LDFlags string
+	// Flags is the list of additional flags to pass to "go build". As with
+	// BuildGoPkg, -o may be specified, and is interpreted relative to binDir.
+	Flags []string
+}
+
+// BuildGoPkgOpts is like BuildGoPkg, but takes BuildOpts. If -o is not
+// specified and GOOS, GOARCH or Race is set, the binary is written to a
+// subdirectory of binDir named after the target, e.g. "windows_amd64" or
+// "linux_amd64_race", so that binaries for different targets don't collide,
+// and binaries for Windows are given an ".exe" suffix.
+func BuildGoPkgOpts(sh *Shell, binDir, pkg string, opts BuildOpts) string {
+	sh.Ok()
+	res, err := buildGoPkgOpts(sh, binDir, pkg, opts)
 	sh.handleError(err)
 	return res
 }
@@ -584,7 +1189,55 @@ func extractOutputFlag(flags ...string) (outputFlag string, otherFlags []string,
 	return
 }
 
-func buildGoPkg(sh *Shell, binDir, pkg string, flags ...string) (string, error) {
+func buildGoPkgOpts(sh *Shell, binDir, pkg string, opts BuildOpts) (string, error) {
+	var flags []string
+	if len(opts.Tags) > 0 {
+		flags = append(flags, "-tags="+strings.Join(opts.Tags, ","))
+	}
+	if opts.Race {
+		flags = append(flags, "-race")
+	}
+	if opts.LDFlags != "" {
+		flags = append(flags, "-ldflags="+opts.LDFlags)
+	}
+	flags = append(flags, opts.Flags...)
+	outputFlag, _, err := extractOutputFlag(flags...)
+	if err != nil {
+		return "", err
+	}
+	vars := map[string]string{}
+	var target []string
+	if opts.GOOS != "" || opts.GOARCH != "" {
+		goos, goarch := runtime.GOOS, runtime.GOARCH
+		if opts.GOOS != "" {
+			goos = opts.GOOS
+			vars["GOOS"] = goos
+		}
+		if opts.GOARCH != "" {
+			goarch = opts.GOARCH
+			vars["GOARCH"] = goarch
+		}
+		target = append(target, goos, goarch)
+	}
+	if opts.Race {
+		if len(target) == 0 {
+			target = append(target, runtime.GOOS, runtime.GOARCH)
+		}
+		target = append(target, "race")
+	}
+	if outputFlag == "" && len(target) > 0 {
+		name := path.Base(pkg)
+		if opts.GOOS == "windows" {
+			name += ".exe"
+		}
+		flags = append(flags, "-o", filepath.Join(strings.Join(target, "_"), name))
+	}
+	return buildGoPkg(sh, binDir, pkg, vars, flags...)
+}
+
+// buildGoPkg builds the given package, with the given env vars added to those
+// of the "go build" command.
+func buildGoPkg(sh *Shell, binDir, pkg string, vars map[string]string, flags ...string) (string, error) {
 	outputFlag, flags, err := extractOutputFlag(flags...)
 	if err != nil {
 		return "", err
@@ -611,15 +1264,25 @@ func buildGoPkg(sh *Shell, binDir, pkg string, flags ...string) (string, error)
 	}
 	defer os.RemoveAll(tempDir)
 	tempBinPath := filepath.Join(tempDir, path.Base(pkg))
-	args := []string{"build", "-o", tempBinPath}
-	args = append(args, flags...)
-	args = append(args, pkg)
-	c, err := sh.cmd(nil, "go", args...)
-	if err != nil {
-		return "", err
-	}
-	if err := c.run(); err != nil {
-		return "", err
+	if sh.BuildCacheDir != "" {
+		cachedPath, err := buildGoPkgCached(sh, pkg, vars, flags...)
+		if err != nil {
+			return "", err
+		}
+		if err := copyFile(tempBinPath, cachedPath); err != nil {
+			return "", err
+		}
+	} else {
+		args := []string{"build", "-o", tempBinPath}
+		args = append(args, flags...)
+		args = append(args, pkg)
+		c, err := sh.cmd(vars, "go", args...)
+		if err != nil {
+			return "", err
+		}
+		if err := c.run(); err != nil {
+			return "", err
+		}
 	}
 	// Create target directory, if needed.
 	if err := os.MkdirAll(filepath.Dir(binPath), 0700); err != nil {
@@ -11,27 +11,41 @@ package gosh_test
 // - Cmd.Clone
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
 	"v.io/x/lib/gosh"
 	lib "v.io/x/lib/gosh/internal/gosh_example_lib"
+	"v.io/x/lib/textutil"
 )
 
 var fakeError = errors.New("fake error")
@@ -173,28 +187,35 @@ func TestPushdPopd(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	startDir, err := os.Getwd()
-	ok(t, err)
-	parentDir := filepath.Dir(startDir)
-	neq(t, startDir, parentDir)
-	sh.Pushd(parentDir)
-	cwd, err := os.Getwd()
-	ok(t, err)
-	eq(t, cwd, parentDir)
-	sh.Pushd(startDir)
-	cwd, err = os.Getwd()
-	ok(t, err)
-	eq(t, cwd, startDir)
+	startDir := getwdEvalSymlinks(t)
+	tmpDir := evalSymlinks(t, sh.MakeTempDir())
+	ok(t, os.Mkdir(filepath.Join(tmpDir, "sub"), 0700))
+
+	// Pushd and Popd set Shell.Dir, which is inherited by subsequently created
+	// commands.
+	sh.Pushd(tmpDir)
+	eq(t, sh.Dir, tmpDir)
+	eq(t, sh.FuncCmd(getwdFunc).Stdout(), tmpDir)
+	// Relative dirs are relative to the current Shell.Dir.
+	sh.Pushd("sub")
+	eq(t, sh.Dir, filepath.Join(tmpDir, "sub"))
+	eq(t, sh.FuncCmd(getwdFunc).Stdout(), filepath.Join(tmpDir, "sub"))
 	sh.Popd()
-	cwd, err = os.Getwd()
-	ok(t, err)
-	eq(t, cwd, parentDir)
+	eq(t, sh.Dir, tmpDir)
 	sh.Popd()
-	cwd, err = os.Getwd()
-	ok(t, err)
-	eq(t, cwd, startDir)
+	eq(t, sh.Dir, "")
+	eq(t, sh.FuncCmd(getwdFunc).Stdout(), startDir)
 	// The next sh.Popd() will fail.
 	setsErr(t, sh, func() { sh.Popd() })
+
+	// Pushd fails for non-existent dirs and files.
+	setsErr(t, sh, func() { sh.Pushd(filepath.Join(tmpDir, "missing")) })
+	ok(t, ioutil.WriteFile(filepath.Join(tmpDir, "file"), nil, 0600))
+	setsErr(t, sh, func() { sh.Pushd(filepath.Join(tmpDir, "file")) })
+	eq(t, sh.Dir, "")
+
+	// The current directory of the calling process is unchanged.
+	eq(t, getwdEvalSymlinks(t), startDir)
 }
 
 func evalSymlinks(t *testing.T, dir string) string {
@@ -210,16 +231,40 @@ func getwdEvalSymlinks(t *testing.T) string {
 	return evalSymlinks(t, dir)
 }
 
-func TestPushdNoPopdCleanup(t *testing.T) {
-	startDir := getwdEvalSymlinks(t)
+var getwdFunc = gosh.RegisterFunc("getwdFunc", func() error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	fmt.Print(dir)
+	return nil
+})
+
+func TestDir(t *testing.T) {
 	sh := gosh.NewShell(t)
-	tmpDir := sh.MakeTempDir()
-	sh.Pushd(tmpDir)
-	eq(t, getwdEvalSymlinks(t), evalSymlinks(t, tmpDir))
-	// There is no matching popd; the cwd is tmpDir, which is deleted by Cleanup.
-	// Cleanup needs to put us back in startDir, otherwise all subsequent Pushd
-	// calls will fail.
-	sh.Cleanup()
+	defer sh.Cleanup()
+
+	startDir := getwdEvalSymlinks(t)
+	tmpDir := evalSymlinks(t, sh.MakeTempDir())
+	eq(t, sh.FuncCmd(getwdFunc).Stdout(), startDir)
+
+	// Cmd.Dir sets the working directory of the command.
+	c := sh.FuncCmd(getwdFunc)
+	c.Dir = tmpDir
+	eq(t, c.Stdout(), tmpDir)
+	eq(t, c.Clone().Stdout(), tmpDir)
+
+	// Shell.Dir is inherited by subsequently created commands.
+	sh.Dir = tmpDir
+	eq(t, sh.FuncCmd(getwdFunc).Stdout(), tmpDir)
+	sh.Dir = ""
+	eq(t, sh.FuncCmd(getwdFunc).Stdout(), startDir)
+
+	// The current directory of the calling process is unchanged.
 	eq(t, getwdEvalSymlinks(t), startDir)
 }
 
@@ -281,6 +326,252 @@ func TestMove(t *testing.T) {
 	eq(t, string(buf), "srcFoo")
 }
 
+func TestCopySymlinkRemove(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	src, dst := sh.MakeTempDir(), sh.MakeTempDir()
+	ok(t, os.Mkdir(filepath.Join(src, "dir"), 0700))
+	ok(t, ioutil.WriteFile(filepath.Join(src, "dir", "foo"), []byte("foo"), 0640))
+	ok(t, os.Symlink("foo", filepath.Join(src, "dir", "link")))
+
+	// Copy should fail if source does not exist, if destination exists, or if
+	// destination's parent does not exist.
+	setsErr(t, sh, func() { sh.Copy(filepath.Join(src, "bar"), filepath.Join(dst, "bar")) })
+	setsErr(t, sh, func() { sh.Copy(src, dst) })
+	setsErr(t, sh, func() { sh.Copy(src, filepath.Join(dst, "subdir", "a")) })
+
+	// Copy should copy directories recursively, with relative paths interpreted
+	// relative to sh.Dir.
+	sh.Dir = dst
+	sh.Copy(filepath.Join(src, "dir"), "dir")
+	buf, err := ioutil.ReadFile(filepath.Join(dst, "dir", "foo"))
+	ok(t, err)
+	eq(t, string(buf), "foo")
+	fi, err := os.Stat(filepath.Join(dst, "dir", "foo"))
+	ok(t, err)
+	eq(t, fi.Mode().Perm(), os.FileMode(0640))
+	target, err := os.Readlink(filepath.Join(dst, "dir", "link"))
+	ok(t, err)
+	eq(t, target, "foo")
+
+	// Symlink should fail if newname exists.
+	setsErr(t, sh, func() { sh.Symlink("dir", "dir") })
+	sh.Symlink("dir", "link")
+	buf, err = ioutil.ReadFile(filepath.Join(dst, "link", "foo"))
+	ok(t, err)
+	eq(t, string(buf), "foo")
+
+	// Remove should remove files and directories, and succeed if the path does
+	// not exist.
+	sh.Remove("link")
+	sh.Remove("link")
+	sh.Remove(filepath.Join(src, "dir"))
+	for _, p := range []string{filepath.Join(dst, "link"), filepath.Join(src, "dir")} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Fatalf("got %v, expected IsNotExist", err)
+		}
+	}
+
+	// Remove should fail for paths that refer to the working directory or a
+	// root directory, leaving the working directory intact.
+	for _, p := range []string{"", ".", "./", "dir/..", dst, dst + "/", "/"} {
+		setsErr(t, sh, func() { sh.Remove(p) })
+	}
+	if _, err := os.Stat(filepath.Join(dst, "dir")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cleanup should remove paths created by Copy and Symlink.
+	sh2 := gosh.NewShell(t)
+	sh2.Dir = dst
+	sh2.Copy("dir", "dir2")
+	sh2.Symlink("dir", "link2")
+	sh2.Cleanup()
+	for _, p := range []string{"dir2", "link2"} {
+		if _, err := os.Lstat(filepath.Join(dst, p)); !os.IsNotExist(err) {
+			t.Fatalf("got %v, expected IsNotExist", err)
+		}
+	}
+	_, err = os.Stat(filepath.Join(dst, "dir"))
+	ok(t, err)
+}
+
+func TestGlob(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	dir := sh.MakeTempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.go"} {
+		ok(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+	eq(t, sh.Glob(filepath.Join(dir, "*.txt")), []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")})
+
+	// Relative patterns are interpreted relative to sh.Dir.
+	sh.Pushd(dir)
+	eq(t, sh.Glob("*.go"), []string{"c.go"})
+	eq(t, len(sh.Glob("*.none")), 0)
+	sh.Popd()
+
+	// Malformed patterns set sh.Err.
+	setsErr(t, sh, func() { sh.Glob("[") })
+}
+
+func TestDownload(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	const contents = "#!/bin/sh\necho hello\n"
+	const sum = "8e5e1a1bd64ae2c0ed3f8b33a16faa8f3eb2a6ffe5a1d8bd6a0c6b1f36b6d3dc"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bin/hello.sh" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(contents))
+	}))
+	defer ts.Close()
+
+	p := sh.Download(ts.URL+"/bin/hello.sh", gosh.DownloadOpts{})
+	eq(t, filepath.Base(p), "hello.sh")
+	buf, err := ioutil.ReadFile(p)
+	ok(t, err)
+	eq(t, string(buf), contents)
+
+	// Test DownloadOpts.
+	h := sha256.Sum256([]byte(contents))
+	p = sh.Download(ts.URL+"/bin/hello.sh", gosh.DownloadOpts{SHA256: hex.EncodeToString(h[:]), Name: "hello", Mode: 0700})
+	eq(t, filepath.Base(p), "hello")
+	fi, err := os.Stat(p)
+	ok(t, err)
+	eq(t, fi.Mode().Perm()&0700, os.FileMode(0700))
+
+	// Download should fail on checksum mismatch and on bad status.
+	setsErr(t, sh, func() { sh.Download(ts.URL+"/bin/hello.sh", gosh.DownloadOpts{SHA256: sum}) })
+	setsErr(t, sh, func() { sh.Download(ts.URL+"/missing", gosh.DownloadOpts{}) })
+
+	// Cleanup should delete the downloaded files.
+	sh.Cleanup()
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Fatalf("got %v, expected IsNotExist", err)
+	}
+}
+
+// archiveEntry is an entry in an archive written by writeTarGz or writeZip. An
+// entry is a directory if its name ends with "/", and a symbolic link if link
+// is set.
+type archiveEntry struct {
+	name, data, link string
+}
+
+func writeTarGz(t *testing.T, name string, entries ...archiveEntry) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0640, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		switch {
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0750
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+		}
+		ok(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.data))
+		ok(t, err)
+	}
+	ok(t, tw.Close())
+	ok(t, gz.Close())
+	ok(t, ioutil.WriteFile(name, buf.Bytes(), 0600))
+}
+
+func writeZip(t *testing.T, name string, entries ...archiveEntry) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name}
+		data := e.data
+		switch {
+		case strings.HasSuffix(e.name, "/"):
+			hdr.SetMode(os.ModeDir | 0750)
+		case e.link != "":
+			hdr.SetMode(os.ModeSymlink | 0777)
+			data = e.link
+		default:
+			hdr.SetMode(0640)
+		}
+		w, err := zw.CreateHeader(hdr)
+		ok(t, err)
+		_, err = w.Write([]byte(data))
+		ok(t, err)
+	}
+	ok(t, zw.Close())
+	ok(t, ioutil.WriteFile(name, buf.Bytes(), 0600))
+}
+
+func TestExtract(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	tmpDir := sh.MakeTempDir()
+	for _, test := range []struct {
+		write   func(*testing.T, string, ...archiveEntry)
+		extract func(string) string
+	}{
+		{writeTarGz, sh.ExtractTarGz},
+		{writeZip, sh.ExtractZip},
+	} {
+		archive := filepath.Join(tmpDir, "archive")
+		test.write(t, archive,
+			archiveEntry{name: "dir/"},
+			archiveEntry{name: "dir/foo", data: "foo"},
+			archiveEntry{name: "dir/sub/bar", data: "bar"},
+			archiveEntry{name: "dir/link", link: "sub/bar"},
+			archiveEntry{name: "dir/sub/up", link: "../foo"})
+		dir := test.extract(archive)
+		for name, want := range map[string]string{"dir/foo": "foo", "dir/sub/bar": "bar", "dir/link": "bar", "dir/sub/up": "foo"} {
+			buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+			ok(t, err)
+			eq(t, string(buf), want)
+		}
+		fi, err := os.Stat(filepath.Join(dir, "dir/foo"))
+		ok(t, err)
+		eq(t, fi.Mode().Perm(), os.FileMode(0640))
+
+		// Extraction should fail for entries that would be written outside the
+		// destination directory.
+		for _, entries := range [][]archiveEntry{
+			{{name: "../escape", data: "x"}},
+			{{name: "a/../../escape", data: "x"}},
+			{{name: "link", link: "../.."}},
+			{{name: "link", link: "/tmp"}},
+			{{name: "sub/"}, {name: "sub/link", link: "."}, {name: "sub/link/escape", data: "x"}},
+			// Lexically "e" points to the destination directory, but since "d" is
+			// a link, it really points to the parent directory.
+			{{name: "d", link: "."}, {name: "e", link: "d/.."}, {name: "e/escape", data: "x"}},
+			{{name: "e", link: "d/.."}, {name: "d", link: "."}},
+		} {
+			ok(t, os.Remove(archive))
+			test.write(t, archive, entries...)
+			setsErr(t, sh, func() { test.extract(archive) })
+		}
+		ok(t, os.Remove(archive))
+		if _, err := os.Stat(filepath.Join(tmpDir, "escape")); !os.IsNotExist(err) {
+			t.Fatalf("got %v, expected IsNotExist", err)
+		}
+	}
+
+	// Cleanup should delete the extracted files.
+	sh2 := gosh.NewShell(t)
+	archive := filepath.Join(tmpDir, "archive")
+	writeTarGz(t, archive, archiveEntry{name: "foo", data: "foo"})
+	dir := sh2.ExtractTarGz(archive)
+	sh2.Cleanup()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("got %v, expected IsNotExist", err)
+	}
+}
+
 func TestShellWait(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
@@ -325,523 +616,2782 @@ func TestShellWait(t *testing.T) {
 	sh.Wait()
 }
 
-// Tests that Shell.Ok panics under various conditions.
-func TestOkPanics(t *testing.T) {
-	func() { // errDidNotCallNewShell
-		sh := gosh.Shell{}
-		defer func() { neq(t, recover(), nil) }()
-		sh.Ok()
-	}()
-	func() { // errShellErrIsNotNil
-		sh := gosh.NewShell(t)
-		sh.ContinueOnError = true
-		defer sh.Cleanup()
-		sh.Err = fakeError
-		defer func() { neq(t, recover(), nil) }()
-		sh.Ok()
-	}()
-	func() { // errAlreadyCalledCleanup
-		sh := gosh.NewShell(t)
-		sh.ContinueOnError = true
-		sh.Cleanup()
-		defer func() { neq(t, recover(), nil) }()
-		sh.Ok()
-	}()
-}
+func TestDryRun(t *testing.T) {
+	tb := &customTB{t: t, buf: &bytes.Buffer{}}
+	sh := gosh.NewShell(tb)
+	defer sh.Cleanup()
+	sh.DryRun = true
+	dir := sh.MakeTempDir()
+	file := filepath.Join(dir, "file")
 
-// Tests that Shell.HandleError panics under various conditions.
-func TestHandleErrorPanics(t *testing.T) {
-	func() { // errDidNotCallNewShell
-		sh := gosh.Shell{}
-		defer func() { neq(t, recover(), nil) }()
-		sh.HandleError(fakeError)
-	}()
-	func() { // errShellErrIsNotNil
-		sh := gosh.NewShell(t)
-		sh.ContinueOnError = true
-		defer sh.Cleanup()
-		sh.Err = fakeError
-		defer func() { neq(t, recover(), nil) }()
-		sh.HandleError(fakeError)
-	}()
-	func() { // errAlreadyCalledCleanup
-		sh := gosh.NewShell(t)
-		sh.ContinueOnError = true
-		sh.Cleanup()
-		defer func() { neq(t, recover(), nil) }()
-		sh.HandleError(fakeError)
-	}()
+	// The command is logged, but not run.
+	c := sh.FuncCmd(writeFileFunc, file)
+	c.Dir = dir
+	c.Vars["GOSH_TEST_VAR"] = "foo"
+	eq(t, c.Stdout(), "")
+	ok(t, sh.Err)
+	eq(t, c.Pid(), -1)
+	_, err := os.Stat(file)
+	eq(t, os.IsNotExist(err), true)
+	log := tb.buf.String()
+	eq(t, strings.Contains(log, "gosh: dry run: "+c.Path), true)
+	eq(t, strings.Contains(log, fmt.Sprintf("dir=%q", dir)), true)
+	eq(t, strings.Contains(log, `GOSH_TEST_VAR="foo"`), true)
+
+	// Signal and AwaitVars succeed, and Wait returns immediately.
+	c = sh.FuncCmd(sleepFunc, time.Hour, 1)
+	c.Start()
+	eq(t, c.AwaitVars("ready"), map[string]string{})
+	c.Signal(os.Interrupt)
+	c.Wait()
+	ok(t, sh.Err)
+	setsErr(t, sh, func() { c.Signal(os.Interrupt) })
 }
 
-// Tests that Shell.Cleanup panics under various conditions.
-func TestCleanupPanics(t *testing.T) {
-	func() { // errDidNotCallNewShell
-		sh := gosh.Shell{}
-		defer func() { neq(t, recover(), nil) }()
-		sh.Cleanup()
-	}()
-}
+var writeFileFunc = gosh.RegisterFunc("writeFileFunc", func(name string) error {
+	return ioutil.WriteFile(name, nil, 0600)
+})
 
-// Tests that Shell.Cleanup succeeds even if sh.Err is not nil.
-func TestCleanupAfterError(t *testing.T) {
+func TestCmdFromString(t *testing.T) {
 	sh := gosh.NewShell(t)
-	sh.Err = fakeError
-	sh.Cleanup()
-}
+	defer sh.Cleanup()
 
-// Tests that Shell.Cleanup can be called multiple times.
-func TestMultipleCleanup(t *testing.T) {
-	sh := gosh.NewShell(t)
-	sh.Cleanup()
-	sh.Cleanup()
+	c := sh.CmdFromString(`echo -n  "a  b" 'c'\ d`)
+	eq(t, c.Args[1:], []string{"-n", "a  b", "c d"})
+	eq(t, c.Stdout(), "a  b c d")
+
+	setsErr(t, sh, func() { sh.CmdFromString("") })
+	setsErr(t, sh, func() { sh.CmdFromString(`echo "a`) })
 }
 
-// Tests that Shell.HandleError logs errors using an appropriate runtime.Caller
-// skip value.
-func TestHandleErrorLogging(t *testing.T) {
-	tb := &customTB{t: t, buf: &bytes.Buffer{}}
-	sh := gosh.NewShell(tb)
-	defer sh.Cleanup()
+var getenvFunc = gosh.RegisterFunc("getenvFunc", func(key string) {
+	fmt.Print(os.Getenv(key))
+})
 
-	// Call HandleError, then check that the stack trace and error got logged.
-	tb.Reset()
-	sh.HandleError(fakeError)
-	_, file, line, _ := runtime.Caller(0)
-	got, wantSuffix := tb.buf.String(), fmt.Sprintf("%s:%d: %v\n", filepath.Base(file), line-1, fakeError)
-	if !strings.HasSuffix(got, wantSuffix) {
-		t.Fatalf("got %v, want suffix %v", got, wantSuffix)
-	}
-	if got == wantSuffix {
-		t.Fatalf("missing stack trace: %v", got)
-	}
-	sh.Err = nil
+func TestPushVarsPopVars(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
 
-	// Same as above, but with ContinueOnError set to true. Only the error should
-	// get logged.
+	sh.Vars["FOO"] = "foo"
+	delete(sh.Vars, "BAR")
+	sh.PushVars(map[string]string{"FOO": "foo1", "BAR": "bar1"})
+	eq(t, sh.FuncCmd(getenvFunc, "FOO").Stdout(), "foo1")
+	eq(t, sh.FuncCmd(getenvFunc, "BAR").Stdout(), "bar1")
+	sh.PushVars(map[string]string{"FOO": "foo2"})
+	eq(t, sh.FuncCmd(getenvFunc, "FOO").Stdout(), "foo2")
+	// Changes to other vars are preserved by PopVars.
+	sh.Vars["BAZ"] = "baz"
+	sh.PopVars()
+	eq(t, sh.Vars["FOO"], "foo1")
+	eq(t, sh.Vars["BAZ"], "baz")
+	sh.PopVars()
+	eq(t, sh.Vars["FOO"], "foo")
+	_, ok := sh.Vars["BAR"]
+	eq(t, ok, false)
+
+	// The next sh.PopVars() will fail.
+	setsErr(t, sh, func() { sh.PopVars() })
+
+	// PopVars works even if Shell.Err is set, e.g. when deferred.
 	sh.ContinueOnError = true
-	tb.Reset()
-	sh.HandleError(fakeError)
-	_, file, line, _ = runtime.Caller(0)
-	got, want := tb.buf.String(), fmt.Sprintf("%s:%d: %v\n", filepath.Base(file), line-1, fakeError)
-	eq(t, got, want)
-	sh.Err = nil
-
-	// Same as above, but calling HandleErrorWithSkip, with skip set to 1.
-	tb.Reset()
-	sh.HandleErrorWithSkip(fakeError, 1)
-	_, file, line, _ = runtime.Caller(0)
-	got, want = tb.buf.String(), fmt.Sprintf("%s:%d: %v\n", filepath.Base(file), line-1, fakeError)
-	eq(t, got, want)
-	sh.Err = nil
-
-	// Same as above, but with skip set to 2.
-	tb.Reset()
-	sh.HandleErrorWithSkip(fakeError, 2)
-	_, file, line, _ = runtime.Caller(1)
-	got, want = tb.buf.String(), fmt.Sprintf("%s:%d: %v\n", filepath.Base(file), line, fakeError)
-	eq(t, got, want)
+	sh.PushVars(map[string]string{"FOO": "foo1"})
+	sh.HandleError(errors.New("fake error"))
+	sh.PopVars()
+	eq(t, sh.Vars["FOO"], "foo")
+	sh.PopVars()
+	eq(t, sh.Err.Error(), "fake error")
 	sh.Err = nil
 }
 
-////////////////////////////////////////////////////////////////////////////////
-// Cmd tests
+func TestExpandVars(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	sh.Vars["GOSH_TEST_A"] = "a"
+
+	// By default, references are not expanded.
+	c := sh.FuncCmd(echoFunc)
+	c.Args = append(c.Args, "${GOSH_TEST_A}")
+	eq(t, c.Stdout(), "${GOSH_TEST_A}\n")
+
+	// References in args and vars are expanded against Shell.Vars.
+	sh.ExpandVars = gosh.ExpandLoose
+	c = sh.FuncCmd(echoFunc)
+	c.Args = append(c.Args, "${GOSH_TEST_A}-$${GOSH_TEST_A}-${GOSH_TEST_UNDEFINED}-$GOSH_TEST_A-${}")
+	eq(t, c.Stdout(), "a-${GOSH_TEST_A}--$GOSH_TEST_A-${}\n")
+	eq(t, c.Args[len(c.Args)-1], "${GOSH_TEST_A}-$${GOSH_TEST_A}-${GOSH_TEST_UNDEFINED}-$GOSH_TEST_A-${}")
+	c = sh.FuncCmd(getenvFunc, "GOSH_TEST_B")
+	c.Vars["GOSH_TEST_B"] = "${GOSH_TEST_A}b"
+	eq(t, c.Stdout(), "ab")
+
+	// In strict mode, references to undefined vars are an error.
+	sh.ExpandVars = gosh.ExpandStrict
+	c = sh.FuncCmd(echoFunc)
+	c.Args = append(c.Args, "${GOSH_TEST_A}")
+	eq(t, c.Stdout(), "a\n")
+	c = sh.FuncCmd(echoFunc)
+	c.Args = append(c.Args, "${GOSH_TEST_UNDEFINED}")
+	setsErr(t, sh, func() { c.Run() })
+	c = sh.FuncCmd(getenvFunc, "GOSH_TEST_B")
+	c.Vars["GOSH_TEST_B"] = "${GOSH_TEST_UNDEFINED}"
+	setsErr(t, sh, func() { c.Run() })
+}
 
-const (
-	helloWorldPkg = "v.io/x/lib/gosh/internal/hello_world"
-	helloWorldStr = "Hello, world!\n"
-)
+func TestInheritVars(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	sh.Vars["GOSH_TEST_A"] = "a"
+	sh.Vars["GOSH_TEST_B"] = "b"
+
+	getenv := func(key string, inherit func(string) bool, vars map[string]string) string {
+		c := sh.FuncCmd(getenvFunc, key)
+		c.InheritVars = inherit
+		for k, v := range vars {
+			c.Vars[k] = v
+		}
+		return c.Clone().Stdout()
+	}
+	eq(t, getenv("GOSH_TEST_A", nil, nil), "a")
+	eq(t, getenv("GOSH_TEST_A", gosh.InheritNone(), nil), "")
+	eq(t, getenv("GOSH_TEST_A", gosh.InheritOnly("GOSH_TEST_A"), nil), "a")
+	eq(t, getenv("GOSH_TEST_B", gosh.InheritOnly("GOSH_TEST_A"), nil), "")
+	eq(t, getenv("GOSH_TEST_A", gosh.InheritExcept("GOSH_TEST_A"), nil), "")
+	eq(t, getenv("GOSH_TEST_B", gosh.InheritExcept("GOSH_TEST_A"), nil), "b")
+
+	// Vars set on the Cmd are always passed.
+	eq(t, getenv("GOSH_TEST_A", gosh.InheritNone(), map[string]string{"GOSH_TEST_A": "x"}), "x")
+	eq(t, getenv("GOSH_TEST_C", gosh.InheritNone(), map[string]string{"GOSH_TEST_C": "c"}), "c")
+}
 
-// Mirrors ExampleCmd in internal/gosh_example/main.go.
-func TestCmd(t *testing.T) {
+func TestIntercept(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	// Start server.
-	binDir := sh.MakeTempDir()
-	binPath := gosh.BuildGoPkg(sh, binDir, "v.io/x/lib/gosh/internal/gosh_example_server")
-	c := sh.Cmd(binPath)
+	// The executable need not exist.
+	const name = "gosh-test-nonexistent"
+	sh.Intercept(name, nil, gosh.CannedOutput("out", "err", 0))
+	sh.Intercept(name, []string{"fail"}, gosh.CannedOutput("", "failed", 3))
+	c := sh.Cmd(name, "foo")
+	stdout, stderr := c.StdoutStderr()
+	eq(t, stdout, "out")
+	eq(t, stderr, "err")
+	eq(t, c.ExitCode(), 0)
+	eq(t, c.Pid(), -1)
+
+	// The most recently registered matching interceptor is used.
+	c = sh.Cmd(name, "fail", "foo")
+	setsErr(t, sh, func() { c.Run() })
+	eq(t, c.ExitCode(), 3)
+	c = sh.Cmd(name, "fail")
+	c.ExitErrorIsOk = true
+	eq(t, c.CombinedOutput(), "failed")
+	eq(t, c.ExitCode(), 3)
+
+	// Interceptors may read stdin, and match by path.
+	cat := sh.Cmd("cat")
+	sh.Intercept(cat.Path, nil, func(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+		fmt.Fprint(stdout, strings.Join(args[1:], " ")+":")
+		io.Copy(stdout, stdin)
+		return 0
+	})
+	c = sh.Cmd("cat", "a", "b")
+	c.SetStdinReader(strings.NewReader("foo"))
+	eq(t, c.Stdout(), "a b:foo")
+	c = sh.Cmd("cat")
+	stdin := c.StdinPipe()
+	stdoutPipe := c.StdoutPipe()
 	c.Start()
-	addr := c.AwaitVars("addr")["addr"]
-	neq(t, addr, "")
+	stdin.Write([]byte("bar"))
+	stdin.Close()
+	out, err := ioutil.ReadAll(stdoutPipe)
+	ok(t, err)
+	eq(t, string(out), ":bar")
+	c.Wait()
+	ok(t, sh.Err)
 
-	// Run client.
-	binPath = gosh.BuildGoPkg(sh, binDir, "v.io/x/lib/gosh/internal/gosh_example_client")
-	c = sh.Cmd(binPath, "-addr="+addr)
-	eq(t, c.Stdout(), helloWorldStr)
+	// Commands that don't match are not intercepted.
+	c = sh.FuncCmd(printFunc, "baz")
+	eq(t, c.Stdout(), "baz")
 }
 
-var (
-	getFunc   = gosh.RegisterFunc("getFunc", lib.Get)
-	serveFunc = gosh.RegisterFunc("serveFunc", lib.Serve)
-)
+func TestCmdEventLogger(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
 
-// Mirrors ExampleFuncCmd in internal/gosh_example/main.go.
-func TestFuncCmd(t *testing.T) {
+	var mu sync.Mutex
+	var events []gosh.CmdEvent
+	sh.CmdEventLogger = func(e gosh.CmdEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+	c := sh.FuncCmd(sleepFunc, time.Hour, 1)
+	c.Vars["GOSH_TEST_VAR"] = "foo"
+	c.Start()
+	c.AwaitVars("ready")
+	c.Terminate(os.Interrupt)
+
+	mu.Lock()
+	eq(t, len(events), 3)
+	for _, e := range events {
+		eq(t, e.Cmd, c)
+		neq(t, e.String(), "")
+	}
+	eq(t, events[0].Type, gosh.CmdStarted)
+	eq(t, events[0].SetVars["GOSH_TEST_VAR"], "foo")
+	eq(t, events[1].Type, gosh.CmdSignaled)
+	eq(t, events[1].Signal, os.Interrupt)
+	eq(t, events[2].Type, gosh.CmdExited)
+	eq(t, events[2].ExitCode, 0)
+	ok(t, events[2].Err)
+	eq(t, events[2].Duration > 0, true)
+	events = nil
+	mu.Unlock()
+
+	// Intercepted and dry-run commands are reported too.
+	const name = "gosh-test-nonexistent"
+	sh.Intercept(name, nil, gosh.CannedOutput("", "", 3))
+	c = sh.Cmd(name)
+	c.ExitErrorIsOk = true
+	c.Run()
+	sh.DryRun = true
+	sh.Cmd(name).Run()
+	sh.DryRun = false
+
+	mu.Lock()
+	defer mu.Unlock()
+	eq(t, len(events), 4)
+	eq(t, events[0].Type, gosh.CmdStarted)
+	eq(t, events[1].Type, gosh.CmdExited)
+	eq(t, events[1].ExitCode, 3)
+	nok(t, events[1].Err)
+	eq(t, events[2].Type, gosh.CmdStarted)
+	eq(t, events[3].Type, gosh.CmdExited)
+	eq(t, events[3].ExitCode, 0)
+	ok(t, events[3].Err)
+}
+
+func TestTracer(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	// Start server.
-	c := sh.FuncCmd(serveFunc)
+	var mu sync.Mutex
+	var events []string
+	record := func(c *gosh.Cmd, event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	sh.Tracer = gosh.Tracer{
+		CmdCreated: func(c *gosh.Cmd) { record(c, "created") },
+		CmdStarted: func(c *gosh.Cmd) { record(c, "started") },
+		CmdReady:   func(c *gosh.Cmd) { record(c, "ready") },
+		CmdSignaled: func(c *gosh.Cmd, sig os.Signal) {
+			record(c, fmt.Sprintf("signaled %v", sig))
+		},
+		CmdExited: func(c *gosh.Cmd, err error) {
+			record(c, fmt.Sprintf("exited %v", err))
+		},
+	}
+	c := sh.FuncCmd(sleepFunc, time.Hour, 1)
 	c.Start()
-	addr := c.AwaitVars("addr")["addr"]
-	neq(t, addr, "")
+	c.AwaitVars("ready")
+	c.AwaitVars("ready")
+	c.Terminate(os.Interrupt)
+	// Clones and failed commands are traced too.
+	setsErr(t, sh, func() { sh.FuncCmd(exitFunc, 1).Clone().Run() })
+
+	mu.Lock()
+	defer mu.Unlock()
+	eq(t, events, []string{"created", "started", "ready", "signaled interrupt", "exited <nil>", "created", "created", "started", "exited exit status 1"})
+}
 
-	// Run client.
-	c = sh.FuncCmd(getFunc, addr)
-	eq(t, c.Stdout(), helloWorldStr)
+func TestShellTerminateAll(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c0 := sh.FuncCmd(sleepFunc, time.Hour, 1)        // running
+	c1 := sh.FuncCmd(sleepFunc, time.Duration(0), 1) // exited with failure
+	c2 := sh.FuncCmd(sleepFunc, time.Hour, 1)        // running
+	c3 := sh.FuncCmd(sleepFunc, time.Duration(0), 0) // not started
+	c4 := sh.FuncCmd(sleepFunc, time.Duration(0), 0) // called wait
+	for _, c := range []*gosh.Cmd{c0, c1, c2} {
+		c.Start()
+		c.AwaitVars("ready")
+	}
+	c4.Run()
+	sh.TerminateAll(os.Interrupt)
+	ok(t, sh.Err)
+	eq(t, c0.ExitCode(), 0)
+	eq(t, c1.ExitCode(), 1)
+	eq(t, c2.ExitCode(), 0)
+	eq(t, c3.ExitCode(), -1)
+
+	// It should be possible to start new commands afterwards.
+	sh.FuncCmd(sleepFunc, time.Duration(0), 0).Run()
+	sh.TerminateAll(os.Interrupt)
+	ok(t, sh.Err)
 }
 
-// Tests that Shell.Cmd uses Shell.Vars["PATH"] to locate executables with
-// relative names.
-func TestLookPath(t *testing.T) {
+// barrierFunc creates a file in dir, then waits until n files exist in dir.  It
+// only succeeds if n children run it concurrently with the same dir.
+var barrierFunc = gosh.RegisterFunc("barrierFunc", func(dir string, n int) error {
+	f, err := ioutil.TempFile(dir, "")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	for deadline := time.Now().Add(time.Minute); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		if len(infos) >= n {
+			return nil
+		}
+	}
+	return errors.New("timed out waiting for other children")
+})
+
+func TestRunGroup(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	binDir := sh.MakeTempDir()
-	sh.Vars["PATH"] = binDir + ":" + sh.Vars["PATH"]
-	relName := "hw"
-	absName := filepath.Join(binDir, relName)
-	gosh.BuildGoPkg(sh, "", helloWorldPkg, "-o", absName)
-	c := sh.Cmd(relName)
-	eq(t, c.Stdout(), helloWorldStr)
+	// All commands succeed, and run concurrently; each one only exits once all of
+	// them have started.
+	dir := sh.MakeTempDir()
+	errs := sh.RunGroup(sh.FuncCmd(barrierFunc, dir, 3), sh.FuncCmd(barrierFunc, dir, 3), sh.FuncCmd(barrierFunc, dir, 3))
+	eq(t, errs, []error{nil, nil, nil})
+	ok(t, sh.Err)
 
-	// Test the case where we cannot find the executable.
-	sh.Vars["PATH"] = ""
-	setsErr(t, sh, func() { sh.Cmd("yes") })
+	// One command fails to start, and one fails to run; the others still run.
+	c0 := sh.FuncCmd(exitFunc, 0)
+	c1 := sh.Cmd("/#invalid#/!binary!")
+	c2 := sh.FuncCmd(exitFunc, 1)
+	c3 := sh.FuncCmd(exitFunc, 0)
+	sh.ContinueOnError = true
+	errs = sh.RunGroup(c0, c1, c2, c3)
+	nok(t, sh.Err)
+	groupErr, isGroupErr := sh.Err.(*gosh.GroupError)
+	eq(t, isGroupErr, true)
+	eq(t, groupErr.Errs, errs)
+	eq(t, len(errs), 4)
+	ok(t, errs[0])
+	nok(t, errs[1])
+	nok(t, errs[2])
+	ok(t, errs[3])
+	ok(t, c0.Err)
+	eq(t, c1.Err, errs[1])
+	eq(t, c2.Err, errs[2])
+	ok(t, c3.Err)
+	sh.Err = nil
+
+	// Exit errors are ignored for commands with ExitErrorIsOk.
+	c2 = sh.FuncCmd(exitFunc, 1)
+	c2.ExitErrorIsOk = true
+	errs = sh.RunGroup(sh.FuncCmd(exitFunc, 0), c2)
+	ok(t, sh.Err)
+	eq(t, errs, []error{nil, nil})
+	nok(t, c2.Err)
 }
 
-var (
-	sendVarsFunc = gosh.RegisterFunc("sendVarsFunc", func(vars map[string]string) {
-		gosh.SendVars(vars)
-		time.Sleep(time.Hour)
+func TestCloneN(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Each clone may be tweaked.
+	bufs := make([]*bytes.Buffer, 3)
+	f := sh.Cmd("echo").CloneN(3, func(i int, c *gosh.Cmd) {
+		c.Args = append(c.Args, strconv.Itoa(i))
+		bufs[i] = &bytes.Buffer{}
+		c.AddStdoutWriter(bufs[i])
 	})
-	stderrFunc = gosh.RegisterFunc("stderrFunc", func(s string) {
-		fmt.Fprintf(os.Stderr, s)
-		time.Sleep(time.Hour)
+	eq(t, len(f.Cmds()), 3)
+	f.Run()
+	for i, buf := range bufs {
+		eq(t, buf.String(), fmt.Sprintf("%d\n", i))
+	}
+
+	// The fleet may be started and terminated together.
+	f = sh.FuncCmd(sleepFunc, time.Hour, 1).CloneN(2, nil)
+	f.Start()
+	for _, c := range f.Cmds() {
+		c.AwaitVars("ready")
+	}
+	f.Terminate(os.Interrupt)
+	for _, c := range f.Cmds() {
+		eq(t, c.ExitCode(), 0)
+	}
+
+	// Wait fails if any command fails.
+	f = sh.FuncCmd(exitFunc, 1).CloneN(2, func(i int, c *gosh.Cmd) {
+		c.ExitErrorIsOk = i == 0
 	})
-)
+	f.Start()
+	sh.ContinueOnError = true
+	f.Wait()
+	groupErr, isGroupErr := sh.Err.(*gosh.GroupError)
+	eq(t, isGroupErr, true)
+	ok(t, groupErr.Errs[0])
+	nok(t, groupErr.Errs[1])
+	eq(t, f.Cmds()[1].Err, groupErr.Errs[1])
+	sh.Err = nil
+	sh.ContinueOnError = false
+}
 
-// Tests that AwaitVars works under various conditions.
-func TestAwaitVars(t *testing.T) {
+func TestPool(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	c := sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
-	c.Start()
-	eq(t, c.AwaitVars("a")["a"], "1")
+	// At most n commands run at a time.
+	d := 300 * time.Millisecond
+	start := time.Now()
+	p := sh.Pool(2)
+	for i := 0; i < 6; i++ {
+		p.Add(sh.FuncCmd(sleepFunc, d, 0))
+	}
+	res := p.Wait()
+	eq(t, len(res), 6)
+	for _, r := range res {
+		ok(t, r.Err)
+	}
+	eq(t, time.Since(start) >= 3*d, true)
+
+	// Results are received as commands complete, and commands are started in
+	// the order in which they were added.
+	p = sh.Pool(1)
+	c0, c1 := sh.FuncCmd(exitFunc, 0), sh.FuncCmd(exitFunc, 1)
+	p.Add(c0, c1)
+	p.Close()
+	var got []gosh.PoolResult
+	for r := range p.Results() {
+		got = append(got, r)
+	}
+	eq(t, len(got), 2)
+	eq(t, got[0].Cmd, c0)
+	ok(t, got[0].Err)
+	eq(t, got[1].Cmd, c1)
+	nok(t, got[1].Err)
+	eq(t, c1.Err, got[1].Err)
+	eq(t, len(p.Wait()), 0)
+
+	// Add fails once the pool is closed.
+	setsErr(t, sh, func() { p.Add(sh.FuncCmd(exitFunc, 0)) })
+
+	// Wait fails if any command fails.
+	p = sh.Pool(3)
+	p.Add(sh.FuncCmd(exitFunc, 0), sh.FuncCmd(exitFunc, 1))
+	sh.ContinueOnError = true
+	res = p.Wait()
+	groupErr, isGroupErr := sh.Err.(*gosh.GroupError)
+	eq(t, isGroupErr, true)
+	eq(t, len(groupErr.Errs), 2)
+	eq(t, len(res), 2)
+	sh.Err = nil
+	sh.ContinueOnError = false
+
+	// The pool requires a positive number of concurrent commands.
+	setsErr(t, sh, func() { sh.Pool(0) })
+
+	// Results that are not received by the time of Cleanup are discarded, rather
+	// than blocking the workers forever.
+	sh2 := gosh.NewShell(t)
+	p = sh2.Pool(1)
+	c0, c1 = sh2.FuncCmd(exitFunc, 0), sh2.FuncCmd(exitFunc, 0)
+	exited := make(chan struct{})
+	c1.OnExit(func(error) { close(exited) })
+	p.Add(c0, c1, sh2.FuncCmd(exitFunc, 0))
+	<-exited
+	sh2.Cleanup()
+	got = nil
+	for r := range p.Results() {
+		got = append(got, r)
+	}
+	eq(t, len(got), 1)
+	eq(t, got[0].Cmd, c0)
+}
 
-	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1","b":"2"}goshVars>`)
-	c.Start()
-	vars := c.AwaitVars("a", "b")
-	eq(t, vars["a"], "1")
-	eq(t, vars["b"], "2")
+func TestMap(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
 
-	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1"}goshVars><gosh`)
-	c.Start()
-	eq(t, c.AwaitVars("a")["a"], "1")
+	res := sh.Map([]string{"a", "b"}, func(in string) *gosh.Cmd {
+		return sh.FuncCmd(printFunc, in)
+	})
+	eq(t, len(res), 2)
+	eq(t, res[0].Stdout, "a")
+	eq(t, res[1].Stdout, "b")
+
+	// Exit errors are returned in the results. Commands run concurrently.
+	d := time.Second
+	start := time.Now()
+	res = sh.MapParallel(3, []string{"0", "1", "2"}, func(in string) *gosh.Cmd {
+		code, err := strconv.Atoi(in)
+		ok(t, err)
+		return sh.FuncCmd(sleepFunc, d, code)
+	})
+	eq(t, time.Since(start) < 3*d, true)
+	ok(t, sh.Err)
+	for i, r := range res {
+		eq(t, r.ExitCode, i)
+		eq(t, r.Err != nil, i != 0)
+	}
 
-	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1"}goshVars><goshVars{"b":"2"}goshVars>`)
-	c.Start()
-	vars = c.AwaitVars("a", "b")
-	eq(t, vars["a"], "1")
-	eq(t, vars["b"], "2")
+	// Other errors are reported once all commands have run.
+	sh.ContinueOnError = true
+	res = sh.MapParallel(2, []string{"/#invalid#/!binary!", ""}, func(in string) *gosh.Cmd {
+		if in == "" {
+			return sh.FuncCmd(printFunc, "ok")
+		}
+		return sh.Cmd(in)
+	})
+	groupErr, isGroupErr := sh.Err.(*gosh.GroupError)
+	eq(t, isGroupErr, true)
+	nok(t, groupErr.Errs[0])
+	ok(t, groupErr.Errs[1])
+	eq(t, res[1].Stdout, "ok")
+	sh.Err = nil
+	sh.ContinueOnError = false
+}
 
-	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1","b":"2"}goshVars>`)
-	c.Start()
-	vars = c.AwaitVars("a")
-	eq(t, vars["a"], "1")
-	eq(t, vars["b"], "")
-	vars = c.AwaitVars("b")
-	eq(t, vars["a"], "")
-	eq(t, vars["b"], "2")
+func TestSentinelErrors(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	sh.ContinueOnError = true
+
+	check := func(target error) {
+		t.Helper()
+		if !errors.Is(sh.Err, target) {
+			t.Errorf("got error %v, want %v", sh.Err, target)
+		}
+		sh.Err = nil
+	}
 
-	c = sh.FuncCmd(stderrFunc, `<g<goshVars{"a":"goshVars"}goshVars>s><goshVars`)
+	c := sh.FuncCmd(exitFunc, 0)
+	c.Signal(os.Interrupt)
+	check(gosh.ErrDidNotCallStart)
 	c.Start()
-	eq(t, c.AwaitVars("a")["a"], "goshVars")
+	c.AwaitVars("x")
+	check(gosh.ErrProcessExited)
+	c.Start()
+	check(gosh.ErrAlreadyCalledStart)
+	c.Wait()
+	c.Signal(os.Interrupt)
+	check(gosh.ErrAlreadyCalledWait)
 
-	c = sh.FuncCmd(stderrFunc, `<<goshVars{"a":"1"}goshVars>><<goshVars{"b":"<goshVars"}goshVars>>`)
+	// Errors that add detail wrap the sentinel errors.
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
 	c.Start()
-	vars = c.AwaitVars("a", "b")
-	eq(t, vars["a"], "1")
-	eq(t, vars["b"], "<goshVars")
+	c.WaitFor(10 * time.Millisecond)
+	check(gosh.ErrTimedOut)
+	sh.DefaultTimeout = 10 * time.Millisecond
+	c.Wait()
+	eq(t, strings.Contains(sh.Err.Error(), "Shell.DefaultTimeout"), true)
+	check(gosh.ErrTimedOut)
+	sh.DefaultTimeout = 0
+	c.Terminate(os.Interrupt)
+	ok(t, sh.Err)
 }
 
-// Tests that AwaitVars returns immediately when the process exits.
-func TestAwaitVarsProcessExit(t *testing.T) {
+// Tests that Shell.Ok panics under various conditions.
+func TestOkPanics(t *testing.T) {
+	func() { // ErrDidNotCallNewShell
+		sh := gosh.Shell{}
+		defer func() { neq(t, recover(), nil) }()
+		sh.Ok()
+	}()
+	func() { // errShellErrIsNotNil
+		sh := gosh.NewShell(t)
+		sh.ContinueOnError = true
+		defer sh.Cleanup()
+		sh.Err = fakeError
+		defer func() { neq(t, recover(), nil) }()
+		sh.Ok()
+	}()
+	func() { // ErrAlreadyCalledCleanup
+		sh := gosh.NewShell(t)
+		sh.ContinueOnError = true
+		sh.Cleanup()
+		defer func() { neq(t, recover(), nil) }()
+		sh.Ok()
+	}()
+}
+
+// Tests that Shell.HandleError panics under various conditions.
+func TestHandleErrorPanics(t *testing.T) {
+	func() { // ErrDidNotCallNewShell
+		sh := gosh.Shell{}
+		defer func() { neq(t, recover(), nil) }()
+		sh.HandleError(fakeError)
+	}()
+	func() { // errShellErrIsNotNil
+		sh := gosh.NewShell(t)
+		sh.ContinueOnError = true
+		defer sh.Cleanup()
+		sh.Err = fakeError
+		defer func() { neq(t, recover(), nil) }()
+		sh.HandleError(fakeError)
+	}()
+	func() { // ErrAlreadyCalledCleanup
+		sh := gosh.NewShell(t)
+		sh.ContinueOnError = true
+		sh.Cleanup()
+		defer func() { neq(t, recover(), nil) }()
+		sh.HandleError(fakeError)
+	}()
+}
+
+// Tests that Shell.Cleanup panics under various conditions.
+func TestCleanupPanics(t *testing.T) {
+	func() { // ErrDidNotCallNewShell
+		sh := gosh.Shell{}
+		defer func() { neq(t, recover(), nil) }()
+		sh.Cleanup()
+	}()
+}
+
+// Tests that Shell.Cleanup succeeds even if sh.Err is not nil.
+func TestCleanupAfterError(t *testing.T) {
 	sh := gosh.NewShell(t)
+	sh.Err = fakeError
+	sh.Cleanup()
+}
+
+// Tests that Shell.Cleanup can be called multiple times.
+func TestMultipleCleanup(t *testing.T) {
+	sh := gosh.NewShell(t)
+	sh.Cleanup()
+	sh.Cleanup()
+}
+
+// Tests that Shell.HandleError logs errors using an appropriate runtime.Caller
+// skip value.
+func TestHandleErrorLogging(t *testing.T) {
+	tb := &customTB{t: t, buf: &bytes.Buffer{}}
+	sh := gosh.NewShell(tb)
 	defer sh.Cleanup()
 
-	c := sh.FuncCmd(exitFunc, 0)
-	c.Start()
-	setsErr(t, sh, func() { c.AwaitVars("foo") })
+	// Call HandleError, then check that the stack trace and error got logged.
+	tb.Reset()
+	sh.HandleError(fakeError)
+	_, file, line, _ := runtime.Caller(0)
+	got, wantSuffix := tb.buf.String(), fmt.Sprintf("%s:%d: %v\n", filepath.Base(file), line-1, fakeError)
+	if !strings.HasSuffix(got, wantSuffix) {
+		t.Fatalf("got %v, want suffix %v", got, wantSuffix)
+	}
+	if got == wantSuffix {
+		t.Fatalf("missing stack trace: %v", got)
+	}
+	sh.Err = nil
+
+	// Same as above, but with ContinueOnError set to true. Only the error should
+	// get logged.
+	sh.ContinueOnError = true
+	tb.Reset()
+	sh.HandleError(fakeError)
+	_, file, line, _ = runtime.Caller(0)
+	got, want := tb.buf.String(), fmt.Sprintf("%s:%d: %v\n", filepath.Base(file), line-1, fakeError)
+	eq(t, got, want)
+	sh.Err = nil
+
+	// Same as above, but calling HandleErrorWithSkip, with skip set to 1.
+	tb.Reset()
+	sh.HandleErrorWithSkip(fakeError, 1)
+	_, file, line, _ = runtime.Caller(0)
+	got, want = tb.buf.String(), fmt.Sprintf("%s:%d: %v\n", filepath.Base(file), line-1, fakeError)
+	eq(t, got, want)
+	sh.Err = nil
+
+	// Same as above, but with skip set to 2.
+	tb.Reset()
+	sh.HandleErrorWithSkip(fakeError, 2)
+	_, file, line, _ = runtime.Caller(1)
+	got, want = tb.buf.String(), fmt.Sprintf("%s:%d: %v\n", filepath.Base(file), line, fakeError)
+	eq(t, got, want)
+	sh.Err = nil
 }
 
-// Functions designed for TestRegistry.
-var (
-	printIntsFunc = gosh.RegisterFunc("printIntsFunc", func(v ...int) {
-		var vi []interface{}
-		for _, x := range v {
-			vi = append(vi, x)
-		}
-		fmt.Print(vi...)
-	})
-	printfIntsFunc = gosh.RegisterFunc("printfIntsFunc", func(format string, v ...int) {
-		var vi []interface{}
-		for _, x := range v {
-			vi = append(vi, x)
-		}
-		fmt.Printf(format, vi...)
+// Tests that with CollectErrors, errors are recorded and calls may continue.
+func TestCollectErrors(t *testing.T) {
+	tb := &customTB{t: t, buf: &bytes.Buffer{}}
+	sh := gosh.NewShell(tb)
+	defer sh.Cleanup()
+	sh.CollectErrors = true
+
+	sh.FuncCmd(exitFunc, 1).Run()
+	nok(t, sh.Err)
+	sh.HandleError(fakeError)
+	eq(t, sh.Err, fakeError)
+	sh.FuncCmd(exitFunc, 0).Run()
+	ok(t, sh.Err)
+	eq(t, tb.calledFailNow, false)
+	errs := sh.Errors()
+	eq(t, len(errs), 2)
+	eq(t, errs[1], fakeError)
+	eq(t, strings.Contains(tb.buf.String(), fakeError.Error()), true)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Cmd tests
+
+const (
+	helloWorldPkg = "v.io/x/lib/gosh/internal/hello_world"
+	helloWorldStr = "Hello, world!\n"
+)
+
+// Mirrors ExampleCmd in internal/gosh_example/main.go.
+func TestCmd(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Start server.
+	binDir := sh.MakeTempDir()
+	binPath := gosh.BuildGoPkg(sh, binDir, "v.io/x/lib/gosh/internal/gosh_example_server")
+	c := sh.Cmd(binPath)
+	c.Start()
+	addr := c.AwaitVars("addr")["addr"]
+	neq(t, addr, "")
+
+	// Run client.
+	binPath = gosh.BuildGoPkg(sh, binDir, "v.io/x/lib/gosh/internal/gosh_example_client")
+	c = sh.Cmd(binPath, "-addr="+addr)
+	eq(t, c.Stdout(), helloWorldStr)
+}
+
+var (
+	getFunc   = gosh.RegisterFunc("getFunc", lib.Get)
+	serveFunc = gosh.RegisterFunc("serveFunc", lib.Serve)
+)
+
+// Mirrors ExampleFuncCmd in internal/gosh_example/main.go.
+func TestFuncCmd(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Start server.
+	c := sh.FuncCmd(serveFunc)
+	c.Start()
+	addr := c.AwaitVars("addr")["addr"]
+	neq(t, addr, "")
+
+	// Run client.
+	c = sh.FuncCmd(getFunc, addr)
+	eq(t, c.Stdout(), helloWorldStr)
+}
+
+func TestCmdOpt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	dir, err := filepath.EvalSymlinks(sh.MakeTempDir())
+	ok(t, err)
+	var stdout, stderr bytes.Buffer
+	c := sh.CmdOpt("sh", []string{"-c", "pwd; echo $FOO; read x; echo $x; echo err >&2; exit 3"},
+		gosh.WithDir(dir),
+		gosh.WithVars(map[string]string{"FOO": "bar"}),
+		gosh.WithStdinReader(strings.NewReader("in\n")),
+		gosh.WithStdoutWriter(&stdout),
+		gosh.WithStderrWriter(&stderr),
+		gosh.WithAllowedExitCodes(3))
+	c.Run()
+	eq(t, stdout.String(), dir+"\nbar\nin\n")
+	eq(t, stderr.String(), "err\n")
+	eq(t, c.ExitCode(), 3)
+
+	// If an option fails, no Cmd is returned.
+	r := strings.NewReader("")
+	setsErr(t, sh, func() { c = sh.CmdOpt("sh", nil, gosh.WithStdinReader(r), gosh.WithStdinReader(r)) })
+	eq(t, c == nil, true)
+}
+
+func TestEnvPreview(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("env is not available on windows")
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.Cmd("env")
+	c.Vars["FOO"] = "bar"
+	c.Vars["HOME"] = "/nonexistent"
+	c.ExitAfter = time.Minute
+	env, diff := c.EnvPreview()
+	eq(t, diff.Added["FOO"], "bar")
+	eq(t, diff.Added["GOSH_EXIT_AFTER"], "1m0s")
+	eq(t, diff.Added["GOSH_WATCH_PARENT"], "1")
+	eq(t, diff.Changed["HOME"], gosh.EnvChange{Parent: os.Getenv("HOME"), Child: "/nonexistent"})
+	eq(t, strings.Contains("\n"+diff.String(), "\n+FOO=bar\n"), true)
+	eq(t, strings.Contains("\n"+diff.String(), "\n+HOME=/nonexistent\n"), true)
+
+	// The preview is exactly the environment the child receives.
+	got := strings.Split(strings.TrimSuffix(c.Stdout(), "\n"), "\n")
+	sort.Strings(got)
+	sort.Strings(env)
+	eq(t, got, env)
+
+	// Children spawned via FuncCmd are also told about gosh's pipes.
+	env, diff = sh.FuncCmd(echoFunc).EnvPreview()
+	eq(t, diff.Added["GOSH_VARS_FD"], "3")
+	eq(t, diff.Empty(), false)
+	eq(t, env[len(env)-1], "GOSH_CALLS_FD=4")
+}
+
+// Tests that Shell.Cmd uses Shell.Vars["PATH"] to locate executables with
+// relative names.
+func TestLookPath(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	binDir := sh.MakeTempDir()
+	sh.Vars["PATH"] = binDir + ":" + sh.Vars["PATH"]
+	relName := "hw"
+	absName := filepath.Join(binDir, relName)
+	gosh.BuildGoPkg(sh, "", helloWorldPkg, "-o", absName)
+	c := sh.Cmd(relName)
+	eq(t, c.Stdout(), helloWorldStr)
+
+	// Test the case where we cannot find the executable.
+	sh.Vars["PATH"] = ""
+	setsErr(t, sh, func() { sh.Cmd("yes") })
+}
+
+func TestFastSpawn(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not supported on windows")
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	sh.FastSpawn = true
+
+	dirs := map[string]string{}
+	for _, name := range []string{"one", "two"} {
+		dirs[name] = sh.MakeTempDir()
+		ok(t, ioutil.WriteFile(filepath.Join(dirs[name], "tool"), []byte("#!/bin/sh\necho "+name+"\n"), 0700))
+	}
+
+	// Names are still resolved using the PATH the child will see.
+	sh.Vars["PATH"] = dirs["one"]
+	eq(t, sh.Cmd("tool").Stdout(), "one\n")
+	c := sh.Cmd("tool")
+	c.Vars["PATH"] = dirs["two"]
+	eq(t, c.Stdout(), "two\n")
+
+	// Resolved paths are cached, so a removed executable is not noticed.
+	ok(t, os.Remove(filepath.Join(dirs["one"], "tool")))
+	eq(t, sh.Cmd("tool").Path, filepath.Join(dirs["one"], "tool"))
+
+	// Failures are not cached.
+	sh.Vars["PATH"] = sh.MakeTempDir()
+	setsErr(t, sh, func() { sh.Cmd("tool") })
+	ok(t, ioutil.WriteFile(filepath.Join(sh.Vars["PATH"], "tool"), []byte("#!/bin/sh\necho three\n"), 0700))
+	eq(t, sh.Cmd("tool").Stdout(), "three\n")
+}
+
+// Tests that Shell.Cmd resolves names using the env vars the child will see,
+// and that Shell.LookPath overrides the default resolution.
+func TestLookPathCmdVars(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts are not supported on windows")
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Create two directories, each with a "tool" executable that prints the
+	// directory's name.
+	dirs := map[string]string{}
+	for _, name := range []string{"one", "two"} {
+		dirs[name] = sh.MakeTempDir()
+		ok(t, ioutil.WriteFile(filepath.Join(dirs[name], "tool"), []byte("#!/bin/sh\necho "+name+"\n"), 0700))
+	}
+
+	// Names are resolved using the PATH the child will see.
+	sh.Vars["PATH"] = dirs["one"]
+	eq(t, sh.Cmd("tool").Stdout(), "one\n")
+	c := sh.Cmd("tool")
+	c.Vars["PATH"] = dirs["two"]
+	eq(t, c.Stdout(), "two\n")
+	eq(t, c.Path, filepath.Join(dirs["two"], "tool"))
+	eq(t, c.Args[0], c.Path)
+
+	// An explicitly set Path is not overridden.
+	c = sh.Cmd("tool")
+	c.Path = filepath.Join(dirs["two"], "tool")
+	c.Vars["PATH"] = dirs["one"]
+	eq(t, c.Stdout(), "two\n")
+
+	// Start should fail if the name can no longer be resolved.
+	c = sh.Cmd("tool")
+	c.Vars["PATH"] = sh.MakeTempDir()
+	setsErr(t, sh, func() { c.Run() })
+
+	// Test Shell.LookPath.
+	var gotName string
+	sh.LookPath = func(vars map[string]string, name string) (string, error) {
+		gotName = name
+		return filepath.Join(dirs["two"], name), nil
+	}
+	eq(t, sh.Cmd("tool").Stdout(), "two\n")
+	eq(t, gotName, "tool")
+	sh.LookPath = func(vars map[string]string, name string) (string, error) {
+		return "", errors.New("not found")
+	}
+	setsErr(t, sh, func() { sh.Cmd("tool") })
+}
+
+var (
+	sendVarsFunc = gosh.RegisterFunc("sendVarsFunc", func(vars map[string]string) {
+		gosh.SendVars(vars)
+		time.Sleep(time.Hour)
+	})
+	stderrFunc = gosh.RegisterFunc("stderrFunc", func(s string) {
+		fmt.Fprintf(os.Stderr, s)
+		time.Sleep(time.Hour)
+	})
+)
+
+// Tests that AwaitVars works under various conditions.
+func TestAwaitVars(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "1")
+
+	c = sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1", "b": "2"})
+	c.Start()
+	vars := c.AwaitVars("a")
+	eq(t, vars["a"], "1")
+	eq(t, vars["b"], "")
+	vars = c.AwaitVars("b")
+	eq(t, vars["a"], "")
+	eq(t, vars["b"], "2")
+
+	// FuncCmd children send vars over a dedicated pipe, so vars written to
+	// stderr are ignored.
+	c = sh.FuncCmd(stderrFunc, `<goshVars{"a":"1"}goshVars>`)
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitVarsFor(100*time.Millisecond, "a") })
+}
+
+// Tests that AwaitVars returns immediately when the process exits.
+func TestAwaitVarsProcessExit(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitVars("foo") })
+}
+
+func TestAwaitVarsPartial(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Received vars are returned, and keys that time out are reported missing.
+	c := sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1", "b": "2"})
+	c.Start()
+	start := time.Now()
+	vars, missing := c.AwaitVarsPartial(map[string]time.Duration{"a": 0, "c": 100 * time.Millisecond, "d": 200 * time.Millisecond})
+	eq(t, vars, map[string]string{"a": "1"})
+	eq(t, missing, []string{"c", "d"})
+	eq(t, time.Since(start) >= 200*time.Millisecond, true)
+
+	// All keys are received.
+	vars, missing = c.AwaitVarsPartial(map[string]time.Duration{"a": time.Minute, "b": time.Minute})
+	eq(t, vars, map[string]string{"a": "1", "b": "2"})
+	eq(t, len(missing), 0)
+
+	// If the process exits, keys without timeouts are reported missing rather
+	// than failing.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	vars, missing = c.AwaitVarsPartial(map[string]time.Duration{"a": 0})
+	eq(t, len(vars), 0)
+	eq(t, missing, []string{"a"})
+	c.Wait()
+	setsErr(t, sh, func() { c.AwaitVarsPartial(map[string]time.Duration{"a": 0}) })
+}
+
+var sendTypedVarsFunc = gosh.RegisterFunc("sendTypedVarsFunc", func() {
+	gosh.SendTypedVars(map[string]interface{}{
+		"port": 8080,
+		"ok":   true,
+		"name": "foo",
+		"cfg":  map[string]int{"a": 1},
+	})
+	time.Sleep(time.Hour)
+})
+
+func TestTypedVars(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sendTypedVarsFunc)
+	c.Start()
+	eq(t, c.AwaitVars("port", "ok", "name"), map[string]string{"port": "8080", "ok": "true", "name": "foo"})
+	eq(t, c.AwaitVarInt("port"), 8080)
+	eq(t, c.AwaitVarBool("ok"), true)
+	var name string
+	c.AwaitVarJSON("name", &name)
+	eq(t, name, "foo")
+	var cfg map[string]int
+	c.AwaitVarJSON("cfg", &cfg)
+	eq(t, cfg, map[string]int{"a": 1})
+	setsErr(t, sh, func() { c.AwaitVarInt("name") })
+
+	// Typed getters also work with vars sent via SendVars.
+	c = sh.FuncCmd(sendVarsFunc, map[string]string{"n": "3"})
+	c.Start()
+	eq(t, c.AwaitVarInt("n"), 3)
+	var n string
+	c.AwaitVarJSON("n", &n)
+	eq(t, n, "3")
+}
+
+type progress struct {
+	Done, Total int
+}
+
+func init() {
+	gosh.RegisterMessageType("progress", progress{})
+	gosh.RegisterMessageType("status", "")
+}
+
+var sendMessagesFunc = gosh.RegisterFunc("sendMessagesFunc", func(n int) {
+	for i := 1; i <= n; i++ {
+		gosh.SendMessage("progress", progress{i, n})
+	}
+	gosh.SendMessage("status", "done")
+	time.Sleep(time.Hour)
+})
+
+// Tests that AwaitMessage returns typed messages in the order they were sent.
+func TestAwaitMessage(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sendMessagesFunc, 2)
+	c.Start()
+	// Messages of other kinds are left for subsequent calls.
+	eq(t, c.AwaitMessage("status"), gosh.Message{Kind: "status", Payload: "done"})
+	eq(t, c.AwaitMessage(), gosh.Message{Kind: "progress", Payload: progress{1, 2}})
+	eq(t, c.AwaitMessage("progress").Payload.(progress), progress{2, 2})
+	setsErr(t, sh, func() { c.AwaitMessageFor(100 * time.Millisecond) })
+	c.Terminate(os.Interrupt)
+
+	// AwaitMessage returns immediately when the process exits.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitMessage() })
+
+	// Sending a message of an unregistered kind or the wrong type panics.
+	func() {
+		defer func() { neq(t, recover(), nil) }()
+		gosh.SendMessage("foo", "")
+	}()
+	func() {
+		defer func() { neq(t, recover(), nil) }()
+		gosh.SendMessage("status", 1)
+	}()
+}
+
+func init() {
+	gosh.RegisterHandler("add", func(args []int) (int, error) {
+		sum := 0
+		for _, v := range args {
+			sum += v
+		}
+		return sum, nil
+	})
+	gosh.RegisterHandler("fail", func(s string) (struct{}, error) {
+		return struct{}{}, errors.New(s)
+	})
+	gosh.RegisterHandler("hang", func(struct{}) (struct{}, error) {
+		select {}
+	})
+}
+
+// Tests that Cmd.Call invokes handlers registered in the child.
+func TestCall(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Cmd.Call is not supported on windows")
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	var sum int
+	c.Call("add", []int{1, 2, 3}, &sum)
+	eq(t, sum, 6)
+	c.Call("add", []int{}, &sum)
+	eq(t, sum, 0)
+	setsErr(t, sh, func() { c.Call("fail", "oops", nil) })
+	setsErr(t, sh, func() { c.Call("missing", nil, nil) })
+	c.Terminate(os.Interrupt)
+	setsErr(t, sh, func() { c.Call("add", []int{1}, &sum) })
+
+	// Calls fail once the process has exited.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitVars("foo") })
+	setsErr(t, sh, func() { c.Call("add", []int{1}, &sum) })
+
+	// Calls are only supported for FuncCmd children.
+	c = sh.Cmd("true")
+	c.Start()
+	setsErr(t, sh, func() { c.Call("add", []int{1}, &sum) })
+	c.Wait()
+}
+
+func TestHelperEcho(t *testing.T) {
+	args, ok := gosh.TestHelperArgs("TestHelperEcho")
+	if !ok {
+		return
+	}
+	defer os.Exit(0)
+	gosh.SendVars(map[string]string{"ready": ""})
+	fmt.Print(strings.Join(args, ","))
+}
+
+func TestTestHelperCmd(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	eq(t, sh.TestHelperCmd("TestHelperEcho", "a", "b c").Stdout(), "a,b c")
+	c := sh.TestHelperCmd("TestHelperEcho")
+	eq(t, c.Args[1:], []string{"-test.run=^TestHelperEcho$", "--"})
+	c.Start()
+	c.AwaitVars("ready")
+	c.Wait()
+	setsErr(t, sh, func() { sh.TestHelperCmd("") })
+}
+
+// Tests that AwaitVarsFor and WaitFor time out if the child misbehaves.
+func TestTimeouts(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
+	c.Start()
+	eq(t, c.AwaitVarsFor(time.Minute, "a")["a"], "1")
+	setsErr(t, sh, func() { c.AwaitVarsFor(100*time.Millisecond, "b") })
+	setsErr(t, sh, func() { c.WaitFor(100 * time.Millisecond) })
+	// The command is still running after WaitFor times out.
+	c.Terminate(os.Interrupt)
+
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	c.WaitFor(time.Minute)
+	// WaitFor returns the same result once the command has exited.
+	c.WaitFor(time.Minute)
+}
+
+// Tests that Cmd methods may be called concurrently with each other.
+func TestCmdConcurrency(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.AwaitVars("ready")
+			neq(t, c.Pid(), -1)
+			eq(t, c.ExitCode(), -1)
+		}()
+	}
+	wg.Wait()
+
+	// Signal the command while another goroutine waits for it.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.Wait()
+	}()
+	c.Signal(os.Interrupt)
+	wg.Wait()
+	eq(t, c.ExitCode(), 0)
+}
+
+func TestRunningOnExit(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	errs := make(chan error, 3)
+	c.OnExit(func(err error) { errs <- err })
+	eq(t, c.Running(), false)
+	c.Start()
+	c.AwaitVars("ready")
+	eq(t, c.Running(), true)
+	c.OnExit(func(err error) { errs <- err })
+	c.Signal(os.Kill)
+	// The functions are called without anyone calling Wait.
+	nok(t, <-errs)
+	nok(t, <-errs)
+	eq(t, c.Running(), false)
+	// Functions registered after exit are called right away.
+	c.OnExit(func(err error) { errs <- err })
+	nok(t, <-errs)
+	setsErr(t, sh, func() { c.Wait() })
+
+	c = sh.FuncCmd(exitFunc, 0)
+	c.OnExit(func(err error) { errs <- err })
+	c.Run()
+	ok(t, <-errs)
+	eq(t, c.Running(), false)
+}
+
+func TestDefaultTimeout(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	sh.DefaultTimeout = 100 * time.Millisecond
+
+	c := sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
+	c.Start()
+	eq(t, c.AwaitVars("a")["a"], "1")
+	setsErr(t, sh, func() { c.AwaitVars("b") })
+	setsErr(t, sh, func() { c.AwaitMessage() })
+	sh.ContinueOnError = true
+	c.Wait()
+	if sh.Err == nil || !strings.Contains(sh.Err.Error(), "DefaultTimeout") {
+		t.Fatalf("got %v, want error mentioning DefaultTimeout", sh.Err)
+	}
+	sh.Err = nil
+	sh.ContinueOnError = false
+	// Per-call timeouts take precedence.
+	setsErr(t, sh, func() { c.WaitFor(200 * time.Millisecond) })
+	// AwaitReady and the like are subject to the default timeout if given a
+	// non-positive timeout, as is Call.
+	waits := []func(){
+		func() { c.AwaitReady(gosh.FileProbe(""), 0, 0) },
+		func() { c.AwaitFileExists("nonexistent", 0) },
+		func() { c.AwaitListening("tcp", "127.0.0.1:1", 0) },
+	}
+	if runtime.GOOS != "windows" {
+		waits = append(waits, func() { c.Call("hang", struct{}{}, nil) })
+	}
+	for _, f := range waits {
+		setsErr(t, sh, f)
+		eq(t, errors.Is(c.Err, gosh.ErrTimedOut), true)
+		eq(t, strings.Contains(c.Err.Error(), "DefaultTimeout"), true)
+	}
+	c.Terminate(os.Interrupt)
+
+	// Run and the like are subject to the default timeout.
+	setsErr(t, sh, func() { sh.FuncCmd(sleepFunc, time.Hour, 0).Run() })
+	sh.DefaultTimeout = time.Minute
+	sh.FuncCmd(exitFunc, 0).Run()
+}
+
+func TestSetDeadline(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// A deadline that is removed or replaced has no effect.
+	sh.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	sh.SetDeadline(time.Time{})
+	sh.SetDeadline(time.Now().Add(time.Hour))
+	sh.SetDeadline(time.Now().Add(3 * time.Second))
+	time.Sleep(100 * time.Millisecond)
+	sh.FuncCmd(exitFunc, 0).Run()
+
+	// Once the deadline is exceeded, running commands are terminated, and
+	// pending and subsequent waits fail.
+	c1 := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c1.Start()
+	c2 := sh.FuncCmd(sendVarsFunc, map[string]string{})
+	c2.Start()
+	start := time.Now()
+	setsErr(t, sh, func() { c2.AwaitVars("a") })
+	setsErr(t, sh, func() { c1.Wait() })
+	if d := time.Since(start); d > time.Minute {
+		t.Fatalf("waits took %v", d)
+	}
+	setsErr(t, sh, func() { c2.Wait() })
+	setsErr(t, sh, func() { sh.FuncCmd(exitFunc, 0).Run() })
+
+	// Setting a new deadline allows commands to be started again.
+	sh.SetDeadline(time.Time{})
+	sh.FuncCmd(exitFunc, 0).Run()
+}
+
+// Tests that cancelling Cmd.Context terminates the process and unblocks Wait and
+// AwaitVars.
+func TestContext(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sh.Context = ctx
+	c1 := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c2 := sh.FuncCmd(sendVarsFunc, map[string]string{"a": "1"})
+	sh.Context = nil
+	c3 := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	eq(t, c1.Context, ctx)
+	eq(t, c3.Context, nil)
+	c1.Start()
+	c1.AwaitVars("ready")
+	c2.Start()
+	c3.Start()
+	c3.AwaitVars("ready")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	setsErr(t, sh, func() { c2.AwaitVars("b") })
+	eq(t, c2.Err, context.Canceled)
+	setsErr(t, sh, func() { c1.Wait() })
+	eq(t, c1.Err, context.Canceled)
+	setsErr(t, sh, func() { c2.Wait() })
+	eq(t, c2.Err, context.Canceled)
+	// Commands created without the context are unaffected.
+	c3.Terminate(os.Interrupt)
+
+	// Commands started after the context is done are terminated immediately.
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Context = ctx
+	c.Start()
+	setsErr(t, sh, func() { c.Wait() })
+	eq(t, c.Err, context.Canceled)
+}
+
+func TestGo(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Errors are returned, rather than handled by the Shell.
+	ok(t, sh.Go(sh.FuncCmd(exitFunc, 0))())
+	c := sh.FuncCmd(exitFunc, 1)
+	err := sh.Go(c)()
+	neq(t, err, nil)
+	eq(t, c.Err, err)
+	ok(t, sh.Err)
+	c = sh.FuncCmd(exitFunc, 1)
+	c.ExitErrorIsOk = true
+	ok(t, sh.Go(c)())
+
+	// Commands that have already been started are waited for.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	ok(t, sh.Go(c)())
+
+	// The command's context is honored.
+	ctx, cancel := context.WithCancel(context.Background())
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Context = ctx
+	errc := make(chan error, 1)
+	go func() { errc <- sh.Go(c)() }()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	eq(t, <-errc, context.Canceled)
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Context = ctx
+	eq(t, sh.Go(c)(), context.Canceled)
+	eq(t, c.Pid(), -1)
+}
+
+// Functions designed for TestRegistry.
+var (
+	printIntsFunc = gosh.RegisterFunc("printIntsFunc", func(v ...int) {
+		var vi []interface{}
+		for _, x := range v {
+			vi = append(vi, x)
+		}
+		fmt.Print(vi...)
+	})
+	printfIntsFunc = gosh.RegisterFunc("printfIntsFunc", func(format string, v ...int) {
+		var vi []interface{}
+		for _, x := range v {
+			vi = append(vi, x)
+		}
+		fmt.Printf(format, vi...)
+	})
+)
+
+// Tests function signature-checking and execution.
+func TestRegistry(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Variadic functions. Non-variadic functions are sufficiently covered in
+	// other tests.
+	eq(t, sh.FuncCmd(printFunc).Stdout(), "")
+	eq(t, sh.FuncCmd(printFunc, 0).Stdout(), "0")
+	eq(t, sh.FuncCmd(printFunc, 0, "foo").Stdout(), "0foo")
+	eq(t, sh.FuncCmd(printfFunc, "").Stdout(), "")
+	eq(t, sh.FuncCmd(printfFunc, "%v", 0).Stdout(), "0")
+	eq(t, sh.FuncCmd(printfFunc, "%v%v", 0, "foo").Stdout(), "0foo")
+	eq(t, sh.FuncCmd(printIntsFunc, 1, 2).Stdout(), "1 2")
+	eq(t, sh.FuncCmd(printfIntsFunc, "%v %v", 1, 2).Stdout(), "1 2")
+
+	// Too few arguments.
+	setsErr(t, sh, func() { sh.FuncCmd(exitFunc) })
+	setsErr(t, sh, func() { sh.FuncCmd(sleepFunc, time.Second) })
+	setsErr(t, sh, func() { sh.FuncCmd(printfFunc) })
+
+	// Too many arguments.
+	setsErr(t, sh, func() { sh.FuncCmd(exitFunc, 0, 0) })
+	setsErr(t, sh, func() { sh.FuncCmd(sleepFunc, time.Second, 0, 0) })
+
+	// Wrong argument types.
+	setsErr(t, sh, func() { sh.FuncCmd(exitFunc, "foo") })
+	setsErr(t, sh, func() { sh.FuncCmd(sleepFunc, 0, 0) })
+	setsErr(t, sh, func() { sh.FuncCmd(printfFunc, 0) })
+	setsErr(t, sh, func() { sh.FuncCmd(printfFunc, 0, 0) })
+
+	// Wrong variadic argument types.
+	setsErr(t, sh, func() { sh.FuncCmd(printIntsFunc, 0.5) })
+	setsErr(t, sh, func() { sh.FuncCmd(printIntsFunc, 0, 0.5) })
+	setsErr(t, sh, func() { sh.FuncCmd(printfIntsFunc, "%v", 0.5) })
+	setsErr(t, sh, func() { sh.FuncCmd(printfIntsFunc, "%v", 0, 0.5) })
+
+	// Unsupported argument types.
+	var p *int
+	setsErr(t, sh, func() { sh.FuncCmd(printFunc, p) })
+	setsErr(t, sh, func() { sh.FuncCmd(printfFunc, "%v", p) })
+}
+
+// Tests the registry introspection functions.
+func TestRegistryIntrospection(t *testing.T) {
+	info := exitFunc.Info()
+	eq(t, info.Name, "exitFunc")
+	eq(t, filepath.Base(info.File), "shell_test.go")
+	eq(t, info.Type, "func(int)")
+	found := false
+	for _, fi := range gosh.RegisteredFuncs() {
+		if fi == info {
+			found = true
+		}
+	}
+	eq(t, found, true)
+
+	buf := &bytes.Buffer{}
+	gosh.DumpRegistry(buf)
+	eq(t, strings.Contains(buf.String(), "exitFunc func(int) ("+info.File), true)
+	eq(t, strings.Contains(buf.String(), "printfFunc func(string, ...interface {}) ("), true)
+
+	// Registering a duplicate name panics, reporting the original location.
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			neq(t, err, nil)
+			eq(t, strings.Contains(err.Error(), fmt.Sprintf("%s:%d", info.File, info.Line)), true)
+		}()
+		gosh.RegisterFunc("exitFunc", func() {})
+	}()
+}
+
+var panicFunc = gosh.RegisterFunc("panicFunc", func() {
+	panic("oops")
+})
+
+// Tests that panics in FuncCmd functions are reported as PanicErrors.
+func TestFuncCmdPanic(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	sh.ContinueOnError = true
+
+	c := sh.FuncCmd(panicFunc)
+	c.Run()
+	pe, isPanicErr := c.Err.(*gosh.PanicError)
+	if !isPanicErr {
+		t.Fatalf("got %T %v, want *gosh.PanicError", c.Err, c.Err)
+	}
+	eq(t, pe.Value, "oops")
+	eq(t, strings.Contains(pe.Stack, "shell_test.go"), true)
+	_, isExitErr := pe.Err.(*exec.ExitError)
+	eq(t, isExitErr, true)
+	var exitErr *exec.ExitError
+	eq(t, errors.As(c.Err, &exitErr), true)
+	eq(t, exitErr, pe.Err)
+	eq(t, sh.Err, c.Err)
+	sh.Err = nil
+
+	// AllowedExitCodes applies to the exit code of the panicking process.
+	c = sh.FuncCmd(panicFunc)
+	c.AllowedExitCodes = []int{exitErr.ExitCode()}
+	c.Run()
+	ok(t, sh.Err)
+
+	// With ExitErrorIsOk, the panic is not reported via Shell.HandleError.
+	c = sh.FuncCmd(panicFunc)
+	c.ExitErrorIsOk = true
+	c.Run()
+	ok(t, sh.Err)
+	_, isPanicErr = c.Err.(*gosh.PanicError)
+	eq(t, isPanicErr, true)
+}
+
+// point has unexported fields, so it can only be passed to FuncCmd via a codec.
+type point struct{ x, y int }
+
+// secret has unexported fields and no codec.
+type secret struct{ s string }
+
+func init() {
+	gosh.RegisterArgCodec(func(p point) ([]byte, error) {
+		return []byte(fmt.Sprintf("%d,%d", p.x, p.y)), nil
+	}, func(b []byte) (point, error) {
+		var p point
+		_, err := fmt.Sscanf(string(b), "%d,%d", &p.x, &p.y)
+		return p, err
+	})
+}
+
+var printPointFunc = gosh.RegisterFunc("printPointFunc", func(p point) {
+	fmt.Printf("%d %d", p.x, p.y)
+})
+
+func TestArgCodec(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	eq(t, sh.FuncCmd(printPointFunc, point{1, 2}).Stdout(), "1 2")
+	// Codecs also apply to values passed as interface{} args.
+	eq(t, sh.FuncCmd(printFunc, point{3, 4}, "foo").Stdout(), "{3 4}foo")
+
+	// Types with unexported fields and no codec are rejected, rather than
+	// having their fields silently dropped.
+	setsErr(t, sh, func() { sh.FuncCmd(printFunc, secret{"foo"}) })
+	setsErr(t, sh, func() { sh.FuncCmd(printFunc, &secret{"foo"}) })
+}
+
+func TestStdin(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// The "cat" command exits after the reader returns EOF.
+	c := sh.FuncCmd(catFunc)
+	c.SetStdinReader(strings.NewReader("foo\n"))
+	eq(t, c.Stdout(), "foo\n")
+
+	// The "cat" command exits after the reader returns EOF, so we must explicitly
+	// close the stdin pipe.
+	c = sh.FuncCmd(catFunc)
+	stdin := c.StdinPipe()
+	stdin.Write([]byte("foo\n"))
+	stdin.Close()
+	eq(t, c.Stdout(), "foo\n")
+
+	// The "read" command exits when it sees a newline, so it is not necessary to
+	// explicitly close the stdin pipe.
+	c = sh.FuncCmd(readFunc)
+	stdin = c.StdinPipe()
+	stdin.Write([]byte("foo\n"))
+	c.Run()
+
+	// No stdin, so cat should exit immediately.
+	c = sh.FuncCmd(catFunc)
+	eq(t, c.Stdout(), "")
+
+	// It's an error to call both StdinPipe and SetStdinReader.
+	c = sh.FuncCmd(catFunc)
+	c.StdinPipe()
+	setsErr(t, sh, func() { c.StdinPipe() })
+
+	c = sh.FuncCmd(catFunc)
+	c.StdinPipe()
+	setsErr(t, sh, func() { c.SetStdinReader(strings.NewReader("")) })
+
+	c = sh.FuncCmd(catFunc)
+	c.SetStdinReader(strings.NewReader(""))
+	setsErr(t, sh, func() { c.StdinPipe() })
+
+	c = sh.FuncCmd(catFunc)
+	c.SetStdinReader(strings.NewReader(""))
+	setsErr(t, sh, func() { c.SetStdinReader(strings.NewReader("")) })
+}
+
+// parentEOFFunc runs "cat" with StdinCloseOnParentEOF, so that it exits once
+// this process's stdin reaches EOF.
+var parentEOFFunc = gosh.RegisterFunc("parentEOFFunc", func() {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+	c := sh.FuncCmd(catFunc)
+	c.SetStdinReader(strings.NewReader("foo\n"))
+	c.StdinMode = gosh.StdinCloseOnParentEOF
+	fmt.Print(c.Stdout())
+})
+
+func TestStdinMode(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// With StdinKeepOpen, "cat" does not exit after the reader returns EOF.
+	c := sh.FuncCmd(catFunc)
+	c.SetStdinReader(strings.NewReader("foo\n"))
+	c.StdinMode = gosh.StdinKeepOpen
+	stdout := bufio.NewReader(c.StdoutPipe())
+	c.Start()
+	line, err := stdout.ReadString('\n')
+	ok(t, err)
+	eq(t, line, "foo\n")
+	time.Sleep(100 * time.Millisecond)
+	eq(t, c.Running(), true)
+	c.Terminate(os.Interrupt)
+
+	// The same holds if stdin is not configured.
+	c = sh.FuncCmd(catFunc)
+	c.StdinMode = gosh.StdinKeepOpen
+	c.Start()
+	time.Sleep(100 * time.Millisecond)
+	eq(t, c.Running(), true)
+	c.Terminate(os.Interrupt)
+
+	// With StdinCloseOnParentEOF, the parent's stdin is copied after the reader,
+	// and "cat" exits once the parent's stdin reaches EOF.
+	c = sh.FuncCmd(parentEOFFunc)
+	c.SetStdinReader(strings.NewReader("bar\n"))
+	eq(t, c.Stdout(), "foo\nbar\n")
+
+	// Other ways of configuring stdin are not supported.
+	c = sh.FuncCmd(catFunc)
+	c.StdinPipe()
+	c.StdinMode = gosh.StdinKeepOpen
+	setsErr(t, sh, func() { c.Start() })
+}
+
+func TestSetStdinFromStdout(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// The commands may be started in either order.
+	for _, srcFirst := range []bool{true, false} {
+		echo := sh.FuncCmd(echoFunc)
+		echo.Args = append(echo.Args, "foo")
+		cat := sh.FuncCmd(catFunc)
+		cat.SetStdinFromStdout(echo)
+		stdout := cat.StdoutPipe()
+		if srcFirst {
+			echo.Start()
+			cat.Start()
+		} else {
+			cat.Start()
+			echo.Start()
+		}
+		echo.Wait()
+		cat.Wait()
+		eq(t, toString(t, stdout), "foo\n")
+	}
+
+	// Stdin can only be set once, and only before Start.
+	echo, cat := sh.FuncCmd(echoFunc), sh.FuncCmd(catFunc)
+	cat.SetStdinReader(strings.NewReader("foo"))
+	setsErr(t, sh, func() { cat.SetStdinFromStdout(echo) })
+	echo, cat = sh.FuncCmd(exitFunc, 0), sh.FuncCmd(catFunc)
+	echo.Run()
+	setsErr(t, sh, func() { cat.SetStdinFromStdout(echo) })
+}
+
+func TestStdinPipeWriteUntilExit(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Ensure that Write calls on stdin fail after the process exits. Note that we
+	// write to the command's stdin concurrently with the command's exit waiter
+	// goroutine closing stdin. Use "go test -race" catch races.
+	//
+	// Set a non-zero exit code, so that os.Exit exits immediately. See the
+	// implementation of https://golang.org/pkg/os/#Exit for details.
+	c := sh.FuncCmd(exitFunc, 1)
+	c.ExitErrorIsOk = true
+	stdin := c.StdinPipe()
+	c.Start()
+	for {
+		if _, err := stdin.Write([]byte("a")); err != nil {
+			return
+		}
+	}
+}
+
+var writeFunc = gosh.RegisterFunc("writeFunc", func(stdout, stderr bool) error {
+	if stdout {
+		if _, err := os.Stdout.Write([]byte("A")); err != nil {
+			return err
+		}
+	}
+	if stderr {
+		if _, err := os.Stderr.Write([]byte("B")); err != nil {
+			return err
+		}
+	}
+	if stdout {
+		if _, err := os.Stdout.Write([]byte("A")); err != nil {
+			return err
+		}
+	}
+	if stderr {
+		if _, err := os.Stderr.Write([]byte("B")); err != nil {
+			return err
+		}
+	}
+	return nil
+})
+
+var ptyFunc = gosh.RegisterFunc("ptyFunc", func() error {
+	rows, cols, err := textutil.TerminalSize()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%dx%d\n", rows, cols)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stderr, "got "+line)
+	return nil
+})
+
+func TestStartWithPTY(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(ptyFunc)
+	stdin := c.StdinPipe()
+	stdout := c.StdoutPipe()
+	c.StartWithPTY(gosh.PTYSize{Rows: 24, Cols: 100})
+	scanner := bufio.NewScanner(stdout)
+	eq(t, scanner.Scan(), true)
+	eq(t, scanner.Text(), "24x100")
+	stdin.Write([]byte("foo\n"))
+	c.Wait()
+	// The terminal echoes the input line, and the child's stderr is also written
+	// to the terminal.
+	eq(t, toString(t, stdout), "foo\r\ngot foo\r\n")
+
+	// Vars are read from the pty only if the child has no dedicated vars pipe.
+	const frame = `<goshVars{"a":"1"}goshVars>`
+	c = sh.Cmd("sh", "-c", "echo '"+frame+"'")
+	c.StartWithPTY(gosh.PTYSize{Rows: 24, Cols: 80})
+	eq(t, c.AwaitVars("a")["a"], "1")
+	c.Wait()
+	c = sh.FuncCmd(printFunc, frame)
+	c.StartWithPTY(gosh.PTYSize{Rows: 24, Cols: 80})
+	vars, missing := c.AwaitVarsPartial(map[string]time.Duration{"a": 0})
+	eq(t, len(vars), 0)
+	eq(t, missing, []string{"a"})
+	c.Wait()
+
+	// SetPTYSize fails unless the command was started with a pty.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	setsErr(t, sh, func() { c.SetPTYSize(gosh.PTYSize{Rows: 24, Cols: 80}) })
+	c.Wait()
+}
+
+func TestStdoutStderr(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Write to stdout only.
+	c := sh.FuncCmd(writeFunc, true, false)
+	stdoutPipe, stderrPipe := c.StdoutPipe(), c.StderrPipe()
+	stdout, stderr := c.StdoutStderr()
+	eq(t, stdout, "AA")
+	eq(t, stderr, "")
+	eq(t, toString(t, stdoutPipe), "AA")
+	eq(t, toString(t, stderrPipe), "")
+
+	// Write to stderr only.
+	c = sh.FuncCmd(writeFunc, false, true)
+	stdoutPipe, stderrPipe = c.StdoutPipe(), c.StderrPipe()
+	stdout, stderr = c.StdoutStderr()
+	eq(t, stdout, "")
+	eq(t, stderr, "BB")
+	eq(t, toString(t, stdoutPipe), "")
+	eq(t, toString(t, stderrPipe), "BB")
+
+	// Write to both stdout and stderr.
+	c = sh.FuncCmd(writeFunc, true, true)
+	stdoutPipe, stderrPipe = c.StdoutPipe(), c.StderrPipe()
+	stdout, stderr = c.StdoutStderr()
+	eq(t, stdout, "AA")
+	eq(t, stderr, "BB")
+	eq(t, toString(t, stdoutPipe), "AA")
+	eq(t, toString(t, stderrPipe), "BB")
+}
+
+var writeMoreFunc = gosh.RegisterFunc("writeMoreFunc", func() {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(writeFunc, true, true)
+	c.AddStdoutWriter(os.Stdout)
+	c.AddStderrWriter(os.Stderr)
+	c.Run()
+
+	fmt.Fprint(os.Stdout, " stdout done")
+	fmt.Fprint(os.Stderr, " stderr done")
+})
+
+var propagatePrefixFunc = gosh.RegisterFunc("propagatePrefixFunc", func(prefix string) {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(printfFunc, "a\nb")
+	c.PropagateOutput = true
+	c.OutputPrefix = prefix
+	c.Run()
+	c = sh.FuncCmd(writeFunc, false, true)
+	c.PropagateOutput = true
+	c.OutputPrefix = prefix
+	c.Run()
+})
+
+func TestOutputPrefix(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	stdout, stderr := sh.FuncCmd(propagatePrefixFunc, "[x] ").StdoutStderr()
+	eq(t, stdout, "[x] a\n[x] b\n")
+	eq(t, stderr, "[x] BB\n")
+	stdout, stderr = sh.FuncCmd(propagatePrefixFunc, "").StdoutStderr()
+	eq(t, stdout, "a\nb")
+	eq(t, stderr, "BB")
+}
+
+func TestTimedOutput(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	chunks := sh.FuncCmd(writeFunc, true, true).TimedOutput()
+	got := map[string]string{}
+	for i, chunk := range chunks {
+		got[chunk.Stream] += chunk.Data
+		if i > 0 {
+			eq(t, chunk.Time.Before(chunks[i-1].Time), false)
+		}
+	}
+	eq(t, got, map[string]string{"stdout": "AA", "stderr": "BB"})
+
+	// TimedOutput must not be called after Start.
+	c := sh.FuncCmd(writeFunc, true, true)
+	c.Start()
+	setsErr(t, sh, func() { c.TimedOutput() })
+	c.Wait()
+}
+
+func TestTranscript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcript_test")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "transcript")
+
+	sh := gosh.NewShell(t)
+	sh.TranscriptFile = path
+	sh.Redact("s3cret")
+	sh.Vars["TRANSCRIPT_VAR"] = "s3cret"
+	sh.FuncCmd(printfFunc, "a\nb").Run()
+	c := sh.FuncCmd(exitFunc, 2)
+	c.ExitErrorIsOk = true
+	c.Run()
+	sh.Cleanup()
+
+	b, err := ioutil.ReadFile(path)
+	ok(t, err)
+	got := string(b)
+	for _, re := range []string{
+		`^=== \S+ session started$`,
+		`^=== \[0\] \S+ started \(PID \d+\): .*TRANSCRIPT_VAR="\[REDACTED\]".*$`,
+		`^\[0 stdout\] a\n\[0 stdout\] b\n=== \[0\] \S+ exited \(PID \d+\): code 0 after .*$`,
+		`^=== \[1\] \S+ exited \(PID \d+\): code 2 after .*$`,
+		`^=== \S+ session ended\n\z`,
+	} {
+		if !regexp.MustCompile(`(?m)` + re).MatchString(got) {
+			t.Errorf("transcript does not match %s:\n%s", re, got)
+		}
+	}
+	eq(t, strings.Contains(got, "s3cret"), false)
+}
+
+func TestMergedOutput(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	buf := &bytes.Buffer{}
+	m := gosh.NewMergedOutput(buf)
+	c0 := sh.FuncCmd(printfFunc, "a\nb")
+	m.Add(c0, "c0")
+	c1 := sh.FuncCmd(writeFunc, true, true)
+	m.Add(c1, "c1")
+	c0.Run()
+	c1.Run()
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	eq(t, len(lines), 4)
+	for _, line := range lines {
+		// Lines start with a timestamp.
+		_, err := time.Parse(gosh.DefaultMergedTimeFormat, strings.Fields(line)[0])
+		ok(t, err)
+	}
+	buf.Reset()
+	m.TimeFormat = "TS"
+	c0 = sh.FuncCmd(printfFunc, "a\nb")
+	m.Add(c0, "c0")
+	c0.Run()
+	eq(t, buf.String(), "TS [c0:stdout] a\nTS [c0:stdout] b\n")
+
+	// MergedOutput.Add must be called before Start.
+	setsErr(t, sh, func() { m.Add(c0, "c0") })
+}
+
+func TestLogChildOutput(t *testing.T) {
+	tb := &customTB{t: t, buf: &bytes.Buffer{}}
+	sh := gosh.NewShell(tb)
+	defer sh.Cleanup()
+	sh.LogChildOutput = true
+
+	sh.FuncCmd(printfFunc, "a\nb").Run()
+	eq(t, tb.buf.String(), "[printfFunc()] a\n[printfFunc()] b\n")
+	tb.Reset()
+	c := sh.Cmd("echo", "foo")
+	c.OutputPrefix = "> "
+	c.Run()
+	eq(t, tb.buf.String(), "> foo\n")
+
+	// Errors for started commands are logged along with the command's args and
+	// output.
+	tb.Reset()
+	c = sh.FuncCmd(stderrFunc, "oops")
+	c.Start()
+	c.AwaitVarsFor(100*time.Millisecond, "a")
+	eq(t, tb.calledFailNow, true)
+	eq(t, strings.Contains(tb.buf.String(), "gosh: command failed: "+strings.Join(c.Args, " ")), true)
+	eq(t, strings.Contains(tb.buf.String(), "STDERR\n"), true)
+	eq(t, strings.Contains(tb.buf.String(), "[stderrFunc()] oops\n"), false)
+	sh.Err = nil
+	c.Terminate(os.Interrupt)
+	eq(t, strings.Contains(tb.buf.String(), "[stderrFunc()] oops\n"), true)
+}
+
+func TestOutputThrottle(t *testing.T) {
+	tb := &customTB{t: t, buf: &bytes.Buffer{}}
+	sh := gosh.NewShell(tb)
+	defer sh.Cleanup()
+	sh.LogChildOutput = true
+
+	sh.ChildOutputThrottle = gosh.Throttle{CollapseRepeats: true}
+	sh.FuncCmd(printfFunc, "a\na\na\nb\nc\nc").Run()
+	eq(t, tb.buf.String(), "[printfFunc()] a\n[printfFunc()] [gosh: previous line repeated 2 more time(s)]\n[printfFunc()] b\n[printfFunc()] c\n[printfFunc()] [gosh: previous line repeated 1 more time(s)]\n")
+
+	// Full output is still written to ChildOutputDir.
+	tb.Reset()
+	sh.ChildOutputThrottle = gosh.Throttle{MaxLinesPerSecond: 2}
+	sh.ChildOutputDir = sh.MakeTempDir()
+	sh.ChildOutputName = "out.{{.Stream}}"
+	sh.FuncCmd(printfFunc, "1\n2\n3\n4\n").Run()
+	eq(t, tb.buf.String(), "[printfFunc()] 1\n[printfFunc()] 2\n[printfFunc()] [gosh: dropped 2 lines]\n")
+	b, err := ioutil.ReadFile(filepath.Join(sh.ChildOutputDir, "out.stdout"))
+	ok(t, err)
+	eq(t, string(b), "1\n2\n3\n4\n")
+}
+
+var propagateRedactFunc = gosh.RegisterFunc("propagateRedactFunc", func(secret string) {
+	sh := gosh.NewShell(nil)
+	defer sh.Cleanup()
+	sh.Redact(secret)
+
+	c := sh.FuncCmd(printfFunc, "a"+secret+"b")
+	c.PropagateOutput = true
+	c.Run()
+})
+
+func TestRedact(t *testing.T) {
+	tb := &customTB{t: t, buf: &bytes.Buffer{}}
+	sh := gosh.NewShell(tb)
+	defer sh.Cleanup()
+	sh.Redact("s3cret", "")
+	sh.RedactPattern(regexp.MustCompile(`tok_[0-9]+`))
+
+	// Captured output.
+	eq(t, sh.FuncCmd(printfFunc, "a s3cret b tok_123\n").Stdout(), "a [REDACTED] b [REDACTED]\n")
+	eq(t, sh.FuncCmd(printfFunc, "s3cret").CombinedOutput(), "[REDACTED]")
+
+	// Propagated output.
+	eq(t, sh.FuncCmd(propagateRedactFunc, "s3cret").Stdout(), "a[REDACTED]b\n")
+
+	// Logged output.
+	sh.LogChildOutput = true
+	sh.FuncCmd(printfFunc, "tok_1").Run()
+	eq(t, tb.buf.String(), "[printfFunc()] [REDACTED]\n")
+	sh.LogChildOutput = false
+
+	// Files in ChildOutputDir.
+	sh.ChildOutputDir = sh.MakeTempDir()
+	sh.ChildOutputName = "out.{{.Stream}}"
+	sh.FuncCmd(printfFunc, "s3cret").Run()
+	b, err := ioutil.ReadFile(filepath.Join(sh.ChildOutputDir, "out.stdout"))
+	ok(t, err)
+	eq(t, string(b), "[REDACTED]\n")
+	sh.ChildOutputDir = ""
+
+	// Writers added via AddStdoutWriter see the raw output.
+	buf := &bytes.Buffer{}
+	c := sh.FuncCmd(printfFunc, "s3cret")
+	c.AddStdoutWriter(buf)
+	c.Run()
+	eq(t, buf.String(), "s3cret")
+	ok(t, sh.Err)
+}
+
+// Tests that it's safe to add os.Stdout and os.Stderr as writers.
+func TestAddStdoutStderrWriter(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	stdout, stderr := sh.FuncCmd(writeMoreFunc).StdoutStderr()
+	eq(t, stdout, "AA stdout done")
+	eq(t, stderr, "BB stderr done")
+}
+
+func TestLineHandlers(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	var stdout, stderr []string
+	c := sh.FuncCmd(printfFunc, "a\nbb\r\n\nccc")
+	c.AddStdoutLineHandler(func(line string) { stdout = append(stdout, line) })
+	c.AddStderrLineHandler(func(line string) { stderr = append(stderr, line) })
+	c.Run()
+	eq(t, stdout, []string{"a", "bb", "", "ccc"})
+	eq(t, stderr, []string(nil))
+
+	stdout, stderr = nil, nil
+	c = sh.FuncCmd(writeFunc, true, true)
+	c.AddStdoutLineHandler(func(line string) { stdout = append(stdout, line) })
+	c.AddStderrLineHandler(func(line string) { stderr = append(stderr, line) })
+	c.Run()
+	eq(t, stdout, []string{"AA"})
+	eq(t, stderr, []string{"BB"})
+
+	// Line handlers must be added before Start.
+	setsErr(t, sh, func() { c.AddStdoutLineHandler(func(string) {}) })
+}
+
+type jsonEvent struct {
+	Name  string
+	Count int
+}
+
+func TestDecodeJSONLines(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(printFunc, "{\"Name\":\"a\",\"Count\":1}\n\n{\"Name\":\"b\",\"Count\":2}")
+	ch := make(chan *jsonEvent)
+	c.DecodeJSONLines(nil, ch)
+	c.Start()
+	var got []jsonEvent
+	for e := range ch {
+		got = append(got, *e)
+	}
+	c.Wait()
+	eq(t, got, []jsonEvent{{"a", 1}, {"b", 2}})
+
+	// Wait fails if a line cannot be decoded.
+	c = sh.FuncCmd(printFunc, "{\"Name\":\"a\"}\nnot json\n{\"Name\":\"b\"}\n")
+	ch2 := make(chan jsonEvent, 10)
+	c.DecodeJSONLines(nil, ch2)
+	setsErr(t, sh, func() { c.Run() })
+	eq(t, <-ch2, jsonEvent{Name: "a"})
+	_, more := <-ch2
+	eq(t, more, false)
+
+	// Once the context is done, values are discarded.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c = sh.FuncCmd(printFunc, "{}\n{}\n")
+	c.DecodeJSONLines(ctx, make(chan jsonEvent))
+	c.Run()
+
+	// DecodeJSONLines requires a channel, and must be called before Start.
+	setsErr(t, sh, func() { sh.FuncCmd(printFunc).DecodeJSONLines(nil, []jsonEvent{}) })
+	setsErr(t, sh, func() { c.DecodeJSONLines(nil, ch) })
+}
+
+func TestSession(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	s := gosh.NewSession(sh.FuncCmd(catFunc))
+	s.Cmd().Start()
+	s.Send("hello world\n")
+	eq(t, s.Expect(regexp.MustCompile(`hel+o (\w+)`), time.Minute), []string{"hello world", "world"})
+	// Output up to the end of the previous match is consumed.
+	s.Send("prompt> ")
+	eq(t, s.Expect(regexp.MustCompile(`\S+> `), time.Minute), []string{"prompt> "})
+
+	// Expect fails if there is no match within the timeout.
+	setsErr(t, sh, func() { s.Expect(regexp.MustCompile("never"), 100*time.Millisecond) })
+
+	// Expect fails once stdout is closed, even with no timeout.
+	s.Send("bye\n")
+	s.Close()
+	s.Cmd().Wait()
+	eq(t, s.Expect(regexp.MustCompile("bye"), 0), []string{"bye"})
+	setsErr(t, sh, func() { s.Expect(regexp.MustCompile("never"), 0) })
+
+	// NewSession must be called before Start.
+	setsErr(t, sh, func() { gosh.NewSession(s.Cmd()) })
+}
+
+func TestMaxCaptureBytes(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(printFunc, "0123456789")
+	c.MaxCaptureBytes = 3
+	eq(t, c.Clone().Stdout(), "012\n[ ... skipping 4 bytes ... ]\n789")
+	stdout, stderr := c.Clone().StdoutStderr()
+	eq(t, stdout, "012\n[ ... skipping 4 bytes ... ]\n789")
+	eq(t, stderr, "")
+	eq(t, c.Clone().CombinedOutput(), "012\n[ ... skipping 4 bytes ... ]\n789")
+	c.MaxCaptureBytes = 5
+	eq(t, c.Stdout(), "0123456789")
+}
+
+func TestCombinedOutput(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(writeFunc, true, true)
+	buf := &bytes.Buffer{}
+	c.AddStdoutWriter(buf)
+	c.AddStderrWriter(buf)
+	output := c.CombinedOutput()
+	// Note, we can't assume any particular ordering of stdout and stderr, so we
+	// simply check the length of the combined output.
+	eq(t, len(output), 4)
+	// The ordering must be the same, regardless of how we captured the combined
+	// output.
+	eq(t, output, buf.String())
+}
+
+func TestResult(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	res := sh.FuncCmd(writeFunc, true, true).Result()
+	eq(t, res.Stdout, "AA")
+	eq(t, res.Stderr, "BB")
+	eq(t, res.ExitCode, 0)
+	ok(t, res.Err)
+	if res.Duration <= 0 {
+		t.Fatalf("got duration %v, want positive", res.Duration)
+	}
+
+	// Exit errors are reported in the Result, not via sh.HandleError.
+	c := sh.FuncCmd(exitFunc, 3)
+	res = c.Result()
+	eq(t, res.ExitCode, 3)
+	nok(t, res.Err)
+	eq(t, c.Err, res.Err)
+	ok(t, sh.Err)
+
+	// Other errors are handled as usual.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Run()
+	setsErr(t, sh, func() { c.Result() })
+}
+
+func TestOutputDir(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	dir := sh.MakeTempDir()
+	c := sh.FuncCmd(writeFunc, true, true)
+	c.OutputDir = dir
+	c.Run()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.stdout"))
+	ok(t, err)
+	eq(t, len(matches), 1)
+	stdout, err := ioutil.ReadFile(matches[0])
+	ok(t, err)
+	eq(t, string(stdout), "AA")
+
+	matches, err = filepath.Glob(filepath.Join(dir, "*.stderr"))
+	ok(t, err)
+	eq(t, len(matches), 1)
+	stderr, err := ioutil.ReadFile(matches[0])
+	ok(t, err)
+	eq(t, string(stderr), "BB")
+
+	// Files are named per OutputName, and are created even if empty.
+	dir = sh.MakeTempDir()
+	sh.FuncCmd(exitFunc, 0).Run()
+	c = sh.FuncCmd(writeFunc, true, false)
+	c.OutputDir = dir
+	c.OutputName = "{{.Index}}-{{.PID}}.{{.Stream}}"
+	c.Run()
+	stdout, err = ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("%d-%d.stdout", 2, c.Pid())))
+	ok(t, err)
+	eq(t, string(stdout), "AA")
+	stderr, err = ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("%d-%d.stderr", 2, c.Pid())))
+	ok(t, err)
+	eq(t, string(stderr), "")
+
+	// Invalid templates are reported when the command is started.
+	c = sh.FuncCmd(writeFunc, true, false)
+	c.OutputDir = dir
+	c.OutputName = "{{.Foo}}"
+	setsErr(t, sh, func() { c.Run() })
+}
+
+func TestOutputInfo(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	sh.Redact("secret")
+
+	dir := sh.MakeTempDir()
+	c := sh.FuncCmd(exitFunc, 2)
+	c.OutputDir = dir
+	c.Dir = sh.MakeTempDir()
+	c.Vars["FOO"] = "secret"
+	c.ExitErrorIsOk = true
+	c.Run()
+
+	// The info file is written by the time Wait returns.
+	matches, err := filepath.Glob(filepath.Join(dir, "*.info"))
+	ok(t, err)
+	eq(t, len(matches), 1)
+	buf, err := ioutil.ReadFile(matches[0])
+	ok(t, err)
+	var info gosh.OutputInfo
+	ok(t, json.Unmarshal(buf, &info))
+	eq(t, info.Path, c.Path)
+	eq(t, info.Args, c.Args)
+	eq(t, info.Dir, c.Dir)
+	eq(t, info.PID, c.Pid())
+	eq(t, info.ExitCode, 2)
+	neq(t, info.Err, "")
+	eq(t, info.StartTime.After(info.ExitTime), false)
+	eq(t, info.StartTime.IsZero(), false)
+	found := false
+	for _, kv := range info.Env {
+		if kv == "FOO="+gosh.RedactedText {
+			found = true
+		}
+	}
+	eq(t, found, true)
+}
+
+var replaceFunc = gosh.RegisterFunc("replaceFunc", func(old, new byte) error {
+	buf := make([]byte, 1024)
+	for {
+		n, err := os.Stdin.Read(buf)
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+		rep := bytes.Replace(buf[:n], []byte{old}, []byte{new}, -1)
+		if _, err := os.Stdout.Write(rep); err != nil {
+			return err
+		}
+	}
+})
+
+func TestSignal(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	for _, d := range []time.Duration{0, time.Hour} {
+		for _, s := range []os.Signal{os.Interrupt, os.Kill, gosh.Kill} {
+			fmt.Println(d, s)
+			c := sh.FuncCmd(sleepFunc, d, 0)
+			c.Start()
+			c.AwaitVars("ready")
+			// Wait for a bit to allow the zero-sleep commands to exit.
+			time.Sleep(100 * time.Millisecond)
+			c.Signal(s)
+			switch {
+			case s == os.Interrupt:
+				// Wait should succeed as long as the exit code was 0, regardless of
+				// whether the signal arrived or the process had already exited.
+				c.Wait()
+			case d != 0:
+				// Note: We don't call Wait in the {d: 0, s: os.Kill} case because doing
+				// so makes the test flaky on slow systems.
+				setsErr(t, sh, func() { c.Wait() })
+			}
+		}
+	}
+
+	// Signal should fail if Wait has been called.
+	c := sh.FuncCmd(sleepFunc, time.Duration(0), 0)
+	c.Run()
+	setsErr(t, sh, func() { c.Signal(os.Interrupt) })
+}
+
+var processGroup = gosh.RegisterFunc("processGroup", func(n int) {
+	pids := make([]string, n)
+	for x := 0; x < n; x++ {
+		c := exec.Command("sleep", "3600")
+		c.Start()
+		pids[x] = strconv.Itoa(c.Process.Pid)
+	}
+	gosh.SendVars(map[string]string{"pids": strings.Join(pids, ",")})
+	time.Sleep(time.Minute)
+})
+
+func TestCleanupOrder(t *testing.T) {
+	sh := gosh.NewShell(t)
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+	running := func(c *gosh.Cmd) bool {
+		return syscall.Kill(c.Pid(), 0) == nil
+	}
+	// Resources are released in the reverse of the order in which they were
+	// acquired, with commands cleaned up before earlier resources are released.
+	var got []string
+	var c *gosh.Cmd
+	dir := sh.MakeTempDir()
+	sh.AddCleanupHandler(func() {
+		got = append(got, "h0")
+		eq(t, exists(dir), true)
+		eq(t, running(c), false)
+	})
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	c.AwaitVars("ready")
+	f := sh.MakeTempFile()
+	sh.AddCleanupHandler(func() {
+		got = append(got, "h1")
+		eq(t, exists(f.Name()), true)
+		eq(t, running(c), true)
+	})
+	sh.AddCleanupHandler(func() {
+		got = append(got, "h2")
+	})
+	sh.AddCleanupHandler(func() {
+		got = append(got, "h3")
+		eq(t, running(c), true)
 	})
-)
+	sh.Cleanup()
+	eq(t, got, []string{"h3", "h2", "h1", "h0"})
+	eq(t, running(c), false)
+	eq(t, exists(f.Name()), false)
+	eq(t, exists(dir), false)
+}
 
-// Tests function signature-checking and execution.
-func TestRegistry(t *testing.T) {
+func TestCleanupProcessGroup(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	// Variadic functions. Non-variadic functions are sufficiently covered in
-	// other tests.
-	eq(t, sh.FuncCmd(printFunc).Stdout(), "")
-	eq(t, sh.FuncCmd(printFunc, 0).Stdout(), "0")
-	eq(t, sh.FuncCmd(printFunc, 0, "foo").Stdout(), "0foo")
-	eq(t, sh.FuncCmd(printfFunc, "").Stdout(), "")
-	eq(t, sh.FuncCmd(printfFunc, "%v", 0).Stdout(), "0")
-	eq(t, sh.FuncCmd(printfFunc, "%v%v", 0, "foo").Stdout(), "0foo")
-	eq(t, sh.FuncCmd(printIntsFunc, 1, 2).Stdout(), "1 2")
-	eq(t, sh.FuncCmd(printfIntsFunc, "%v %v", 1, 2).Stdout(), "1 2")
-
-	// Too few arguments.
-	setsErr(t, sh, func() { sh.FuncCmd(exitFunc) })
-	setsErr(t, sh, func() { sh.FuncCmd(sleepFunc, time.Second) })
-	setsErr(t, sh, func() { sh.FuncCmd(printfFunc) })
-
-	// Too many arguments.
-	setsErr(t, sh, func() { sh.FuncCmd(exitFunc, 0, 0) })
-	setsErr(t, sh, func() { sh.FuncCmd(sleepFunc, time.Second, 0, 0) })
-
-	// Wrong argument types.
-	setsErr(t, sh, func() { sh.FuncCmd(exitFunc, "foo") })
-	setsErr(t, sh, func() { sh.FuncCmd(sleepFunc, 0, 0) })
-	setsErr(t, sh, func() { sh.FuncCmd(printfFunc, 0) })
-	setsErr(t, sh, func() { sh.FuncCmd(printfFunc, 0, 0) })
-
-	// Wrong variadic argument types.
-	setsErr(t, sh, func() { sh.FuncCmd(printIntsFunc, 0.5) })
-	setsErr(t, sh, func() { sh.FuncCmd(printIntsFunc, 0, 0.5) })
-	setsErr(t, sh, func() { sh.FuncCmd(printfIntsFunc, "%v", 0.5) })
-	setsErr(t, sh, func() { sh.FuncCmd(printfIntsFunc, "%v", 0, 0.5) })
+	c := sh.FuncCmd(processGroup, 5)
+	c.Start()
+	pids := c.AwaitVars("pids")["pids"]
+	c.Signal(os.Interrupt)
 
-	// Unsupported argument types.
-	var p *int
-	setsErr(t, sh, func() { sh.FuncCmd(printFunc, p) })
-	setsErr(t, sh, func() { sh.FuncCmd(printfFunc, "%v", p) })
+	// Wait for all processes in the child's process group to exit.
+	for syscall.Kill(-c.Pid(), 0) != syscall.ESRCH {
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, pid := range strings.Split(pids, ",") {
+		p, _ := strconv.Atoi(pid)
+		eq(t, syscall.Kill(p, 0), syscall.ESRCH)
+	}
 }
 
-func TestStdin(t *testing.T) {
+var catchTermProcessGroup = gosh.RegisterFunc("catchTermProcessGroup", func(n int) {
+	// Use Notify rather than Ignore, since ignored signals are inherited by the
+	// descendants.
+	signal.Notify(make(chan os.Signal, 1), syscall.SIGTERM)
+	pids := make([]string, n)
+	for x := 0; x < n; x++ {
+		c := exec.Command("sleep", "3600")
+		c.Start()
+		// Reap the child once it exits.
+		go c.Wait()
+		pids[x] = strconv.Itoa(c.Process.Pid)
+	}
+	gosh.SendVars(map[string]string{"pids": strings.Join(pids, ",")})
+	time.Sleep(time.Minute)
+})
+
+func TestSignalProcessGroup(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	// The "cat" command exits after the reader returns EOF.
-	c := sh.FuncCmd(catFunc)
-	c.SetStdinReader(strings.NewReader("foo\n"))
-	eq(t, c.Stdout(), "foo\n")
+	c := sh.FuncCmd(catchTermProcessGroup, 3)
+	c.SignalProcessGroup = true
+	c.Start()
+	pids := c.AwaitVars("pids")["pids"]
+	c.Signal(syscall.SIGTERM)
 
-	// The "cat" command exits after the reader returns EOF, so we must explicitly
-	// close the stdin pipe.
-	c = sh.FuncCmd(catFunc)
-	stdin := c.StdinPipe()
-	stdin.Write([]byte("foo\n"))
-	stdin.Close()
-	eq(t, c.Stdout(), "foo\n")
+	// Wait for the descendants to exit; the child itself catches SIGTERM.
+	for _, pid := range strings.Split(pids, ",") {
+		p, _ := strconv.Atoi(pid)
+		for syscall.Kill(p, 0) != syscall.ESRCH {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	ok(t, syscall.Kill(c.Pid(), 0))
+	c.Terminate(os.Kill)
+}
 
-	// The "read" command exits when it sees a newline, so it is not necessary to
-	// explicitly close the stdin pipe.
-	c = sh.FuncCmd(readFunc)
-	stdin = c.StdinPipe()
-	stdin.Write([]byte("foo\n"))
-	c.Run()
+// subreaperFunc runs in a child process, since being a subreaper would affect
+// the other tests.
+var subreaperFunc = gosh.RegisterFunc("subreaperFunc", func(script string) error {
+	sh := gosh.NewShell(nil)
+	sh.Subreaper = true
+	// The shell exits immediately, orphaning the sleep.
+	pid, err := strconv.Atoi(strings.TrimSpace(sh.Cmd("sh", "-c", script).Stdout()))
+	if err != nil {
+		return err
+	}
+	// The orphan is re-parented to this process, so Wait4 does not fail.
+	var ws syscall.WaitStatus
+	if _, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil); err != nil {
+		return fmt.Errorf("orphan %d was not re-parented: %v", pid, err)
+	}
+	// Cleanup kills and reaps the orphan, so it no longer exists.
+	sh.Cleanup()
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		return fmt.Errorf("orphan %d still exists: %v", pid, err)
+	}
+	return nil
+})
 
-	// No stdin, so cat should exit immediately.
-	c = sh.FuncCmd(catFunc)
-	eq(t, c.Stdout(), "")
+func TestSubreaper(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
 
-	// It's an error to call both StdinPipe and SetStdinReader.
-	c = sh.FuncCmd(catFunc)
-	c.StdinPipe()
-	setsErr(t, sh, func() { c.StdinPipe() })
+	if runtime.GOOS != "linux" {
+		sh.ContinueOnError = true
+		sh.Subreaper = true
+		sh.FuncCmd(exitFunc, 0).Run()
+		nok(t, sh.Err)
+		return
+	}
+	sh.FuncCmd(subreaperFunc, "sleep 3600 >/dev/null 2>&1 & echo $!").Run()
+	// Orphans that daemonize by moving to a new session are also found. Since
+	// the shell isn't interactive, setsid runs in its process group and doesn't
+	// need to fork.
+	sh.FuncCmd(subreaperFunc, "setsid sleep 3600 >/dev/null 2>&1 & echo $!").Run()
+}
 
-	c = sh.FuncCmd(catFunc)
-	c.StdinPipe()
-	setsErr(t, sh, func() { c.SetStdinReader(strings.NewReader("")) })
+var pgidFunc = gosh.RegisterFunc("pgidFunc", func() error {
+	pgid, err := syscall.Getpgid(0)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d,%d", os.Getpid(), pgid)
+	return nil
+})
 
-	c = sh.FuncCmd(catFunc)
-	c.SetStdinReader(strings.NewReader(""))
-	setsErr(t, sh, func() { c.StdinPipe() })
+func TestSysProcAttr(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
 
-	c = sh.FuncCmd(catFunc)
-	c.SetStdinReader(strings.NewReader(""))
-	setsErr(t, sh, func() { c.SetStdinReader(strings.NewReader("")) })
+	// The child is always started in its own process group, and the given
+	// SysProcAttr is not modified.
+	attr := &syscall.SysProcAttr{}
+	c := sh.FuncCmd(pgidFunc)
+	c.SysProcAttr = attr
+	ids := strings.Split(c.Stdout(), ",")
+	eq(t, len(ids), 2)
+	eq(t, ids[0], ids[1])
+	eq(t, attr.Setpgid, false)
 }
 
-func TestStdinPipeWriteUntilExit(t *testing.T) {
+var nsInfoFunc = gosh.RegisterFunc("nsInfoFunc", func() error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, iface := range ifaces {
+		names = append(names, iface.Name)
+	}
+	fmt.Printf("%d,%s", os.Getpid(), strings.Join(names, ","))
+	return nil
+})
+
+func TestNamespaces(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	// Ensure that Write calls on stdin fail after the process exits. Note that we
-	// write to the command's stdin concurrently with the command's exit waiter
-	// goroutine closing stdin. Use "go test -race" catch races.
-	//
-	// Set a non-zero exit code, so that os.Exit exits immediately. See the
-	// implementation of https://golang.org/pkg/os/#Exit for details.
-	c := sh.FuncCmd(exitFunc, 1)
-	c.ExitErrorIsOk = true
-	stdin := c.StdinPipe()
-	c.Start()
-	for {
-		if _, err := stdin.Write([]byte("a")); err != nil {
-			return
-		}
+	c := sh.FuncCmd(nsInfoFunc)
+	c.Namespaces = gosh.NewUserNamespace | gosh.NewPIDNamespace | gosh.NewNetworkNamespace | gosh.NewMountNamespace
+	if runtime.GOOS != "linux" {
+		setsErr(t, sh, func() { c.Run() })
+		return
 	}
+	sh.ContinueOnError = true
+	out := c.Stdout()
+	if sh.Err != nil {
+		t.Skipf("namespaces not permitted: %v", sh.Err)
+	}
+	eq(t, out, "1,lo")
 }
 
-var writeFunc = gosh.RegisterFunc("writeFunc", func(stdout, stderr bool) error {
-	if stdout {
-		if _, err := os.Stdout.Write([]byte("A")); err != nil {
-			return err
-		}
-	}
-	if stderr {
-		if _, err := os.Stderr.Write([]byte("B")); err != nil {
-			return err
-		}
-	}
-	if stdout {
-		if _, err := os.Stdout.Write([]byte("A")); err != nil {
-			return err
-		}
-	}
-	if stderr {
-		if _, err := os.Stderr.Write([]byte("B")); err != nil {
-			return err
-		}
+var rlimitFunc = gosh.RegisterFunc("rlimitFunc", func() error {
+	var r syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r); err != nil {
+		return err
 	}
+	fmt.Printf("%d,%d", r.Cur, r.Max)
 	return nil
 })
 
-func TestStdoutStderr(t *testing.T) {
+func TestRlimits(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	// Write to stdout only.
-	c := sh.FuncCmd(writeFunc, true, false)
-	stdoutPipe, stderrPipe := c.StdoutPipe(), c.StderrPipe()
-	stdout, stderr := c.StdoutStderr()
-	eq(t, stdout, "AA")
-	eq(t, stderr, "")
-	eq(t, toString(t, stdoutPipe), "AA")
-	eq(t, toString(t, stderrPipe), "")
+	var r syscall.Rlimit
+	ok(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r))
+	eq(t, sh.FuncCmd(rlimitFunc).Stdout(), fmt.Sprintf("%d,%d", r.Cur, r.Max))
 
-	// Write to stderr only.
-	c = sh.FuncCmd(writeFunc, false, true)
-	stdoutPipe, stderrPipe = c.StdoutPipe(), c.StderrPipe()
-	stdout, stderr = c.StdoutStderr()
-	eq(t, stdout, "")
-	eq(t, stderr, "BB")
-	eq(t, toString(t, stdoutPipe), "")
-	eq(t, toString(t, stderrPipe), "BB")
+	c := sh.FuncCmd(rlimitFunc)
+	c.Rlimits = []gosh.Rlimit{{Resource: syscall.RLIMIT_NOFILE, Cur: 32, Max: 64}}
+	eq(t, c.Clone().Stdout(), "32,64")
 
-	// Write to both stdout and stderr.
-	c = sh.FuncCmd(writeFunc, true, true)
-	stdoutPipe, stderrPipe = c.StdoutPipe(), c.StderrPipe()
-	stdout, stderr = c.StdoutStderr()
-	eq(t, stdout, "AA")
-	eq(t, stderr, "BB")
-	eq(t, toString(t, stdoutPipe), "AA")
-	eq(t, toString(t, stderrPipe), "BB")
+	// Raising the hard limit above that of the parent fails, unless privileged.
+	if os.Geteuid() != 0 && r.Max != ^uint64(0) {
+		c = sh.FuncCmd(rlimitFunc)
+		c.Rlimits = []gosh.Rlimit{{Resource: syscall.RLIMIT_NOFILE, Cur: r.Max + 1, Max: r.Max + 1}}
+		setsErr(t, sh, func() { c.Run() })
+	}
+
+	// Other commands can't apply the limits, so Start fails.
+	c = sh.Cmd("true")
+	c.Rlimits = []gosh.Rlimit{{Resource: syscall.RLIMIT_NOFILE, Cur: 32, Max: 64}}
+	setsErr(t, sh, func() { c.Start() })
 }
 
-var writeMoreFunc = gosh.RegisterFunc("writeMoreFunc", func() {
-	sh := gosh.NewShell(nil)
+var extraFileFunc = gosh.RegisterFunc("extraFileFunc", func(name string, i int) error {
+	f := gosh.ExtraFileByName(name)
+	if f == nil || gosh.ExtraFile(i) != f {
+		return fmt.Errorf("bad extra file %q", name)
+	}
+	_, err := fmt.Fprintf(f, "hello %s", name)
+	return err
+})
+
+func TestExtraFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ExtraFiles is not supported on windows")
+	}
+	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	c := sh.FuncCmd(writeFunc, true, true)
-	c.AddStdoutWriter(os.Stdout)
-	c.AddStderrWriter(os.Stderr)
+	pr, pw, err := os.Pipe()
+	ok(t, err)
+	defer pr.Close()
+	c := sh.FuncCmd(extraFileFunc, "out", 1)
+	c.ExtraFiles = []*os.File{os.Stdin}
+	c.AddExtraFile("out", pw)
+	eq(t, len(c.ExtraFiles), 2)
+	setsErr(t, sh, func() { c.AddExtraFile("out", pw) })
 	c.Run()
+	pw.Close()
+	buf, err := ioutil.ReadAll(pr)
+	ok(t, err)
+	eq(t, string(buf), "hello out")
 
-	fmt.Fprint(os.Stdout, " stdout done")
-	fmt.Fprint(os.Stderr, " stderr done")
+	// Unknown names and indices are reported as missing.
+	c = sh.FuncCmd(extraFileFunc, "missing", 0)
+	c.ExtraFiles = []*os.File{os.Stdin}
+	setsErr(t, sh, func() { c.Run() })
+	eq(t, gosh.ExtraFile(0), (*os.File)(nil))
+	eq(t, gosh.ExtraFileByName("out"), (*os.File)(nil))
+}
+
+var serveOnceFunc = gosh.RegisterFunc("serveOnceFunc", func(name string) error {
+	l, err := gosh.Listener(name)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "hello from %s", name)
+	return err
 })
 
-// Tests that it's safe to add os.Stdout and os.Stderr as writers.
-func TestAddStdoutStderrWriter(t *testing.T) {
+func TestListen(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ExtraFiles is not supported on windows")
+	}
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	stdout, stderr := sh.FuncCmd(writeMoreFunc).StdoutStderr()
-	eq(t, stdout, "AA stdout done")
-	eq(t, stderr, "BB stderr done")
+	c := sh.FuncCmd(serveOnceFunc, "srv")
+	addr := c.Listen("srv", "tcp", "127.0.0.1:0")
+	// The socket accepts connections before the child has started.
+	conn, err := net.Dial(addr.Network(), addr.String())
+	ok(t, err)
+	defer conn.Close()
+	c.Start()
+	buf, err := ioutil.ReadAll(conn)
+	ok(t, err)
+	eq(t, string(buf), "hello from srv")
+	c.Wait()
+
+	// The child fails to retrieve a listener that was not passed to it.
+	c = sh.FuncCmd(serveOnceFunc, "missing")
+	c.Listen("srv", "tcp", "127.0.0.1:0")
+	setsErr(t, sh, func() { c.Run() })
+	setsErr(t, sh, func() { c.Listen("srv", "tcp", "127.0.0.1:0") })
 }
 
-func TestCombinedOutput(t *testing.T) {
+var listenFunc = gosh.RegisterFunc("listenFunc", func(network, addr string, delay time.Duration) error {
+	time.Sleep(delay)
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+})
+
+func TestAwaitListening(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not supported on windows")
+	}
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	c := sh.FuncCmd(writeFunc, true, true)
-	buf := &bytes.Buffer{}
-	c.AddStdoutWriter(buf)
-	c.AddStderrWriter(buf)
-	output := c.CombinedOutput()
-	// Note, we can't assume any particular ordering of stdout and stderr, so we
-	// simply check the length of the combined output.
-	eq(t, len(output), 4)
-	// The ordering must be the same, regardless of how we captured the combined
-	// output.
-	eq(t, output, buf.String())
+	addr := filepath.Join(sh.MakeTempDir(), "sock")
+	c := sh.FuncCmd(listenFunc, "unix", addr, 200*time.Millisecond)
+	setsErr(t, sh, func() { c.AwaitListening("unix", addr, time.Minute) })
+	c.Start()
+	c.AwaitListening("unix", addr, time.Minute)
+	// Subsequent calls return immediately.
+	c.AwaitListening("unix", addr, time.Millisecond)
+	c.Terminate(os.Interrupt)
+
+	// AwaitListening fails if the address isn't listening within the timeout.
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitListening("unix", addr+"2", 100*time.Millisecond) })
+	c.Terminate(os.Interrupt)
+
+	// AwaitListening fails if the process exits first.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitListening("unix", addr+"2", time.Minute) })
 }
 
-func TestOutputDir(t *testing.T) {
+func TestAwaitFileExists(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
 	dir := sh.MakeTempDir()
-	c := sh.FuncCmd(writeFunc, true, true)
-	c.OutputDir = dir
-	c.Run()
+	c := sh.FuncCmd(writeFileFunc, "foo")
+	c.Dir = dir
+	c.Start()
+	c.AwaitFileExists("foo", time.Minute)
+	c.AwaitFileExists(filepath.Join(dir, "foo"), time.Minute)
+	c.Wait()
 
-	matches, err := filepath.Glob(filepath.Join(dir, "*.stdout"))
-	ok(t, err)
-	eq(t, len(matches), 1)
-	stdout, err := ioutil.ReadFile(matches[0])
-	ok(t, err)
-	eq(t, string(stdout), "AA")
+	// AwaitFileExists fails if the file isn't created within the timeout.
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitFileExists(filepath.Join(dir, "bar"), 100*time.Millisecond) })
+	c.Terminate(os.Interrupt)
 
-	matches, err = filepath.Glob(filepath.Join(dir, "*.stderr"))
-	ok(t, err)
-	eq(t, len(matches), 1)
-	stderr, err := ioutil.ReadFile(matches[0])
-	ok(t, err)
-	eq(t, string(stderr), "BB")
+	// AwaitFileExists fails if the process exits first.
+	c = sh.FuncCmd(exitFunc, 0)
+	c.Start()
+	setsErr(t, sh, func() { c.AwaitFileExists(filepath.Join(dir, "bar"), time.Minute) })
 }
 
-var replaceFunc = gosh.RegisterFunc("replaceFunc", func(old, new byte) error {
-	buf := make([]byte, 1024)
-	for {
-		n, err := os.Stdin.Read(buf)
-		switch {
-		case err == io.EOF:
-			return nil
-		case err != nil:
-			return err
+func TestAwaitReady(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+
+	// Custom probes are called until they succeed.
+	n := 0
+	c.AwaitReady(func() error {
+		if n++; n < 3 {
+			return fakeError
 		}
-		rep := bytes.Replace(buf[:n], []byte{old}, []byte{new}, -1)
-		if _, err := os.Stdout.Write(rep); err != nil {
-			return err
+		return nil
+	}, time.Millisecond, time.Minute)
+	eq(t, n, 3)
+
+	// HTTPProbe waits for a successful status code.
+	var mu sync.Mutex
+	healthy := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
 		}
-	}
-})
+	}))
+	defer ts.Close()
+	setsErr(t, sh, func() { c.AwaitReady(gosh.HTTPProbe(ts.URL), 0, 100*time.Millisecond) })
+	mu.Lock()
+	healthy = true
+	mu.Unlock()
+	c.AwaitReady(gosh.HTTPProbe(ts.URL), 0, time.Minute)
+	c.AwaitReady(gosh.DialProbe("tcp", ts.Listener.Addr().String()), 0, time.Minute)
+
+	// The timeout error includes the probe's most recent error.
+	sh.ContinueOnError = true
+	c.AwaitReady(func() error { return fakeError }, 0, 100*time.Millisecond)
+	eq(t, strings.Contains(sh.Err.Error(), fakeError.Error()), true)
+	sh.Err = nil
+	sh.ContinueOnError = false
+	c.Terminate(os.Interrupt)
+}
 
-func TestSignal(t *testing.T) {
+func TestReport(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c0 := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c0.Start()
+	c0.AwaitVars("ready")
+	c1 := sh.Cmd("echo", "foo")
+	c1.ExitErrorIsOk = true
+	c1.Run()
+	t0, t1 := c0.Timing(), c1.Timing()
+	eq(t, t0.Start.IsZero() || t0.Ready.Before(t0.Start), false)
+	eq(t, t0.Exit.IsZero(), true)
+	eq(t, t1.Ready.IsZero(), true)
+	eq(t, t1.Exit.Before(t1.Start), false)
+	eq(t, sh.Cmd("echo").Timing(), gosh.CmdTiming{})
+
+	buf := &bytes.Buffer{}
+	sh.Report(buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	eq(t, len(lines), 3)
+	eq(t, strings.Fields(lines[0]), []string{"PID", "COMMAND", "START", "READY", "EXIT", "STATUS"})
+	eq(t, strings.Fields(lines[1])[1], "sleepFunc()")
+	eq(t, strings.HasSuffix(lines[1], "running"), true)
+	eq(t, strings.Fields(lines[2])[1:3], []string{"echo", "foo"})
+	eq(t, strings.HasSuffix(lines[2], "exit 0"), true)
+	c0.Terminate(os.Interrupt)
+}
+
+func TestTerminate(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
@@ -853,78 +3403,136 @@ func TestSignal(t *testing.T) {
 			c.AwaitVars("ready")
 			// Wait for a bit to allow the zero-sleep commands to exit.
 			time.Sleep(100 * time.Millisecond)
-			c.Signal(s)
-			switch {
-			case s == os.Interrupt:
-				// Wait should succeed as long as the exit code was 0, regardless of
-				// whether the signal arrived or the process had already exited.
-				c.Wait()
-			case d != 0:
-				// Note: We don't call Wait in the {d: 0, s: os.Kill} case because doing
-				// so makes the test flaky on slow systems.
-				setsErr(t, sh, func() { c.Wait() })
-			}
+			// Terminate should succeed regardless of the exit code, and regardless of
+			// whether the signal arrived or the process had already exited.
+			c.Terminate(s)
 		}
 	}
 
-	// Signal should fail if Wait has been called.
+	// Terminate should succeed if Wait has been called, and may be called
+	// repeatedly.
 	c := sh.FuncCmd(sleepFunc, time.Duration(0), 0)
 	c.Run()
-	setsErr(t, sh, func() { c.Signal(os.Interrupt) })
-}
+	c.Terminate(os.Interrupt)
+	c.Terminate(os.Interrupt)
 
-var processGroup = gosh.RegisterFunc("processGroup", func(n int) {
-	pids := make([]string, n)
-	for x := 0; x < n; x++ {
-		c := exec.Command("sleep", "3600")
-		c.Start()
-		pids[x] = strconv.Itoa(c.Process.Pid)
-	}
-	gosh.SendVars(map[string]string{"pids": strings.Join(pids, ",")})
-	time.Sleep(time.Minute)
-})
+	// Wait should return the same result each time.
+	c = sh.FuncCmd(exitFunc, 1)
+	c.Start()
+	setsErr(t, sh, func() { c.Wait() })
+	setsErr(t, sh, func() { c.Wait() })
+	eq(t, c.ExitCode(), 1)
+	c.Terminate(os.Interrupt)
+
+	// Terminate should also succeed for other errors that mean the process has
+	// exited: an intercepted non-zero exit, a panic in a FuncCmd, and a canceled
+	// Context.
+	const name = "gosh-test-nonexistent"
+	sh.Intercept(name, nil, gosh.CannedOutput("", "", 3))
+	c = sh.Cmd(name)
+	c.Start()
+	c.Terminate(os.Interrupt)
+	c.Terminate(os.Interrupt)
+	eq(t, c.ExitCode(), 3)
+	c = sh.FuncCmd(panicFunc)
+	exitErr := make(chan error, 1)
+	c.OnExit(func(err error) { exitErr <- err })
+	c.Start()
+	_, isPanicErr := (<-exitErr).(*gosh.PanicError)
+	eq(t, isPanicErr, true)
+	c.Terminate(os.Interrupt)
+	ctx, cancel := context.WithCancel(context.Background())
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Context = ctx
+	c.Start()
+	c.AwaitVars("ready")
+	cancel()
+	c.Terminate(os.Interrupt)
+	ok(t, sh.Err)
+	f := sh.FuncCmd(panicFunc).CloneN(2, nil)
+	f.Start()
+	f.Terminate(os.Interrupt)
+	ok(t, sh.Err)
 
-func TestCleanupProcessGroup(t *testing.T) {
+	// Kill also works with SignalProcessGroup, and is not caught by the process.
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.SignalProcessGroup = true
+	c.Start()
+	c.AwaitVars("ready")
+	c.Signal(gosh.Kill)
+	setsErr(t, sh, func() { c.Wait() })
+	neq(t, c.ExitCode(), 0)
+}
+
+func TestShutdown(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	c := sh.FuncCmd(processGroup, 5)
+	// The process exits within the grace period.
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
 	c.Start()
-	pids := c.AwaitVars("pids")["pids"]
-	c.Signal(os.Interrupt)
+	c.AwaitVars("ready")
+	start := time.Now()
+	c.Shutdown(os.Interrupt, time.Hour)
+	eq(t, time.Since(start) < time.Minute, true)
 
-	// Wait for all processes in the child's process group to exit.
-	for syscall.Kill(-c.Pid(), 0) != syscall.ESRCH {
-		time.Sleep(100 * time.Millisecond)
-	}
-	for _, pid := range strings.Split(pids, ",") {
-		p, _ := strconv.Atoi(pid)
-		eq(t, syscall.Kill(p, 0), syscall.ESRCH)
-	}
+	// The process ignores the signal, and is killed after the grace period.
+	c = sh.FuncCmd(catchTermProcessGroup, 0)
+	c.Start()
+	c.AwaitVars("pids")
+	start = time.Now()
+	c.Shutdown(syscall.SIGTERM, 100*time.Millisecond)
+	eq(t, time.Since(start) >= 100*time.Millisecond, true)
+
+	// Shutdown should succeed if Wait has been called.
+	c = sh.FuncCmd(sleepFunc, time.Duration(0), 0)
+	c.Run()
+	c.Shutdown(os.Interrupt, time.Second)
 }
 
-func TestTerminate(t *testing.T) {
+func TestSupervisor(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
 
-	for _, d := range []time.Duration{0, time.Hour} {
-		for _, s := range []os.Signal{os.Interrupt, os.Kill} {
-			fmt.Println(d, s)
-			c := sh.FuncCmd(sleepFunc, d, 0)
-			c.Start()
-			c.AwaitVars("ready")
-			// Wait for a bit to allow the zero-sleep commands to exit.
-			time.Sleep(100 * time.Millisecond)
-			// Terminate should succeed regardless of the exit code, and regardless of
-			// whether the signal arrived or the process had already exited.
-			c.Terminate(s)
+	// The command keeps failing, so the supervisor gives up after MaxRestarts.
+	s := gosh.NewSupervisor(sh.FuncCmd(exitFunc, 1))
+	s.MaxRestarts = 2
+	s.Backoff = time.Millisecond
+	s.Start()
+	var got []gosh.SupervisorEventType
+	for e := range s.Events() {
+		got = append(got, e.Type)
+		if e.Type == gosh.SupervisorExited {
+			nok(t, e.Err)
 		}
 	}
+	eq(t, got, []gosh.SupervisorEventType{
+		gosh.SupervisorStarted, gosh.SupervisorExited,
+		gosh.SupervisorStarted, gosh.SupervisorExited,
+		gosh.SupervisorStarted, gosh.SupervisorExited,
+		gosh.SupervisorGaveUp,
+	})
+	ok(t, sh.Err)
 
-	// Terminate should fail if Wait has been called.
-	c := sh.FuncCmd(sleepFunc, time.Duration(0), 0)
-	c.Run()
-	setsErr(t, sh, func() { c.Terminate(os.Interrupt) })
+	// Stop terminates the current instance, and no further instances are
+	// started.
+	s = gosh.NewSupervisor(sh.FuncCmd(sleepFunc, time.Hour, 0))
+	s.Start()
+	e := <-s.Events()
+	eq(t, e.Type, gosh.SupervisorStarted)
+	eq(t, e.Cmd, s.Cmd())
+	s.Stop(os.Kill)
+	e = <-s.Events()
+	eq(t, e.Type, gosh.SupervisorExited)
+	nok(t, e.Err)
+	_, open := <-s.Events()
+	eq(t, open, false)
+	ok(t, sh.Err)
+
+	// Start and Stop should fail if called at the wrong time.
+	setsErr(t, sh, func() { s.Start() })
+	s = gosh.NewSupervisor(sh.FuncCmd(exitFunc, 0))
+	setsErr(t, sh, func() { s.Stop(os.Kill) })
 }
 
 func TestExitErrorIsOk(t *testing.T) {
@@ -950,6 +3558,304 @@ func TestExitErrorIsOk(t *testing.T) {
 	nok(t, c.Err)
 }
 
+func TestAllowedExitCodes(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Allowed exit codes are not reported via sh.HandleError.
+	c := sh.FuncCmd(exitFunc, 1)
+	c.AllowedExitCodes = []int{1, 2}
+	c.Run()
+	nok(t, c.Err)
+	ok(t, sh.Err)
+	eq(t, c.ExitCode(), 1)
+
+	// Clones have the same allowed exit codes.
+	c = c.Clone()
+	c.Run()
+	eq(t, c.ExitCode(), 1)
+
+	// Other exit codes are.
+	c = sh.FuncCmd(exitFunc, 3)
+	c.AllowedExitCodes = []int{1, 2}
+	setsErr(t, sh, func() { c.Run() })
+	nok(t, c.Err)
+
+	// So are panics, even though they exit with code 1.
+	c = sh.FuncCmd(panicFunc)
+	c.AllowedExitCodes = []int{1}
+	setsErr(t, sh, func() { c.Run() })
+}
+
+func TestWindowsOptions(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Commands run with all options set, and the options are cloned. On other
+	// platforms, the options are ignored.
+	c := sh.FuncCmd(printFunc, "hello")
+	c.Windows = gosh.WindowsOptions{HideWindow: true, NewProcessGroup: true}
+	c = c.Clone()
+	eq(t, c.Windows, gosh.WindowsOptions{HideWindow: true, NewProcessGroup: true})
+	eq(t, c.Stdout(), "hello")
+
+	// With NewProcessGroup, os.Interrupt is supported on all platforms.
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Windows.NewProcessGroup = true
+	c.Start()
+	c.AwaitVars("ready")
+	c.Terminate(os.Interrupt)
+	eq(t, c.ExitCode(), 0)
+}
+
+func TestExitCode(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(exitFunc, 0)
+	eq(t, c.ExitCode(), -1)
+	eq(t, c.ProcessState() == nil, true)
+	c.Run()
+	eq(t, c.ExitCode(), 0)
+	eq(t, c.ProcessState().Success(), true)
+
+	c = sh.FuncCmd(exitFunc, 3)
+	c.ExitErrorIsOk = true
+	c.Start()
+	eq(t, c.ExitCode(), -1)
+	c.Wait()
+	eq(t, c.ExitCode(), 3)
+	eq(t, c.ProcessState().Success(), false)
+
+	// A process terminated by a signal has exit code -1.
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	c.AwaitVars("ready")
+	c.Terminate(os.Kill)
+	eq(t, c.ExitCode(), -1)
+	eq(t, c.ProcessState() != nil, true)
+}
+
+func TestExitStatus(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(exitFunc, 3)
+	c.ExitErrorIsOk = true
+	eq(t, c.ExitStatus() == nil, true)
+	c.Run()
+	eq(t, *c.ExitStatus(), gosh.ExitStatus{Code: 3})
+	eq(t, c.ExitStatus().Signaled(), false)
+	eq(t, c.ExitStatus().String(), "exit code 3")
+
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	c.AwaitVars("ready")
+	c.Terminate(os.Kill)
+	if runtime.GOOS == "windows" {
+		eq(t, c.ExitStatus().Signaled(), false)
+	} else {
+		eq(t, *c.ExitStatus(), gosh.ExitStatus{Code: -1, Signal: os.Kill})
+		eq(t, c.ExitStatus().String(), "signal: killed")
+	}
+}
+
+var spinFunc = gosh.RegisterFunc("spinFunc", func(d time.Duration) {
+	for start := time.Now(); time.Since(start) < d; {
+	}
+})
+
+func TestUsage(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	c := sh.FuncCmd(spinFunc, 200*time.Millisecond)
+	eq(t, c.Usage() == nil, true)
+	c.Run()
+	u := c.Usage()
+	eq(t, u.UserTime+u.SystemTime >= 100*time.Millisecond, true)
+	eq(t, u.MaxRSS > 0, true)
+}
+
+func TestInactivityTimeout(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// A command that produces no output is terminated.
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.InactivityTimeout = 200 * time.Millisecond
+	c.Start()
+	setsErr(t, sh, func() { c.Wait() })
+	eq(t, strings.Contains(c.Err.Error(), "InactivityTimeout"), true)
+
+	// A command that keeps producing output is not, even if it runs for longer
+	// than the timeout.
+	c = sh.Cmd("sh", "-c", "for i in 1 2 3 4 5 6; do echo $i; sleep 0.25; done")
+	c.InactivityTimeout = time.Second
+	eq(t, c.Stdout(), "1\n2\n3\n4\n5\n6\n")
+}
+
+func TestClock(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+	clock := gosh.NewFakeClock(time.Unix(0, 0))
+	sh.Clock = clock
+
+	// Timers fire in order once the clock has been advanced past them.
+	var fired []int
+	clock.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	clock.AfterFunc(time.Second, func() { fired = append(fired, 1) })
+	stopped := clock.AfterFunc(time.Second, func() { fired = append(fired, 3) })
+	eq(t, stopped.Stop(), true)
+	clock.Advance(time.Second - 1)
+	eq(t, len(fired), 0)
+	clock.Advance(time.Hour)
+	eq(t, fired, []int{1, 2})
+	eq(t, clock.Now(), time.Unix(0, 0).Add(time.Hour+time.Second-1))
+
+	// InactivityTimeout only fires once the clock has been advanced.
+	c := sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.InactivityTimeout = time.Minute
+	c.Start()
+	c.AwaitVars("ready")
+	clock.Advance(time.Minute - 1)
+	clock.Advance(time.Minute)
+	setsErr(t, sh, func() { c.Wait() })
+	eq(t, strings.Contains(c.Err.Error(), "InactivityTimeout"), true)
+
+	// So does ExitAfter, which is enforced by the Shell.
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.ExitAfter = time.Hour
+	c.Start()
+	clock.Advance(time.Hour)
+	setsErr(t, sh, func() { c.Wait() })
+	eq(t, strings.Contains(c.Err.Error(), "ExitAfter"), true)
+
+	// So do the timeouts of AwaitVarsFor and the like. A new clock ensures that
+	// the only timer is the one armed by AwaitVarsPartial.
+	clock = gosh.NewFakeClock(time.Unix(0, 0))
+	sh.Clock = clock
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	var vars map[string]string
+	var missing []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		vars, missing = c.AwaitVarsPartial(map[string]time.Duration{"ready": 0, "foo": time.Minute})
+	}()
+	clock.BlockUntil(1)
+	eq(t, clock.Waiters(), 1)
+	clock.Advance(time.Minute)
+	<-done
+	eq(t, vars, map[string]string{"ready": ""})
+	eq(t, missing, []string{"foo"})
+
+	// And the probe interval and timeout of AwaitReady. Each wait arms two
+	// timers: one for the timeout, and one for the next probe.
+	calls := 0
+	probe := func() error {
+		if calls++; calls < 3 {
+			return errors.New("not ready")
+		}
+		return nil
+	}
+	go func() {
+		for i := 0; i < 2; i++ {
+			clock.BlockUntil(2)
+			clock.Advance(time.Second)
+		}
+	}()
+	c.AwaitReady(probe, time.Second, time.Hour)
+	eq(t, calls, 3)
+	go func() {
+		clock.BlockUntil(2)
+		clock.Advance(time.Minute)
+	}()
+	setsErr(t, sh, func() { c.AwaitReady(gosh.FileProbe(""), time.Hour, time.Minute) })
+	eq(t, errors.Is(c.Err, gosh.ErrTimedOut), true)
+	c.Terminate(os.Interrupt)
+
+	// And SetDeadline.
+	sh.SetDeadline(clock.Now().Add(time.Hour))
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	clock.Advance(time.Hour)
+	setsErr(t, sh, func() { c.Wait() })
+	eq(t, c.Err, gosh.ErrDeadlineExceeded)
+}
+
+// heartbeatFunc sends a heartbeat for each line read from stdin, followed by a
+// var named after the line, so that the parent knows the heartbeat has been
+// received.
+var heartbeatFunc = gosh.RegisterFunc("heartbeatFunc", func() error {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		gosh.SendHeartbeat()
+		gosh.SendVars(map[string]string{scanner.Text(): ""})
+	}
+	return scanner.Err()
+})
+
+func TestHeartbeat(t *testing.T) {
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Children send heartbeats periodically per Cmd.Heartbeat.
+	c := sh.FuncCmd(sleepFunc, 100*time.Millisecond, 0)
+	c.Heartbeat = time.Millisecond
+	eq(t, c.LastHeartbeat().IsZero(), true)
+	c.Run()
+	eq(t, c.LastHeartbeat().IsZero(), false)
+
+	// A child that sends heartbeats only stalls once it stops sending them.
+	clock := gosh.NewFakeClock(time.Unix(0, 0))
+	sh.Clock = clock
+	c = sh.FuncCmd(heartbeatFunc)
+	stdin := c.StdinPipe()
+	var stalls []time.Time
+	c.OnStall(time.Minute, func(last time.Time) { stalls = append(stalls, last) })
+	c.Start()
+	clock.Advance(time.Minute - 1)
+	_, err := io.WriteString(stdin, "a\n")
+	ok(t, err)
+	c.AwaitVars("a")
+	last := c.LastHeartbeat()
+	eq(t, last, clock.Now())
+	clock.Advance(time.Minute - 1)
+	eq(t, len(stalls), 0)
+	clock.Advance(1)
+	eq(t, stalls, []time.Time{last})
+	// It stalls again only after sending another heartbeat.
+	clock.Advance(time.Hour)
+	eq(t, len(stalls), 1)
+	_, err = io.WriteString(stdin, "b\n")
+	ok(t, err)
+	c.AwaitVars("b")
+	clock.Advance(time.Minute)
+	eq(t, stalls, []time.Time{last, clock.Now().Add(-time.Minute)})
+	ok(t, stdin.Close())
+	c.Wait()
+
+	// A child that sends no heartbeats stalls right away, per Shell.Clock.
+	c = sh.FuncCmd(sleepFunc, time.Hour, 0)
+	c.Start()
+	c.AwaitVars("ready")
+	calls := 0
+	c.OnStall(time.Minute, func(last time.Time) {
+		eq(t, last.IsZero(), true)
+		calls++
+	})
+	clock.Advance(time.Minute - 1)
+	eq(t, calls, 0)
+	clock.Advance(time.Hour)
+	eq(t, calls, 1)
+	c.Terminate(os.Interrupt)
+
+	// OnStall requires a positive duration.
+	setsErr(t, sh, func() { c.OnStall(0, func(time.Time) {}) })
+}
+
 func TestIgnoreClosedPipeError(t *testing.T) {
 	sh := gosh.NewShell(t)
 	defer sh.Cleanup()
@@ -1129,3 +4035,108 @@ func TestBuildGoPkg(t *testing.T) {
 	c = sh.Cmd(absName)
 	eq(t, c.Stdout(), helloWorldStr)
 }
+
+// Tests BuildGoPkgOpts.
+func TestBuildGoPkgOpts(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	sh := gosh.NewShell(t)
+	defer sh.Cleanup()
+
+	// Tags and LDFlags are passed through, and the binary is written to binDir.
+	binDir := sh.MakeTempDir()
+	binPath := gosh.BuildGoPkgOpts(sh, binDir, helloWorldPkg, gosh.BuildOpts{
+		Tags:    []string{"foo", "bar"},
+		LDFlags: "-s -w",
+	})
+	eq(t, binPath, filepath.Join(binDir, "hello_world"))
+	eq(t, sh.Cmd(binPath).Stdout(), helloWorldStr)
+
+	// Binaries for other platforms go in a subdirectory named after the target.
+	goos := "windows"
+	if runtime.GOOS == "windows" {
+		goos = "linux"
+	}
+	binPath = gosh.BuildGoPkgOpts(sh, binDir, helloWorldPkg, gosh.BuildOpts{GOOS: goos, GOARCH: "amd64"})
+	want := filepath.Join(binDir, goos+"_amd64", "hello_world")
+	if goos == "windows" {
+		want += ".exe"
+	}
+	eq(t, binPath, want)
+	_, err := os.Stat(binPath)
+	ok(t, err)
+
+	// An explicit -o takes precedence.
+	binPath = gosh.BuildGoPkgOpts(sh, binDir, helloWorldPkg, gosh.BuildOpts{GOARCH: "amd64", Flags: []string{"-o", "hw"}})
+	eq(t, binPath, filepath.Join(binDir, "hw"))
+}
+
+// Tests that BuildGoPkg reuses binaries from Shell.BuildCacheDir.
+func TestBuildGoPkgCache(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	tb := &customTB{t: t, buf: &bytes.Buffer{}}
+	sh := gosh.NewShell(tb)
+	defer sh.Cleanup()
+	sh.BuildCacheDir = sh.MakeTempDir()
+
+	// The first build populates the cache.
+	binPath := gosh.BuildGoPkg(sh, sh.MakeTempDir(), helloWorldPkg)
+	eq(t, sh.Cmd(binPath).Stdout(), helloWorldStr)
+	eq(t, strings.Contains(tb.buf.String(), "Using cached executable"), false)
+	entries, err := ioutil.ReadDir(sh.BuildCacheDir)
+	ok(t, err)
+	eq(t, len(entries), 1)
+
+	// A second Shell with the same cache dir reuses the cached binary.
+	tb.Reset()
+	sh2 := gosh.NewShell(tb)
+	defer sh2.Cleanup()
+	sh2.BuildCacheDir = sh.BuildCacheDir
+	binPath = gosh.BuildGoPkg(sh2, sh.MakeTempDir(), helloWorldPkg)
+	eq(t, sh2.Cmd(binPath).Stdout(), helloWorldStr)
+	eq(t, strings.Contains(tb.buf.String(), "Using cached executable"), true)
+	entries, err = ioutil.ReadDir(sh.BuildCacheDir)
+	ok(t, err)
+	eq(t, len(entries), 1)
+
+	// Different build flags yield a different cache entry.
+	binPath = gosh.BuildGoPkg(sh, sh.MakeTempDir(), helloWorldPkg, "-ldflags=-s")
+	eq(t, sh.Cmd(binPath).Stdout(), helloWorldStr)
+	entries, err = ioutil.ReadDir(sh.BuildCacheDir)
+	ok(t, err)
+	eq(t, len(entries), 2)
+	ok(t, sh.Err)
+	ok(t, sh2.Err)
+}
+
+func benchmarkRun(b *testing.B, fastSpawn bool, makeCmd func(sh *gosh.Shell) *gosh.Cmd) {
+	sh := gosh.NewShell(b)
+	defer sh.Cleanup()
+	sh.FastSpawn = fastSpawn
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		makeCmd(sh).Run()
+	}
+}
+
+func BenchmarkRun(b *testing.B) {
+	if runtime.GOOS == "windows" {
+		b.Skip("true is not available on windows")
+	}
+	for _, fastSpawn := range []bool{false, true} {
+		b.Run(fmt.Sprintf("FastSpawn=%v", fastSpawn), func(b *testing.B) {
+			benchmarkRun(b, fastSpawn, func(sh *gosh.Shell) *gosh.Cmd { return sh.Cmd("true") })
+		})
+	}
+}
+
+func BenchmarkRunFunc(b *testing.B) {
+	for _, fastSpawn := range []bool{false, true} {
+		b.Run(fmt.Sprintf("FastSpawn=%v", fastSpawn), func(b *testing.B) {
+			benchmarkRun(b, fastSpawn, func(sh *gosh.Shell) *gosh.Cmd { return sh.FuncCmd(exitFunc, 0) })
+		})
+	}
+}
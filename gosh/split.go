@@ -0,0 +1,83 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+var (
+	errEmptyCommand      = errors.New("gosh: empty command string")
+	errTrailingBackslash = errors.New("gosh: command string ends with a backslash")
+	errUnterminatedQuote = errors.New("gosh: command string has an unterminated quote")
+)
+
+// splitCommand splits s into words, following the quoting rules of the POSIX
+// shell: words are separated by unquoted whitespace; a backslash outside of
+// quotes preserves the literal value of the next character, and a backslash
+// followed by a newline is removed; single quotes preserve the literal value
+// of all enclosed characters; and double quotes preserve the literal value of
+// all enclosed characters except backslash, which only escapes '$', '`', '"',
+// '\' and newline. No other expansion or substitution is performed, so
+// characters such as '$', '*' and '|' have no special meaning.
+func splitCommand(s string) ([]string, error) {
+	var words []string
+	var word bytes.Buffer
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case ' ', '\t', '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case '\\':
+			if i+1 == len(s) {
+				return nil, errTrailingBackslash
+			}
+			i++
+			if s[i] != '\n' {
+				word.WriteByte(s[i])
+				inWord = true
+			}
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errUnterminatedQuote
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += 1 + end
+			inWord = true
+		case '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					switch s[i+1] {
+					case '$', '`', '"', '\\':
+						i++
+					case '\n':
+						i++
+						continue
+					}
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, errUnterminatedQuote
+			}
+			inWord = true
+		default:
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
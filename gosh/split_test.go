@@ -0,0 +1,43 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+		err  error
+	}{
+		{``, nil, nil},
+		{` 	`, nil, nil},
+		{`ls`, []string{"ls"}, nil},
+		{`  ls  -la  `, []string{"ls", "-la"}, nil},
+		{`ls -la "a b"`, []string{"ls", "-la", "a b"}, nil},
+		{`echo 'a "b" \c'`, []string{"echo", `a "b" \c`}, nil},
+		{`echo "a 'b' \c \$d \"e\" \\f"`, []string{"echo", `a 'b' \c $d "e" \f`}, nil},
+		{`echo a\ b \'c\' \\`, []string{"echo", "a b", "'c'", `\`}, nil},
+		{"echo a\\\nb \"c\\\nd\"", []string{"echo", "ab", "cd"}, nil},
+		{`echo ''  "" x""y`, []string{"echo", "", "", "xy"}, nil},
+		{`echo $HOME * | grep x`, []string{"echo", "$HOME", "*", "|", "grep", "x"}, nil},
+		{`echo 'a`, nil, errUnterminatedQuote},
+		{`echo "a`, nil, errUnterminatedQuote},
+		{`echo "a\"`, nil, errUnterminatedQuote},
+		{`echo a\`, nil, errTrailingBackslash},
+	}
+	for _, test := range tests {
+		got, err := splitCommand(test.s)
+		if err != test.err {
+			t.Errorf("%q: got error %v, want %v", test.s, err, test.err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.s, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// StdinMode specifies when a command's stdin is closed; see Cmd.StdinMode.
+// Some programs treat EOF on stdin as a signal to shut down, so the choice
+// determines how long they run.
+type StdinMode int
+
+const (
+	// StdinCloseOnEOF closes the process's stdin once the reader passed to
+	// SetStdinReader is exhausted, or right away if stdin is not configured.
+	StdinCloseOnEOF StdinMode = iota
+	// StdinKeepOpen keeps the process's stdin open after the reader passed to
+	// SetStdinReader, if any, is exhausted, until the process exits.
+	StdinKeepOpen
+	// StdinCloseOnParentEOF copies the calling process's stdin to the process's
+	// stdin after the reader passed to SetStdinReader, if any, is exhausted,
+	// and closes the process's stdin once the calling process's stdin reaches
+	// EOF. This lets the process shut down along with the calling process's
+	// input. Since the calling process's stdin is consumed, at most one command
+	// should use this mode at a time.
+	StdinCloseOnParentEOF
+)
+
+////////////////////////////////////////
+// Internals
+
+// setupStdinMode configures the process's stdin per c.StdinMode. Stdin is fed
+// through an os.Pipe with our own copier goroutine rather than by os/exec, so
+// that Wait does not wait for stdin to be closed.
+func (c *Cmd) setupStdinMode() error {
+	if c.StdinMode == StdinCloseOnEOF {
+		return nil
+	}
+	if c.c.Stdin != nil && !c.stdinFromReader {
+		return errors.New("gosh: StdinMode requires stdin to be set via SetStdinReader, if at all")
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	r := c.c.Stdin
+	if r == nil {
+		r = eofReader{}
+	}
+	// The done channel is closed once the process has exited, or has failed to
+	// start.
+	done := make(doneCloser)
+	c.c.Stdin = pr
+	c.afterStartClosers = append(c.afterStartClosers, pr)
+	c.afterWaitClosers = append(c.afterWaitClosers, done)
+	go c.stdinModeCopier(pw, r, done) // pw is closed by stdinModeCopier
+	return nil
+}
+
+// stdinModeCopier copies r to w, then closes w per c.StdinMode. Errors are
+// ignored, since they typically mean the process has exited.
+func (c *Cmd) stdinModeCopier(w io.WriteCloser, r io.Reader, done <-chan struct{}) {
+	defer w.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return
+	}
+	switch c.StdinMode {
+	case StdinKeepOpen:
+		<-done
+	case StdinCloseOnParentEOF:
+		// Reads from os.Stdin cannot be interrupted, so this returns on the first
+		// read after the process exits.
+		io.Copy(w, os.Stdin)
+	}
+}
+
+// doneCloser is a channel that is closed by Close.
+type doneCloser chan struct{}
+
+func (d doneCloser) Close() error {
+	close(d)
+	return nil
+}
+
+// eofReader is an empty io.Reader.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,159 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package gosh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+const prSetChildSubreaper = 36
+
+var (
+	subreaperOnce sync.Once
+	subreaperErr  error
+	subreaperIDs  int64
+)
+
+// setSubreaper makes the current process a child subreaper, if it isn't one
+// already.
+func setSubreaper() error {
+	subreaperOnce.Do(func() {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+			subreaperErr = fmt.Errorf("gosh: prctl(PR_SET_CHILD_SUBREAPER) failed: %v", errno)
+		}
+	})
+	return subreaperErr
+}
+
+// subreaperID returns the value of the env var that identifies the descendants
+// of sh's commands, allocating it on first use. Requires that sh.cleanupMu is
+// held.
+func (sh *Shell) subreaperID() string {
+	if sh.subreaper == "" {
+		sh.subreaper = fmt.Sprintf("%d.%d", os.Getpid(), atomic.AddInt64(&subreaperIDs, 1))
+	}
+	return sh.subreaper
+}
+
+// hasSubreaperID returns true if the initial environment of the process with
+// the given pid identifies it as a descendant of sh's commands.
+func (sh *Shell) hasSubreaperID(pid int) bool {
+	if sh.subreaper == "" {
+		return false
+	}
+	buf, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return false
+	}
+	want := []byte(envSubreaper + "=" + sh.subreaper)
+	for _, kv := range bytes.Split(buf, []byte{0}) {
+		if bytes.Equal(kv, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// procStat holds the fields of /proc/<pid>/stat needed by reapOrphans.
+type procStat struct {
+	pid, ppid, pgid, sid int
+}
+
+// readProcStat parses /proc/<pid>/stat, whose second field is the executable
+// name in parentheses, which may itself contain spaces and parentheses.
+func readProcStat(pid int) (procStat, error) {
+	buf, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procStat{}, err
+	}
+	s := string(buf)
+	i := strings.LastIndexByte(s, ')')
+	if i < 0 {
+		return procStat{}, fmt.Errorf("gosh: malformed /proc/%d/stat", pid)
+	}
+	// The fields after the name are state, ppid, pgrp and session.
+	fields := strings.Fields(s[i+1:])
+	if len(fields) < 4 {
+		return procStat{}, fmt.Errorf("gosh: malformed /proc/%d/stat", pid)
+	}
+	res := procStat{pid: pid}
+	for j, p := range []*int{&res.ppid, &res.pgid, &res.sid} {
+		if *p, err = strconv.Atoi(fields[j+1]); err != nil {
+			return procStat{}, err
+		}
+	}
+	return res, nil
+}
+
+// childStats returns the stats of all children of the current process.
+func childStats() ([]procStat, error) {
+	names, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	var res []procStat
+	for _, fi := range names {
+		pid, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		// The process may have exited since the directory was read.
+		if st, err := readProcStat(pid); err == nil && st.ppid == self {
+			res = append(res, st)
+		}
+	}
+	return res, nil
+}
+
+// reapOrphans kills and reaps children of the current process that are not
+// commands started by this Shell, but are descendants of them that were
+// re-parented per Shell.Subreaper, i.e. are in the process group or session of
+// one of them, or have the Shell's subreaper env var. Killing an orphan
+// re-parents its own children, so this repeats until no orphans are found.
+// Commands themselves are reaped by their exit waiters.
+func (sh *Shell) reapOrphans() {
+	if !sh.Subreaper {
+		return
+	}
+	groups := map[int]bool{}
+	for _, c := range sh.startedCmds {
+		if c.c.Process != nil {
+			groups[c.c.Process.Pid] = true
+		}
+	}
+	for found := true; found; {
+		stats, err := childStats()
+		if err != nil {
+			sh.tb.Logf("gosh: failed to list child processes: %v\n", err)
+			return
+		}
+		found = false
+		for _, st := range stats {
+			if groups[st.pid] || !groups[st.pgid] && !groups[st.sid] && !sh.hasSubreaperID(st.pid) {
+				continue
+			}
+			// Orphans in the process group of a command have already been sent
+			// SIGINT, then SIGKILL, so most are zombies by now.
+			syscall.Kill(st.pid, syscall.SIGKILL)
+			var ws syscall.WaitStatus
+			if _, err := syscall.Wait4(st.pid, &ws, 0, nil); err != nil && err != syscall.ECHILD {
+				sh.tb.Logf("gosh: failed to reap PID %d: %v\n", st.pid, err)
+				continue
+			}
+			found = true
+		}
+	}
+}
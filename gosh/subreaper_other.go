@@ -0,0 +1,23 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package gosh
+
+import (
+	"errors"
+)
+
+var errSubreaperNotSupported = errors.New("gosh: subreapers are only supported on linux")
+
+func setSubreaper() error {
+	return errSubreaperNotSupported
+}
+
+func (sh *Shell) subreaperID() string {
+	return ""
+}
+
+func (sh *Shell) reapOrphans() {}
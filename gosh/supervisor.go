@@ -0,0 +1,200 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+var errAlreadyCalledSupervisorStart = errors.New("gosh: already called Supervisor.Start")
+
+// SupervisorEventType describes the type of a SupervisorEvent.
+type SupervisorEventType int
+
+const (
+	SupervisorStarted SupervisorEventType = iota // A command instance started.
+	SupervisorExited                             // A command instance exited.
+	SupervisorGaveUp                             // No more instances will be started.
+)
+
+// SupervisorEvent describes a change in the state of a supervised command.
+type SupervisorEvent struct {
+	Type SupervisorEventType
+	// Cmd is the command instance that the event applies to.
+	Cmd *Cmd
+	// Restarts is the number of times the command has been restarted.
+	Restarts int
+	// Err is the error returned by Wait for SupervisorExited events, and the
+	// reason for giving up, if any, for SupervisorGaveUp events.
+	Err error
+}
+
+// Supervisor keeps a long-lived command running, restarting it whenever it
+// exits, until Stop is called. Each instance of the command is created by
+// cloning the template command passed to NewSupervisor; the template itself is
+// never started. Restarts happen in a background goroutine, with exponential
+// backoff between them.
+//
+// Errors that occur after Start are not reported to the Shell; they're sent on
+// the Events channel instead.
+type Supervisor struct {
+	// MaxRestarts is the maximum number of restarts; negative means unlimited.
+	MaxRestarts int
+	// Backoff is the delay before the first restart. The delay is doubled after
+	// each restart, up to MaxBackoff.
+	Backoff, MaxBackoff time.Duration
+	// Internal state.
+	template *Cmd
+	events   chan SupervisorEvent
+	stopChan chan struct{}
+	doneChan chan struct{}
+	mu       sync.Mutex // protects the fields below
+	started  bool
+	stopped  bool
+	cmd      *Cmd
+}
+
+// NewSupervisor returns a new Supervisor for the given template command, which
+// must not have been started. By default, the command is restarted at most 10
+// times, with backoff starting at 100ms and increasing to at most 10s.
+func NewSupervisor(template *Cmd) *Supervisor {
+	return &Supervisor{
+		MaxRestarts: 10,
+		Backoff:     100 * time.Millisecond,
+		MaxBackoff:  10 * time.Second,
+		template:    template,
+		events:      make(chan SupervisorEvent, 100),
+		stopChan:    make(chan struct{}),
+		doneChan:    make(chan struct{}),
+	}
+}
+
+// Start starts the first instance of the command.
+func (s *Supervisor) Start() {
+	s.template.sh.Ok()
+	s.template.handleError(s.start())
+}
+
+// Events returns a channel that receives events as command instances start and
+// exit. The channel is closed once the Supervisor stops starting instances.
+// Events are dropped if the channel's buffer is full.
+func (s *Supervisor) Events() <-chan SupervisorEvent {
+	return s.events
+}
+
+// Cmd returns the current command instance, or nil if Start has not been
+// called.
+func (s *Supervisor) Cmd() *Cmd {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cmd
+}
+
+// Stop stops restarting the command, sends the given signal to the current
+// instance, and waits for it to exit.
+func (s *Supervisor) Stop(sig os.Signal) {
+	s.template.sh.Ok()
+	s.template.handleError(s.stop(sig))
+}
+
+////////////////////////////////////////
+// Internals
+
+func (s *Supervisor) start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errAlreadyCalledSupervisorStart
+	}
+	s.started = true
+	c, err := s.startInstance()
+	if err != nil {
+		close(s.events)
+		close(s.doneChan)
+		return err
+	}
+	s.cmd = c
+	go s.run(c)
+	return nil
+}
+
+func (s *Supervisor) startInstance() (*Cmd, error) {
+	c, err := s.template.clone()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Supervisor) send(event SupervisorEvent) {
+	select {
+	case s.events <- event:
+	default:
+	}
+}
+
+// run waits for each instance to exit, and starts the next one. Meant to be run
+// in a goroutine.
+func (s *Supervisor) run(c *Cmd) {
+	defer close(s.doneChan)
+	defer close(s.events)
+	backoff := s.Backoff
+	for restarts := 0; ; restarts++ {
+		s.send(SupervisorEvent{Type: SupervisorStarted, Cmd: c, Restarts: restarts})
+		err := c.wait()
+		s.send(SupervisorEvent{Type: SupervisorExited, Cmd: c, Restarts: restarts, Err: err})
+		if s.MaxRestarts >= 0 && restarts >= s.MaxRestarts {
+			s.send(SupervisorEvent{Type: SupervisorGaveUp, Cmd: c, Restarts: restarts})
+			return
+		}
+		wake := make(chan struct{})
+		timer := c.sh.clock().AfterFunc(backoff, func() { close(wake) })
+		select {
+		case <-s.stopChan:
+			timer.Stop()
+			return
+		case <-wake:
+		}
+		if backoff *= 2; backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			return
+		}
+		next, err := s.startInstance()
+		if err != nil {
+			s.mu.Unlock()
+			s.send(SupervisorEvent{Type: SupervisorGaveUp, Cmd: c, Restarts: restarts, Err: err})
+			return
+		}
+		s.cmd, c = next, next
+		s.mu.Unlock()
+	}
+}
+
+func (s *Supervisor) stop(sig os.Signal) error {
+	s.mu.Lock()
+	if !s.started {
+		s.mu.Unlock()
+		return ErrDidNotCallStart
+	}
+	var err error
+	if !s.stopped {
+		s.stopped = true
+		close(s.stopChan)
+		err = s.cmd.sendSignal(sig)
+	}
+	s.mu.Unlock()
+	<-s.doneChan
+	return err
+}
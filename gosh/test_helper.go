@@ -0,0 +1,69 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"sync"
+)
+
+var errEmptyTestHelperName = errors.New("gosh: test helper name must not be empty")
+
+// TestHelperCmd returns a Cmd for an invocation of the current test binary
+// that runs only the test function with the given name, passing it the given
+// args. It is an alternative to FuncCmd for packages whose TestMain cannot call
+// InitMain. The test function must call TestHelperArgs to determine whether it
+// is running as a helper, in the style of the os/exec package's tests:
+//
+//	func TestHelperServer(t *testing.T) {
+//	  args, ok := gosh.TestHelperArgs("TestHelperServer")
+//	  if !ok {
+//	    return
+//	  }
+//	  defer os.Exit(0)
+//	  ...
+//	}
+//
+// As with FuncCmd, the child process may send vars, and exits when the parent
+// exits, unless Cmd.IgnoreParentExit is set.
+func (sh *Shell) TestHelperCmd(name string, args ...string) *Cmd {
+	sh.Ok()
+	res, err := sh.testHelperCmd(name, args...)
+	sh.handleError(err)
+	return res
+}
+
+// TestHelperArgs reports whether the current process was started via
+// Shell.TestHelperCmd to run the test function with the given name, and if so,
+// returns the args that were passed to TestHelperCmd. The first call that
+// returns true also calls InitChildMain.
+func TestHelperArgs(name string) ([]string, bool) {
+	if os.Getenv(envTestHelper) != name || name == "" {
+		return nil, false
+	}
+	testHelperOnce.Do(InitChildMain)
+	for i, arg := range os.Args {
+		if arg == "--" {
+			return os.Args[i+1:], true
+		}
+	}
+	return nil, true
+}
+
+////////////////////////////////////////
+// Internals
+
+var testHelperOnce sync.Once
+
+func (sh *Shell) testHelperCmd(name string, args ...string) (*Cmd, error) {
+	if name == "" {
+		return nil, errEmptyTestHelperName
+	}
+	vars := map[string]string{envTestHelper: name}
+	runFlag := "-test.run=^" + regexp.QuoteMeta(name) + "$"
+	return sh.cmd(vars, executablePath, append([]string{runFlag, "--"}, args...)...)
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Throttle limits the output propagated per Cmd.PropagateOutput and
+// Cmd.LogOutput, so that extremely chatty commands don't flood the terminal or
+// log. Each of stdout and stderr is throttled separately. The zero value means
+// no throttling. Output captured by Stdout and the like, or written to files
+// per Cmd.OutputDir, is not affected.
+type Throttle struct {
+	// CollapseRepeats, if true, makes it so a run of identical consecutive lines
+	// is propagated as the first such line, followed by a line noting how many
+	// times it was repeated.
+	CollapseRepeats bool
+	// MaxLinesPerSecond, if positive, limits the number of lines propagated per
+	// second. Lines beyond the limit are dropped, and a line noting how many
+	// were dropped is propagated once the limit allows.
+	MaxLinesPerSecond int
+}
+
+////////////////////////////////////////
+// Internals
+
+// throttleWriter is a lineWriter that writes lines to w, throttled per a
+// Throttle. Close writes any pending notes about repeated or dropped lines.
+type throttleWriter struct {
+	*lineWriter
+	w       io.Writer
+	t       Throttle
+	last    *string // the last line, per CollapseRepeats
+	repeats int
+	start   time.Time // the start of the current one-second window
+	n       int       // the number of lines written in the current window
+	dropped int
+}
+
+func newThrottleWriter(w io.Writer, t Throttle) *throttleWriter {
+	res := &throttleWriter{w: w, t: t}
+	res.lineWriter = newLineWriter(res.handleLine)
+	return res
+}
+
+func (w *throttleWriter) handleLine(line string) {
+	if w.t.CollapseRepeats {
+		if w.last != nil && *w.last == line {
+			w.repeats++
+			return
+		}
+		w.flushRepeats()
+		w.last = &line
+	}
+	w.limit(line)
+}
+
+// flushRepeats writes a note about the repeats of the last line, if any.
+func (w *throttleWriter) flushRepeats() {
+	if w.repeats > 0 {
+		w.limit(fmt.Sprintf("[gosh: previous line repeated %d more time(s)]", w.repeats))
+		w.repeats = 0
+	}
+}
+
+// limit writes line, unless doing so would exceed MaxLinesPerSecond.
+func (w *throttleWriter) limit(line string) {
+	if w.t.MaxLinesPerSecond > 0 {
+		if now := time.Now(); now.Sub(w.start) >= time.Second {
+			w.flushDropped()
+			w.start, w.n = now, 0
+		}
+		if w.n >= w.t.MaxLinesPerSecond {
+			w.dropped++
+			return
+		}
+		w.n++
+	}
+	fmt.Fprintln(w.w, line)
+}
+
+// flushDropped writes a note about dropped lines, if any.
+func (w *throttleWriter) flushDropped() {
+	if w.dropped > 0 {
+		fmt.Fprintf(w.w, "[gosh: dropped %d lines]\n", w.dropped)
+		w.dropped = 0
+	}
+}
+
+// Close passes any remaining partial line to the handler, then writes any
+// pending notes, regardless of MaxLinesPerSecond.
+func (w *throttleWriter) Close() error {
+	w.lineWriter.Close()
+	w.flushRepeats()
+	w.flushDropped()
+	return nil
+}
+
+// throttleOutput returns a writer for output to be propagated to w, throttled
+// per c.OutputThrottle. Closers for the returned writer, if any, are appended
+// to afterWaitClosers, to be closed before w.
+func (c *Cmd) throttleOutput(w io.Writer) io.Writer {
+	if c.OutputThrottle == (Throttle{}) {
+		return w
+	}
+	tw := newThrottleWriter(w, c.OutputThrottle)
+	c.afterWaitClosers = append(c.afterWaitClosers, tw)
+	return tw
+}
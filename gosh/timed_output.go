@@ -0,0 +1,77 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"sync"
+	"time"
+)
+
+// OutputChunk is a chunk of output written by a command, as returned by
+// Cmd.TimedOutput.
+type OutputChunk struct {
+	// Time is the time at which the chunk was received by the parent process.
+	Time time.Time
+	// Stream is "stdout" or "stderr".
+	Stream string
+	// Data is the contents of the chunk.
+	Data string
+}
+
+// TimedOutput calls Start followed by Wait, then returns the command's stdout
+// and stderr as a list of chunks, in the order in which they were received,
+// each tagged with its stream and the time at which it was received. Unlike
+// CombinedOutput, this makes it possible to tell how writes to the two streams
+// were interleaved in time, e.g. when debugging races. Each chunk corresponds
+// to a read by the parent process, which may combine or split the child's
+// writes. Redaction per Shell.Redact is applied to each chunk separately.
+func (c *Cmd) TimedOutput() []OutputChunk {
+	c.sh.Ok()
+	res, err := c.timedOutput()
+	c.handleError(err)
+	return res
+}
+
+////////////////////////////////////////
+// Internals
+
+// chunkRecorder records the chunks written to its stream writers.
+type chunkRecorder struct {
+	mu     sync.Mutex // protects chunks
+	chunks []OutputChunk
+}
+
+// writer returns a writer that records chunks for the given stream.
+func (r *chunkRecorder) writer(stream string) *chunkWriter {
+	return &chunkWriter{r: r, stream: stream}
+}
+
+type chunkWriter struct {
+	r      *chunkRecorder
+	stream string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.r.mu.Lock()
+	defer w.r.mu.Unlock()
+	w.r.chunks = append(w.r.chunks, OutputChunk{Time: time.Now(), Stream: w.stream, Data: string(p)})
+	return len(p), nil
+}
+
+func (c *Cmd) timedOutput() ([]OutputChunk, error) {
+	if c.calledStart {
+		return nil, ErrAlreadyCalledStart
+	}
+	r := &chunkRecorder{}
+	c.stdoutWriters = append(c.stdoutWriters, r.writer("stdout"))
+	c.stderrWriters = append(c.stderrWriters, r.writer("stderr"))
+	err := c.run()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.chunks {
+		r.chunks[i].Data = redact(c.sh.redactions, r.chunks[i].Data)
+	}
+	return r.chunks, err
+}
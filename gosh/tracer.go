@@ -0,0 +1,67 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"os"
+)
+
+// Tracer holds functions that are called as the commands created by a Shell
+// move through their lifecycle, so that external tooling, e.g. for metrics or
+// distributed tracing, can observe every command without wrapping gosh. Any of
+// the functions may be nil. Like Shell.CmdEventLogger, they are called
+// synchronously, possibly from a goroutine spawned by gosh and while internal
+// locks are held, so they must be thread-safe and must not call methods on the
+// Shell or its Cmds, other than Pid.
+type Tracer struct {
+	// CmdCreated is called when a Cmd is created, e.g. by Shell.Cmd or
+	// Cmd.Clone, once it has been configured per the Shell's settings.
+	CmdCreated func(c *Cmd)
+	// CmdStarted is called when a command is started, including commands that
+	// run in-process per Shell.Intercept or Shell.DryRun.
+	CmdStarted func(c *Cmd)
+	// CmdReady is called when a command first becomes ready, i.e. when a call
+	// to AwaitVars, AwaitReady, AwaitListening or AwaitFileExists first
+	// succeeds.
+	CmdReady func(c *Cmd)
+	// CmdSignaled is called when a signal is sent to a command.
+	CmdSignaled func(c *Cmd, sig os.Signal)
+	// CmdExited is called when a command exits, with the error that Wait will
+	// return, if any.
+	CmdExited func(c *Cmd, err error)
+}
+
+////////////////////////////////////////
+// Internals
+
+func (c *Cmd) traceCreated() {
+	if f := c.sh.Tracer.CmdCreated; f != nil {
+		f(c)
+	}
+}
+
+func (c *Cmd) traceStarted() {
+	if f := c.sh.Tracer.CmdStarted; f != nil {
+		f(c)
+	}
+}
+
+func (c *Cmd) traceReady() {
+	if f := c.sh.Tracer.CmdReady; f != nil {
+		f(c)
+	}
+}
+
+func (c *Cmd) traceSignaled(sig os.Signal) {
+	if f := c.sh.Tracer.CmdSignaled; f != nil {
+		f(c, sig)
+	}
+}
+
+func (c *Cmd) traceExited(err error) {
+	if f := c.sh.Tracer.CmdExited; f != nil {
+		f(c, err)
+	}
+}
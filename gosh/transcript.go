@@ -0,0 +1,87 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////
+// Internals
+
+// transcriptTimeFormat is the time.Format layout used in transcripts.
+const transcriptTimeFormat = "15:04:05.000000"
+
+// transcript is the file written per Shell.TranscriptFile. It is safe for
+// concurrent use.
+type transcript struct {
+	mu     sync.Mutex // protects the fields below
+	f      *os.File
+	res    []*regexp.Regexp
+	closed bool
+}
+
+// openTranscript returns the Shell's transcript, creating the file on first
+// use.
+func (sh *Shell) openTranscript() (*transcript, error) {
+	t := sh.transcript
+	if t == nil {
+		f, err := os.OpenFile(sh.TranscriptFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		t = &transcript{f: f}
+		t.printf("=== %s session started\n", time.Now().Format(transcriptTimeFormat))
+		sh.transcript = t
+	}
+	// Pick up any redactions added since the transcript was opened.
+	t.mu.Lock()
+	t.res = sh.redactions
+	t.mu.Unlock()
+	return t, nil
+}
+
+// closeTranscript closes the Shell's transcript, if any.
+func (sh *Shell) closeTranscript() {
+	t := sh.transcript
+	if t == nil {
+		return
+	}
+	t.printf("=== %s session ended\n", time.Now().Format(transcriptTimeFormat))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if err := t.f.Close(); err != nil {
+		sh.tb.Logf("%q.Close() failed: %v\n", t.f.Name(), err)
+	}
+}
+
+// printf writes a redacted line to the transcript. Write errors are ignored.
+func (t *transcript) printf(format string, args ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	t.f.WriteString(redact(t.res, fmt.Sprintf(format, args...)))
+}
+
+// writeEvent writes the given event for the command with the given index.
+func (t *transcript) writeEvent(index int, e CmdEvent) {
+	t.printf("=== [%d] %s %s\n", index, e.Time.Format(transcriptTimeFormat), strings.TrimPrefix(e.String(), "gosh: "))
+}
+
+// lineHandler returns a function that writes lines from the given stream of
+// the command with the given index.
+func (t *transcript) lineHandler(index int, stream string) func(string) {
+	return func(line string) {
+		t.printf("[%d %s] %s\n", index, stream, line)
+	}
+}
@@ -7,70 +7,310 @@
 package gosh
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
+// errRlimitsNotApplied is returned by Start if Cmd.Rlimits is set for a child
+// process that would not apply them.
+var errRlimitsNotApplied = errors.New("gosh: Cmd.Rlimits requires a command spawned via Shell.FuncCmd or Shell.TestHelperCmd")
+
 // TODO(sadovsky): Maybe wrap every child process with a "supervisor" process
 // that calls InitChildMain.
 
 func (c *Cmd) start() (e error) {
+	// Methods that require the command to have been started wait for start to
+	// return; see stateAfterStart.
+	c.startMu.Lock()
+	defer c.startMu.Unlock()
 	defer func() {
 		// Always close afterStartClosers upon return. Only close afterWaitClosers
 		// if start failed; if start succeeds, they're closed in the startExitWaiter
-		// goroutine. Only the first error is reported.
+		// goroutine, or in the startInProcess goroutine. Only the first error is
+		// reported.
 		if err := closeClosers(c.afterStartClosers); e == nil {
 			e = err
 		}
-		if !c.started {
+		if !c.started && !c.inProcess {
 			if err := closeClosers(c.afterWaitClosers); e == nil {
 				e = err
 			}
 		}
 	}()
-	if c.calledStart {
-		return errAlreadyCalledStart
-	}
+	c.stateMu.Lock()
+	calledStart := c.calledStart
 	c.calledStart = true
+	c.stateMu.Unlock()
+	if calledStart {
+		return ErrAlreadyCalledStart
+	}
 	// Protect against Cmd.start() writing to c.c.Process concurrently with
 	// signal-triggered Shell.cleanup() reading from it.
 	c.sh.cleanupMu.Lock()
 	defer c.sh.cleanupMu.Unlock()
 	if c.sh.calledCleanup {
-		return errAlreadyCalledCleanup
+		return ErrAlreadyCalledCleanup
+	}
+	if c.sh.deadline != nil && c.sh.deadline.exceeded {
+		return ErrDeadlineExceeded
 	}
 	// Configure the command.
 	c.c.Path = c.Path
-	vars := copyMap(c.Vars)
+	c.c.Dir = c.Dir
+	args, vars, err := c.resolveArgsAndVars()
+	if err != nil {
+		return err
+	}
+	if err := c.relookPath(args, vars); err != nil {
+		return err
+	}
+	if err := c.setGoshVars(vars); err != nil {
+		return err
+	}
+	// Leave room for envVarsFD and envCallsFD.
+	c.c.Env = mapToSliceCap(vars, 2)
+	c.c.Args = args
+	if c.sh.DryRun {
+		c.stateMu.Lock()
+		c.dryRun = true
+		c.stateMu.Unlock()
+		c.logDryRun()
+		return c.startInProcess(nil)
+	}
+	if f := c.sh.findInterceptor(c); f != nil {
+		return c.startInProcess(f)
+	}
+	// Children spawned via FuncCmd or TestHelperCmd send vars over a dedicated
+	// pipe, and serve calls over another. Other commands are not given the pipes,
+	// since they may not expect extra file descriptors; SendVars falls back to
+	// stderr for them.
+	if usesPipes(vars) {
+		if err := c.startVarsReader(); err != nil {
+			return err
+		}
+		if err := c.startCallsPipe(); err != nil {
+			return err
+		}
+	}
+	if err := c.setupStdinMode(); err != nil {
+		return err
+	}
+	if c.c.Stdout, c.c.Stderr, err = c.makeStdoutStderr(); err != nil {
+		return err
+	}
+	c.c.ExtraFiles = c.ExtraFiles
+	if c.varsWriter != nil {
+		n := len(c.ExtraFiles)
+		c.c.ExtraFiles = append(c.ExtraFiles[:n:n], c.varsWriter, c.callsReader)
+		c.c.Env = append(c.c.Env, c.pipeFDVars()...)
+	}
+	c.c.SysProcAttr = &syscall.SysProcAttr{}
+	if c.SysProcAttr != nil {
+		*c.c.SysProcAttr = *c.SysProcAttr
+	}
+	if err := setNamespaces(c.c.SysProcAttr, c.Namespaces); err != nil {
+		return err
+	}
+	if c.sh.Subreaper {
+		if err := setSubreaper(); err != nil {
+			return err
+		}
+	}
+	if c.ptySize != nil {
+		// Start the child in a new session, with the pty as its controlling
+		// terminal. This also creates a new process group for the child.
+		if err := c.setupPTY(); err != nil {
+			return err
+		}
+	} else {
+		// Create a new process group for the child.
+		c.c.SysProcAttr.Setpgid = true
+		c.c.SysProcAttr.Pgid = 0
+	}
+	// Start the command.
+	c.startTime = time.Now()
+	if err = c.c.Start(); err != nil {
+		return err
+	}
+	c.stateMu.Lock()
+	c.started = true
+	c.stateMu.Unlock()
+	c.sh.startedCmds = append(c.sh.startedCmds, c)
+	c.logStarted()
+	c.traceStarted()
+	if c.ptyMaster != nil {
+		c.startPTYCopier()
+	}
+	c.startExitWaiter()
+	return nil
+}
+
+// setGoshVars sets the env vars that configure gosh in the child process, e.g.
+// per Cmd.ExitAfter, and removes any that don't apply.
+func (c *Cmd) setGoshVars(vars map[string]string) error {
 	if c.IgnoreParentExit {
 		delete(vars, envWatchParent)
 	} else {
 		vars[envWatchParent] = "1"
 	}
-	if c.ExitAfter == 0 {
+	if c.ExitAfter == 0 || c.sh.Clock != nil {
+		// With a Clock, ExitAfter is enforced by startExitAfterTimer.
 		delete(vars, envExitAfter)
 	} else {
 		vars[envExitAfter] = c.ExitAfter.String()
 	}
-	c.c.Env = mapToSlice(vars)
-	c.c.Args = c.Args
-	var err error
-	if c.c.Stdout, c.c.Stderr, err = c.makeStdoutStderr(); err != nil {
+	if c.Heartbeat == 0 {
+		delete(vars, envHeartbeat)
+	} else {
+		vars[envHeartbeat] = c.Heartbeat.String()
+	}
+	if c.sh.Subreaper {
+		// Unlike the other vars, an inherited value is kept otherwise, so that
+		// the outer Shell may still find its descendants.
+		vars[envSubreaper] = c.sh.subreaperID()
+	}
+	if len(c.Rlimits) == 0 {
+		delete(vars, envRlimits)
+	} else if !usesPipes(vars) {
+		return errRlimitsNotApplied
+	} else {
+		buf, err := json.Marshal(c.Rlimits)
+		if err != nil {
+			return err
+		}
+		vars[envRlimits] = string(buf)
+	}
+	if len(c.ExtraFiles) == 0 {
+		delete(vars, envExtraFiles)
+	} else {
+		s, err := c.extraFilesVar()
+		if err != nil {
+			return err
+		}
+		vars[envExtraFiles] = s
+	}
+	delete(vars, envCallsFD)
+	delete(vars, envVarsFD)
+	return nil
+}
+
+// pipeFDVars returns the env vars, in "key=value" form, that tell the child
+// process the file descriptors of the vars and calls pipes, which are passed
+// after Cmd.ExtraFiles.
+func (c *Cmd) pipeFDVars() []string {
+	// File i in ExtraFiles becomes file descriptor 3+i in the child.
+	n := len(c.ExtraFiles)
+	return []string{fmt.Sprintf("%s=%d", envVarsFD, 3+n), fmt.Sprintf("%s=%d", envCallsFD, 4+n)}
+}
+
+// setupPTY opens a new pty, and configures c.c to use the slave end of the pty
+// as its stdin, stdout and stderr, and as its controlling terminal. Any stdin
+// configured for c is copied to the master end of the pty.
+func (c *Cmd) setupPTY() error {
+	master, slave, err := openPTY()
+	if err != nil {
 		return err
 	}
-	c.c.ExtraFiles = c.ExtraFiles
-	// Create a new process group for the child.
-	if c.c.SysProcAttr == nil {
-		c.c.SysProcAttr = &syscall.SysProcAttr{}
+	c.afterStartClosers = append(c.afterStartClosers, slave)
+	c.afterWaitClosers = append(c.afterWaitClosers, master)
+	if err := setPTYSize(master, *c.ptySize); err != nil {
+		return err
 	}
-	c.c.SysProcAttr.Setpgid = true
-	c.c.SysProcAttr.Pgid = 0
-	// Start the command.
-	if err = c.c.Start(); err != nil {
+	if stdin := c.c.Stdin; stdin != nil {
+		// The read side of the StdinPipe os.Pipe is normally closed after start,
+		// since the child has its own copy. Here we read it ourselves, so we close
+		// it after wait instead.
+		for i, closer := range c.afterStartClosers {
+			if f, ok := stdin.(*os.File); ok && closer == f {
+				c.afterStartClosers = append(c.afterStartClosers[:i], c.afterStartClosers[i+1:]...)
+				c.afterWaitClosers = append(c.afterWaitClosers, closer)
+				break
+			}
+		}
+		go c.ptyStdinCopier(master, stdin)
+	}
+	c.ptyOutput = c.c.Stdout
+	if c.varsDoneChan == nil {
+		// Listen for vars on the pty, since the child's stderr is written there.
+		c.ptyOutput = io.MultiWriter(c.ptyOutput, newRecvWriter(c))
+	}
+	c.c.Stdin, c.c.Stdout, c.c.Stderr = slave, slave, slave
+	c.c.SysProcAttr.Setsid = true
+	c.c.SysProcAttr.Setctty = true
+	c.c.SysProcAttr.Ctty = 0
+	c.ptyMaster = master
+	return nil
+}
+
+// ptyStdinCopier copies r to the master end of the pty until the process
+// exits. Reads from r cannot in general be interrupted, so if a read is blocked
+// when the process exits, this returns once it completes.
+func (c *Cmd) ptyStdinCopier(master io.Writer, r io.Reader) {
+	io.Copy(master, exitReader{r, c.exitedChan})
+}
+
+// exitReader reads from r until the exited channel is closed, after which it
+// returns io.EOF.
+type exitReader struct {
+	r      io.Reader
+	exited <-chan struct{}
+}
+
+func (r exitReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.exited:
+		return 0, io.EOF
+	default:
+		return r.r.Read(p)
+	}
+}
+
+// startPTYCopier spawns a goroutine that copies the output of the pty to the
+// stdout writers, closing ptyDoneChan when the pty has been closed by all
+// processes holding its slave end.
+func (c *Cmd) startPTYCopier() {
+	c.ptyDoneChan = make(chan struct{})
+	go func() {
+		// Reads from the master return an error (EIO on Linux) once the slave has
+		// been closed, which we treat as EOF.
+		io.Copy(c.ptyOutput, c.ptyMaster)
+		close(c.ptyDoneChan)
+	}()
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setPTYSize(f *os.File, size PTYSize) error {
+	ws := struct{ Row, Col, Xpixel, Ypixel uint16 }{Row: size.Rows, Col: size.Cols}
+	return ioctl(f.Fd(), syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+// signalProcess sends sig to the process.
+func (c *Cmd) signalProcess(sig os.Signal) error {
+	return c.c.Process.Signal(sig)
+}
+
+// signalProcessGroup sends sig to every process in the command's process group.
+func (c *Cmd) signalProcessGroup(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("gosh: unsupported signal: %v", sig)
+	}
+	if err := syscall.Kill(-c.Pid(), s); err != nil && err != syscall.ESRCH {
 		return err
 	}
-	c.started = true
-	c.startExitWaiter()
 	return nil
 }
 
@@ -98,4 +338,41 @@ func (c *Cmd) cleanupProcessGroup() {
 		}
 	}
 	syscall.Kill(-c.Pid(), syscall.SIGKILL)
-}
\ No newline at end of file
+}
+
+// exitSignal returns the signal that terminated the process, or nil if the
+// process exited normally.
+func exitSignal(ps *os.ProcessState) os.Signal {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal()
+	}
+	return nil
+}
+
+// maxRSS returns the maximum resident set size of the process in bytes.
+func maxRSS(ps *os.ProcessState) int64 {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// Maxrss is reported in bytes on darwin, and in kilobytes on linux.
+	if runtime.GOOS == "darwin" {
+		return int64(ru.Maxrss)
+	}
+	return int64(ru.Maxrss) * 1024
+}
+
+// setRlimits sets the given resource limits for the current process.
+func setRlimits(rlimits []Rlimit) error {
+	for _, r := range rlimits {
+		if err := syscall.Setrlimit(r.Resource, &syscall.Rlimit{Cur: r.Cur, Max: r.Max}); err != nil {
+			return fmt.Errorf("gosh: setrlimit(%d) failed: %v", r.Resource, err)
+		}
+	}
+	return nil
+}
+
+// closeOnExec marks f as close-on-exec.
+func closeOnExec(f *os.File) {
+	syscall.CloseOnExec(int(f.Fd()))
+}
@@ -6,63 +6,237 @@
 
 package gosh
 
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	createBreakawayFromJob = 0x01000000
+	createNoWindow         = 0x08000000
+	ctrlBreakEvent         = 1
+)
+
+var procGenerateConsoleCtrlEvent = kernel32.NewProc("GenerateConsoleCtrlEvent")
+
+var (
+	errPTYNotSupported     = errors.New("gosh: ptys are not supported on windows")
+	errRlimitsNotSupported = errors.New("gosh: rlimits are not supported on windows")
+)
+
 // TODO(sadovsky): Maybe wrap every child process with a "supervisor" process
 // that calls InitChildMain.
 
 func (c *Cmd) start() (e error) {
+	// Methods that require the command to have been started wait for start to
+	// return; see stateAfterStart.
+	c.startMu.Lock()
+	defer c.startMu.Unlock()
 	defer func() {
 		// Always close afterStartClosers upon return. Only close afterWaitClosers
 		// if start failed; if start succeeds, they're closed in the startExitWaiter
-		// goroutine. Only the first error is reported.
+		// goroutine, or in the startInProcess goroutine. Only the first error is
+		// reported.
 		if err := closeClosers(c.afterStartClosers); e == nil {
 			e = err
 		}
-		if !c.started {
+		if !c.started && !c.inProcess {
 			if err := closeClosers(c.afterWaitClosers); e == nil {
 				e = err
 			}
 		}
 	}()
-	if c.calledStart {
-		return errAlreadyCalledStart
-	}
+	c.stateMu.Lock()
+	calledStart := c.calledStart
 	c.calledStart = true
+	c.stateMu.Unlock()
+	if calledStart {
+		return ErrAlreadyCalledStart
+	}
+	if c.ptySize != nil {
+		return errPTYNotSupported
+	}
 	// Protect against Cmd.start() writing to c.c.Process concurrently with
 	// signal-triggered Shell.cleanup() reading from it.
 	c.sh.cleanupMu.Lock()
 	defer c.sh.cleanupMu.Unlock()
 	if c.sh.calledCleanup {
-		return errAlreadyCalledCleanup
+		return ErrAlreadyCalledCleanup
+	}
+	if c.sh.deadline != nil && c.sh.deadline.exceeded {
+		return ErrDeadlineExceeded
 	}
 	// Configure the command.
 	c.c.Path = c.Path
-	vars := copyMap(c.Vars)
-	if c.IgnoreParentExit {
-		delete(vars, envWatchParent)
-	} else {
-		vars[envWatchParent] = "1"
+	c.c.Dir = c.Dir
+	args, vars, err := c.resolveArgsAndVars()
+	if err != nil {
+		return err
 	}
-	if c.ExitAfter == 0 {
-		delete(vars, envExitAfter)
-	} else {
-		vars[envExitAfter] = c.ExitAfter.String()
+	if err := c.relookPath(args, vars); err != nil {
+		return err
+	}
+	if err := c.setGoshVars(vars); err != nil {
+		return err
 	}
 	c.c.Env = mapToSlice(vars)
-	c.c.Args = c.Args
-	var err error
+	c.c.Args = args
+	if c.sh.DryRun {
+		c.stateMu.Lock()
+		c.dryRun = true
+		c.stateMu.Unlock()
+		c.logDryRun()
+		return c.startInProcess(nil)
+	}
+	if f := c.sh.findInterceptor(c); f != nil {
+		return c.startInProcess(f)
+	}
+	if err := c.setupStdinMode(); err != nil {
+		return err
+	}
 	if c.c.Stdout, c.c.Stderr, err = c.makeStdoutStderr(); err != nil {
 		return err
 	}
 	c.c.ExtraFiles = c.ExtraFiles
+	if c.SysProcAttr != nil {
+		attr := *c.SysProcAttr
+		c.c.SysProcAttr = &attr
+	}
+	c.setWindowsOptions()
+	if err := setNamespaces(c.c.SysProcAttr, c.Namespaces); err != nil {
+		return err
+	}
+	if c.sh.Subreaper {
+		if err := setSubreaper(); err != nil {
+			return err
+		}
+	}
 	// Start the command.
+	c.startTime = time.Now()
 	if err = c.c.Start(); err != nil {
 		return err
 	}
+	c.stateMu.Lock()
 	c.started = true
+	c.stateMu.Unlock()
+	c.sh.startedCmds = append(c.sh.startedCmds, c)
+	if c.SignalProcessGroup {
+		// Place the process in its own job object, so that it may be terminated
+		// along with its descendants.
+		if job, err := newCmdJob(c.c.Process.Pid); err != nil {
+			c.sh.tb.Logf("gosh: failed to create job object for PID %d: %v\n", c.c.Process.Pid, err)
+		} else {
+			c.job = uintptr(job)
+		}
+	}
+	if !c.IgnoreParentExit {
+		// Make sure the child exits when the current process exits. There's a
+		// small window after the child has started in which it may spawn
+		// descendants that are not in the job.
+		if err := addToJob(c.c.Process.Pid); err != nil {
+			c.sh.tb.Logf("gosh: failed to add PID %d to job object: %v\n", c.c.Process.Pid, err)
+		}
+	}
+	c.logStarted()
+	c.traceStarted()
 	c.startExitWaiter()
 	return nil
 }
 
+// setGoshVars sets the env vars that configure gosh in the child process, e.g.
+// per Cmd.ExitAfter, and removes any that don't apply.
+func (c *Cmd) setGoshVars(vars map[string]string) error {
+	if c.IgnoreParentExit {
+		delete(vars, envWatchParent)
+	} else {
+		vars[envWatchParent] = "1"
+	}
+	if c.ExitAfter == 0 || c.sh.Clock != nil {
+		// With a Clock, ExitAfter is enforced by startExitAfterTimer.
+		delete(vars, envExitAfter)
+	} else {
+		vars[envExitAfter] = c.ExitAfter.String()
+	}
+	if c.Heartbeat == 0 {
+		delete(vars, envHeartbeat)
+	} else {
+		vars[envHeartbeat] = c.Heartbeat.String()
+	}
+	if len(c.Rlimits) > 0 {
+		return errRlimitsNotSupported
+	}
+	delete(vars, envRlimits)
+	// ExtraFiles is not supported on windows, so children always send vars
+	// over stderr, and cannot serve calls.
+	delete(vars, envCallsFD)
+	delete(vars, envExtraFiles)
+	delete(vars, envVarsFD)
+	return nil
+}
+
+// pipeFDVars returns nil, since children are not given the vars and calls pipes
+// on windows.
+func (c *Cmd) pipeFDVars() []string {
+	return nil
+}
+
+// setWindowsOptions applies c.Windows to the attributes of the underlying
+// exec.Cmd object.
+func (c *Cmd) setWindowsOptions() {
+	opts := c.Windows
+	if opts == (WindowsOptions{}) {
+		return
+	}
+	if c.c.SysProcAttr == nil {
+		c.c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := c.c.SysProcAttr
+	if opts.HideWindow {
+		attr.HideWindow = true
+		attr.CreationFlags |= createNoWindow
+	}
+	if opts.NewProcessGroup {
+		attr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+	}
+	if opts.BreakawayFromJob {
+		attr.CreationFlags |= createBreakawayFromJob
+	}
+}
+
+// signalProcess sends sig to the process. If the process was started in a new
+// process group per WindowsOptions.NewProcessGroup, os.Interrupt is sent as a
+// CTRL_BREAK_EVENT to that group.
+func (c *Cmd) signalProcess(sig os.Signal) error {
+	if sig == os.Interrupt && c.Windows.NewProcessGroup {
+		if ok, _, err := procGenerateConsoleCtrlEvent.Call(ctrlBreakEvent, uintptr(c.c.Process.Pid)); ok == 0 {
+			return err
+		}
+		return nil
+	}
+	return c.c.Process.Signal(sig)
+}
+
+// signalProcessGroup sends sig to the process. Windows has no process groups in
+// the Unix sense; instead, if the process has its own job object, os.Kill
+// terminates all processes in the job. Other signals are only sent to the
+// process.
+func (c *Cmd) signalProcessGroup(sig os.Signal) error {
+	if sig == os.Kill {
+		c.cleanupMu.Lock()
+		job := syscall.Handle(c.job)
+		c.cleanupMu.Unlock()
+		if job != 0 {
+			return terminateJob(job)
+		}
+	}
+	if err := c.signalProcess(sig); err != nil && err.Error() != errFinished {
+		return err
+	}
+	return nil
+}
+
 func (c *Cmd) cleanupProcessGroup() {
 	if !c.started {
 		return
@@ -75,6 +249,35 @@ func (c *Cmd) cleanupProcessGroup() {
 	}
 	c.calledCleanup = true
 
-	// No grace period.
+	// No grace period. If the process has its own job object, terminate any
+	// descendants along with it, as on Unix.
+	if c.job != 0 {
+		terminateJob(syscall.Handle(c.job))
+		syscall.CloseHandle(syscall.Handle(c.job))
+		c.job = 0
+	}
 	c.c.Process.Kill()
-}
\ No newline at end of file
+}
+func setPTYSize(f *os.File, size PTYSize) error {
+	return errPTYNotSupported
+}
+
+// exitSignal returns nil, since processes are not terminated by signals on
+// windows.
+func exitSignal(ps *os.ProcessState) os.Signal {
+	return nil
+}
+
+// maxRSS returns 0, since the peak memory usage of the process is not
+// available via the syscall package on windows.
+func maxRSS(ps *os.ProcessState) int64 {
+	return 0
+}
+
+func setRlimits(rlimits []Rlimit) error {
+	return errRlimitsNotSupported
+}
+
+// closeOnExec does nothing, since handles are not inherited by default on
+// windows.
+func closeOnExec(f *os.File) {}
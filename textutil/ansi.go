@@ -0,0 +1,67 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+// ansiState tracks whether a stream of runes is within an ANSI escape sequence,
+// e.g. "\x1b[1m" to select bold text.  Escape sequences aren't displayed, and
+// so have no width.
+//
+// The recognized sequences are CSI sequences (ESC [ params final), OSC
+// sequences (ESC ] string, terminated by BEL or ESC \), and two-rune ESC
+// sequences.  A malformed sequence ends at the first rune that cannot be part
+// of it, e.g. an end-of-line; that rune is not part of the sequence.
+type ansiState int
+
+const (
+	ansiNone ansiState = iota // Not within an escape sequence [start state]
+	ansiEsc                   // After ESC
+	ansiCSI                   // Within a CSI sequence, after ESC [
+	ansiOSC                   // Within an OSC sequence, after ESC ]
+)
+
+const (
+	ansiESC = '\x1b'
+	ansiBEL = '\x07'
+)
+
+// next returns the state after r, and whether r is part of an escape sequence.
+func (s ansiState) next(r rune) (ansiState, bool) {
+	if runeKind(r) == kindEOL {
+		return ansiNone, false
+	}
+	switch s {
+	case ansiEsc:
+		switch r {
+		case '[':
+			return ansiCSI, true
+		case ']':
+			return ansiOSC, true
+		}
+		return ansiNone, true
+	case ansiCSI:
+		switch {
+		case r >= 0x40 && r <= 0x7e:
+			// The final byte ends the sequence.
+			return ansiNone, true
+		case r >= 0x20 && r <= 0x3f:
+			// Parameter and intermediate bytes.
+			return ansiCSI, true
+		}
+	case ansiOSC:
+		switch {
+		case r == ansiBEL:
+			return ansiNone, true
+		case r == ansiESC:
+			// Either ESC \ ends the sequence, or a new sequence starts.
+			return ansiEsc, true
+		case r >= 0x20 && r != 0x7f:
+			return ansiOSC, true
+		}
+	}
+	if r == ansiESC {
+		return ansiEsc, true
+	}
+	return ansiNone, false
+}
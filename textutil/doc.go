@@ -7,6 +7,8 @@
 // This package includes a combination of low-level and high-level utilities.
 // The main high-level utilities are:
 //   NewUTF8WrapWriter: Text formatter with line-based word wrapping.
+//   NewTableWriter:    Text formatter with aligned columns.
+//   NewMarkdownWriter: Text formatter that renders markdown.
 //   PrefixWriter:      Add prefix to output.
 //   PrefixLineWriter:  Add prefix to each line in output.
 //   ByteReplaceWriter: Replace single byte with bytes in output.
@@ -0,0 +1,280 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// MarkdownWriter implements an io.Writer filter that renders a subset of
+// markdown as terminal text, word-wrapped to a given target width in runes.
+// This lets e.g. long command descriptions and help topics be authored in
+// markdown.
+//
+// The supported subset is:
+//
+//	Headings:    lines starting with 1 to 6 '#', followed by a space.
+//	Lists:       lines starting with "-", "*", "+" or a number followed by "."
+//	             and a space, nested by indenting with two spaces per level.
+//	Code blocks: lines between ``` fences, or indented by four spaces.
+//	Bold:        text between ** or __ markers.
+//	Paragraphs:  everything else, separated by blank lines.
+//
+// Paragraphs and list items are word-wrapped, with list items indented per
+// their nesting level.  Code blocks are output verbatim, indented by four
+// spaces.  Headings and bold text are rendered using ANSI escape sequences if
+// enabled via SetANSI; otherwise the bold markers are removed, and top-level
+// headings are underlined.  Other markdown, e.g. `code spans`, is output as is.
+//
+// Flush must be called after the last call to Write; the input is buffered.
+type MarkdownWriter struct {
+	w     io.Writer
+	width int
+	ansi  bool
+	buf   bytes.Buffer
+}
+
+// NewMarkdownWriter returns a new MarkdownWriter with the given target width in
+// runes, producing output on the underlying writer w.  If width < 0 the width
+// is unlimited; each paragraph is output as a single line.
+func NewMarkdownWriter(w io.Writer, width int) *MarkdownWriter {
+	return &MarkdownWriter{w: w, width: width}
+}
+
+// Width returns the target width in runes.
+func (m *MarkdownWriter) Width() int { return m.width }
+
+// SetANSI sets whether subsequent Flush calls render headings and bold text
+// using ANSI escape sequences.  A new MarkdownWriter doesn't use them.
+func (m *MarkdownWriter) SetANSI(ansi bool) {
+	m.ansi = ansi
+}
+
+// Write implements io.Writer by buffering data into the MarkdownWriter m.
+//
+// Flush must be called after the last call to Write.
+func (m *MarkdownWriter) Write(data []byte) (int, error) {
+	return m.buf.Write(data)
+}
+
+// Flush renders the buffered markdown.  Each call to Flush renders a separate
+// document; Flush must be called after the last call to Write.
+func (m *MarkdownWriter) Flush() error {
+	blocks := parseMarkdown(m.buf.String())
+	m.buf.Reset()
+	ww := NewUTF8WrapWriter(m.w, m.width)
+	for ix, b := range blocks {
+		// Separate blocks with a blank line, except for consecutive list items.
+		if ix > 0 && (b.kind != mdListItem || blocks[ix-1].kind != mdListItem || b.afterBlank) {
+			if _, err := io.WriteString(m.w, "\n"); err != nil {
+				return err
+			}
+		}
+		if err := m.renderBlock(ww, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	ansiBold   = "\x1b[1m"
+	ansiNormal = "\x1b[22m"
+)
+
+func (m *MarkdownWriter) renderBlock(ww *WrapWriter, b mdBlock) error {
+	switch b.kind {
+	case mdCode:
+		for _, line := range b.lines {
+			if line != "" {
+				line = "    " + line
+			}
+			if _, err := io.WriteString(m.w, line+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	case mdHeading:
+		text := m.inline(b.text)
+		if m.ansi {
+			text = ansiBold + text + ansiNormal
+		}
+		if err := m.wrap(ww, text); err != nil {
+			return err
+		}
+		if !m.ansi && b.level <= 2 {
+			underline := "="
+			if b.level == 2 {
+				underline = "-"
+			}
+			width := stringWidth(text)
+			if m.width >= 0 && width > m.width {
+				width = m.width
+			}
+			return m.wrap(ww, strings.Repeat(underline, width))
+		}
+		return nil
+	case mdListItem:
+		indent := strings.Repeat("  ", b.level)
+		if err := ww.SetIndents(indent+b.marker+" ", indent+strings.Repeat(" ", len(b.marker)+1)); err != nil {
+			return err
+		}
+		if err := m.wrap(ww, m.inline(b.text)); err != nil {
+			return err
+		}
+		return ww.SetIndents()
+	default:
+		return m.wrap(ww, m.inline(b.text))
+	}
+}
+
+// wrap writes text to ww as a single paragraph.
+func (m *MarkdownWriter) wrap(ww *WrapWriter, text string) error {
+	if _, err := io.WriteString(ww, text); err != nil {
+		return err
+	}
+	return ww.Flush()
+}
+
+// inline renders the bold text in text, leaving code spans as is.
+func (m *MarkdownWriter) inline(text string) string {
+	var buf strings.Builder
+	inCode := false
+	for ix := 0; ix < len(text); ix++ {
+		if text[ix] == '`' {
+			inCode = !inCode
+		}
+		if !inCode && ix+1 < len(text) && (text[ix:ix+2] == "**" || text[ix:ix+2] == "__") {
+			marker := text[ix : ix+2]
+			if end := strings.Index(text[ix+2:], marker); end > 0 {
+				bold := text[ix+2 : ix+2+end]
+				if m.ansi {
+					bold = ansiBold + bold + ansiNormal
+				}
+				buf.WriteString(bold)
+				ix += 2 + end + 1
+				continue
+			}
+		}
+		buf.WriteByte(text[ix])
+	}
+	return buf.String()
+}
+
+type mdKind int
+
+const (
+	mdParagraph mdKind = iota
+	mdHeading
+	mdListItem
+	mdCode
+)
+
+// mdBlock is a block of markdown, e.g. a paragraph or a list item.
+type mdBlock struct {
+	kind       mdKind
+	level      int      // heading level, or list item nesting level
+	marker     string   // list item marker, e.g. "-" or "1."
+	text       string   // text of paragraphs, headings and list items
+	lines      []string // lines of code blocks
+	afterBlank bool     // preceded by a blank line
+}
+
+// parseMarkdown splits src into blocks.
+func parseMarkdown(src string) []mdBlock {
+	var blocks []mdBlock
+	var cur *mdBlock // the block that lines may be appended to, if any
+	blank, fenced := false, false
+	add := func(b mdBlock) {
+		b.afterBlank = blank
+		blocks = append(blocks, b)
+		cur, blank = &blocks[len(blocks)-1], false
+	}
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	for _, line := range strings.Split(strings.TrimSuffix(src, "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		switch {
+		case fenced:
+			if strings.HasPrefix(trimmed, "```") {
+				fenced, cur = false, nil
+			} else {
+				cur.lines = append(cur.lines, line)
+			}
+		case strings.HasPrefix(trimmed, "```"):
+			add(mdBlock{kind: mdCode})
+			fenced = true
+		case trimmed == "":
+			if cur != nil && cur.kind == mdCode {
+				cur.lines = append(cur.lines, "")
+			} else {
+				cur = nil
+			}
+			blank = true
+		case indent >= 4 && cur != nil && cur.kind == mdCode:
+			cur.lines = append(cur.lines, line[4:])
+		case indent >= 4 && cur == nil && !afterListItem(blocks):
+			add(mdBlock{kind: mdCode})
+			cur.lines = append(cur.lines, line[4:])
+		default:
+			if level := headingLevel(trimmed); level > 0 {
+				add(mdBlock{kind: mdHeading, level: level, text: strings.TrimSpace(trimmed[level:])})
+				cur = nil
+			} else if marker, text := listMarker(trimmed); marker != "" {
+				add(mdBlock{kind: mdListItem, level: indent / 2, marker: marker, text: text})
+			} else if cur != nil && cur.kind != mdCode {
+				cur.text += " " + trimmed
+			} else {
+				add(mdBlock{kind: mdParagraph, text: trimmed})
+			}
+		}
+	}
+	// Trim trailing blank lines from code blocks.
+	for ix := range blocks {
+		if b := &blocks[ix]; b.kind == mdCode {
+			for len(b.lines) > 0 && b.lines[len(b.lines)-1] == "" {
+				b.lines = b.lines[:len(b.lines)-1]
+			}
+		}
+	}
+	return blocks
+}
+
+// afterListItem returns true if the last of the blocks is a list item, in which
+// case indented lines are nested list items or continuations, not code.
+func afterListItem(blocks []mdBlock) bool {
+	return len(blocks) > 0 && blocks[len(blocks)-1].kind == mdListItem
+}
+
+// headingLevel returns the level of the heading in line, or 0 if line is not a
+// heading.
+func headingLevel(line string) int {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(line) || line[level] != ' ' {
+		return 0
+	}
+	return level
+}
+
+// listMarker returns the list item marker and text in line, or an empty marker
+// if line is not a list item.  Unordered markers are normalized to "-".
+func listMarker(line string) (string, string) {
+	if len(line) >= 2 && strings.IndexByte("-*+", line[0]) != -1 && line[1] == ' ' {
+		return "-", strings.TrimSpace(line[2:])
+	}
+	digits := 0
+	for digits < len(line) && line[digits] >= '0' && line[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 && digits+1 < len(line) && line[digits] == '.' && line[digits+1] == ' ' {
+		return line[:digits+1], strings.TrimSpace(line[digits+2:])
+	}
+	return "", ""
+}
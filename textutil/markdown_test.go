@@ -0,0 +1,72 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMarkdownWriter(t *testing.T) {
+	tests := []struct {
+		Width int
+		ANSI  bool
+		In    string
+		Want  string
+	}{
+		// Empty input yields empty output.
+		{-1, false, "", ""},
+		// Paragraphs are joined, wrapped and separated by blank lines.
+		{-1, false, "a b\nc\n\n\nd", "a b c\n\nd\n"},
+		{5, false, "aaa bbb ccc\n\nd", "aaa\nbbb\nccc\n\nd\n"},
+		// Headings are underlined, or bold with ANSI.
+		{-1, false, "# Title\ntext", "Title\n=====\n\ntext\n"},
+		{-1, false, "## Sub\n### Sub sub", "Sub\n---\n\nSub sub\n"},
+		{3, false, "# Title", "Title\n===\n"},
+		{-1, true, "# Title", "\x1b[1mTitle\x1b[22m\n"},
+		{-1, false, "#Title", "#Title\n"},
+		{-1, false, "# 世界", "世界\n====\n"},
+		// Bold text is rendered with ANSI, or the markers are removed.
+		{-1, false, "a **b c** __d__ **e", "a b c d **e\n"},
+		{-1, true, "a **b c** d", "a \x1b[1mb c\x1b[22m d\n"},
+		{6, true, "**aaaa** **bbbb**", "\x1b[1maaaa\x1b[22m\n\x1b[1mbbbb\x1b[22m\n"},
+		// Code spans are output as is.
+		{-1, false, "a `**b**` **c**", "a `**b**` c\n"},
+		// List items are indented and wrapped.
+		{-1, false, "- a\n* b\n+ c", "- a\n- b\n- c\n"},
+		{-1, false, "1. a\n2. b\n10. c", "1. a\n2. b\n10. c\n"},
+		{7, false, "- aa bb cc\n  dd\n- ee", "- aa bb\n  cc dd\n- ee\n"},
+		{-1, false, "- a\n  - b\n    - c\n- d", "- a\n  - b\n    - c\n- d\n"},
+		{-1, false, "text\n- a\n\n- b", "text\n\n- a\n\n- b\n"},
+		// Code blocks are output verbatim, indented.
+		{5, false, "```\n  aaa bbb\n\n**c**\n```\nd", "      aaa bbb\n\n    **c**\n\nd\n"},
+		{5, false, "a\n\n    aaa bbb\n\n      c\n\n\nd", "a\n\n    aaa bbb\n\n      c\n\nd\n"},
+		{-1, false, "- a\n    b", "- a b\n"},
+		// Windows line endings are supported.
+		{-1, false, "a\r\nb\r\n\r\nc\r\n", "a b\n\nc\n"},
+	}
+	for _, test := range tests {
+		// Run with a variety of chunk sizes.
+		for _, sizes := range [][]int{nil, {1}, {2}, {1, 2}, {2, 1}} {
+			var buf bytes.Buffer
+			w := NewMarkdownWriter(&buf, test.Width)
+			w.SetANSI(test.ANSI)
+			remain := []byte(test.In)
+			for ix := 0; len(remain) > 0; ix++ {
+				var chunk []byte
+				chunk, remain = nextChunk(remain, sizes, ix)
+				if got, err := w.Write(chunk); got != len(chunk) || err != nil {
+					t.Errorf("%q Write(%q) got (%d,%v), want (%d,nil)", test.In, chunk, got, err, len(chunk))
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Errorf("%q Flush() got %v, want nil", test.In, err)
+			}
+			if got, want := buf.String(), test.Want; got != want {
+				t.Errorf("%q width:%d ansi:%v sizes:%v got %q, want %q", test.In, test.Width, test.ANSI, sizes, got, want)
+			}
+		}
+	}
+}
@@ -81,6 +81,7 @@ func FlushRuneChunk(d RuneChunkDecoder, fn func(rune) error) error {
 
 // bytePos and runePos distinguish positions that are used in either domain;
 // we're trying to avoid silly mistakes like adding a bytePos to a runePos.
+// Rune positions count display columns, as returned by runeWidth.
 type bytePos int
 type runePos int
 
@@ -100,16 +101,25 @@ func (b *byteRuneBuffer) Reset() {
 	b.runeLen = 0
 }
 
-// WriteRune writes r into b.
-func (b *byteRuneBuffer) WriteRune(r rune) {
+// WriteRune writes r into b, incrementing the rune length by width.
+func (b *byteRuneBuffer) WriteRune(r rune, width runePos) {
 	b.enc.Encode(r, &b.buf)
-	b.runeLen++
+	b.runeLen += width
 }
 
-// WriteString writes str into b.
+// WriteString writes str into b, incrementing the rune length by the width of
+// each rune.  Runes within ANSI escape sequences have no width.
 func (b *byteRuneBuffer) WriteString(str string) {
+	var ansi ansiState
+	var prev rune
 	for _, r := range str {
-		b.WriteRune(r)
+		var esc bool
+		if ansi, esc = ansi.next(r); esc {
+			b.WriteRune(r, 0)
+		} else {
+			b.WriteRune(r, runePos(runeWidth(prev, r)))
+			prev = r
+		}
 	}
 }
 
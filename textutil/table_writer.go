@@ -0,0 +1,223 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Column configures a column of a TableWriter.
+type Column struct {
+	// Header is the header of the column.  If any column has a non-empty header,
+	// the headers are output as the first row of the table, underlined.
+	Header string
+	// MinWidth is the minimum width of the column in runes.  The column is never
+	// narrower, even if the table is then wider than its target width.
+	MinWidth int
+	// MaxWidth, if positive, is the maximum width of the column in runes.
+	MaxWidth int
+}
+
+// TableWriter implements an io.Writer filter that formats input rows into
+// aligned columns, such that output lines are usually no longer than a given
+// target width in runes.
+//
+// Input rows are terminated by '\n', and the cells within each row are
+// separated by '\t'; rows may also be added via WriteRow.  The rows are
+// buffered, and output on Flush, once the widths of the columns are known.
+//
+// Each column is as wide as its widest cell, within the bounds configured via
+// Column.  If the table would be wider than the target width, the widest
+// columns are narrowed until it fits, but not below their minimum widths.
+// Cells wider than their column are truncated, ending with "..." if there's
+// room.  Widths don't count ANSI escape sequences, which are never truncated.
+//
+// Columns are separated by two spaces by default; see SetSeparator.  Output
+// lines end with their last non-empty cell, without padding.
+type TableWriter struct {
+	w       io.Writer
+	width   int
+	columns []Column
+	sep     string
+	buf     []byte     // partial input row
+	rows    [][]string // buffered rows
+}
+
+// NewTableWriter returns a new TableWriter with the given target width in
+// runes, producing output on the underlying writer w.  If width < 0 the width
+// is unlimited.  OutputWidth returns a suitable width.  The columns configure
+// the leftmost columns of the table; rows may have more cells, in which case
+// the additional columns have the default configuration.
+func NewTableWriter(w io.Writer, width int, columns ...Column) *TableWriter {
+	return &TableWriter{
+		w:       w,
+		width:   width,
+		columns: append([]Column(nil), columns...),
+		sep:     "  ",
+	}
+}
+
+// Width returns the target width in runes.  If width < 0 the width is
+// unlimited.
+func (t *TableWriter) Width() int { return t.width }
+
+// SetSeparator sets the separator between columns for subsequent Flush calls.
+// The separator counts towards the width of the table.
+func (t *TableWriter) SetSeparator(sep string) {
+	t.sep = sep
+}
+
+// Write implements io.Writer by buffering data into the TableWriter t, as rows
+// terminated by '\n', with cells separated by '\t'.
+//
+// Flush must be called after the last call to Write.
+func (t *TableWriter) Write(data []byte) (int, error) {
+	t.buf = append(t.buf, data...)
+	for {
+		ix := bytes.IndexByte(t.buf, '\n')
+		if ix == -1 {
+			break
+		}
+		t.WriteRow(strings.Split(string(t.buf[:ix]), "\t")...)
+		t.buf = t.buf[ix+1:]
+	}
+	return len(data), nil
+}
+
+// WriteRow adds a row with the given cells to the TableWriter t.  The cells may
+// contain tabs, but not newlines.
+func (t *TableWriter) WriteRow(cells ...string) {
+	t.rows = append(t.rows, append([]string(nil), cells...))
+}
+
+// Flush outputs the buffered rows, including any final row that isn't
+// terminated by '\n', preceded by the headers, if any.  Rows written after
+// Flush form a new table, with its own column widths.
+//
+// Flush must be called after the last call to Write, and may be called an
+// arbitrary number of times before the last Write.
+func (t *TableWriter) Flush() error {
+	if len(t.buf) > 0 {
+		t.WriteRow(strings.Split(string(t.buf), "\t")...)
+		t.buf = nil
+	}
+	rows := t.rows
+	t.rows = nil
+	header := t.header()
+	if header != nil {
+		rows = append([][]string{header}, rows...)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	widths := t.columnWidths(rows)
+	var line bytes.Buffer
+	writeLine := func(cells []string) error {
+		// Don't output trailing empty cells, or padding after the last cell.
+		last := len(cells) - 1
+		for last >= 0 && cells[last] == "" {
+			last--
+		}
+		line.Reset()
+		for ix := 0; ix <= last; ix++ {
+			if ix > 0 {
+				line.WriteString(t.sep)
+			}
+			cell := truncateString(cells[ix], widths[ix])
+			line.WriteString(cell)
+			if ix < last {
+				line.WriteString(strings.Repeat(" ", widths[ix]-stringWidth(cell)))
+			}
+		}
+		line.WriteByte('\n')
+		_, err := t.w.Write(line.Bytes())
+		return err
+	}
+	for ix, row := range rows {
+		if err := writeLine(row); err != nil {
+			return err
+		}
+		if ix == 0 && header != nil {
+			// Underline the headers.
+			underline := make([]string, len(widths))
+			for ix, width := range widths {
+				underline[ix] = strings.Repeat("-", width)
+			}
+			if err := writeLine(underline); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// header returns the row of headers, or nil if all headers are empty.
+func (t *TableWriter) header() []string {
+	for _, col := range t.columns {
+		if col.Header != "" {
+			header := make([]string, len(t.columns))
+			for ix, col := range t.columns {
+				header[ix] = col.Header
+			}
+			return header
+		}
+	}
+	return nil
+}
+
+// column returns the configuration of the column with the given index.
+func (t *TableWriter) column(ix int) Column {
+	if ix < len(t.columns) {
+		return t.columns[ix]
+	}
+	return Column{}
+}
+
+// columnWidths returns the width of each column of the given rows.
+func (t *TableWriter) columnWidths(rows [][]string) []int {
+	numCols := len(t.columns)
+	for _, row := range rows {
+		if len(row) > numCols {
+			numCols = len(row)
+		}
+	}
+	// Start with the width of the widest cell in each column, within bounds.
+	widths := make([]int, numCols)
+	for _, row := range rows {
+		for ix, cell := range row {
+			if w := stringWidth(cell); w > widths[ix] {
+				widths[ix] = w
+			}
+		}
+	}
+	total := stringWidth(t.sep) * (numCols - 1)
+	for ix := range widths {
+		col := t.column(ix)
+		if col.MaxWidth > 0 && widths[ix] > col.MaxWidth {
+			widths[ix] = col.MaxWidth
+		}
+		if widths[ix] < col.MinWidth {
+			widths[ix] = col.MinWidth
+		}
+		total += widths[ix]
+	}
+	// Narrow the widest columns until the table fits.
+	for t.width >= 0 && total > t.width {
+		widest := -1
+		for ix, w := range widths {
+			if minWidth := t.column(ix).MinWidth; w > minWidth && w > 1 && (widest == -1 || w > widths[widest]) {
+				widest = ix
+			}
+		}
+		if widest == -1 {
+			break
+		}
+		widths[widest]--
+		total--
+	}
+	return widths
+}
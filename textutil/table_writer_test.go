@@ -0,0 +1,95 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTableWriter(t *testing.T) {
+	tests := []struct {
+		Width   int
+		Columns []Column
+		In      string
+		Want    string
+	}{
+		// Empty input yields empty output.
+		{-1, nil, "", ""},
+		// Columns are aligned, without trailing spaces.
+		{-1, nil, "a\tbb\tc\nddd\te\n", "a    bb  c\nddd  e\n"},
+		{-1, nil, "a\tbb\nddd\te", "a    bb\nddd  e\n"},
+		{-1, nil, "a\t\tc\n", "a    c\n"},
+		// Headers are underlined.
+		{-1, []Column{{Header: "NAME"}, {Header: "V"}}, "a\tbb\n", "NAME  V\n----  --\na     bb\n"},
+		{-1, []Column{{Header: "NAME"}}, "", "NAME\n----\n"},
+		// Columns are bounded by their minimum and maximum widths.
+		{-1, []Column{{MinWidth: 3}}, "a\tb\n", "a    b\n"},
+		{-1, []Column{{MaxWidth: 5}}, "abcdefgh\tb\n", "ab...  b\n"},
+		{-1, []Column{{MaxWidth: 2}}, "abcdefgh\tb\n", "ab  b\n"},
+		// The widest columns are narrowed to fit the target width.
+		{10, nil, "abcdefgh\tabcdefgh\n", "a...  a...\n"},
+		{12, nil, "abcdefghij\tab\n", "abcde...  ab\n"},
+		{11, nil, "abcdefghij\tab\n", "abcd...  ab\n"},
+		{4, []Column{{MinWidth: 4}, {MinWidth: 2}}, "abcdef\tabcdef\n", "a...  ab\n"},
+		// Widths don't count ANSI escape sequences.
+		{-1, nil, "\x1b[1mab\x1b[0m\tc\nd\te\n", "\x1b[1mab\x1b[0m  c\nd   e\n"},
+		{-1, []Column{{MaxWidth: 4}}, "\x1b[1mabcdef\x1b[0m\tc\n", "\x1b[1ma\x1b[0m...  c\n"},
+		// Widths are measured in terminal columns; wide runes are never split.
+		{-1, nil, "世界\ta\nb\tc\n", "世界  a\nb     c\n"},
+		{-1, nil, "cafe\u0301\ta\nb\tc\n", "cafe\u0301  a\nb     c\n"},
+		{-1, []Column{{MaxWidth: 6}}, "世界世界\tc\n", "世...   c\n"},
+		{-1, []Column{{MaxWidth: 6}}, "abe\u0301\u0301cdefg\tc\n", "abe\u0301\u0301...  c\n"},
+	}
+	for _, test := range tests {
+		// Run with a variety of chunk sizes.
+		for _, sizes := range [][]int{nil, {1}, {2}, {1, 2}, {2, 1}} {
+			var buf bytes.Buffer
+			w := NewTableWriter(&buf, test.Width, test.Columns...)
+			remain := []byte(test.In)
+			for ix := 0; len(remain) > 0; ix++ {
+				var chunk []byte
+				chunk, remain = nextChunk(remain, sizes, ix)
+				if got, err := w.Write(chunk); got != len(chunk) || err != nil {
+					t.Errorf("%q Write(%q) got (%d,%v), want (%d,nil)", test.In, chunk, got, err, len(chunk))
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Errorf("%q Flush() got %v, want nil", test.In, err)
+			}
+			if got, want := buf.String(), test.Want; got != want {
+				t.Errorf("%q width:%d columns:%v sizes:%v got %q, want %q", test.In, test.Width, test.Columns, sizes, got, want)
+			}
+		}
+	}
+}
+
+func TestTableWriterWriteRow(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewTableWriter(&buf, -1)
+	w.SetSeparator(" | ")
+	w.WriteRow("a\tb", "c")
+	w.WriteRow("d")
+	if err := w.Flush(); err != nil {
+		t.Errorf("Flush() got %v, want nil", err)
+	}
+	// Each Flush outputs a separate table.
+	w.WriteRow("e", "f")
+	if err := w.Flush(); err != nil {
+		t.Errorf("Flush() got %v, want nil", err)
+	}
+	if got, want := buf.String(), "a\tb | c\nd\ne | f\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOutputWidth(t *testing.T) {
+	if got, want := OutputWidth(map[string]string{WidthVar: "123"}), 123; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+	if got, want := OutputWidth(map[string]string{WidthVar: "-1"}), -1; got != want {
+		t.Errorf("got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// DefaultWidth is a reasonable default for the output width in runes.
+	DefaultWidth = 80
+	// WidthVar is the name of the environment variable that overrides the
+	// output width; see OutputWidth.
+	WidthVar = "CMDLINE_WIDTH"
+)
+
+// OutputWidth returns the target output width in runes, for use with e.g.
+// NewUTF8WrapWriter and NewTableWriter.  The width is taken from the WidthVar
+// environment variable in vars, if it's set to a non-zero integer, otherwise
+// from the terminal, if available, otherwise it's DefaultWidth.  A width < 0
+// means unlimited.
+//
+// This is the same width used by the cmdline package for help output, so that
+// output from commands and their help shares a single width budget.
+func OutputWidth(vars map[string]string) int {
+	if width, err := strconv.Atoi(vars[WidthVar]); err == nil && width != 0 {
+		return width
+	}
+	if _, width, err := TerminalSize(); err == nil && width != 0 {
+		return width
+	}
+	return DefaultWidth
+}
+
+const zeroWidthJoiner = '\u200d'
+
+// runeWidth returns the number of terminal columns used to display r, which
+// follows the rune prev.  East Asian wide and fullwidth runes are two columns
+// wide.  Combining marks, format characters and runes that follow a zero width
+// joiner have no width; they're displayed as part of the preceding rune.  All
+// other runes are one column wide.
+func runeWidth(prev, r rune) int {
+	switch {
+	case prev == zeroWidthJoiner:
+		return 0
+	case r < 0x300:
+		// Fast path for ASCII and Latin-1, which are never zero-width or wide.
+		if r == '\u00ad' {
+			return 0 // Soft hyphen
+		}
+		return 1
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf, hangulJamoMedialFinal):
+		return 0
+	case unicode.Is(wideRunes, r):
+		return 2
+	}
+	return 1
+}
+
+// hangulJamoMedialFinal holds the conjoining Hangul vowels and final
+// consonants, which combine with the preceding initial consonant.
+var hangulJamoMedialFinal = &unicode.RangeTable{
+	R16: []unicode.Range16{{0x1160, 0x11ff, 1}},
+}
+
+// wideRunes holds the runes with East Asian width wide or fullwidth, which are
+// displayed in two terminal columns.  Rarely used ranges, e.g. some symbols,
+// are omitted.  See http://www.unicode.org/reports/tr11 [East Asian Width].
+var wideRunes = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x1100, 0x115f, 1}, // Hangul Jamo initial consonants
+		{0x231a, 0x231b, 1}, // Watch, hourglass
+		{0x2329, 0x232a, 1}, // Angle brackets
+		{0x2e80, 0x303e, 1}, // CJK radicals, symbols and punctuation
+		{0x3041, 0x33ff, 1}, // Hiragana, Katakana, Bopomofo, CJK compatibility
+		{0x3400, 0x4dbf, 1}, // CJK unified ideographs extension A
+		{0x4e00, 0x9fff, 1}, // CJK unified ideographs
+		{0xa000, 0xa4cf, 1}, // Yi
+		{0xa960, 0xa97f, 1}, // Hangul Jamo extended A
+		{0xac00, 0xd7a3, 1}, // Hangul syllables
+		{0xf900, 0xfaff, 1}, // CJK compatibility ideographs
+		{0xfe10, 0xfe19, 1}, // Vertical forms
+		{0xfe30, 0xfe6f, 1}, // CJK compatibility forms, small form variants
+		{0xff00, 0xff60, 1}, // Fullwidth forms
+		{0xffe0, 0xffe6, 1}, // Fullwidth signs
+	},
+	R32: []unicode.Range32{
+		{0x16fe0, 0x18aff, 1}, // Tangut, Khitan, ideographic symbols
+		{0x1b000, 0x1b2ff, 1}, // Kana supplement and extensions, Nushu
+		{0x1f004, 0x1f004, 1}, // Mahjong tile red dragon
+		{0x1f200, 0x1f251, 1}, // Enclosed ideographic supplement
+		{0x1f300, 0x1f64f, 1}, // Emoji: pictographs, emoticons
+		{0x1f680, 0x1f6ff, 1}, // Emoji: transport and map symbols
+		{0x1f900, 0x1f9ff, 1}, // Emoji: supplemental symbols and pictographs
+		{0x1fa70, 0x1faff, 1}, // Emoji: symbols and pictographs extended A
+		{0x20000, 0x2fffd, 1}, // CJK unified ideographs extensions B and later
+		{0x30000, 0x3fffd, 1}, // CJK unified ideographs extensions G and later
+	},
+}
+
+// stringWidth returns the width of s in terminal columns, per runeWidth, not
+// counting ANSI escape sequences.
+func stringWidth(s string) int {
+	var ansi ansiState
+	var prev rune
+	width := 0
+	for _, r := range s {
+		var esc bool
+		if ansi, esc = ansi.next(r); !esc {
+			width += runeWidth(prev, r)
+			prev = r
+		}
+	}
+	return width
+}
+
+// truncateString returns s truncated to the given width in terminal columns,
+// not counting ANSI escape sequences.  If s is truncated and width allows, it
+// ends with "...".  All escape sequences in s are kept, so that e.g. a sequence
+// that resets colors at the end of s still takes effect.  Wide runes are never
+// split; if a wide rune doesn't fit, the result is narrower than width.
+func truncateString(s string, width int) string {
+	if stringWidth(s) <= width {
+		return s
+	}
+	const ellipsis = "..."
+	keep := width
+	if width > len(ellipsis) {
+		keep -= len(ellipsis)
+	}
+	var ansi ansiState
+	var buf strings.Builder
+	var prev rune
+	for _, r := range s {
+		var esc bool
+		if ansi, esc = ansi.next(r); esc {
+			buf.WriteRune(r)
+			continue
+		}
+		// Once a rune is dropped, so are all following runes, including any
+		// zero-width runes that would be displayed as part of it.
+		if rw := runeWidth(prev, r); keep >= 0 && rw <= keep {
+			buf.WriteRune(r)
+			keep -= rw
+		} else {
+			keep = -1
+		}
+		prev = r
+	}
+	if width > len(ellipsis) {
+		buf.WriteString(ellipsis)
+	}
+	return buf.String()
+}
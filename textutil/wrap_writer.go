@@ -38,9 +38,15 @@ import (
 // be output as a single space ' ' to maintain word separation.
 //
 // The algorithm greedily fills each output line with as many words as it can,
-// assuming that all Unicode code points have the same width.  Invalid UTF-8 is
-// silently transformed to the replacement character U+FFFD and treated as a
-// single rune.
+// measuring the width of each rune in terminal columns.  Most runes are one
+// column wide, but East Asian wide and fullwidth runes are two columns wide,
+// and combining marks and other zero-width runes, e.g. the runes joined into a
+// single emoji via U+200D zero width joiner, have no width, and so are never
+// separated from the preceding rune.  ANSI escape sequences, e.g. to select
+// colors, are treated as letters with no width, so they don't affect where
+// lines are broken, and stay with the adjacent word.
+// Invalid UTF-8 is silently transformed to the replacement character U+FFFD
+// and treated as a single rune.
 //
 // Flush must be called after the last call to Write; the input is buffered.
 //
@@ -65,9 +71,10 @@ type WrapWriter struct {
 	// The buffer contains a single output line.
 	lineBuf byteRuneBuffer
 
-	// Keep track of the previous state and rune.
+	// Keep track of the previous state and rune, and of ANSI escape sequences.
 	prevState state
 	prevRune  rune
+	ansi      ansiState
 
 	// Keep track of blank input lines.
 	inputLineHasLetter bool
@@ -227,13 +234,19 @@ func (w *WrapWriter) Flush() error {
 
 // addRune is called every time w.runeDecoder decodes a full rune.
 func (w *WrapWriter) addRune(r rune) error {
-	state, lineBreak := w.nextState(r, w.updateRune(r))
+	// Runes within ANSI escape sequences are letters with no width.
+	kind, width := runeKind(r), runePos(runeWidth(w.prevRune, r))
+	var esc bool
+	if w.ansi, esc = w.ansi.next(r); esc {
+		kind, width = kindLetter, 0
+	}
+	state, lineBreak := w.nextState(kind, width, w.updateRune(r, kind))
 	if lineBreak {
 		if err := w.writeLine(); err != nil {
 			return err
 		}
 	}
-	w.bufferRune(r, state, lineBreak)
+	w.bufferRune(r, kind, width, state, lineBreak)
 	w.prevState = state
 	w.prevRune = r
 	return nil
@@ -259,9 +272,9 @@ func runeKind(r rune) kind {
 	return kindLetter
 }
 
-func (w *WrapWriter) updateRune(r rune) bool {
+func (w *WrapWriter) updateRune(r rune, kind kind) bool {
 	forceLineBreak := false
-	switch kind := runeKind(r); kind {
+	switch kind {
 	case kindEOL:
 		// Update lastWordEnd if the last word just ended.
 		if w.newWordStart != -1 {
@@ -342,9 +355,10 @@ func (w *WrapWriter) updateRune(r rune) bool {
 //     |      Visual indication of width=4, has no width itself.
 //
 // Note that Flush calls behave exactly as if an explicit U+2028 line separator
-// were added to the end of all buffered data.
-func (w *WrapWriter) nextState(r rune, forceLineBreak bool) (state, bool) {
-	kind := runeKind(r)
+// were added to the end of all buffered data.  The width of the current rune is
+// zero for zero-width runes and runes within ANSI escape sequences, which never
+// break the line, and two for wide runes.
+func (w *WrapWriter) nextState(kind kind, width runePos, forceLineBreak bool) (state, bool) {
 	if w.forceVerbatim {
 		return stateVerbatim, forceLineBreak || kind == kindEOL
 	}
@@ -371,7 +385,7 @@ func (w *WrapWriter) nextState(r rune, forceLineBreak bool) (state, bool) {
 		return stateVerbatim, true
 	}
 	// Break on EOL or space when the line is too wide.  See above table.
-	if w.width >= 0 && w.width <= w.lineBuf.RuneLen()+1 {
+	if w.width >= 0 && w.width <= w.lineBuf.RuneLen()+width {
 		switch kind {
 		case kindEOL:
 			return stateWordWrap, true
@@ -381,7 +395,7 @@ func (w *WrapWriter) nextState(r rune, forceLineBreak bool) (state, bool) {
 		// case kindLetter falls through
 	}
 	// Handle the newWordStart case in the above table.
-	if w.width >= 0 && w.width < w.lineBuf.RuneLen()+1 && w.newWordStart != w.lineStart {
+	if w.width >= 0 && w.width < w.lineBuf.RuneLen()+width && w.newWordStart != w.lineStart {
 		return stateWordWrap, true
 	}
 	// Stay in the wordWrap state and don't break the line.
@@ -441,23 +455,23 @@ func (w *WrapWriter) resetLine() {
 	w.lineStart = w.lineBuf.ByteLen()
 }
 
-func (w *WrapWriter) bufferRune(r rune, state state, lineBreak bool) {
+func (w *WrapWriter) bufferRune(r rune, kind kind, width runePos, state state, lineBreak bool) {
 	// Never add leading spaces to the buffer in the wordWrap state.
 	wordWrapNoLeadingSpaces := state == stateWordWrap && !lineBreak
-	switch kind := runeKind(r); kind {
+	switch kind {
 	case kindEOL:
 		// When we're word-wrapping and we see a letter followed by EOL, we convert
 		// the EOL into a single space in the buffer, to break the previous word
 		// from the next word.
 		if wordWrapNoLeadingSpaces && runeKind(w.prevRune) == kindLetter {
-			w.lineBuf.WriteRune(' ')
+			w.lineBuf.WriteRune(' ', 1)
 		}
 	case kindSpace:
 		if wordWrapNoLeadingSpaces || state == stateVerbatim {
-			w.lineBuf.WriteRune(r)
+			w.lineBuf.WriteRune(r, width)
 		}
 	case kindLetter:
-		w.lineBuf.WriteRune(r)
+		w.lineBuf.WriteRune(r, width)
 	default:
 		panic(fmt.Errorf("textutil: bufferRune unhandled kind %d", kind))
 	}
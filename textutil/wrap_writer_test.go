@@ -216,6 +216,88 @@ func TestWrapWriterForceVerbatim(t *testing.T) {
 	}
 }
 
+func TestWrapWriterANSI(t *testing.T) {
+	const (
+		bold  = "\x1b[1m"
+		reset = "\x1b[0m"
+		link  = "\x1b]8;;http://example.com\x07"
+		unlnk = "\x1b]8;;\x1b\\"
+	)
+	tests := []struct {
+		Width   int
+		Indents []string
+		In      string
+		Want    string
+	}{
+		// Escape sequences have no width.
+		{4, nil, bold + "ab" + reset + " c", bold + "ab" + reset + " c\n"},
+		{4, nil, bold + "ab" + reset + " cd", bold + "ab" + reset + "\ncd\n"},
+		{5, nil, "ab " + bold + "cd" + reset, "ab " + bold + "cd" + reset + "\n"},
+		{5, nil, link + "ab" + unlnk + " cd", link + "ab" + unlnk + " cd\n"},
+		// Escape sequences stay with the adjacent word.
+		{4, nil, "abc " + bold + "de" + reset, "abc\n" + bold + "de" + reset + "\n"},
+		{4, nil, "abc " + bold + "de" + reset + " f", "abc\n" + bold + "de" + reset + " f\n"},
+		// Escape sequences in indents have no width.
+		{5, []string{bold + ">" + reset + " "}, "a b c", bold + ">" + reset + " a b\n" + bold + ">" + reset + " c\n"},
+		// Malformed escape sequences end at the end of the line.
+		{4, nil, "\x1b]8;;ab\ncd", "\x1b]8;;ab cd\n"},
+	}
+	for _, test := range tests {
+		// Run with a variety of chunk sizes.
+		for _, sizes := range [][]int{nil, {1}, {2}, {1, 2}, {2, 1}} {
+			var buf bytes.Buffer
+			w := NewUTF8WrapWriter(&buf, test.Width)
+			if err := w.SetIndents(test.Indents...); err != nil {
+				t.Errorf("SetIndents(%q) got %v, want nil", test.Indents, err)
+			}
+			wrapWriterWriteFlush(t, w, test.In, sizes)
+			if got, want := buf.String(), test.Want; got != want {
+				t.Errorf("%q sizes:%v got %q, want %q", test.In, sizes, got, want)
+			}
+		}
+	}
+}
+
+func TestWrapWriterWide(t *testing.T) {
+	tests := []struct {
+		Width   int
+		Indents []string
+		In      string
+		Want    string
+	}{
+		// Wide runes are two columns wide.
+		{4, nil, "世界 a", "世界\na\n"},
+		{5, nil, "ab 世界", "ab\n世界\n"},
+		{7, nil, "ab 世界", "ab 世界\n"},
+		{8, nil, "世界 世界", "世界\n世界\n"},
+		{9, nil, "世界 世界", "世界 世界\n"},
+		{4, nil, "世\u3000界", "世\n界\n"},
+		{6, nil, "世\u3000界", "世\u3000界\n"},
+		// Wide runes in indents are two columns wide.
+		{4, []string{"・"}, "a b c", "・a\n・b\n・c\n"},
+		// Combining marks have no width.
+		{6, nil, "cafe\u0301 b", "cafe\u0301 b\n"},
+		{6, nil, "ab cde\u0301", "ab cde\u0301\n"},
+		{5, nil, "ab cde\u0301", "ab\ncde\u0301\n"},
+		// Runes joined by a zero width joiner are displayed as one.
+		{4, nil, "a 👩\u200d💻 b", "a 👩\u200d💻\nb\n"},
+	}
+	for _, test := range tests {
+		// Run with a variety of chunk sizes.
+		for _, sizes := range [][]int{nil, {1}, {2}, {1, 2}, {2, 1}} {
+			var buf bytes.Buffer
+			w := NewUTF8WrapWriter(&buf, test.Width)
+			if err := w.SetIndents(test.Indents...); err != nil {
+				t.Errorf("SetIndents(%q) got %v, want nil", test.Indents, err)
+			}
+			wrapWriterWriteFlush(t, w, test.In, sizes)
+			if got, want := buf.String(), test.Want; got != want {
+				t.Errorf("%q width:%d sizes:%v got %q, want %q", test.In, test.Width, sizes, got, want)
+			}
+		}
+	}
+}
+
 // xlateIn translates our test.In pattern into an actual input string to feed
 // into the writer.  The point is to make it easy to specify the various control
 // sequences in a single character, so it's easier to understand.